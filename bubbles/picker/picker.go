@@ -0,0 +1,130 @@
+package picker
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// This is a Charm BubbleTea model that lets the user pick one item from a
+// short list. The user moves with the arrow keys (or j/k, or a number), and
+// either presses enter to run the item or p to print it. After the program
+// exits check Choice and Action on the returned model.
+
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionRun
+	ActionPrint
+)
+
+type PickerModel struct {
+	Title         string
+	Items         []string
+	SelectedStyle lipgloss.Style
+	HelpStyle     lipgloss.Style
+	cursor        int
+	choice        int
+	action        Action
+}
+
+func NewPickerModel(title string, items []string) PickerModel {
+	return PickerModel{
+		Title:         title,
+		Items:         items,
+		SelectedStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("5")),
+		HelpStyle:     lipgloss.NewStyle().Faint(true),
+		choice:        -1,
+	}
+}
+
+// The index of the chosen item, or -1 if the user cancelled
+func (this PickerModel) Choice() int {
+	return this.choice
+}
+
+func (this PickerModel) Action() Action {
+	return this.action
+}
+
+// Run the picker until the user chooses or cancels, returning the final
+// model. Options are passed to the program, e.g. tea.WithOutput(os.Stderr)
+// to keep the picker off stdout.
+func Pick(model PickerModel, options ...tea.ProgramOption) (PickerModel, error) {
+	final, err := tea.NewProgram(model, options...).Run()
+	if err != nil {
+		return model, err
+	}
+	return final.(PickerModel), nil
+}
+
+func (this PickerModel) Init() tea.Cmd {
+	return nil
+}
+
+func (this PickerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	keyMsg, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return this, nil
+	}
+
+	switch keyMsg.String() {
+	case "ctrl+c", "esc", "q":
+		this.choice = -1
+		this.action = ActionNone
+		return this, tea.Quit
+
+	case "up", "k":
+		if this.cursor > 0 {
+			this.cursor--
+		}
+
+	case "down", "j":
+		if this.cursor < len(this.Items)-1 {
+			this.cursor++
+		}
+
+	case "enter":
+		this.choice = this.cursor
+		this.action = ActionRun
+		return this, tea.Quit
+
+	case "p":
+		this.choice = this.cursor
+		this.action = ActionPrint
+		return this, tea.Quit
+
+	default:
+		var index int
+		if _, err := fmt.Sscanf(keyMsg.String(), "%d", &index); err == nil &&
+			index >= 1 && index <= len(this.Items) {
+			this.cursor = index - 1
+		}
+	}
+
+	return this, nil
+}
+
+func (this PickerModel) View() string {
+	builder := strings.Builder{}
+	if this.Title != "" {
+		builder.WriteString(this.Title + "\n\n")
+	}
+
+	for i, item := range this.Items {
+		// indent continuation lines of multi-line items under the first
+		item = strings.ReplaceAll(item, "\n", "\n     ")
+		line := fmt.Sprintf("%d. %s", i+1, item)
+		if i == this.cursor {
+			builder.WriteString(this.SelectedStyle.Render("> "+line) + "\n")
+		} else {
+			builder.WriteString("  " + line + "\n")
+		}
+	}
+
+	builder.WriteString("\n" + this.HelpStyle.Render("enter: run • p: print • ↑/↓: move • esc: cancel") + "\n")
+	return builder.String()
+}
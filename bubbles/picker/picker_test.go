@@ -0,0 +1,38 @@
+package picker
+
+import (
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/stretchr/testify/assert"
+)
+
+func key(model tea.Model, keyType tea.KeyType, runes ...rune) PickerModel {
+	model, _ = model.Update(tea.KeyMsg{Type: keyType, Runes: runes})
+	return model.(PickerModel)
+}
+
+func TestPicker(t *testing.T) {
+	model := NewPickerModel("Pick a command", []string{"ls", "ls -l", "ls -la"})
+	assert.Equal(t, -1, model.Choice())
+
+	model = key(model, tea.KeyDown)
+	model = key(model, tea.KeyDown)
+	model = key(model, tea.KeyDown)
+	model = key(model, tea.KeyUp)
+	assert.Contains(t, model.View(), "> 2. ls -l")
+
+	chosen := key(model, tea.KeyEnter)
+	assert.Equal(t, 1, chosen.Choice())
+	assert.Equal(t, ActionRun, chosen.Action())
+
+	// jump by number, then print
+	model = key(model, tea.KeyRunes, '3')
+	chosen = key(model, tea.KeyRunes, 'p')
+	assert.Equal(t, 2, chosen.Choice())
+	assert.Equal(t, ActionPrint, chosen.Action())
+
+	cancelled := key(model, tea.KeyEsc)
+	assert.Equal(t, -1, cancelled.Choice())
+	assert.Equal(t, ActionNone, cancelled.Action())
+}
@@ -0,0 +1,118 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A DEC private mode set or reset, e.g. ESC [ ? 1049 h
+var privateModeRegex = regexp.MustCompile("\x1b\\[\\?([0-9;]*)([hl])")
+
+// The start of a private mode sequence at the end of a chunk of output, the
+// rest will come in the next chunk
+var partialPrivateModeRegex = regexp.MustCompile("\x1b(\\[(\\?[0-9;]*)?)?$")
+
+// Private modes that switch to the alternate screen, 1049 is what current
+// programs use, 47 and 1047 are older variants
+var altScreenModes = map[string]bool{
+	"47":   true,
+	"1047": true,
+	"1049": true,
+}
+
+// AltScreenTracker follows the child shell's output in and out of the
+// alternate screen, which full-screen programs like vim, htop and less draw
+// on. Their redraws mean nothing once they've exited so we keep them out of
+// history and leave a placeholder like "[full-screen app: vim, 3m12s]".
+type AltScreenTracker struct {
+	active  bool
+	app     string
+	started time.Time
+	partial string
+	now     func() time.Time
+}
+
+func NewAltScreenTracker() *AltScreenTracker {
+	return &AltScreenTracker{now: time.Now}
+}
+
+// Whether the child is currently drawing on the alternate screen
+func (this *AltScreenTracker) Active() bool {
+	return this.active
+}
+
+// Given a chunk of child output, return what should go in history: output
+// on the normal screen and a placeholder for each full-screen session that
+// ends. appName is called when a session starts to name the program.
+func (this *AltScreenTracker) Filter(data string, appName func() string) string {
+	data = this.partial + data
+	this.partial = ""
+
+	// hold back a sequence split across chunks until we can see all of it
+	if loc := partialPrivateModeRegex.FindStringIndex(data); loc != nil {
+		this.partial = data[loc[0]:]
+		data = data[:loc[0]]
+	}
+
+	// fast path, this is most output
+	if !this.active && !strings.Contains(data, "\x1b[?") {
+		return data
+	}
+
+	builder := strings.Builder{}
+	last := 0
+	for _, match := range privateModeRegex.FindAllStringSubmatchIndex(data, -1) {
+		if !isAltScreenMode(data[match[2]:match[3]]) {
+			continue
+		}
+		enter := data[match[4]:match[5]] == "h"
+
+		if !this.active {
+			builder.WriteString(data[last:match[0]])
+		}
+		if enter && !this.active {
+			this.active = true
+			this.app = appName()
+			this.started = this.now()
+		} else if !enter && this.active {
+			this.active = false
+			builder.WriteString(this.placeholder())
+		}
+		last = match[1]
+	}
+
+	if !this.active {
+		builder.WriteString(data[last:])
+	}
+	return builder.String()
+}
+
+// End a full-screen session that never switched back, e.g. because the
+// program was killed, returning its placeholder or "" if there wasn't one
+func (this *AltScreenTracker) End() string {
+	if !this.active {
+		return ""
+	}
+	this.active = false
+	return this.placeholder()
+}
+
+func isAltScreenMode(params string) bool {
+	for _, mode := range strings.Split(params, ";") {
+		if altScreenModes[mode] {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *AltScreenTracker) placeholder() string {
+	app := this.app
+	if app == "" {
+		app = "unknown"
+	}
+	elapsed := this.now().Sub(this.started).Round(time.Second)
+	return fmt.Sprintf("[full-screen app: %s, %s]\n", app, elapsed)
+}
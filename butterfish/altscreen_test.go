@@ -0,0 +1,77 @@
+package butterfish
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAltScreenTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewAltScreenTracker()
+	tracker.now = func() time.Time { return now }
+	names := 0
+	appName := func() string {
+		names++
+		return "vim"
+	}
+
+	assert.Equal(t, "ls\r\nmain.go\r\n", tracker.Filter("ls\r\nmain.go\r\n", appName))
+
+	// output on the alternate screen is dropped until the program exits
+	out := tracker.Filter("vim main.go\r\n\x1b[?1049h\x1b[22;0;0t\x1b[H\x1b[2Jpackage main", appName)
+	assert.Equal(t, "vim main.go\r\n", out)
+	assert.True(t, tracker.Active())
+	assert.Equal(t, "", tracker.Filter("\x1b[1;1H~\r\n~\r\n", appName))
+	now = now.Add(3*time.Minute + 12*time.Second + 300*time.Millisecond)
+	out = tracker.Filter("\x1b[?1049l\x1b[23;0;0t$ ", appName)
+	assert.Equal(t, "[full-screen app: vim, 3m12s]\n\x1b[23;0;0t$ ", out)
+	assert.False(t, tracker.Active())
+	assert.Equal(t, 1, names)
+
+	// sequences may be split across chunks, other private modes are kept
+	assert.Equal(t, "less\r\n\x1b[?1h", tracker.Filter("less\r\n\x1b[?1h\x1b[?10", appName))
+	assert.Equal(t, "", tracker.Filter("49h\x1b[?1049", appName))
+	assert.Equal(t, "[full-screen app: vim, 0s]\n", tracker.Filter("l\x1b", appName))
+	assert.Equal(t, "\x1b[0m", tracker.Filter("[0m", appName))
+
+	// older modes, combined with other modes, in a single chunk
+	out = tracker.Filter("a\x1b[?7;47hdrawing\x1b[?47lb\x1b[?1047hmore\x1b[?1047l", func() string { return "" })
+	assert.Equal(t, "a[full-screen app: unknown, 0s]\nb[full-screen app: unknown, 0s]\n", out)
+}
+
+func TestAltScreenTrackerEnd(t *testing.T) {
+	now := time.Now()
+	tracker := NewAltScreenTracker()
+	tracker.now = func() time.Time { return now }
+	appName := func() string { return "htop" }
+
+	assert.Equal(t, "", tracker.End())
+
+	// a program is killed and never switches back
+	assert.Equal(t, "htop\r\n", tracker.Filter("htop\r\n\x1b[?1049h\x1b[H\x1b[2J  PID USER", appName))
+	now = now.Add(5 * time.Second)
+	assert.Equal(t, "", tracker.Filter("Killed\r\n$ ", appName))
+	assert.Equal(t, "[full-screen app: htop, 5s]\n", tracker.End())
+	assert.False(t, tracker.Active())
+
+	// later output is kept
+	assert.Equal(t, "ls\r\nmain.go\r\n", tracker.Filter("ls\r\nmain.go\r\n", appName))
+	assert.Equal(t, "", tracker.End())
+}
+
+func TestFullScreenAppName(t *testing.T) {
+	state, _ := newTestShellState()
+	assert.Equal(t, "", state.fullScreenAppName())
+
+	state.History.Append(historyTypeShellInput, "/usr/bin/htop -d 10")
+	state.History.Append(historyTypeShellOutput, "output")
+	assert.Equal(t, "htop", state.fullScreenAppName())
+
+	fake := &fakeForeground{pgrp: 200, names: map[int]string{100: "bash", 200: "vim"}}
+	state.Foreground = fake.detector(100)
+	assert.Equal(t, "vim", state.fullScreenAppName())
+	fake.pgrp = 100
+	assert.Equal(t, "htop", state.fullScreenAppName())
+}
@@ -0,0 +1,633 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const AnthropicDefaultBaseURL = "https://api.anthropic.com"
+const AnthropicAPIVersion = "2023-06-01"
+
+// Anthropic implements the LLM interface against the Anthropic Messages API,
+// https://docs.anthropic.com/en/api/messages. We speak the wire format
+// directly rather than pulling in an SDK, the surface we need is small.
+type Anthropic struct {
+	token   string
+	baseURL string
+	client  *http.Client
+	models  *ModelCatalog
+}
+
+func NewAnthropic(token, baseUrl string) *Anthropic {
+	if baseUrl == "" {
+		baseUrl = AnthropicDefaultBaseURL
+	}
+
+	return &Anthropic{
+		token:   token,
+		baseURL: strings.TrimSuffix(baseUrl, "/"),
+		client:  &http.Client{},
+		models:  DefaultModelCatalog(),
+	}
+}
+
+// Wire types for the Messages API
+
+type anthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Id        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseId string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	// image data for image blocks
+	Source *anthropicImageSource `json:"source,omitempty"`
+}
+
+type anthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []anthropicContentBlock `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature float32            `json:"temperature"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice  any                `json:"tool_choice,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicResponse struct {
+	Id         string                  `json:"id"`
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// A single server-sent event from a streaming response, we decode all event
+// types into the same struct and switch on Type.
+type anthropicStreamEvent struct {
+	Type         string                `json:"type"`
+	Index        int                   `json:"index"`
+	Message      anthropicResponse     `json:"message"`
+	ContentBlock anthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJson string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	// output token count on message_delta events
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// The Messages API requires strictly alternating user/assistant roles, so
+// consecutive blocks with the same role are merged into one message.
+func appendAnthropicBlock(msgs []anthropicMessage, role string, block anthropicContentBlock) []anthropicMessage {
+	if len(msgs) > 0 && msgs[len(msgs)-1].Role == role {
+		last := &msgs[len(msgs)-1]
+		last.Content = append(last.Content, block)
+		return msgs
+	}
+
+	return append(msgs, anthropicMessage{
+		Role:    role,
+		Content: []anthropicContentBlock{block},
+	})
+}
+
+// Tool inputs must be JSON objects, the model sometimes streams back nothing
+// for a function without parameters.
+func anthropicToolInput(params string) json.RawMessage {
+	if strings.TrimSpace(params) == "" || !json.Valid([]byte(params)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(params)
+}
+
+// Convert butterfish history blocks to Anthropic messages. Legacy function
+// calls (FunctionName/FunctionParams) don't carry an id, so we synthesize one
+// and pair it with the following function output block.
+func ShellHistoryBlocksToAnthropicChat(blocks []util.HistoryBlock) []anthropicMessage {
+	msgs := []anthropicMessage{}
+	lastFunctionId := ""
+
+	for i, block := range blocks {
+		if block.Content == "" && block.FunctionName == "" && block.ToolCalls == nil {
+			// skip empty blocks
+			continue
+		}
+
+		switch ShellHistoryTypeToRole(block.Type) {
+		case "assistant":
+			if block.Content != "" {
+				msgs = appendAnthropicBlock(msgs, "assistant", anthropicContentBlock{
+					Type: "text",
+					Text: block.Content,
+				})
+			}
+			if block.FunctionName != "" {
+				lastFunctionId = fmt.Sprintf("function_call_%d", i)
+				msgs = appendAnthropicBlock(msgs, "assistant", anthropicContentBlock{
+					Type:  "tool_use",
+					Id:    lastFunctionId,
+					Name:  block.FunctionName,
+					Input: anthropicToolInput(block.FunctionParams),
+				})
+			}
+			for _, toolCall := range block.ToolCalls {
+				msgs = appendAnthropicBlock(msgs, "assistant", anthropicContentBlock{
+					Type:  "tool_use",
+					Id:    toolCall.Id,
+					Name:  toolCall.Function.Name,
+					Input: anthropicToolInput(toolCall.Function.Parameters),
+				})
+			}
+
+		case "function":
+			if lastFunctionId == "" {
+				// no matching call, fall back to plain text
+				msgs = appendAnthropicBlock(msgs, "user", anthropicContentBlock{
+					Type: "text",
+					Text: block.Content,
+				})
+				continue
+			}
+			msgs = appendAnthropicBlock(msgs, "user", anthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseId: lastFunctionId,
+				Content:   block.Content,
+			})
+			lastFunctionId = ""
+
+		case "tool":
+			msgs = appendAnthropicBlock(msgs, "user", anthropicContentBlock{
+				Type:      "tool_result",
+				ToolUseId: block.ToolCallId,
+				Content:   block.Content,
+			})
+
+		default:
+			msgs = appendAnthropicUserBlocks(msgs, block.Content, block.Attachments)
+		}
+	}
+
+	return msgs
+}
+
+// Add a user prompt, images go first as Anthropic recommends, then the text
+// with text attachments inlined
+func appendAnthropicUserBlocks(msgs []anthropicMessage, prompt string, attachments []util.Attachment) []anthropicMessage {
+	for _, image := range util.ImageAttachments(attachments) {
+		msgs = appendAnthropicBlock(msgs, "user", anthropicContentBlock{
+			Type: "image",
+			Source: &anthropicImageSource{
+				Type:      "base64",
+				MediaType: image.MimeType,
+				Data:      base64.StdEncoding.EncodeToString(image.Data),
+			},
+		})
+	}
+
+	text := util.PromptWithAttachments(prompt, attachments)
+	if text != "" {
+		msgs = appendAnthropicBlock(msgs, "user", anthropicContentBlock{
+			Type: "text",
+			Text: text,
+		})
+	}
+	return msgs
+}
+
+// Both legacy functions and tools are sent as Anthropic tools
+func convertToAnthropicTools(funcs []util.FunctionDefinition, tools []util.ToolDefinition) []anthropicTool {
+	out := []anthropicTool{}
+	for _, f := range funcs {
+		out = append(out, anthropicTool{
+			Name:        f.Name,
+			Description: f.Description,
+			InputSchema: f.Parameters,
+		})
+	}
+	for _, t := range tools {
+		out = append(out, anthropicTool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			InputSchema: t.Function.Parameters,
+		})
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func (this *Anthropic) buildRequest(request *util.CompletionRequest, stream bool) (*anthropicRequest, error) {
+	if this.models.IsCompletionModel(request.Model) {
+		return nil, fmt.Errorf("Model %s uses the legacy completion API, which the Anthropic provider doesn't support", request.Model)
+	}
+
+	msgs := ShellHistoryBlocksToAnthropicChat(request.HistoryBlocks)
+	if request.Prompt != "" || len(request.Attachments) > 0 {
+		msgs = appendAnthropicUserBlocks(msgs, request.Prompt, request.Attachments)
+	}
+
+	if len(msgs) == 0 {
+		return nil, errors.New("No messages to send in Anthropic request")
+	}
+
+	system := request.SystemMessage
+	if system == "N/A" { // placeholder used by some commands
+		system = ""
+	}
+
+	req := &anthropicRequest{
+		Model:       request.Model,
+		System:      system,
+		Messages:    msgs,
+		MaxTokens:   request.MaxTokens,
+		Temperature: request.Temperature,
+		Tools:       convertToAnthropicTools(request.Functions, request.Tools),
+		Stream:      stream,
+	}
+
+	// Anthropic has no JSON mode, so we force a call to a tool that takes the
+	// schema as its input
+	if request.ResponseSchema != nil {
+		req.Tools = []anthropicTool{{
+			Name:        schemaFunctionName,
+			Description: schemaFunctionDescription,
+			InputSchema: request.ResponseSchema,
+		}}
+		req.ToolChoice = map[string]string{"type": "tool", "name": schemaFunctionName}
+	}
+
+	return req, nil
+}
+
+func LogAnthropicRequest(req *anthropicRequest) {
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
+		req.Model, req.Temperature, req.MaxTokens)
+
+	messageBoxes := []LoggingBox{
+		{
+			Title:   "system",
+			Content: req.System,
+			Color:   6,
+		},
+	}
+
+	for _, msg := range req.Messages {
+		color := 4
+		if msg.Role == "assistant" {
+			color = 5
+		}
+
+		for _, block := range msg.Content {
+			content := block.Text
+			title := fmt.Sprintf("%s: %s", msg.Role, block.Type)
+			switch block.Type {
+			case "tool_use":
+				title = fmt.Sprintf("%s: %s %s", title, block.Name, block.Id)
+				content = string(block.Input)
+			case "tool_result":
+				title = fmt.Sprintf("%s: %s", title, block.ToolUseId)
+				content = block.Content
+			}
+
+			messageBoxes = append(messageBoxes, LoggingBox{
+				Title:   title,
+				Content: content,
+				Color:   color,
+			})
+		}
+	}
+
+	box := LoggingBox{
+		Title:   "Anthropic Request /v1/messages",
+		Content: meta,
+		Color:   0,
+		Children: []LoggingBox{
+			{
+				Title:    "Messages",
+				Children: messageBoxes,
+				Color:    1,
+			},
+		},
+	}
+
+	toolBoxes := []LoggingBox{}
+	for _, tool := range req.Tools {
+		toolBoxes = append(toolBoxes, LoggingBox{
+			Title:   tool.Name,
+			Content: fmt.Sprintf("%s\n%s", tool.Description, PrettyJSON(JSONString(tool.InputSchema))),
+			Color:   3,
+		})
+	}
+	if len(toolBoxes) > 0 {
+		box.Children = append(box.Children, LoggingBox{
+			Title:    "Tools",
+			Children: toolBoxes,
+			Color:    2,
+		})
+	}
+
+	PrintLoggingBox(box)
+}
+
+func (this *Anthropic) post(ctx context.Context, req *anthropicRequest) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		this.baseURL+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("content-type", "application/json")
+	httpReq.Header.Set("x-api-key", this.token)
+	httpReq.Header.Set("anthropic-version", AnthropicAPIVersion)
+	if req.Stream {
+		httpReq.Header.Set("accept", "text/event-stream")
+	}
+
+	resp, err := this.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		var apiErr anthropicError
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error.Message != "" {
+			return nil, &StatusError{
+				Service:    "Anthropic API",
+				StatusCode: resp.StatusCode,
+				Message:    apiErr.Error.Type + ": " + apiErr.Error.Message,
+			}
+		}
+		return nil, &StatusError{
+			Service:    "Anthropic API",
+			StatusCode: resp.StatusCode,
+			Message:    string(respBody),
+		}
+	}
+
+	return resp, nil
+}
+
+// Turn the final list of content blocks into a CompletionResponse. If the
+// request used legacy functions then the first tool_use becomes the
+// FunctionName/FunctionParameters pair, otherwise tool_use blocks are
+// returned as ToolCalls.
+func anthropicBlocksToResponse(blocks []anthropicContentBlock, legacyFunctions bool) *util.CompletionResponse {
+	response := &util.CompletionResponse{}
+	text := strings.Builder{}
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			params := string(block.Input)
+			if legacyFunctions {
+				if response.FunctionName == "" {
+					response.FunctionName = block.Name
+					response.FunctionParameters = params
+				}
+				continue
+			}
+			response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+				Id:   block.Id,
+				Type: "function",
+				Function: util.FunctionCall{
+					Name:       block.Name,
+					Parameters: params,
+				},
+			})
+		}
+	}
+
+	response.Completion = text.String()
+	return response
+}
+
+func (this *Anthropic) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	req, err := this.buildRequest(request, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		LogAnthropicRequest(req)
+	}
+
+	resp, err := this.post(request.Ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result anthropicResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	response := anthropicBlocksToResponse(result.Content, len(request.Functions) > 0)
+	response.Completion = strings.TrimSpace(response.Completion)
+	if request.ResponseSchema != nil {
+		applySchemaResponse(response)
+	}
+	response.Usage = &util.TokenUsage{
+		PromptTokens:     result.Usage.InputTokens,
+		CompletionTokens: result.Usage.OutputTokens,
+	}
+
+	if request.Verbose {
+		LogCompletionResponse(*response, result.Id)
+	}
+	return response, nil
+}
+
+func (this *Anthropic) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	req, err := this.buildRequest(request, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Verbose {
+		LogAnthropicRequest(req)
+	}
+
+	// Like the GPT implementation we want to time out if we don't get a chunk
+	// back for a while, the timer is reset on every line of the stream
+	innerCtx, cancel := context.WithCancel(request.Ctx)
+	defer cancel()
+	tokenTimeout := request.TokenTimeout
+	var chunkTimeoutErr error
+	var timer *time.Timer
+
+	if tokenTimeout > 0 {
+		timer = time.AfterFunc(tokenTimeout, func() {
+			chunkTimeoutErr = NewTokenTimeoutError(tokenTimeout)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	resp, err := this.post(innerCtx, req)
+	if chunkTimeoutErr != nil {
+		return nil, chunkTimeoutErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	blocks := []anthropicContentBlock{}
+	toolInputs := map[int]*strings.Builder{}
+	var id string
+	usage := &util.TokenUsage{}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if timer != nil {
+			timer.Reset(tokenTimeout)
+		}
+
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			// event names are duplicated in the data payload, blank lines
+			// separate events
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+
+		var event anthropicStreamEvent
+		err := json.Unmarshal([]byte(data), &event)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing Anthropic stream event: %s", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			id = event.Message.Id
+			usage.PromptTokens = event.Message.Usage.InputTokens
+
+		case "message_delta":
+			usage.CompletionTokens = event.Usage.OutputTokens
+
+		case "content_block_start":
+			for len(blocks) <= event.Index {
+				blocks = append(blocks, anthropicContentBlock{})
+			}
+			blocks[event.Index] = event.ContentBlock
+			if event.ContentBlock.Type == "tool_use" {
+				toolInputs[event.Index] = &strings.Builder{}
+				writer.Write([]byte(event.ContentBlock.Name))
+				writer.Write([]byte("("))
+			} else if event.ContentBlock.Text != "" {
+				writer.Write([]byte(event.ContentBlock.Text))
+			}
+
+		case "content_block_delta":
+			if event.Index >= len(blocks) {
+				continue
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				blocks[event.Index].Text += event.Delta.Text
+				writer.Write([]byte(event.Delta.Text))
+			case "input_json_delta":
+				if builder, ok := toolInputs[event.Index]; ok {
+					builder.WriteString(event.Delta.PartialJson)
+					writer.Write([]byte(event.Delta.PartialJson))
+				}
+			}
+
+		case "content_block_stop":
+			if builder, ok := toolInputs[event.Index]; ok {
+				blocks[event.Index].Input = anthropicToolInput(builder.String())
+				writer.Write([]byte(")"))
+			}
+
+		case "error":
+			return nil, fmt.Errorf("Anthropic stream error, %s: %s",
+				event.Error.Type, event.Error.Message)
+		}
+	}
+
+	if chunkTimeoutErr != nil {
+		return nil, chunkTimeoutErr
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(writer, "\n") // the stream doesn't finish with a newline
+
+	response := anthropicBlocksToResponse(blocks, len(request.Functions) > 0)
+	response.Usage = usage
+
+	if request.Verbose {
+		LogCompletionResponse(*response, id)
+	}
+	return response, nil
+}
+
+// Anthropic doesn't offer an embeddings endpoint
+func (this *Anthropic) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	return nil, errors.New("The Anthropic provider does not support embeddings, use the openai provider for indexing")
+}
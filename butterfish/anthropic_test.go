@@ -0,0 +1,151 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestShellHistoryBlocksToAnthropicChat(t *testing.T) {
+	blocks := []util.HistoryBlock{
+		{Type: historyTypePrompt, Content: "list files"},
+		{Type: historyTypeShellInput, Content: "ls"},
+		{Type: historyTypeLLMOutput, Content: "", FunctionName: "command", FunctionParams: `{"cmd":"ls"}`},
+		{Type: historyTypeFunctionOutput, Content: "foo.txt", FunctionName: "command"},
+		{Type: historyTypeLLMOutput, ToolCalls: []*util.ToolCall{
+			{Id: "toolu_1", Function: util.FunctionCall{Name: "edit", Parameters: ""}},
+		}},
+		{Type: historyTypeToolOutput, Content: "1 hello", ToolCallId: "toolu_1"},
+	}
+
+	msgs := ShellHistoryBlocksToAnthropicChat(blocks)
+
+	// user blocks are merged so roles alternate
+	assert.Equal(t, 5, len(msgs))
+	assert.Equal(t, "user", msgs[0].Role)
+	assert.Equal(t, 2, len(msgs[0].Content))
+	assert.Equal(t, "assistant", msgs[1].Role)
+	assert.Equal(t, "tool_use", msgs[1].Content[0].Type)
+	assert.Equal(t, "command", msgs[1].Content[0].Name)
+	assert.Equal(t, "tool_result", msgs[2].Content[0].Type)
+	assert.Equal(t, msgs[1].Content[0].Id, msgs[2].Content[0].ToolUseId)
+	assert.Equal(t, "assistant", msgs[3].Role)
+	assert.Equal(t, "{}", string(msgs[3].Content[0].Input))
+	assert.Equal(t, "toolu_1", msgs[4].Content[0].ToolUseId)
+}
+
+func newAnthropicTestServer(t *testing.T, handler func(req *anthropicRequest, w http.ResponseWriter)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("x-api-key"))
+		assert.Equal(t, AnthropicAPIVersion, r.Header.Get("anthropic-version"))
+
+		var req anthropicRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.NoError(t, err)
+		handler(&req, w)
+	}))
+}
+
+func writeSSE(w http.ResponseWriter, events ...string) {
+	for _, event := range events {
+		var parsed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &parsed)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", parsed.Type, event)
+	}
+}
+
+func TestAnthropicCompletionStream(t *testing.T) {
+	server := newAnthropicTestServer(t, func(req *anthropicRequest, w http.ResponseWriter) {
+		assert.True(t, req.Stream)
+		assert.Equal(t, "be brief", req.System)
+		assert.Equal(t, 1, len(req.Tools))
+
+		w.Header().Set("content-type", "text/event-stream")
+		writeSSE(w,
+			`{"type":"message_start","message":{"id":"msg_1","content":[]}}`,
+			`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+			`{"type":"ping"}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+			`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+			`{"type":"content_block_stop","index":0}`,
+			`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_9","name":"edit","input":{}}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"range_start\":"}}`,
+			`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" 1}"}}`,
+			`{"type":"content_block_stop","index":1}`,
+			`{"type":"message_delta","delta":{"stop_reason":"tool_use"}}`,
+			`{"type":"message_stop"}`)
+	})
+	defer server.Close()
+
+	client := NewAnthropic("test-key", server.URL)
+	out := new(bytes.Buffer)
+	resp, err := client.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		Model:         "claude-3-haiku-20240307",
+		MaxTokens:     64,
+		SystemMessage: "be brief",
+		Tools:         EditTools,
+	}, out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world", resp.Completion)
+	assert.Equal(t, 1, len(resp.ToolCalls))
+	assert.Equal(t, "toolu_9", resp.ToolCalls[0].Id)
+	assert.Equal(t, "edit", resp.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"range_start": 1}`, resp.ToolCalls[0].Function.Parameters)
+	assert.Equal(t, "Hello worldedit({\"range_start\": 1})\n", out.String())
+}
+
+func TestAnthropicCompletionLegacyFunctions(t *testing.T) {
+	server := newAnthropicTestServer(t, func(req *anthropicRequest, w http.ResponseWriter) {
+		assert.False(t, req.Stream)
+		assert.Equal(t, 3, len(req.Tools))
+		w.Write([]byte(`{"id":"msg_2","content":[{"type":"text","text":" ok "},{"type":"tool_use","id":"toolu_2","name":"command","input":{"cmd":"ls"}}]}`))
+	})
+	defer server.Close()
+
+	client := NewAnthropic("test-key", server.URL)
+	resp, err := client.Completion(&util.CompletionRequest{
+		Ctx:       context.Background(),
+		Prompt:    "hi",
+		Model:     "claude-3-haiku-20240307",
+		MaxTokens: 64,
+		Functions: goalModeFunctions,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp.Completion)
+	assert.Equal(t, "command", resp.FunctionName)
+	assert.Equal(t, `{"cmd":"ls"}`, resp.FunctionParameters)
+}
+
+func TestAnthropicError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+	}))
+	defer server.Close()
+
+	client := NewAnthropic("bad-key", server.URL)
+	_, err := client.Completion(&util.CompletionRequest{
+		Ctx:       context.Background(),
+		Prompt:    "hi",
+		Model:     "claude-3-haiku-20240307",
+		MaxTokens: 64,
+	})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid x-api-key")
+}
@@ -0,0 +1,183 @@
+package butterfish
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Files larger than this can't be attached, the APIs refuse images much
+// larger than this and text this long wouldn't fit in a context window
+const maxAttachmentBytes = 20 * 1024 * 1024
+
+// Image formats the model APIs accept
+var attachableImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Load the files for --attach. Each argument may be a glob pattern, which
+// covers patterns the shell didn't expand, e.g. a quoted 'src/*.go'.
+func LoadAttachments(patterns []string) ([]util.Attachment, error) {
+	attachments := []util.Attachment{}
+
+	for _, pattern := range patterns {
+		pattern, err := homedir.Expand(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid attachment pattern %s: %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			// not a pattern, or a pattern matching nothing, either way let
+			// LoadAttachment report the missing file
+			matches = []string{pattern}
+		}
+
+		for _, path := range matches {
+			attachment, err := LoadAttachment(path)
+			if err != nil {
+				return nil, err
+			}
+			attachments = append(attachments, attachment)
+		}
+	}
+
+	return attachments, nil
+}
+
+// Load a single text file or image to attach to a prompt
+func LoadAttachment(path string) (util.Attachment, error) {
+	attachment := util.Attachment{Path: path}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return attachment, fmt.Errorf("Could not attach file: %w", err)
+	}
+	if info.IsDir() {
+		return attachment, fmt.Errorf("Could not attach %s, it's a directory", path)
+	}
+	if info.Size() > maxAttachmentBytes {
+		return attachment, fmt.Errorf("Could not attach %s, it's larger than %dMB",
+			path, maxAttachmentBytes/1024/1024)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return attachment, fmt.Errorf("Could not attach file: %w", err)
+	}
+	attachment.Data = data
+
+	// sniffing is reliable for images and doesn't depend on the extension
+	mimeType := http.DetectContentType(data)
+	if strings.HasPrefix(mimeType, "image/") {
+		if !attachableImageTypes[mimeType] {
+			return attachment, fmt.Errorf("Could not attach %s, %s images aren't supported", path, mimeType)
+		}
+		attachment.MimeType = mimeType
+		return attachment, nil
+	}
+
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return attachment, fmt.Errorf("Could not attach %s, only text files and images can be attached", path)
+	}
+	attachment.MimeType = "text/plain"
+	return attachment, nil
+}
+
+// Matches @path tokens in a shell prompt, e.g. "what's wrong with @main.go"
+var attachmentTokenRegex = regexp.MustCompile(`(^|\s)@(\S+)`)
+
+// The path of a file named in a prompt, relative paths are relative to dir.
+// False if there's no such file.
+func attachmentPath(name, dir string) (string, bool) {
+	path, err := homedir.Expand(name)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// Find @path tokens in a shell prompt and load each one that names a file,
+// relative paths are resolved against dir. Tokens that don't name a file are
+// left alone since they might be something else, like a username. The
+// prompt itself is unchanged, the model sees the token and the attachment
+// under the same path.
+func promptAttachments(prompt, dir string) ([]util.Attachment, error) {
+	attachments := []util.Attachment{}
+
+	for _, match := range attachmentTokenRegex.FindAllStringSubmatch(prompt, -1) {
+		name := strings.TrimRight(match[2], ",.;:?!)")
+		path, found := attachmentPath(name, dir)
+		if !found {
+			continue
+		}
+
+		attachment, err := LoadAttachment(path)
+		if err != nil {
+			return nil, err
+		}
+		attachment.Path = name
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+// Rough number of tokens an image costs, using OpenAI's formula: the image
+// is scaled to fit 2048x2048 then so its short side is at most 768, and
+// costs 170 tokens per 512px tile plus 85. Other providers are in the same
+// ballpark. If we can't read the dimensions we assume a typical image.
+func estimateImageTokens(attachment util.Attachment) int {
+	config, _, err := image.DecodeConfig(bytes.NewReader(attachment.Data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return 765
+	}
+
+	width, height := float64(config.Width), float64(config.Height)
+	if width > 2048 || height > 2048 {
+		scale := 2048 / math.Max(width, height)
+		width, height = width*scale, height*scale
+	}
+	if short := math.Min(width, height); short > 768 {
+		width, height = width*768/short, height*768/short
+	}
+
+	tiles := int(math.Ceil(width/512) * math.Ceil(height/512))
+	return 85 + 170*tiles
+}
+
+// Tokens used by attachments, text is counted with the tokenizer and images
+// are estimated
+func attachmentTokens(attachments []util.Attachment, tokenizer Tokenizer) int {
+	total := tokenizer.Count(util.PromptWithAttachments("", attachments))
+	for _, img := range util.ImageAttachments(attachments) {
+		total += estimateImageTokens(img)
+	}
+	return total
+}
@@ -0,0 +1,123 @@
+package butterfish
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	assert.Nil(t, err)
+	return buf.Bytes()
+}
+
+func TestLoadAttachments(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.go"), []byte("package b\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "shot.png"), testPNG(t, 10, 10), 0644)
+	os.WriteFile(filepath.Join(dir, "blob.bin"), []byte{0x7f, 0x00, 0x01, 0xff}, 0644)
+
+	attachments, err := LoadAttachments([]string{
+		filepath.Join(dir, "*.go"),
+		filepath.Join(dir, "shot.png"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(attachments))
+	assert.Equal(t, filepath.Join(dir, "a.go"), attachments[0].Path)
+	assert.Equal(t, "text/plain", attachments[0].MimeType)
+	assert.Equal(t, "package a\n", string(attachments[0].Data))
+	assert.Equal(t, "image/png", attachments[2].MimeType)
+	assert.True(t, attachments[2].IsImage())
+
+	_, err = LoadAttachments([]string{filepath.Join(dir, "blob.bin")})
+	assert.ErrorContains(t, err, "only text files and images")
+
+	_, err = LoadAttachments([]string{dir})
+	assert.ErrorContains(t, err, "directory")
+
+	_, err = LoadAttachments([]string{filepath.Join(dir, "missing.txt")})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestPromptAttachments(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644)
+
+	attachments, err := promptAttachments("What's wrong with @main.go? Ask @nobody", dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(attachments))
+	assert.Equal(t, "main.go", attachments[0].Path)
+
+	attachments, err = promptAttachments("email me@example.com", dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(attachments))
+}
+
+func TestPromptWithAttachments(t *testing.T) {
+	attachments := []util.Attachment{
+		{Path: "src/a.go", MimeType: "text/plain", Data: []byte("package a")},
+		{Path: "shot.png", MimeType: "image/png", Data: []byte("png")},
+	}
+
+	assert.Equal(t, "explain\n\n--- src/a.go ---\npackage a",
+		util.PromptWithAttachments("explain", attachments))
+	assert.Equal(t, "--- src/a.go ---\npackage a",
+		util.PromptWithAttachments("", attachments))
+}
+
+func TestEstimateImageTokens(t *testing.T) {
+	// scaled down to 768x768, 4 tiles
+	assert.Equal(t, 765, estimateImageTokens(util.Attachment{Data: testPNG(t, 1024, 1024)}))
+	// one tile
+	assert.Equal(t, 255, estimateImageTokens(util.Attachment{Data: testPNG(t, 100, 50)}))
+	// unreadable, assume a typical image
+	assert.Equal(t, 765, estimateImageTokens(util.Attachment{Data: []byte("nope")}))
+}
+
+func TestAttachmentMessages(t *testing.T) {
+	img := util.Attachment{Path: "shot.png", MimeType: "image/png", Data: []byte("png")}
+	text := util.Attachment{Path: "a.txt", MimeType: "text/plain", Data: []byte("hello")}
+	encoded := base64.StdEncoding.EncodeToString(img.Data)
+
+	msg := openaiUserMessage("look", []util.Attachment{img, text})
+	assert.Equal(t, "", msg.Content)
+	assert.Equal(t, 2, len(msg.MultiContent))
+	assert.Equal(t, openai.ChatMessagePartTypeText, msg.MultiContent[0].Type)
+	assert.Equal(t, "look\n\n--- a.txt ---\nhello", msg.MultiContent[0].Text)
+	assert.Equal(t, "data:image/png;base64,"+encoded, msg.MultiContent[1].ImageURL.URL)
+
+	// no images, plain content
+	msg = openaiUserMessage("look", []util.Attachment{text})
+	assert.Equal(t, "look\n\n--- a.txt ---\nhello", msg.Content)
+	assert.Nil(t, msg.MultiContent)
+
+	anthropic := &Anthropic{models: DefaultModelCatalog()}
+	req, err := anthropic.buildRequest(&util.CompletionRequest{
+		Model:       "claude-3-haiku-20240307",
+		Prompt:      "look",
+		Attachments: []util.Attachment{img},
+	}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(req.Messages))
+	assert.Equal(t, "image", req.Messages[0].Content[0].Type)
+	assert.Equal(t, encoded, req.Messages[0].Content[0].Source.Data)
+	assert.Equal(t, "look", req.Messages[0].Content[1].Text)
+
+	ollamaMsgs := ShellHistoryBlocksToOllamaChat("", []util.HistoryBlock{
+		{Type: historyTypePrompt, Content: "look", Attachments: []util.Attachment{img}},
+	})
+	assert.Equal(t, []string{encoded}, ollamaMsgs[0].Images)
+}
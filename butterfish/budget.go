@@ -0,0 +1,97 @@
+package butterfish
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Budget key that limits spend across all features
+const BudgetTotal = "total"
+
+// Returned when a feature has spent its budget, or would with the next call
+type BudgetError struct {
+	Feature string
+	// "daily" or "session"
+	Period string
+	Limit  float64
+	Spent  float64
+}
+
+func (this *BudgetError) Error() string {
+	feature := this.Feature + " "
+	if this.Feature == BudgetTotal {
+		feature = ""
+	}
+	return fmt.Sprintf("The %s %sbudget of $%.2f has been reached ($%.4f spent)",
+		this.Period, feature, this.Limit, this.Spent)
+}
+
+// Check the daily and session budgets for a feature, as well as the total
+// budgets. estimate is the expected cost of the next call, pass 0 to only
+// check whether the budget has already been spent. Returns a *BudgetError if
+// a budget is exceeded, nil otherwise or if usage tracking is off.
+func (this *ButterfishCtx) CheckBudget(feature string, estimate float64) error {
+	if this.UsageLedger == nil {
+		return nil
+	}
+
+	exceeded := func(spent, limit float64) bool {
+		return limit > 0 && (spent >= limit || spent+estimate > limit)
+	}
+
+	for _, key := range []string{feature, BudgetTotal} {
+		if limit := this.Config.SessionBudgets[key]; limit > 0 {
+			spent := this.UsageLedger.SessionSpend(key)
+			if exceeded(spent, limit) {
+				return &BudgetError{key, "session", limit, spent}
+			}
+		}
+
+		if limit := this.Config.DailyBudgets[key]; limit > 0 {
+			spent := this.UsageLedger.DailySpend(key)
+			if exceeded(spent, limit) {
+				return &BudgetError{key, "daily", limit, spent}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Worst case cost of a request, assuming it uses all of maxTokens
+func (this *ButterfishCtx) EstimateCost(model string, promptTokens, maxTokens int) float64 {
+	if this.UsageLedger == nil {
+		return 0
+	}
+	return this.UsageLedger.Cost(UsageRecord{
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: maxTokens,
+	})
+}
+
+// Describe spend against each configured budget, one line per budget, for
+// the shell Status command
+func (this *ButterfishCtx) budgetStatus() string {
+	if this.UsageLedger == nil {
+		return ""
+	}
+
+	text := ""
+	describe := func(period string, budgets map[string]float64, spend func(string) float64) {
+		keys := []string{}
+		for key := range budgets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			label := fmt.Sprintf("Budget (%s %s):", period, key)
+			text += fmt.Sprintf("%-23s$%.4f of $%.2f\n", label, spend(key), budgets[key])
+		}
+	}
+
+	describe("daily", this.Config.DailyBudgets, this.UsageLedger.DailySpend)
+	describe("session", this.Config.SessionBudgets, this.UsageLedger.SessionSpend)
+	return text
+}
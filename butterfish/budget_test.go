@@ -0,0 +1,77 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckBudget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	prices := map[string]ModelPrice{"test-model": {Input: 1000000, Output: 0}}
+
+	// a call from another process earlier today, $1 of autosuggest
+	data, _ := json.Marshal(UsageRecord{Time: time.Now(), Session: "other",
+		Feature: FeatureAutosuggest, Model: "test-model", PromptTokens: 1})
+	os.WriteFile(path, append(data, '\n'), 0600)
+
+	ctx := &ButterfishCtx{
+		Config: &ButterfishConfig{
+			DailyBudgets:   map[string]float64{FeatureAutosuggest: 1.5},
+			SessionBudgets: map[string]float64{BudgetTotal: 3},
+		},
+		UsageLedger: NewUsageLedger(path, prices),
+	}
+
+	// $1 spent today, under the $1.50 daily budget
+	assert.NoError(t, ctx.CheckBudget(FeatureAutosuggest, 0))
+	// but the next call is expected to go over
+	err := ctx.CheckBudget(FeatureAutosuggest, 1)
+	var budgetErr *BudgetError
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.Equal(t, "daily", budgetErr.Period)
+	assert.Equal(t, "The daily autosuggest budget of $1.50 has been reached ($1.0000 spent)", err.Error())
+
+	// recording this session counts toward today
+	ctx.UsageLedger.Record(UsageRecord{Feature: FeatureAutosuggest, Model: "test-model", PromptTokens: 1})
+	assert.Error(t, ctx.CheckBudget(FeatureAutosuggest, 0))
+	// other features have no daily budget
+	assert.NoError(t, ctx.CheckBudget(FeaturePrompt, 0))
+
+	// the session total includes every feature from this process only
+	ctx.UsageLedger.Record(UsageRecord{Feature: FeaturePrompt, Model: "test-model", PromptTokens: 2})
+	err = ctx.CheckBudget(FeaturePrompt, 0)
+	assert.Equal(t, "The session budget of $3.00 has been reached ($3.0000 spent)", err.Error())
+
+	// no ledger means no usage tracking, so no budgets
+	ctx.UsageLedger = nil
+	assert.NoError(t, ctx.CheckBudget(FeaturePrompt, 100))
+}
+
+func TestDailySpendAcrossLedgers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	prices := map[string]ModelPrice{"test-model": {Input: 1000000, Output: 0}}
+	first := NewUsageLedger(path, prices)
+	second := NewUsageLedger(path, prices)
+	second.session = "second"
+
+	first.Record(UsageRecord{Feature: FeaturePrompt, Model: "test-model", PromptTokens: 1})
+	assert.Equal(t, 1.0, first.DailySpend(BudgetTotal))
+
+	// another shell running at the same time spends after our first check
+	second.Record(UsageRecord{Feature: FeaturePrompt, Model: "test-model", PromptTokens: 2})
+	assert.Equal(t, 3.0, first.DailySpend(FeaturePrompt))
+	assert.Equal(t, 3.0, second.DailySpend(FeaturePrompt))
+
+	// our own calls aren't counted twice
+	first.Record(UsageRecord{Feature: FeatureAutosuggest, Model: "test-model", PromptTokens: 1})
+	second.Record(UsageRecord{Feature: FeatureAutosuggest, Model: "test-model", PromptTokens: 1})
+	assert.Equal(t, 5.0, first.DailySpend(BudgetTotal))
+	assert.Equal(t, 5.0, second.DailySpend(BudgetTotal))
+	assert.Equal(t, 2.0, first.DailySpend(FeatureAutosuggest))
+}
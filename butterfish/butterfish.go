@@ -10,8 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode"
@@ -49,6 +51,65 @@ type ButterfishConfig struct {
 	BaseURL      string
 	TokenTimeout time.Duration // how long to wait for a token before timing out
 
+	// Which LLM API to talk to, "openai" (the default), "anthropic" or
+	// "ollama"
+	LLMProvider string
+	// Anthropic API key, used when LLMProvider is "anthropic"
+	AnthropicToken string
+	// Model used to embed files for the vector index, blank for the
+	// provider's default
+	EmbeddingModel string
+
+	// Ordered fallback chains of providers, if a provider fails with a server
+	// error or timeout we move on to the next one. Entries are "provider" or
+	// "provider:model", e.g. "ollama:llama3:8b". An empty prompt chain means
+	// LLMProvider alone, empty autosuggest and embedding chains use the
+	// prompt chain.
+	PromptProviders      []string
+	AutosuggestProviders []string
+	EmbeddingProviders   []string
+	// How long a failed provider is skipped before we try it again
+	FallbackCooldown time.Duration
+
+	// On-disk cache of LLM responses for repeated low-temperature requests
+	// and embeddings, e.g. autosuggest and summarize
+	CacheEnabled bool
+	CachePath    string
+	CacheTTL     time.Duration
+	CacheMaxSize int64
+	// requests with a higher temperature than this aren't cached
+	CacheMaxTemperature float32
+
+	// Append-only JSONL record of token usage per call, blank to disable
+	UsageLedgerPath string
+	// YAML file overriding the prices in the model catalog
+	PriceTablePath string
+	// YAML file extending the built-in model catalog, see ModelCatalog
+	ModelCatalogPath string
+
+	// Mask secrets in shell history before it's sent to an LLM, with the
+	// built-in detectors plus any configured in the YAML file at
+	// RedactionConfigPath, see RedactionConfig
+	RedactionEnabled    bool
+	RedactionConfigPath string
+
+	// Spend limits in USD keyed by feature (e.g. "autosuggest", see the
+	// Feature constants) or BudgetTotal for all features. Daily budgets reset
+	// at local midnight, session budgets apply to this process. Zero or
+	// missing means no limit. These require the usage ledger.
+	DailyBudgets   map[string]float64
+	SessionBudgets map[string]float64
+
+	// Append every LLM request and response with timings to a JSONL file,
+	// see TranscriptLog. The path is also read by the transcripts command.
+	TranscriptEnabled bool
+	TranscriptPath    string
+
+	// Write every LLM call to a cassette file, or serve calls from one
+	// instead of an API, see Cassette. At most one of these should be set.
+	RecordPath string
+	ReplayPath string
+
 	// LLM API communication client that implements the LLM interface
 	LLMClient LLM
 
@@ -74,6 +135,7 @@ type ButterfishConfig struct {
 	ShellBinary             string // path to the shell binary to use, e.g. /bin/zsh
 	ShellPromptModel        string // used when the user enters an explicit prompt
 	ShellLeavePromptAlone   bool   // don't try to edit the shell prompt
+	ShellPromptIntegration  string // PromptIntegrationPS1 or PromptIntegrationOSC133
 	ShellAutosuggestEnabled bool   // whether to use autosuggest
 	ShellAutosuggestModel   string // used when we're autocompleting a command
 	// how long to wait between when the user stos typing and we ask for an
@@ -85,6 +147,19 @@ type ButterfishConfig struct {
 	ShellMaxHistoryBlockTokens int
 	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
 	ShellMaxResponseTokens int
+	// Save shell history to this session in the HistoryStore at
+	// ShellHistoryPath and load it when the shell starts, blank to disable.
+	// This is the working directory unless the user names a session.
+	ShellHistorySession string
+	ShellHistoryPath    string
+	// History blocks and sessions older than this are dropped
+	ShellHistoryRetention time.Duration
+	// Embed shell history blocks in a RecallIndex at ShellRecallPath so
+	// older history can be searched and relevant blocks are added to prompts
+	ShellRecallEnabled bool
+	ShellRecallPath    string
+	// recalled blocks must have at least this cosine similarity to the query
+	ShellRecallMinScore float64
 
 	// Model, temp, and max tokens to use when executing the `gencmd` command
 	GencmdModel       string
@@ -100,6 +175,9 @@ type ButterfishConfig struct {
 	SummarizeModel       string
 	SummarizeTemperature float32
 	SummarizeMaxTokens   int
+	// temperature for extracting facts from chunks of a long document, low
+	// so results are repeatable and can be cached
+	SummarizeFactsTemperature float32
 }
 
 func (this *ButterfishConfig) ParseShell() string {
@@ -130,6 +208,64 @@ type LLM interface {
 	Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error)
 }
 
+// Implemented by LLM decorators (e.g. CachingLLM) so we can find the client
+// they wrap.
+type LLMWrapper interface {
+	Unwrap() LLM
+}
+
+// Walk down through any decorators until we find a client of type T
+func UnwrapLLM[T any](client LLM) (T, bool) {
+	for client != nil {
+		if found, ok := client.(T); ok {
+			return found, true
+		}
+		wrapper, ok := client.(LLMWrapper)
+		if !ok {
+			break
+		}
+		client = wrapper.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+// Returned by streaming calls when the server stops sending tokens for longer
+// than the token timeout.
+var ErrTokenTimeout = errors.New("Timed out waiting for streaming response")
+
+func NewTokenTimeoutError(timeout time.Duration) error {
+	return fmt.Errorf("%w, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", ErrTokenTimeout, timeout)
+}
+
+// A non-200 response from an LLM API
+type StatusError struct {
+	Service    string
+	StatusCode int
+	Message    string
+}
+
+func (this *StatusError) Error() string {
+	return fmt.Sprintf("%s error, status %d: %s", this.Service, this.StatusCode, this.Message)
+}
+
+// Information about a model reported by the LLM server
+type ModelInfo struct {
+	Name string
+	// context window size in tokens, 0 if unknown
+	ContextLength int
+	// free-form description, e.g. family and quantization
+	Details string
+}
+
+// An LLM client that can ask its server which models are available and how
+// large their context windows are, e.g. a local Ollama server.
+type ModelDiscoverer interface {
+	ListModels(ctx context.Context) ([]ModelInfo, error)
+	ContextLength(ctx context.Context, model string) (int, error)
+}
+
 type ButterfishCtx struct {
 	// global context, should be passed through to other calls
 	Ctx context.Context
@@ -144,12 +280,34 @@ type ButterfishCtx struct {
 	InConsoleMode bool
 	// library of prompts
 	PromptLibrary PromptLibrary
-	// GPT client
+	// what we know about each model, the defaults plus the user's catalog file
+	Models *ModelCatalog
+	// masks secrets in shell history, nil if redaction is disabled
+	HistoryRedactor *Redactor
+	// GPT client, used for prompting
 	LLMClient LLM
+	// client for autosuggest and embeddings, these are the same as LLMClient
+	// unless a separate fallback chain is configured
+	AutosuggestLLMClient LLM
+	EmbeddingLLMClient   LLM
 	// landing space for generated commands
 	CommandRegister string
 	// embedding index for searching local files
 	VectorIndex embedding.FileEmbeddingIndex
+	// on-disk response cache, the clients above only use it if caching is
+	// enabled
+	ResponseCache *ResponseCache
+	// record of token usage, nil if usage tracking is disabled
+	UsageLedger *UsageLedger
+	// transcript of LLM calls, the clients above only write to it if
+	// transcripts are enabled
+	TranscriptLog *TranscriptLog
+
+	// models the server listed, see IsKnownModel
+	serverModels      map[string]bool
+	serverModelsFrom  LLM
+	serverModelsAt    time.Time
+	serverModelsMutex sync.Mutex
 }
 
 type ColorScheme struct {
@@ -193,8 +351,6 @@ var GruvboxLight = ColorScheme{
 	Grey:       "#928374",
 }
 
-const BestCompletionModel = "gpt-3.5-turbo"
-
 func MakeButterfishConfig() *ButterfishConfig {
 	colorScheme := &GruvboxDark
 
@@ -211,6 +367,17 @@ func MakeButterfishConfig() *ButterfishConfig {
 		SummarizeModel:       BestCompletionModel,
 		SummarizeTemperature: 0.7,
 		SummarizeMaxTokens:   1024,
+
+		SummarizeFactsTemperature: DefaultSummarizeFactsTemperature,
+
+		CachePath:              "~/.cache/butterfish",
+		CacheTTL:               DefaultCacheTTL,
+		CacheMaxSize:           DefaultCacheMaxBytes,
+		CacheMaxTemperature:    DefaultCacheMaxTemperature,
+		RedactionEnabled:       true,
+		ShellHistoryRetention:  DefaultHistoryRetention,
+		ShellPromptIntegration: PromptIntegrationPS1,
+		ShellRecallMinScore:    DefaultRecallMinScore,
 	}
 }
 
@@ -255,7 +422,9 @@ func sanitizeTTYString(data string) string {
 	return filterNonPrintable(stripANSI(data))
 }
 
-func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, func() error, error) {
+// Start a command in a pty, returning the pty, the child's pid, and a
+// cleanup function that restores the terminal
+func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, int, func() error, error) {
 	// Create arbitrary command.
 	var cmd *exec.Cmd
 
@@ -273,7 +442,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 	// Start the command with a pty.
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
-		return nil, nil, err
+		return nil, 0, nil, err
 	}
 
 	// Handle pty size.
@@ -294,7 +463,7 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		ptmx.Close()
 		signal.Stop(ch)
 		close(ch)
-		return nil, nil, err
+		return nil, 0, nil, err
 	}
 
 	cleanup := func() error {
@@ -309,11 +478,65 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		return term.Restore(int(os.Stdin.Fd()), oldState)
 	}
 
-	return ptmx, cleanup, nil
+	return ptmx, cmd.Process.Pid, cleanup, nil
 }
 
 func (this *ButterfishCtx) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
-	return this.LLMClient.Embeddings(ctx, content, this.Config.Verbose > 0)
+	return this.EmbeddingLLMClient.Embeddings(ctx, content, this.Config.Verbose > 0)
+}
+
+// Context window size for a model. If the LLM client can ask its server
+// (e.g. a local model server) we trust that, otherwise we use our table of
+// known models.
+func (this *ButterfishCtx) ContextLengthForModel(client LLM, model string) int {
+	if discoverer, ok := UnwrapLLM[ModelDiscoverer](client); ok {
+		numTokens, err := discoverer.ContextLength(this.Ctx, model)
+		if err == nil && numTokens > 0 {
+			log.Printf("Server reports context window size of %d tokens for %s", numTokens, model)
+			return numTokens
+		}
+		log.Printf("Could not get context window size for %s from server: %v", model, err)
+	}
+
+	return this.Models.NumTokens(model)
+}
+
+// How long we trust the list of models on the server, so prompts starting
+// with @ don't each wait on the server
+const serverModelsTTL = time.Minute
+
+// Whether a model is in the catalog, or on the server if the LLM client can
+// list the server's models, so we can tell a model name from other text. The
+// server's list is cached for serverModelsTTL, including a failure to get it.
+func (this *ButterfishCtx) IsKnownModel(client LLM, model string) bool {
+	if _, found := this.Models.Lookup(model); found {
+		return true
+	}
+
+	discoverer, ok := UnwrapLLM[ModelDiscoverer](client)
+	if !ok {
+		return false
+	}
+
+	this.serverModelsMutex.Lock()
+	defer this.serverModelsMutex.Unlock()
+
+	if this.serverModels == nil || this.serverModelsFrom != client ||
+		time.Since(this.serverModelsAt) > serverModelsTTL {
+		this.serverModels = map[string]bool{}
+		this.serverModelsFrom = client
+		this.serverModelsAt = time.Now()
+
+		models, err := discoverer.ListModels(this.Ctx)
+		if err != nil {
+			log.Printf("Could not list models on the server: %s", err)
+		}
+		for _, info := range models {
+			this.serverModels[info.Name] = true
+		}
+	}
+
+	return this.serverModels[model]
 }
 
 // A local printf that writes to the butterfishctx out using a lipgloss style
@@ -436,19 +659,137 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 	return promptLibrary, nil
 }
 
-func initLLM(config *ButterfishConfig) (LLM, error) {
+const (
+	LLMProviderOpenAI    = "openai"
+	LLMProviderAnthropic = "anthropic"
+	LLMProviderOllama    = "ollama"
+)
+
+// Create the client for a single provider. The base URL only applies to the
+// main provider (LLMProvider), fallback providers use their defaults.
+func initProvider(config *ButterfishConfig, catalog *ModelCatalog, provider string) (LLM, error) {
+	baseURL := ""
+	if provider == config.LLMProvider || (provider == LLMProviderOpenAI && config.LLMProvider == "") {
+		baseURL = config.BaseURL
+	}
+
+	switch provider {
+	case "", LLMProviderOpenAI:
+	case LLMProviderAnthropic:
+		if config.LLMClient != nil {
+			return config.LLMClient, nil
+		}
+		if config.AnthropicToken == "" {
+			return nil, errors.New("Must provide an Anthropic token to use the anthropic provider.")
+		}
+		anthropic := NewAnthropic(config.AnthropicToken, baseURL)
+		anthropic.models = catalog
+		return anthropic, nil
+	case LLMProviderOllama:
+		if config.LLMClient != nil {
+			return config.LLMClient, nil
+		}
+		return NewOllama(baseURL, config.EmbeddingModel), nil
+	default:
+		return nil, fmt.Errorf("Unknown LLM provider %s, expected %s, %s or %s.",
+			provider, LLMProviderOpenAI, LLMProviderAnthropic, LLMProviderOllama)
+	}
+
 	if config.OpenAIToken == "" && config.LLMClient != nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
 	} else if config.OpenAIToken != "" && config.LLMClient != nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client, not both.")
 	} else if config.OpenAIToken != "" {
-		gpt := NewGPT(config.OpenAIToken, config.BaseURL)
+		gpt := NewGPT(config.OpenAIToken, baseURL)
+		gpt.embeddingModel = config.EmbeddingModel
+		gpt.models = catalog
 		return gpt, nil
 	} else {
 		return config.LLMClient, nil
 	}
 }
 
+func providerName(provider string) string {
+	if provider == "" {
+		return LLMProviderOpenAI
+	}
+	return provider
+}
+
+// The embedding model a provider will use, for usage accounting
+func embeddingModelForProvider(config *ButterfishConfig, provider string) string {
+	if config.EmbeddingModel != "" {
+		return config.EmbeddingModel
+	}
+	switch provider {
+	case LLMProviderOllama:
+		return OllamaDefaultEmbeddingModel
+	case LLMProviderAnthropic:
+		return ""
+	default:
+		return string(GPTEmbeddingsModel)
+	}
+}
+
+// Split a chain entry like "ollama:llama3:8b" into provider and model, the
+// model is optional.
+func parseProviderEntry(entry string) (string, string) {
+	provider, model, _ := strings.Cut(strings.TrimSpace(entry), ":")
+	return provider, model
+}
+
+// Create the LLM client for a fallback chain of providers. An empty chain
+// means just the main provider, and a chain with a single entry and no model
+// override is returned undecorated. Clients are shared between chains
+// through the clients map so we don't set up the same provider twice. If
+// ledger is set then each provider's calls are recorded in it.
+func initLLMChain(
+	config *ButterfishConfig,
+	catalog *ModelCatalog,
+	chain []string,
+	clients map[string]LLM,
+	ledger *UsageLedger,
+) (LLM, error) {
+	if len(chain) == 0 {
+		chain = []string{config.LLMProvider}
+	}
+
+	getClient := func(provider string) (LLM, error) {
+		if client, ok := clients[provider]; ok {
+			return client, nil
+		}
+		client, err := initProvider(config, catalog, provider)
+		if err != nil {
+			return nil, err
+		}
+		if ledger != nil {
+			client = NewUsageLLM(client, ledger, providerName(provider),
+				embeddingModelForProvider(config, provider))
+		}
+		clients[provider] = client
+		return client, nil
+	}
+
+	if len(chain) == 1 {
+		provider, model := parseProviderEntry(chain[0])
+		if model == "" {
+			return getClient(provider)
+		}
+	}
+
+	fallback := NewFallbackLLM(config.FallbackCooldown)
+	for _, entry := range chain {
+		provider, model := parseProviderEntry(entry)
+		client, err := getClient(provider)
+		if err != nil {
+			return nil, err
+		}
+		fallback.AddBackend(providerName(provider), client, model)
+	}
+
+	return fallback, nil
+}
+
 func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 	verboseWriter := util.NewStyledWriter(os.Stdout, config.Styles.Grey)
 
@@ -464,12 +805,163 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 	return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
 }
 
+func autosuggestChain(config *ButterfishConfig) []string {
+	if len(config.AutosuggestProviders) == 0 {
+		return config.PromptProviders
+	}
+	return config.AutosuggestProviders
+}
+
+func embeddingChain(config *ButterfishConfig) []string {
+	if len(config.EmbeddingProviders) == 0 {
+		return config.PromptProviders
+	}
+	return config.EmbeddingProviders
+}
+
+// Build the prompt, autosuggest, and embedding clients from their provider
+// chains, clients are shared between chains where providers overlap. When
+// replaying a cassette all three are served from it and we don't talk to
+// any provider.
+func initLLMClients(config *ButterfishConfig, catalog *ModelCatalog, ledger *UsageLedger) (LLM, LLM, LLM, error) {
+	if config.ReplayPath != "" {
+		path, err := homedir.Expand(config.ReplayPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cassette, err := LoadCassette(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		replay := NewReplayLLM(cassette, false)
+		replay.Verbose = config.Verbose > 0
+		return replay, replay, replay, nil
+	}
+
+	clients := map[string]LLM{}
+	llmClient, err := initLLMChain(config, catalog, config.PromptProviders, clients, ledger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	autosuggestClient, err := initLLMChain(config, catalog, autosuggestChain(config), clients, ledger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	embeddingClient, err := initLLMChain(config, catalog, embeddingChain(config), clients, ledger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return llmClient, autosuggestClient, embeddingClient, nil
+}
+
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
-	llmClient, err := initLLM(config)
+	if config.RecordPath != "" && config.ReplayPath != "" {
+		return nil, errors.New("Can't record and replay a cassette at the same time")
+	}
+
+	catalogPath, err := homedir.Expand(config.ModelCatalogPath)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := LoadModelCatalog(catalogPath)
+	if err != nil {
+		return nil, err
+	}
+	// models left at the built-in default follow the catalog's choice
+	for _, model := range []*string{&config.GencmdModel, &config.ExeccheckModel, &config.SummarizeModel} {
+		if *model == BestCompletionModel {
+			*model = catalog.BestCompletionModel
+		}
+	}
+
+	var redactor *Redactor
+	if config.RedactionEnabled {
+		redactionPath, err := homedir.Expand(config.RedactionConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		redactor, err = LoadRedactor(redactionPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ledger *UsageLedger
+	// replayed calls cost nothing so there's nothing to record
+	if config.UsageLedgerPath != "" && config.ReplayPath == "" {
+		ledgerPath, err := homedir.Expand(config.UsageLedgerPath)
+		if err != nil {
+			return nil, err
+		}
+		pricePath, err := homedir.Expand(config.PriceTablePath)
+		if err != nil {
+			return nil, err
+		}
+		prices, err := LoadPriceTable(pricePath, catalog)
+		if err != nil {
+			return nil, err
+		}
+		ledger = NewUsageLedger(ledgerPath, prices)
+	}
+
+	llmClient, autosuggestClient, embeddingClient, err := initLLMClients(config, catalog, ledger)
 	if err != nil {
 		return nil, err
 	}
 
+	cachePath, err := homedir.Expand(config.CachePath)
+	if err != nil {
+		return nil, err
+	}
+	responseCache := NewResponseCache(filepath.Join(cachePath, "responses"),
+		config.CacheTTL, config.CacheMaxSize)
+
+	// the cassette sits outside the cache so it records what we actually
+	// served, and we don't cache replayed responses
+	if config.CacheEnabled && config.CachePath != "" && config.ReplayPath == "" {
+		// the namespace keeps responses from different providers apart
+		namespace := func(chain []string) string {
+			if len(chain) == 0 {
+				chain = []string{config.LLMProvider}
+			}
+			return strings.Join(chain, ",") + "|" + config.BaseURL
+		}
+
+		llmClient = NewCachingLLM(llmClient, responseCache,
+			namespace(config.PromptProviders), config.CacheMaxTemperature)
+		autosuggestClient = NewCachingLLM(autosuggestClient, responseCache,
+			namespace(autosuggestChain(config)), config.CacheMaxTemperature)
+		embeddingClient = NewCachingLLM(embeddingClient, responseCache,
+			namespace(embeddingChain(config))+"|"+config.EmbeddingModel, config.CacheMaxTemperature)
+	}
+
+	var transcriptLog *TranscriptLog
+	if config.TranscriptPath != "" {
+		transcriptPath, err := homedir.Expand(config.TranscriptPath)
+		if err != nil {
+			return nil, err
+		}
+		transcriptLog = NewTranscriptLog(transcriptPath)
+	}
+	// outside the cache so we log what was actually served
+	if config.TranscriptEnabled && transcriptLog != nil {
+		llmClient = NewTranscriptLLM(llmClient, transcriptLog)
+		autosuggestClient = NewTranscriptLLM(autosuggestClient, transcriptLog)
+		embeddingClient = NewTranscriptLLM(embeddingClient, transcriptLog)
+	}
+
+	if config.RecordPath != "" {
+		recordPath, err := homedir.Expand(config.RecordPath)
+		if err != nil {
+			return nil, err
+		}
+		cassette := NewCassette(recordPath)
+		llmClient = NewRecordingLLM(llmClient, cassette)
+		autosuggestClient = NewRecordingLLM(autosuggestClient, cassette)
+		embeddingClient = NewRecordingLLM(embeddingClient, cassette)
+	}
+
 	promptLibrary, err := initPromptLibrary(config)
 	if err != nil {
 		return nil, err
@@ -478,13 +970,20 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 	ctx, cancel := context.WithCancel(ctx)
 
 	butterfishCtx := &ButterfishCtx{
-		Ctx:           ctx,
-		Cancel:        cancel,
-		PromptLibrary: promptLibrary,
-		InConsoleMode: false,
-		Config:        config,
-		LLMClient:     llmClient,
-		Out:           os.Stdout,
+		Ctx:                  ctx,
+		Cancel:               cancel,
+		PromptLibrary:        promptLibrary,
+		InConsoleMode:        false,
+		Config:               config,
+		Models:               catalog,
+		HistoryRedactor:      redactor,
+		LLMClient:            llmClient,
+		AutosuggestLLMClient: autosuggestClient,
+		EmbeddingLLMClient:   embeddingClient,
+		ResponseCache:        responseCache,
+		UsageLedger:          ledger,
+		TranscriptLog:        transcriptLog,
+		Out:                  os.Stdout,
 	}
 
 	return butterfishCtx, nil
@@ -0,0 +1,444 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const DefaultCacheTTL = 7 * 24 * time.Hour
+const DefaultCacheMaxBytes = 100 * 1024 * 1024
+
+// Requests with a temperature above this are expected to give a different
+// answer each time, so we don't cache them
+const DefaultCacheMaxTemperature = 0.3
+
+// Fact extraction in summarize runs at this temperature so it's cached by
+// default
+const DefaultSummarizeFactsTemperature = 0.2
+
+// ResponseCache is a content-addressed store of LLM responses on disk. Each
+// entry is a JSON file named by the hash of the request, sharded into
+// subdirectories by the first byte of the hash. Entries expire after a TTL
+// and the oldest entries are evicted when the cache grows past its size
+// limit.
+type ResponseCache struct {
+	path     string
+	ttl      time.Duration
+	maxBytes int64
+
+	mutex sync.Mutex
+	// total size of the cache, -1 until we've walked the directory
+	size int64
+	// hits and misses during this session
+	hits   int
+	misses int
+}
+
+func NewResponseCache(path string, ttl time.Duration, maxBytes int64) *ResponseCache {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheMaxBytes
+	}
+
+	return &ResponseCache{
+		path:     path,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		size:     -1,
+	}
+}
+
+// What we store on disk for each request
+type cacheEntry struct {
+	Created    time.Time                `json:"created"`
+	Response   *util.CompletionResponse `json:"response,omitempty"`
+	Output     string                   `json:"output,omitempty"`
+	Embeddings [][]float32              `json:"embeddings,omitempty"`
+}
+
+// Hash an arbitrary JSON-serializable key. This fails if the key can't be
+// serialized, e.g. a request with a malformed schema.
+func cacheKey(key any) (string, error) {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (this *ResponseCache) entryPath(key string) string {
+	return filepath.Join(this.path, key[:2], key+".json")
+}
+
+func (this *ResponseCache) Get(key string) (*cacheEntry, bool) {
+	path := this.entryPath(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		this.recordLookup(false)
+		return nil, false
+	}
+
+	entry := &cacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || time.Since(entry.Created) > this.ttl {
+		this.remove(path, int64(len(data)))
+		this.recordLookup(false)
+		return nil, false
+	}
+
+	// touch the file so eviction removes least recently used entries first
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	this.recordLookup(true)
+	return entry, true
+}
+
+func (this *ResponseCache) recordLookup(hit bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if hit {
+		this.hits++
+	} else {
+		this.misses++
+	}
+}
+
+func (this *ResponseCache) Put(key string, entry *cacheEntry) {
+	entry.Created = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error serializing cache entry: %s", err)
+		return
+	}
+
+	path := this.entryPath(key)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Printf("Error creating cache directory: %s", err)
+		return
+	}
+
+	// write to a temp file then rename so readers never see a partial entry
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		log.Printf("Error writing cache entry: %s", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error writing cache entry: %s", err)
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.size < 0 {
+		this.size, _ = this.walk(nil)
+	} else {
+		this.size += int64(len(data))
+	}
+	if this.size > this.maxBytes {
+		this.evict()
+	}
+}
+
+func (this *ResponseCache) remove(path string, size int64) {
+	if os.Remove(path) != nil {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.size >= 0 {
+		this.size -= size
+	}
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Walk the cache directory, returning its total size and optionally calling
+// visit for each entry.
+func (this *ResponseCache) walk(visit func(file cacheFile)) (int64, int) {
+	var total int64
+	count := 0
+
+	filepath.WalkDir(this.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		total += info.Size()
+		count++
+		if visit != nil {
+			visit(cacheFile{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+
+	return total, count
+}
+
+// Remove the least recently used entries until we're down to 90% of the
+// size limit, must be called with the mutex held.
+func (this *ResponseCache) evict() {
+	files := []cacheFile{}
+	this.size, _ = this.walk(func(file cacheFile) {
+		files = append(files, file)
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	target := this.maxBytes * 9 / 10
+	for _, file := range files {
+		if this.size <= target {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			this.size -= file.size
+		}
+	}
+}
+
+type CacheStats struct {
+	Path     string
+	Entries  int
+	Expired  int
+	Bytes    int64
+	MaxBytes int64
+	TTL      time.Duration
+	Hits     int
+	Misses   int
+}
+
+func (this *ResponseCache) Stats() CacheStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	expired := 0
+	cutoff := time.Now().Add(-this.ttl)
+	size, count := this.walk(func(file cacheFile) {
+		// reads touch the file, so this only counts entries that have expired
+		// and haven't been read since, which is close enough for stats
+		if file.modTime.Before(cutoff) {
+			expired++
+		}
+	})
+	this.size = size
+
+	return CacheStats{
+		Path:     this.path,
+		Entries:  count,
+		Expired:  expired,
+		Bytes:    size,
+		MaxBytes: this.maxBytes,
+		TTL:      this.ttl,
+		Hits:     this.hits,
+		Misses:   this.misses,
+	}
+}
+
+// Delete every entry in the cache
+func (this *ResponseCache) Clear() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entries, err := os.ReadDir(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(this.path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	this.size = 0
+	return nil
+}
+
+// CachingLLM is an LLM decorator that serves repeated requests from a
+// ResponseCache. Completions are keyed on everything that affects the
+// answer, embeddings are cached per input string. The namespace separates
+// entries from different providers or embedding models that might
+// otherwise share a key.
+type CachingLLM struct {
+	llm            LLM
+	cache          *ResponseCache
+	namespace      string
+	maxTemperature float32
+}
+
+func NewCachingLLM(llm LLM, cache *ResponseCache, namespace string, maxTemperature float32) *CachingLLM {
+	return &CachingLLM{
+		llm:            llm,
+		cache:          cache,
+		namespace:      namespace,
+		maxTemperature: maxTemperature,
+	}
+}
+
+func (this *CachingLLM) Unwrap() LLM {
+	return this.llm
+}
+
+func (this *CachingLLM) completionKey(request *util.CompletionRequest, stream bool) (string, error) {
+	return cacheKey(struct {
+		Namespace     string
+		Stream        bool
+		Model         string
+		Prompt        string
+		SystemMessage string
+		History       []util.HistoryBlock
+		Temperature   float32
+		MaxTokens     int
+		Functions     []util.FunctionDefinition
+		Tools         []util.ToolDefinition
+		Schema        json.RawMessage
+		Attachments   []util.Attachment
+	}{
+		this.namespace,
+		stream,
+		request.Model,
+		request.Prompt,
+		request.SystemMessage,
+		request.HistoryBlocks,
+		request.Temperature,
+		request.MaxTokens,
+		request.Functions,
+		request.Tools,
+		request.ResponseSchema,
+		request.Attachments,
+	})
+}
+
+func (this *CachingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	if request.Temperature > this.maxTemperature {
+		return this.llm.Completion(request)
+	}
+
+	key, err := this.completionKey(request, false)
+	if err != nil {
+		// we can't key it so it isn't cached, the backend will complain if
+		// the request is really broken
+		log.Printf("Not caching completion: %s", err)
+		return this.llm.Completion(request)
+	}
+	if entry, ok := this.cache.Get(key); ok && entry.Response != nil {
+		if request.Verbose {
+			log.Printf("Serving completion from cache")
+		}
+		return entry.Response, nil
+	}
+
+	response, err := this.llm.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+	this.cache.Put(key, &cacheEntry{Response: response})
+	return response, nil
+}
+
+func (this *CachingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	if request.Temperature > this.maxTemperature {
+		return this.llm.CompletionStream(request, writer)
+	}
+
+	key, err := this.completionKey(request, true)
+	if err != nil {
+		log.Printf("Not caching completion: %s", err)
+		return this.llm.CompletionStream(request, writer)
+	}
+	if entry, ok := this.cache.Get(key); ok && entry.Response != nil {
+		if request.Verbose {
+			log.Printf("Serving streaming completion from cache")
+		}
+		writer.Write([]byte(entry.Output))
+		return entry.Response, nil
+	}
+
+	// record exactly what was streamed so a cache hit looks the same
+	output := new(bytes.Buffer)
+	response, err := this.llm.CompletionStream(request, io.MultiWriter(writer, output))
+	if err != nil {
+		return nil, err
+	}
+	this.cache.Put(key, &cacheEntry{Response: response, Output: output.String()})
+	return response, nil
+}
+
+func (this *CachingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	results := make([][]float32, len(input))
+	keys := make([]string, len(input))
+	missing := []string{}
+	missingIndexes := []int{}
+
+	for i, str := range input {
+		// a string slice always serializes
+		keys[i], _ = cacheKey([]string{this.namespace, "embedding", str})
+		if entry, ok := this.cache.Get(keys[i]); ok && len(entry.Embeddings) == 1 {
+			results[i] = entry.Embeddings[0]
+			continue
+		}
+		missing = append(missing, str)
+		missingIndexes = append(missingIndexes, i)
+	}
+
+	if verbose {
+		log.Printf("Embeddings cache: %d hits, %d misses", len(input)-len(missing), len(missing))
+	}
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	embeddings, err := this.llm.Embeddings(ctx, missing, verbose)
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) != len(missing) {
+		return nil, fmt.Errorf("Expected %d embeddings, got %d", len(missing), len(embeddings))
+	}
+
+	for i, embedding := range embeddings {
+		index := missingIndexes[i]
+		results[index] = embedding
+		this.cache.Put(keys[index], &cacheEntry{Embeddings: [][]float32{embedding}})
+	}
+
+	return results, nil
+}
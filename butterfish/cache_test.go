@@ -0,0 +1,163 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// Counts embedding calls and returns the length of each input as its
+// embedding
+type fakeEmbedder struct {
+	fakeLLM
+	embedded []string
+}
+
+func (this *fakeEmbedder) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	this.embedded = append(this.embedded, input...)
+	results := [][]float32{}
+	for _, str := range input {
+		results = append(results, []float32{float32(len(str))})
+	}
+	return results, nil
+}
+
+func TestCachingLLMCompletion(t *testing.T) {
+	cache := NewResponseCache(t.TempDir(), time.Hour, 0)
+	backend := &fakeLLM{output: "streamed"}
+	client := NewCachingLLM(backend, cache, "test", DefaultCacheMaxTemperature)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-3.5-turbo", Prompt: "ls", Temperature: 0.2}
+	resp, err := client.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-3.5-turbo", resp.Completion)
+	resp, err = client.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-3.5-turbo", resp.Completion)
+	assert.Equal(t, 1, backend.calls)
+
+	// a different prompt is a different key
+	request.Prompt = "ls -l"
+	client.Completion(request)
+	assert.Equal(t, 2, backend.calls)
+
+	// high temperature requests aren't cached
+	request.Temperature = 0.7
+	client.Completion(request)
+	client.Completion(request)
+	assert.Equal(t, 4, backend.calls)
+
+	// streamed output is replayed on a hit
+	request.Temperature = 0
+	out := new(bytes.Buffer)
+	client.CompletionStream(request, out)
+	client.CompletionStream(request, out)
+	assert.Equal(t, "streamedstreamed", out.String())
+	assert.Equal(t, 5, backend.calls)
+
+	stats := cache.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, 2, stats.Hits)
+
+	assert.NoError(t, cache.Clear())
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCachingLLMBadRequest(t *testing.T) {
+	cache := NewResponseCache(t.TempDir(), time.Hour, 0)
+	backend := &fakeLLM{}
+	client := NewCachingLLM(backend, cache, "test", DefaultCacheMaxTemperature)
+
+	// a request we can't serialize skips the cache
+	request := &util.CompletionRequest{Prompt: "ls", ResponseSchema: json.RawMessage("{bad")}
+	_, err := client.Completion(request)
+	assert.NoError(t, err)
+	_, err = client.CompletionStream(request, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backend.calls)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCachingLLMEmbeddings(t *testing.T) {
+	cache := NewResponseCache(t.TempDir(), time.Hour, 0)
+	backend := &fakeEmbedder{}
+	client := NewCachingLLM(backend, cache, "test", DefaultCacheMaxTemperature)
+
+	results, err := client.Embeddings(context.Background(), []string{"a", "bb"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{1}, {2}}, results)
+
+	// only the new string goes to the backend
+	results, err = client.Embeddings(context.Background(), []string{"bb", "ccc"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{2}, {3}}, results)
+	assert.Equal(t, []string{"a", "bb", "ccc"}, backend.embedded)
+}
+
+func TestResponseCacheExpiryAndEviction(t *testing.T) {
+	cache := NewResponseCache(t.TempDir(), time.Hour, 4096)
+
+	cache.Put("aaaa", &cacheEntry{Output: "old"})
+	entry, ok := cache.Get("aaaa")
+	assert.True(t, ok)
+	assert.Equal(t, "old", entry.Output)
+
+	cache.ttl = -time.Second
+	_, ok = cache.Get("aaaa")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Entries)
+	cache.ttl = time.Hour
+
+	// each entry is about 1KB, so we can't keep them all
+	big := strings.Repeat("x", 1000)
+	for _, key := range []string{"k1aa", "k2aa", "k3aa", "k4aa", "k5aa", "k6aa"} {
+		cache.Put(key, &cacheEntry{Output: big})
+	}
+	stats := cache.Stats()
+	assert.LessOrEqual(t, stats.Bytes, int64(4096))
+	_, ok = cache.Get("k6aa")
+	assert.True(t, ok)
+}
+
+func TestUnwrapLLM(t *testing.T) {
+	fallback := NewFallbackLLM(0)
+	var client LLM = NewCachingLLM(fallback, NewResponseCache(t.TempDir(), 0, 0), "", 0)
+
+	found, ok := UnwrapLLM[*FallbackLLM](client)
+	assert.True(t, ok)
+	assert.Equal(t, fallback, found)
+
+	_, ok = UnwrapLLM[*Ollama](client)
+	assert.False(t, ok)
+}
+
+func TestSummarizeFactsCached(t *testing.T) {
+	cache := NewResponseCache(t.TempDir(), time.Hour, 0)
+	backend := &fakeLLM{output: "summary"}
+	ctx := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		PromptLibrary: &prompt.DiskPromptLibrary{Prompts: prompt.DefaultPrompts},
+		LLMClient:     NewCachingLLM(backend, cache, "test", DefaultCacheMaxTemperature),
+		Out:           &bytes.Buffer{},
+	}
+	chunks := [][]byte{
+		[]byte("The first chunk of a long document."),
+		[]byte("The second chunk of a long document."),
+	}
+
+	// fact extraction is cached, the summary at 0.7 isn't
+	assert.NoError(t, ctx.SummarizeChunks(chunks))
+	assert.Equal(t, 3, backend.calls)
+	assert.NoError(t, ctx.SummarizeChunks(chunks))
+	assert.Equal(t, 4, backend.calls)
+}
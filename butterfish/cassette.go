@@ -0,0 +1,338 @@
+package butterfish
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const CassetteVersion = 1
+
+// Kinds of cassette interaction, one per LLM interface method
+const (
+	cassetteCompletion = "completion"
+	cassetteStream     = "stream"
+	cassetteEmbeddings = "embeddings"
+)
+
+// The parts of a CompletionRequest that affect the answer, what we record
+// and what we match on when replaying
+type CassetteRequest struct {
+	Model          string                    `json:"model,omitempty"`
+	Prompt         string                    `json:"prompt,omitempty"`
+	SystemMessage  string                    `json:"system_message,omitempty"`
+	HistoryBlocks  []util.HistoryBlock       `json:"history,omitempty"`
+	Temperature    float32                   `json:"temperature,omitempty"`
+	MaxTokens      int                       `json:"max_tokens,omitempty"`
+	Functions      []util.FunctionDefinition `json:"functions,omitempty"`
+	Tools          []util.ToolDefinition     `json:"tools,omitempty"`
+	ResponseSchema json.RawMessage           `json:"response_schema,omitempty"`
+	Attachments    []util.Attachment         `json:"attachments,omitempty"`
+	// not used for matching, but useful when reading a cassette
+	Feature string `json:"feature,omitempty"`
+}
+
+func newCassetteRequest(request *util.CompletionRequest) *CassetteRequest {
+	return &CassetteRequest{
+		Model:          request.Model,
+		Prompt:         request.Prompt,
+		SystemMessage:  request.SystemMessage,
+		HistoryBlocks:  request.HistoryBlocks,
+		Temperature:    request.Temperature,
+		MaxTokens:      request.MaxTokens,
+		Functions:      request.Functions,
+		Tools:          request.Tools,
+		ResponseSchema: request.ResponseSchema,
+		Attachments:    request.Attachments,
+		Feature:        request.Feature,
+	}
+}
+
+// One recorded call and its result
+type CassetteInteraction struct {
+	Kind    string           `json:"kind"`
+	Request *CassetteRequest `json:"request,omitempty"`
+	// embedding input
+	Input []string `json:"input,omitempty"`
+	// each write to the output stream, so replay streams the same way
+	Chunks     []string                 `json:"chunks,omitempty"`
+	Response   *util.CompletionResponse `json:"response,omitempty"`
+	Embeddings [][]float32              `json:"embeddings,omitempty"`
+	// set if the call failed, we replay the failure
+	Error string `json:"error,omitempty"`
+}
+
+// The key we match a replayed request on, which leaves out fields like the
+// feature and timeouts that don't change the answer
+func (this *CassetteInteraction) key() (string, error) {
+	if this.Kind == cassetteEmbeddings {
+		return cacheKey([]any{this.Kind, this.Input})
+	}
+	request := *this.Request
+	request.Feature = ""
+	return cacheKey([]any{this.Kind, request})
+}
+
+// A Cassette is a JSON file of LLM interactions. When recording we rewrite
+// the file after each interaction so a crash or Ctrl-C still leaves a
+// usable cassette, which can be attached to a bug report and replayed
+// without network access.
+type Cassette struct {
+	Version      int                    `json:"version"`
+	Interactions []*CassetteInteraction `json:"interactions"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+// Start an empty cassette that will be written to path
+func NewCassette(path string) *Cassette {
+	return &Cassette{
+		Version:      CassetteVersion,
+		Interactions: []*CassetteInteraction{},
+		path:         path,
+	}
+}
+
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette := &Cassette{path: path}
+	err = json.Unmarshal(data, cassette)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing cassette %s: %s", path, err)
+	}
+	if cassette.Version > CassetteVersion {
+		return nil, fmt.Errorf("Cassette %s is version %d, this version of butterfish reads up to %d",
+			path, cassette.Version, CassetteVersion)
+	}
+
+	return cassette, nil
+}
+
+func (this *Cassette) Append(interaction *CassetteInteraction) error {
+	// an interaction that can't be serialized would stop the cassette saving
+	if _, err := interaction.key(); err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.Interactions = append(this.Interactions, interaction)
+	return this.save()
+}
+
+// Must be called with the mutex held
+func (this *Cassette) save() error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(this.path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".cassette-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// RecordingLLM is an LLM decorator that appends every call made through it,
+// including failures, to a cassette.
+type RecordingLLM struct {
+	llm      LLM
+	cassette *Cassette
+}
+
+func NewRecordingLLM(llm LLM, cassette *Cassette) *RecordingLLM {
+	return &RecordingLLM{
+		llm:      llm,
+		cassette: cassette,
+	}
+}
+
+func (this *RecordingLLM) Unwrap() LLM {
+	return this.llm
+}
+
+func (this *RecordingLLM) record(interaction *CassetteInteraction, err error) {
+	if err != nil {
+		interaction.Error = err.Error()
+	}
+	if recordErr := this.cassette.Append(interaction); recordErr != nil {
+		log.Printf("Error writing cassette: %s", recordErr)
+	}
+}
+
+func (this *RecordingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	response, err := this.llm.Completion(request)
+	this.record(&CassetteInteraction{
+		Kind:     cassetteCompletion,
+		Request:  newCassetteRequest(request),
+		Response: response,
+	}, err)
+	return response, err
+}
+
+// Keeps a copy of each write so we can replay the stream chunk by chunk
+type chunkRecorder struct {
+	writer io.Writer
+	chunks []string
+}
+
+func (this *chunkRecorder) Write(p []byte) (int, error) {
+	this.chunks = append(this.chunks, string(p))
+	return this.writer.Write(p)
+}
+
+func (this *RecordingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	recorder := &chunkRecorder{writer: writer}
+	response, err := this.llm.CompletionStream(request, recorder)
+	this.record(&CassetteInteraction{
+		Kind:     cassetteStream,
+		Request:  newCassetteRequest(request),
+		Chunks:   recorder.chunks,
+		Response: response,
+	}, err)
+	return response, err
+}
+
+func (this *RecordingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	embeddings, err := this.llm.Embeddings(ctx, input, verbose)
+	this.record(&CassetteInteraction{
+		Kind:       cassetteEmbeddings,
+		Input:      input,
+		Embeddings: embeddings,
+	}, err)
+	return embeddings, err
+}
+
+// ReplayLLM serves the interactions in a cassette instead of calling an
+// API. A request is answered by the first unused interaction with an
+// identical request, so repeated requests replay in recorded order. If
+// nothing matches and Strict is false we fall back to the next unused
+// interaction of the same kind, which lets a cassette from a bug report
+// replay even when details like shell output differ slightly. Tests should
+// use strict mode.
+type ReplayLLM struct {
+	cassette *Cassette
+	Strict   bool
+	Verbose  bool
+
+	used  []bool
+	mutex sync.Mutex
+}
+
+func NewReplayLLM(cassette *Cassette, strict bool) *ReplayLLM {
+	return &ReplayLLM{
+		cassette: cassette,
+		Strict:   strict,
+		used:     make([]bool, len(cassette.Interactions)),
+	}
+}
+
+var ErrCassetteMiss = errors.New("No recorded interaction matches the request")
+
+func (this *ReplayLLM) next(wanted *CassetteInteraction) (*CassetteInteraction, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	key, err := wanted.key()
+	if err != nil {
+		return nil, fmt.Errorf("Can't match %s request against cassette %s: %s", wanted.Kind, this.cassette.path, err)
+	}
+	fallback := -1
+	for i, interaction := range this.cassette.Interactions {
+		if this.used[i] || interaction.Kind != wanted.Kind {
+			continue
+		}
+		if recorded, err := interaction.key(); err == nil && recorded == key {
+			this.used[i] = true
+			return interaction, nil
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+
+	if this.Strict || fallback < 0 {
+		return nil, fmt.Errorf("%w in cassette %s (%s)", ErrCassetteMiss, this.cassette.path, wanted.Kind)
+	}
+
+	if this.Verbose {
+		log.Printf("No exact cassette match for %s request, replaying interaction %d", wanted.Kind, fallback)
+	}
+	this.used[fallback] = true
+	return this.cassette.Interactions[fallback], nil
+}
+
+func (this *CassetteInteraction) err() error {
+	if this.Error == "" {
+		return nil
+	}
+	return errors.New(this.Error)
+}
+
+func (this *ReplayLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	interaction, err := this.next(&CassetteInteraction{
+		Kind:    cassetteCompletion,
+		Request: newCassetteRequest(request),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interaction.Response, interaction.err()
+}
+
+func (this *ReplayLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	interaction, err := this.next(&CassetteInteraction{
+		Kind:    cassetteStream,
+		Request: newCassetteRequest(request),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chunk := range interaction.Chunks {
+		_, err = writer.Write([]byte(chunk))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return interaction.Response, interaction.err()
+}
+
+func (this *ReplayLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	interaction, err := this.next(&CassetteInteraction{
+		Kind:  cassetteEmbeddings,
+		Input: input,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return interaction.Embeddings, interaction.err()
+}
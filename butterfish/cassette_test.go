@@ -0,0 +1,146 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Streams its output in two chunks and calls a tool
+type chunkingLLM struct {
+	fakeLLM
+}
+
+func (this *chunkingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	writer.Write([]byte("hello "))
+	writer.Write([]byte(request.Prompt))
+	return &util.CompletionResponse{
+		Completion: "hello " + request.Prompt,
+		ToolCalls: []*util.ToolCall{{
+			Id:       "call_1",
+			Type:     "function",
+			Function: util.FunctionCall{Name: "command", Parameters: `{"cmd":"ls"}`},
+		}},
+	}, nil
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecordingLLM(&chunkingLLM{}, NewCassette(path))
+
+	for _, prompt := range []string{"world", "there", "world"} {
+		_, err := recorder.CompletionStream(&util.CompletionRequest{Prompt: prompt, Feature: FeaturePrompt}, io.Discard)
+		assert.NoError(t, err)
+	}
+	// failures are recorded too
+	recorder = NewRecordingLLM(&fakeLLM{err: errors.New("boom")}, recorder.cassette)
+	_, err := recorder.Completion(&util.CompletionRequest{Prompt: "fail"})
+	assert.Error(t, err)
+
+	cassette, err := LoadCassette(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(cassette.Interactions))
+	replay := NewReplayLLM(cassette, true)
+
+	// requests are matched regardless of order, and the feature doesn't matter
+	out := new(bytes.Buffer)
+	writer := &chunkRecorder{writer: out}
+	response, err := replay.CompletionStream(&util.CompletionRequest{Prompt: "there"}, writer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello there", out.String())
+	assert.Equal(t, []string{"hello ", "there"}, writer.chunks)
+	assert.Equal(t, `{"cmd":"ls"}`, response.ToolCalls[0].Function.Parameters)
+
+	for i := 0; i < 2; i++ {
+		response, err = replay.CompletionStream(&util.CompletionRequest{Prompt: "world"}, io.Discard)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", response.Completion)
+	}
+
+	// each recording is served once
+	_, err = replay.CompletionStream(&util.CompletionRequest{Prompt: "world"}, io.Discard)
+	assert.ErrorIs(t, err, ErrCassetteMiss)
+
+	_, err = replay.Completion(&util.CompletionRequest{Prompt: "fail"})
+	assert.EqualError(t, err, "boom")
+}
+
+func TestCassetteBadRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := NewRecordingLLM(&fakeLLM{}, NewCassette(path))
+
+	// a request that can't be serialized isn't recorded, and doesn't stop
+	// later ones being saved
+	bad := &util.CompletionRequest{Prompt: "bad", ResponseSchema: json.RawMessage("{bad")}
+	_, err := recorder.Completion(bad)
+	assert.NoError(t, err)
+	_, err = recorder.Completion(&util.CompletionRequest{Prompt: "good"})
+	assert.NoError(t, err)
+
+	cassette, err := LoadCassette(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cassette.Interactions))
+
+	replay := NewReplayLLM(cassette, false)
+	_, err = replay.Completion(bad)
+	assert.ErrorContains(t, err, "Can't match")
+}
+
+func TestReplayLLMLenient(t *testing.T) {
+	cassette := NewCassette("")
+	cassette.Interactions = []*CassetteInteraction{
+		{Kind: cassetteEmbeddings, Input: []string{"a"}, Embeddings: [][]float32{{1}}},
+		{Kind: cassetteCompletion, Request: &CassetteRequest{Prompt: "a"},
+			Response: &util.CompletionResponse{Completion: "first"}},
+		{Kind: cassetteCompletion, Request: &CassetteRequest{Prompt: "b"},
+			Response: &util.CompletionResponse{Completion: "second"}},
+	}
+
+	// an unmatched request gets the next unused interaction of the same kind
+	replay := NewReplayLLM(cassette, false)
+	response, err := replay.Completion(&util.CompletionRequest{Prompt: "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "second", response.Completion)
+	response, err = replay.Completion(&util.CompletionRequest{Prompt: "changed"})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", response.Completion)
+	_, err = replay.Completion(&util.CompletionRequest{Prompt: "changed"})
+	assert.ErrorIs(t, err, ErrCassetteMiss)
+
+	embeddings, err := replay.Embeddings(context.Background(), []string{"z"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{1}}, embeddings)
+}
+
+// An example of turning a recorded cassette into a regression test
+func TestPromptFromCassette(t *testing.T) {
+	cassette, err := LoadCassette("testdata/prompt_cassette.json")
+	assert.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	ctx := &ButterfishCtx{
+		Ctx:       context.Background(),
+		Config:    MakeButterfishConfig(),
+		LLMClient: NewReplayLLM(cassette, true),
+		Out:       out,
+	}
+
+	response, err := ctx.Prompt(&promptCommand{
+		Prompt:    "How do I list files?",
+		SysMsg:    "You are a helpful assistant.",
+		Model:     "gpt-4-turbo",
+		NumTokens: 256,
+		NoColor:   true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Use `ls`.", response.Completion)
+	assert.Equal(t, "Use `ls`.", out.String())
+}
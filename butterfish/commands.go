@@ -1,18 +1,24 @@
 package butterfish
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
+	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/mitchellh/go-homedir"
 	"github.com/sashabaranov/go-openai/jsonschema"
@@ -20,6 +26,7 @@ import (
 	"github.com/spf13/afero"
 	"golang.org/x/term"
 
+	"github.com/bakks/butterfish/bubbles/picker"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
 )
@@ -59,9 +66,13 @@ type CliCommandConfig struct {
 		Model         string   `short:"m" default:"gpt-4-turbo" help:"LLM to use for the prompt."`
 		NumTokens     int      `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
 		Temperature   float32  `short:"T" default:"0.7" help:"Temperature to use for the prompt, higher temperature indicates more freedom/randomness when generating each token."`
-		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
+		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt. This can be a list of function definitions, or a tool manifest that says how to run each tool locally, in which case we run the tools the model calls and send back the results until it's done."`
+		MaxIterations int      `default:"10" help:"With a tool manifest, the maximum number of rounds of tool calls before giving up."`
+		Yes           bool     `short:"y" default:"false" help:"With a tool manifest, run tools without asking for confirmation first."`
 		NoColor       bool     `default:"false" help:"Disable color output."`
 		NoBackticks   bool     `default:"false" help:"Strip out backticks around codeblocks."`
+		Schema        string   `default:"" help:"Path to a JSON schema file. The response is validated against it and printed as raw JSON, suitable for piping into jq. Exits with an error if the response doesn't match."`
+		Attach        []string `short:"a" sep:"none" help:"File to send with the prompt, can be repeated or a glob pattern. Images (png, jpeg, gif, webp) are sent as images to models that accept them, text files are included after the prompt with their path."`
 	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo."`
 
 	Promptedit struct {
@@ -84,20 +95,45 @@ type CliCommandConfig struct {
 	} `cmd:"" help:"Edit a file by using a line range editing tool."`
 
 	Summarize struct {
-		Files     []string `arg:"" help:"File paths to summarize." optional:""`
-		ChunkSize int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
-		MaxChunks int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
+		Files            []string `arg:"" help:"File paths to summarize." optional:""`
+		ChunkSize        int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
+		MaxChunks        int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
+		FactsTemperature float32  `default:"0.2" help:"Temperature for extracting facts from each chunk of a long file. At 0.3 or below these requests are cached, so summarizing the same file again is cheap."`
 	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it is short then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into chunks and ask for a list of facts from each chunk (max 8 chunks), then concatenate facts and ask GPT for an overall summary."`
 
 	Gencmd struct {
 		Prompt []string `arg:"" help:"Prompt describing the desired shell command."`
 		Force  bool     `short:"f" default:"false" help:"Execute the command without prompting."`
-	} `cmd:"" help:"Generate a shell command from a prompt, i.e. pass in what you want, a shell command will be generated. Accepts piped input. You can use the -f command to execute it sight-unseen."`
+		K      int      `short:"k" default:"1" help:"Number of candidate commands to generate. With more than one, the candidates are ranked and you pick one to run or print."`
+	} `cmd:"" help:"Generate a shell command from a prompt, i.e. pass in what you want, a shell command will be generated. Accepts piped input. You can use the -f command to execute it sight-unseen, with -k it executes the top-ranked candidate."`
 
 	Exec struct {
 		Command []string `arg:"" help:"Command to execute." optional:""`
 	} `cmd:"" help:"Execute a command and try to debug problems. The command can either passed in or in the command register (if you have run gencmd in Console Mode)."`
 
+	Cache struct {
+		Action string `arg:"" enum:"stats,clear" help:"Either stats or clear."`
+	} `cmd:"" help:"Show statistics for the on-disk LLM response cache, or clear it. Low temperature requests (e.g. autosuggest and summarize) and embeddings are cached, by default under ~/.cache/butterfish."`
+
+	Usage struct {
+		Days int `short:"d" default:"7" help:"Number of days to report on."`
+	} `cmd:"" help:"Report token usage and estimated cost per day and per feature (prompt, autosuggest, goal, edit, index, etc). Usage is recorded in ~/.config/butterfish/usage.jsonl and costs are estimated using a built-in price table, which you can override in ~/.config/butterfish/prices.yaml. Costs prefixed with ~ include token counts we had to estimate."`
+
+	Transcripts struct {
+		Since   string `short:"s" default:"24h" help:"Only show calls made within this long, e.g. 1h or 168h."`
+		Feature string `short:"f" default:"" help:"Only show calls from this feature, e.g. prompt or autosuggest."`
+		Model   string `short:"m" default:"" help:"Only show calls to models with names containing this."`
+		Errors  bool   `short:"e" default:"false" help:"Only show calls that failed."`
+		Grep    string `short:"g" default:"" help:"Only show calls whose request or response contains this text."`
+		Limit   int    `short:"n" default:"20" help:"Show at most this many of the most recent matching calls, 0 for all."`
+		Full    bool   `short:"F" default:"false" help:"Print each call in full: the system message, history, and prompt as they were sent, then the response."`
+		JSON    bool   `short:"j" default:"false" help:"Print matching records as JSONL, e.g. to pipe into jq."`
+	} `cmd:"" help:"Search the transcript of LLM calls, which is recorded in ~/.config/butterfish/transcripts.jsonl when butterfish is run with --transcript. By default prints one line per call with its latency, time to first token, and token counts."`
+
+	Models struct {
+		Filter string `arg:"" help:"Only show models with names containing this, e.g. 'gpt-4'." optional:""`
+	} `cmd:"" help:"List the models in the model catalog with their context window, maximum output tokens, tokenizer, API endpoint, tool support, and input/output price per million tokens. The catalog is built in and can be extended or overridden in ~/.config/butterfish/models.yaml. If the LLM provider supports model discovery, e.g. a local Ollama server (-P ollama), the models available from the server are listed too."`
+
 	Index struct {
 		Paths     []string `arg:"" help:"Paths to index." optional:""`
 		Force     bool     `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
@@ -280,7 +316,7 @@ func (this *ButterfishCtx) ExecCommand(
 
 		var input string
 
-		if piped == "" && prompt == "" {
+		if piped == "" && prompt == "" && len(options.Prompt.Attach) == 0 {
 			return errors.New("Please provide a prompt")
 		} else if piped == "" {
 			input = prompt
@@ -290,8 +326,14 @@ func (this *ButterfishCtx) ExecCommand(
 			input = fmt.Sprintf("%s\n%s", prompt, piped)
 		}
 
+		attachments, err := LoadAttachments(options.Prompt.Attach)
+		if err != nil {
+			return err
+		}
+
 		commandConfig := &promptCommand{
 			Prompt:      input,
+			Attachments: attachments,
 			SysMsg:      options.Prompt.SystemMessage,
 			Model:       options.Prompt.Model,
 			NumTokens:   options.Prompt.NumTokens,
@@ -302,7 +344,26 @@ func (this *ButterfishCtx) ExecCommand(
 			Verbose:     this.Config.Verbose,
 		}
 
-		_, err := this.Prompt(commandConfig)
+		if options.Prompt.Functions != "" && options.Prompt.Schema == "" {
+			manifest, err := LoadToolManifest(options.Prompt.Functions)
+			if err != nil {
+				return err
+			}
+			if manifest != nil {
+				confirm := this.confirmToolCall
+				if options.Prompt.Yes {
+					confirm = nil
+				}
+				return this.PromptTools(commandConfig, manifest, options.Prompt.MaxIterations, confirm)
+			}
+		}
+
+		if options.Prompt.Schema != "" {
+			_, err := this.PromptSchema(commandConfig, options.Prompt.Schema)
+			return err
+		}
+
+		_, err = this.Prompt(commandConfig)
 		return err
 
 	case "promptedit":
@@ -395,6 +456,7 @@ func (this *ButterfishCtx) ExecCommand(
 		return nil
 
 	case "summarize":
+		this.Config.SummarizeFactsTemperature = options.Summarize.FactsTemperature
 		chunks, err := util.GetChunks(
 			os.Stdin,
 			options.Summarize.ChunkSize,
@@ -415,6 +477,7 @@ func (this *ButterfishCtx) ExecCommand(
 		if len(files) == 0 {
 			return errors.New("Please provide file paths or piped data to summarize")
 		}
+		this.Config.SummarizeFactsTemperature = options.Summarize.FactsTemperature
 
 		err := this.SummarizePaths(files,
 			options.Summarize.ChunkSize,
@@ -427,6 +490,18 @@ func (this *ButterfishCtx) ExecCommand(
 			return errors.New("Please provide a description to generate a command")
 		}
 
+		if options.Gencmd.K > 1 {
+			candidates, err := this.gencmdCandidates(input, options.Gencmd.K)
+			if err != nil {
+				return err
+			}
+			if options.Gencmd.Force {
+				_, err := this.execCommand(candidates[0])
+				return err
+			}
+			return this.pickCommand(candidates)
+		}
+
 		cmd, err := this.gencmdCommand(input)
 		if err != nil {
 			return err
@@ -457,6 +532,180 @@ func (this *ButterfishCtx) ExecCommand(
 
 		return this.execAndCheck(this.Ctx, input)
 
+	case "models", "models <filter>":
+		filter := options.Models.Filter
+
+		this.StylePrintf(this.Config.Styles.Highlight, "%-28s %8s %8s %-12s %-10s %-5s %s\n",
+			"Model", "Context", "Output", "Tokenizer", "Endpoint", "Tools", "Price (in/out per 1M)")
+		for _, name := range this.Models.Names() {
+			if !strings.Contains(name, filter) {
+				continue
+			}
+			spec, _ := this.Models.Lookup(name)
+
+			maxOutput := "-"
+			if spec.MaxOutput > 0 {
+				maxOutput = fmt.Sprintf("%d", spec.MaxOutput)
+			}
+			tools := "no"
+			if spec.Tools {
+				tools = "yes"
+			}
+			price := "free"
+			if spec.Price != nil {
+				price = fmt.Sprintf("$%g / $%g", spec.Price.Input, spec.Price.Output)
+			}
+
+			this.Printf("%-28s %8d %8s %-12s %-10s %-5s %s\n", name, spec.ContextWindow,
+				maxOutput, spec.Tokenizer, spec.Endpoint, tools, price)
+		}
+
+		discoverer, ok := UnwrapLLM[ModelDiscoverer](this.LLMClient)
+		if !ok {
+			return nil
+		}
+
+		models, err := discoverer.ListModels(this.Ctx)
+		if err != nil {
+			return err
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "\nModels on the server\n")
+		for _, model := range models {
+			if !strings.Contains(model.Name, filter) {
+				continue
+			}
+			contextLength := "unknown"
+			if model.ContextLength > 0 {
+				contextLength = fmt.Sprintf("%d", model.ContextLength)
+			}
+			this.StylePrintf(this.Config.Styles.Highlight, "%s", model.Name)
+			this.Printf("  context: %s  %s\n", contextLength, model.Details)
+		}
+
+	case "usage":
+		if this.UsageLedger == nil {
+			return errors.New("Usage tracking is disabled")
+		}
+
+		// count from local midnight so today is a full day
+		now := time.Now()
+		since := time.Date(now.Year(), now.Month(), now.Day()-options.Usage.Days+1,
+			0, 0, 0, 0, now.Location())
+		records, err := this.UsageLedger.Records(since)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			this.Printf("No usage recorded in the last %d days\n", options.Usage.Days)
+			return nil
+		}
+
+		printTotals := func(name string, totals *UsageTotals) {
+			this.Printf("  %-12s %6d calls %10d in %10d out %12s\n", name, totals.Calls,
+				totals.PromptTokens, totals.CompletionTokens,
+				formatCost(totals.Cost, totals.Estimated))
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "Daily usage\n")
+		days, byDay := this.UsageLedger.Summarize(records, func(record UsageRecord) string {
+			return record.Time.Local().Format("2006-01-02")
+		})
+		for _, day := range days {
+			printTotals(day, byDay[day])
+		}
+
+		this.StylePrintf(this.Config.Styles.Highlight, "\nBy feature\n")
+		features, byFeature := this.UsageLedger.Summarize(records, func(record UsageRecord) string {
+			if record.Feature == "" {
+				return "other"
+			}
+			return record.Feature
+		})
+		total := &UsageTotals{}
+		for _, feature := range features {
+			printTotals(feature, byFeature[feature])
+			total.Calls += byFeature[feature].Calls
+			total.PromptTokens += byFeature[feature].PromptTokens
+			total.CompletionTokens += byFeature[feature].CompletionTokens
+			total.Cost += byFeature[feature].Cost
+			total.Estimated = total.Estimated || byFeature[feature].Estimated
+		}
+
+		this.Printf("\n")
+		printTotals("total", total)
+
+	case "transcripts":
+		if this.TranscriptLog == nil {
+			return errors.New("No transcript path is configured")
+		}
+
+		since, err := time.ParseDuration(options.Transcripts.Since)
+		if err != nil {
+			return fmt.Errorf("Invalid --since: %s", err)
+		}
+		records, err := this.TranscriptLog.Records(&TranscriptFilter{
+			Since:      time.Now().Add(-since),
+			Feature:    options.Transcripts.Feature,
+			Model:      options.Transcripts.Model,
+			ErrorsOnly: options.Transcripts.Errors,
+			Text:       options.Transcripts.Grep,
+		})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			this.Printf("No matching calls in %s\n", this.TranscriptLog.Path())
+			if !this.Config.TranscriptEnabled {
+				this.Printf("Run butterfish with --transcript to record calls\n")
+			}
+			return nil
+		}
+
+		limit := options.Transcripts.Limit
+		if limit > 0 && len(records) > limit {
+			records = records[len(records)-limit:]
+		}
+
+		for _, record := range records {
+			switch {
+			case options.Transcripts.JSON:
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(this.Out, "%s\n", data)
+			case options.Transcripts.Full:
+				this.printTranscriptReplay(record)
+			default:
+				this.printTranscriptSummary(record)
+			}
+		}
+
+	case "cache <action>":
+		switch options.Cache.Action {
+		case "stats":
+			stats := this.ResponseCache.Stats()
+			enabled := "enabled"
+			if !this.Config.CacheEnabled {
+				enabled = "disabled"
+			}
+			this.Printf("Cache:    %s (%s)\n", stats.Path, enabled)
+			this.Printf("Entries:  %d (%d expired)\n", stats.Entries, stats.Expired)
+			this.Printf("Size:     %s of %s\n", formatBytes(stats.Bytes), formatBytes(stats.MaxBytes))
+			this.Printf("TTL:      %s\n", stats.TTL)
+			if stats.Hits+stats.Misses > 0 {
+				this.Printf("Session:  %d hits, %d misses\n", stats.Hits, stats.Misses)
+			}
+
+		case "clear":
+			err := this.ResponseCache.Clear()
+			if err != nil {
+				return err
+			}
+			this.Printf("Cleared %s\n", this.ResponseCache.path)
+		}
+
 	case "clearindex", "clearindex <paths>":
 		this.initVectorIndex(nil)
 
@@ -578,6 +827,7 @@ func (this *ButterfishCtx) ExecCommand(
 			MaxTokens:     options.Indexquestion.NumTokens,
 			Temperature:   options.Indexquestion.Temperature,
 			SystemMessage: "N/A",
+			Feature:       FeatureIndex,
 		}
 
 		_, err = this.LLMClient.CompletionStream(req, this.Out)
@@ -591,6 +841,92 @@ func (this *ButterfishCtx) ExecCommand(
 	return nil
 }
 
+// One line per call: time, feature, model, timing, tokens, and any error
+func (this *ButterfishCtx) printTranscriptSummary(record *TranscriptRecord) {
+	firstToken := ""
+	if record.FirstTokenMs > 0 {
+		firstToken = fmt.Sprintf("%dms", record.FirstTokenMs)
+	}
+	tokens := ""
+	if record.Response != nil && record.Response.Usage != nil {
+		tokens = fmt.Sprintf("%d in %d out",
+			record.Response.Usage.PromptTokens, record.Response.Usage.CompletionTokens)
+	}
+
+	this.Printf("%s  %-12s %-28s %7dms %7s  %s",
+		record.Time.Local().Format("2006-01-02 15:04:05"), record.Feature,
+		record.Model, record.LatencyMs, firstToken, tokens)
+	if record.Error != "" {
+		this.StylePrintf(this.Config.Styles.Error, "  %s", record.Error)
+	}
+	this.Printf("\n")
+}
+
+// A call in full, as the model saw it
+func (this *ButterfishCtx) printTranscriptReplay(record *TranscriptRecord) {
+	this.StylePrintf(this.Config.Styles.Highlight, "── %s  %s  %s  %dms ──\n",
+		record.Time.Local().Format("2006-01-02 15:04:05"), record.Feature,
+		record.Model, record.LatencyMs)
+
+	printMessage := func(role, content string, attachments []util.Attachment) {
+		this.StylePrintf(this.Config.Styles.Grey, "%s: ", role)
+		this.Printf("%s\n", content)
+		for _, attachment := range attachments {
+			this.StylePrintf(this.Config.Styles.Grey, "  [attached %s, %s]\n",
+				attachment.Path, attachment.MimeType)
+		}
+	}
+
+	if record.Request != nil {
+		if record.Request.SystemMessage != "" {
+			printMessage("system", record.Request.SystemMessage, nil)
+		}
+		for _, block := range record.Request.HistoryBlocks {
+			content := block.Content
+			if block.FunctionName != "" {
+				content = fmt.Sprintf("%s(%s) %s", block.FunctionName, block.FunctionParams, content)
+			}
+			printMessage(ShellHistoryTypeToRole(block.Type), content, block.Attachments)
+		}
+		if record.Request.Prompt != "" {
+			printMessage("user", record.Request.Prompt, record.Request.Attachments)
+		}
+	}
+	for _, input := range record.Input {
+		printMessage("input", input, nil)
+	}
+
+	if record.Response != nil {
+		response := record.Response.Completion
+		if record.Response.FunctionName != "" {
+			response += fmt.Sprintf("\n%s(%s)", record.Response.FunctionName, record.Response.FunctionParameters)
+		}
+		for _, toolCall := range record.Response.ToolCalls {
+			response += fmt.Sprintf("\n%s(%s)", toolCall.Function.Name, toolCall.Function.Parameters)
+		}
+		this.StylePrintf(this.Config.Styles.Grey, "assistant: ")
+		this.StylePrintf(this.Config.Styles.Answer, "%s\n", strings.TrimSpace(response))
+	}
+	if record.Embeddings > 0 {
+		this.StylePrintf(this.Config.Styles.Grey, "%d embeddings\n", record.Embeddings)
+	}
+	if record.Error != "" {
+		this.StylePrintf(this.Config.Styles.Error, "error: %s\n", record.Error)
+	}
+	this.Printf("\n")
+}
+
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
 func styleToEscape(color lipgloss.TerminalColor) string {
 	r, g, b, _ := color.RGBA()
 	color256 := 16 + (36 * (r / 257 / 51)) + (6 * (g / 257 / 51)) + (b / 257 / 51)
@@ -599,6 +935,7 @@ func styleToEscape(color lipgloss.TerminalColor) string {
 
 type promptCommand struct {
 	Prompt      string
+	Attachments []util.Attachment
 	SysMsg      string
 	Model       string
 	NumTokens   int
@@ -609,6 +946,7 @@ type promptCommand struct {
 	Verbose     int
 	History     []util.HistoryBlock
 	Tools       []util.ToolDefinition
+	Feature     string
 }
 
 func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse, error) {
@@ -657,6 +995,11 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		}
 	}
 
+	feature := cmd.Feature
+	if feature == "" {
+		feature = FeaturePrompt
+	}
+
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Prompt:        cmd.Prompt,
@@ -669,11 +1012,100 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 		Tools:         cmd.Tools,
 		HistoryBlocks: cmd.History,
 		TokenTimeout:  this.Config.TokenTimeout,
+		Feature:       feature,
+		Attachments:   cmd.Attachments,
+	}
+
+	estimate := this.EstimateCost(req.Model, estimateRequestTokens(req), req.MaxTokens)
+	if err := this.CheckBudget(feature, estimate); err != nil {
+		this.StylePrintf(this.Config.Styles.Error, "Warning: %s, this prompt may go over.\n", err)
 	}
 
 	return this.LLMClient.CompletionStream(req, writer)
 }
 
+// How many times we ask the model to fix a response that doesn't match the
+// schema before giving up
+const schemaRepairAttempts = 1
+
+// Like Prompt, but the response must be JSON matching the schema at
+// schemaPath. We validate it locally and write it to stdout without any
+// styling so it can be piped into other tools. If the response doesn't
+// match we tell the model what's wrong and ask again.
+func (this *ButterfishCtx) PromptSchema(cmd *promptCommand, schemaPath string) (*util.CompletionResponse, error) {
+	if cmd.Functions != "" {
+		return nil, errors.New("A schema can't be combined with a functions file")
+	}
+
+	schema, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(schema) {
+		return nil, fmt.Errorf("Schema file %s is not valid JSON", schemaPath)
+	}
+
+	sysMsg := cmd.SysMsg
+	if sysMsg == "" {
+		sysMsg, err = this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:            this.Ctx,
+		Prompt:         cmd.Prompt,
+		Model:          cmd.Model,
+		MaxTokens:      cmd.NumTokens,
+		Temperature:    cmd.Temperature,
+		SystemMessage:  sysMsg,
+		Verbose:        cmd.Verbose > 0,
+		TokenTimeout:   this.Config.TokenTimeout,
+		Feature:        FeaturePrompt,
+		ResponseSchema: schema,
+		Attachments:    cmd.Attachments,
+	}
+
+	// stdout is for the JSON only
+	estimate := this.EstimateCost(req.Model, estimateRequestTokens(req), req.MaxTokens)
+	if err := this.CheckBudget(FeaturePrompt, estimate); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s, this prompt may go over.\n", err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := this.LLMClient.Completion(req)
+		if err != nil {
+			return nil, err
+		}
+
+		output := extractJSON(resp.Completion)
+		err = ValidateJSONSchema(schema, []byte(output))
+		if err == nil {
+			compacted := new(bytes.Buffer)
+			json.Compact(compacted, []byte(output))
+			fmt.Fprintln(this.Out, compacted.String())
+			resp.Completion = output
+			return resp, nil
+		}
+
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) || attempt >= schemaRepairAttempts {
+			return nil, err
+		}
+		if cmd.Verbose > 0 {
+			log.Printf("Response didn't match schema, asking for a repair: %s", err)
+		}
+
+		req.HistoryBlocks = append(req.HistoryBlocks,
+			util.HistoryBlock{Type: historyTypePrompt, Content: req.Prompt, Attachments: req.Attachments},
+			util.HistoryBlock{Type: historyTypeLLMOutput, Content: output})
+		req.Attachments = nil
+		req.Prompt = fmt.Sprintf("That response doesn't match the JSON schema:\n%s\nRespond again with only JSON that matches the schema.",
+			strings.Join(schemaErr.Problems, "\n"))
+	}
+}
+
 var EditSysMsg = `You're helping an expert programmer edit a file of code. You can either respond with questions and clarifications, or you can use the edit() tool, which replaces a range from the file with new code. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent file for your edits. If there are no more edits, just say "DONE!"`
 
 var EditTools = []util.ToolDefinition{
@@ -729,6 +1161,7 @@ func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string,
 			NoBackticks: options.Edit.NoBackticks,
 			Verbose:     this.Config.Verbose,
 			History:     history,
+			Feature:     FeatureEdit,
 		}
 
 		// send prompt
@@ -774,6 +1207,128 @@ func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string,
 	return nil
 }
 
+// Run a prompt with the tools in a manifest, executing each tool the model
+// calls and sending back the output until it stops calling tools. If
+// confirm is set it's called before each tool runs, a declined call is
+// reported back to the model.
+func (this *ButterfishCtx) PromptTools(
+	cmd *promptCommand,
+	manifest *ToolManifest,
+	maxIterations int,
+	confirm func(description string) (bool, error),
+) error {
+	if !this.Models.SupportsTools(cmd.Model) {
+		return fmt.Errorf("Model %s can't call tools according to the model catalog", cmd.Model)
+	}
+
+	history := cmd.History
+	history = append(history, util.HistoryBlock{
+		Type:        historyTypePrompt,
+		Content:     cmd.Prompt,
+		Attachments: cmd.Attachments,
+	})
+
+	for i := 0; ; i++ {
+		if i >= maxIterations {
+			return fmt.Errorf("Stopped after %d rounds of tool calls, use --max-iterations to allow more", maxIterations)
+		}
+
+		roundCmd := *cmd
+		roundCmd.Prompt = ""
+		roundCmd.Attachments = nil
+		roundCmd.Functions = ""
+		roundCmd.Tools = manifest.Definitions()
+		roundCmd.History = history
+
+		resp, err := this.Prompt(&roundCmd)
+		if err != nil {
+			return err
+		}
+
+		history = append(history, util.HistoryBlock{
+			Type:      historyTypeLLMOutput,
+			Content:   resp.Completion,
+			ToolCalls: resp.ToolCalls,
+		})
+
+		if len(resp.ToolCalls) == 0 {
+			return nil
+		}
+
+		for _, toolCall := range resp.ToolCalls {
+			output, err := this.runManifestTool(manifest, toolCall, confirm)
+			if err != nil {
+				return err
+			}
+
+			history = append(history, util.HistoryBlock{
+				Type:         historyTypeToolOutput,
+				Content:      output,
+				FunctionName: toolCall.Function.Name,
+				ToolCallId:   toolCall.Id,
+			})
+		}
+	}
+}
+
+// Run a single tool call and return the output to send back to the model
+func (this *ButterfishCtx) runManifestTool(
+	manifest *ToolManifest,
+	toolCall *util.ToolCall,
+	confirm func(description string) (bool, error),
+) (string, error) {
+	tool := manifest.Tool(toolCall.Function.Name)
+	if tool == nil {
+		// let the model try again rather than failing the whole prompt
+		return fmt.Sprintf("Unknown tool %s, available tools are: %s",
+			toolCall.Function.Name, manifest.names()), nil
+	}
+
+	description, err := tool.Describe(toolCall.Function.Parameters)
+	if err != nil {
+		return err.Error(), nil
+	}
+
+	if confirm != nil {
+		ok, err := confirm(description)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "The user declined to run this tool.", nil
+		}
+	} else if this.Config.Verbose > 0 {
+		this.StylePrintf(this.Config.Styles.Question, "tool> %s\n", description)
+	}
+
+	output, err := tool.Run(this.Ctx, manifest.dir, toolCall.Function.Parameters)
+	if err != nil {
+		output = err.Error()
+	}
+	this.StylePrintf(this.Config.Styles.Foreground, "%s\n", strings.TrimRight(output, "\n"))
+	return output, nil
+}
+
+// Ask the user whether to run a tool. Stdin may be the piped prompt, so we
+// read the answer from the terminal.
+func (this *ButterfishCtx) confirmToolCall(description string) (bool, error) {
+	this.StylePrintf(this.Config.Styles.Question, "Run %s? [y/N]: ", description)
+
+	input := io.Reader(os.Stdin)
+	tty, err := os.Open("/dev/tty")
+	if err == nil {
+		defer tty.Close()
+		input = tty
+	}
+
+	var answer string
+	_, err = fmt.Fscanln(input, &answer)
+	if err != nil && err.Error() != "unexpected newline" {
+		return false, err
+	}
+	return strings.ToLower(strings.TrimSpace(answer)) == "y", nil
+}
+
 func (this *ButterfishCtx) diffStrings(a, b string) string {
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(a, b, false)
@@ -793,19 +1348,17 @@ func (this *ButterfishCtx) diffStrings(a, b string) string {
 	return strBuilder.String()
 }
 
-// Given a description of functionality, we call GPT to generate a shell
-// command
-func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
-	promptStr, err := this.PromptLibrary.GetPrompt("generate_command", "content", description)
+func (this *ButterfishCtx) gencmdRequest(description string) (*util.CompletionRequest, error) {
+	promptStr, err := this.PromptLibrary.GetPrompt(prompt.PromptGenerateCommand, "content", description)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req := &util.CompletionRequest{
+	return &util.CompletionRequest{
 		Ctx:           this.Ctx,
 		Prompt:        promptStr,
 		Model:         this.Config.GencmdModel,
@@ -813,6 +1366,16 @@ func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
 		Temperature:   this.Config.GencmdTemperature,
 		SystemMessage: sysMsg,
 		TokenTimeout:  this.Config.TokenTimeout,
+		Feature:       FeatureGencmd,
+	}, nil
+}
+
+// Given a description of functionality, we call GPT to generate a shell
+// command
+func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
+	req, err := this.gencmdRequest(description)
+	if err != nil {
+		return "", err
 	}
 
 	resp, err := this.LLMClient.Completion(req)
@@ -824,6 +1387,172 @@ func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
 	return resp.Completion, nil
 }
 
+// Generate up to k candidate commands for a description, best first. The
+// requests are made in parallel, duplicates are dropped, then we ask the
+// model to rank what's left. If ranking fails we keep the candidates in the
+// order they were generated.
+func (this *ButterfishCtx) gencmdCandidates(description string, k int) ([]string, error) {
+	req, err := this.gencmdRequest(description)
+	if err != nil {
+		return nil, err
+	}
+
+	completions := make([]string, k)
+	errs := make([]error, k)
+	wg := sync.WaitGroup{}
+	for i := 0; i < k; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each goroutine gets its own copy since decorators may modify it
+			reqCopy := *req
+			resp, err := this.LLMClient.Completion(&reqCopy)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			completions[i] = resp.Completion
+		}(i)
+	}
+	wg.Wait()
+
+	candidates := dedupeCommands(completions)
+	if len(candidates) == 0 {
+		// every request failed, report the first error
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, errors.New("No commands were generated")
+	}
+
+	if len(candidates) == 1 {
+		return candidates, nil
+	}
+
+	ranked, err := this.rankCommands(description, candidates)
+	if err != nil {
+		log.Printf("Could not rank generated commands: %s", err)
+		return candidates, nil
+	}
+	return ranked, nil
+}
+
+// Trim commands and drop empty ones and duplicates, commands that differ
+// only in whitespace are considered duplicates
+func dedupeCommands(commands []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+
+	for _, cmd := range commands {
+		cmd = strings.TrimSpace(cmd)
+		key := strings.Join(strings.Fields(cmd), " ")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, cmd)
+	}
+
+	return result
+}
+
+// Ask the model to rank candidate commands with a short, cheap prompt
+func (this *ButterfishCtx) rankCommands(description string, candidates []string) ([]string, error) {
+	numbered := strings.Builder{}
+	for i, cmd := range candidates {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, cmd)
+	}
+
+	promptStr, err := this.PromptLibrary.GetPrompt(prompt.PromptRankCommands,
+		"content", description,
+		"commands", numbered.String())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Prompt:        promptStr,
+		Model:         this.Config.GencmdModel,
+		MaxTokens:     64,
+		Temperature:   0,
+		SystemMessage: "N/A",
+		TokenTimeout:  this.Config.TokenTimeout,
+		Feature:       FeatureGencmd,
+	}
+
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyCommandRanking(candidates, resp.Completion), nil
+}
+
+// Reorder candidates by a ranking like "2,1,3". Numbers that are out of
+// range or repeated are ignored, and candidates the ranking leaves out go
+// at the end in their original order.
+func applyCommandRanking(candidates []string, ranking string) []string {
+	used := make([]bool, len(candidates))
+	result := []string{}
+
+	for _, numStr := range regexp.MustCompile(`\d+`).FindAllString(ranking, -1) {
+		num, err := strconv.Atoi(numStr)
+		if err != nil || num < 1 || num > len(candidates) || used[num-1] {
+			continue
+		}
+		used[num-1] = true
+		result = append(result, candidates[num-1])
+	}
+
+	for i, cmd := range candidates {
+		if !used[i] {
+			result = append(result, cmd)
+		}
+	}
+
+	return result
+}
+
+// Let the user pick one of several generated commands, then run it with
+// execAndCheck or print it. The picker draws on stderr and reads the
+// terminal directly so that stdout can be piped and the description can
+// come from stdin.
+func (this *ButterfishCtx) pickCommand(candidates []string) error {
+	if this.InConsoleMode {
+		// the console already owns the screen, list the candidates and put
+		// the best one in the register
+		for i, cmd := range candidates {
+			this.StylePrintf(this.Config.Styles.Highlight, "%d. %s\n", i+1, cmd)
+		}
+		this.updateCommandRegister(candidates[0])
+		return nil
+	}
+
+	model := picker.NewPickerModel("Choose a command", candidates)
+	model.SelectedStyle = this.Config.Styles.Highlight
+	model, err := picker.Pick(model, tea.WithInputTTY(), tea.WithOutput(os.Stderr))
+	if err != nil {
+		return err
+	}
+
+	if model.Choice() < 0 {
+		return nil
+	}
+	cmd := candidates[model.Choice()]
+
+	switch model.Action() {
+	case picker.ActionRun:
+		return this.execAndCheck(this.Ctx, cmd)
+	case picker.ActionPrint:
+		// unstyled, this is meant to be piped
+		fmt.Fprintf(this.Out, "%s\n", cmd)
+	}
+	return nil
+}
+
 // We're parsing the results from an LLM requesting a command fix, we expect
 // that there will be natural language text in the string and the command
 // will appear somewhere like:
@@ -884,6 +1613,7 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 			Temperature:   this.Config.ExeccheckTemperature,
 			SystemMessage: "N/A",
 			TokenTimeout:  this.Config.TokenTimeout,
+			Feature:       FeatureExec,
 		}
 
 		response, err := this.LLMClient.CompletionStream(req, styleWriter)
@@ -1016,6 +1746,7 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 		MaxTokens:     this.Config.SummarizeMaxTokens,
 		Temperature:   this.Config.SummarizeTemperature,
 		SystemMessage: "N/A",
+		Feature:       FeatureSummarize,
 	}
 
 	if len(chunks) == 1 {
@@ -1044,8 +1775,10 @@ func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
 		if err != nil {
 			return err
 		}
-		req.Prompt = prompt
-		resp, err := this.LLMClient.Completion(req)
+		factsReq := *req
+		factsReq.Prompt = prompt
+		factsReq.Temperature = this.Config.SummarizeFactsTemperature
+		resp, err := this.LLMClient.Completion(&factsReq)
 		if err != nil {
 			return err
 		}
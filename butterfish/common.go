@@ -5,75 +5,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 
 	"github.com/mattn/go-runewidth"
 )
 
-// See https://platform.openai.com/docs/models/overview
-var MODEL_TO_NUM_TOKENS = map[string]int{
-	"gpt-4":                       8192,
-	"gpt-4-1106":                  128000,
-	"gpt-4-0125-preview":          128000,
-	"gpt-4-vision":                128000,
-	"gpt-4-0314":                  8192,
-	"gpt-4-0613":                  8192,
-	"gpt-4-32k":                   32768,
-	"gpt-4-32k-0314":              32768,
-	"gpt-4-32k-0613":              32768,
-	"gpt-4-turbo":                 128000,
-	"gpt-4-turbo-preview":         128000,
-	"gpt-4-turbo-2024-04-09":      128000,
-	"gpt-3.5-turbo":               16384,
-	"gpt-3.5-turbo-0301":          4096,
-	"gpt-3.5-turbo-0613":          4096,
-	"gpt-3.5-turbo-1106":          16384,
-	"gpt-3.5-turbo-0125":          16384,
-	"gpt-3.5-turbo-16k":           16384,
-	"gpt-3.5-turbo-16k-0613":      16384,
-	"gpt-3.5-turbo-instruct":      4096,
-	"gpt-3.5-turbo-instruct-0913": 4096,
-	"text-davinci-003":            2047,
-	"text-davinci-002":            2047,
-	"code-davinci-002":            8001,
-	"code-davinci-001":            8001,
-	"text-curie-001":              2049,
-	"text-babbage-001":            2049,
-	"text-ada-001":                2049,
-	"davinci":                     2049,
-	"curie":                       2049,
-	"babbage":                     2049,
-	"ada":                         2049,
-	"code-cushman-002":            2048,
-	"code-cushman-001":            2048,
-}
-
-// these token numbers come from
-// https://github.com/pkoukk/tiktoken-go#counting-tokens-for-chat-api-calls
-var MODEL_TO_TOKENS_PER_MESSAGE = map[string]int{
-	"gpt-4":                  3,
-	"gpt-4-0314":             3,
-	"gpt-4-0613":             3,
-	"gpt-4-32k":              3,
-	"gpt-4-32k-0314":         3,
-	"gpt-4-32k-0613":         3,
-	"gpt-3.5-turbo":          4,
-	"gpt-3.5-turbo-0301":     4,
-	"gpt-3.5-turbo-1613":     4,
-	"gpt-3.5-turbo-1106":     4,
-	"gpt-3.5-turbo-16k":      4,
-	"gpt-3.5-turbo-16k-0613": 4,
-}
-
 // Given a model name (e.g. gpt-4-32k-0613), search the kv map for the
 // value associated with the model name. If the model name is not found,
 // attempt to find a simpler model name by removing the last segment
 // (delimited by -) and searching again.
 // returns (model found, value)
-func findModelValue(model string, kv map[string]int) (string, int) {
+func findModelValue[T any](model string, kv map[string]T) (string, T) {
 	value, ok := kv[model]
 	if ok {
 		return model, value
@@ -94,39 +41,8 @@ func findModelValue(model string, kv map[string]int) (string, int) {
 		}
 	}
 
-	return "", -1
-}
-
-func NumTokensForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_NUM_TOKENS)
-
-	// couldn't find model
-	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default context window size of 2048 tokens", model)
-		return 2048
-	}
-
-	// found simpler model
-	if foundModel != model {
-		log.Printf("WARNING: Unknown model %s, using model %s settings instead with context window size of %d tokens", model, foundModel, numTokens)
-		return numTokens
-	}
-
-	log.Printf("Found model %s context window size of %d tokens", model, numTokens)
-
-	// normal
-	return numTokens
-}
-
-func NumTokensPerMessageForModel(model string) int {
-	foundModel, numTokens := findModelValue(model, MODEL_TO_TOKENS_PER_MESSAGE)
-
-	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default num tokens per message 5", model)
-		return 5
-	}
-
-	return numTokens
+	var zero T
+	return "", zero
 }
 
 // Data type for passing byte chunks from a wrapped command around
@@ -413,3 +329,22 @@ func GetSystemInfo() string {
 	sysInfo = string(out)
 	return sysInfo
 }
+
+// Current working directory of another process. Linux exposes this in
+// /proc, on macOS we ask lsof.
+func processWorkingDir(pid int) (string, error) {
+	if runtime.GOOS == "linux" {
+		return os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	}
+
+	out, err := exec.Command("lsof", "-a", "-p", strconv.Itoa(pid), "-d", "cwd", "-Fn").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "n") {
+			return line[1:], nil
+		}
+	}
+	return "", fmt.Errorf("No working directory found for pid %d", pid)
+}
@@ -0,0 +1,300 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// How long a backend is skipped after it fails, unless configured otherwise
+const DefaultFallbackCooldown = 60 * time.Second
+
+// One entry in a fallback chain
+type fallbackBackend struct {
+	name string
+	llm  LLM
+	// if set, requests to this backend use this model rather than the one
+	// in the request, since model names rarely carry across providers
+	model string
+
+	unhealthyUntil time.Time
+	lastError      error
+	served         int
+}
+
+// FallbackLLM is an LLM decorator that wraps an ordered list of backends.
+// Each request goes to the first healthy backend, if that fails with a
+// server error or a timeout we mark it unhealthy for a cool-down period and
+// try the next one. If every backend is unhealthy we try them all anyway in
+// order rather than failing outright.
+type FallbackLLM struct {
+	backends []*fallbackBackend
+	cooldown time.Duration
+	// name of the backend that served the most recent request
+	lastServed string
+	mutex      sync.Mutex
+}
+
+func NewFallbackLLM(cooldown time.Duration) *FallbackLLM {
+	if cooldown <= 0 {
+		cooldown = DefaultFallbackCooldown
+	}
+
+	return &FallbackLLM{
+		cooldown: cooldown,
+	}
+}
+
+// Add a backend to the end of the chain, model may be empty to use the
+// requested model.
+func (this *FallbackLLM) AddBackend(name string, llm LLM, model string) {
+	this.backends = append(this.backends, &fallbackBackend{
+		name:  name,
+		llm:   llm,
+		model: model,
+	})
+}
+
+// Health of a single backend in the chain, for status reporting
+type FallbackBackendStatus struct {
+	Name           string
+	Model          string
+	Healthy        bool
+	UnhealthyUntil time.Time
+	LastError      error
+	Served         int
+}
+
+// Report on the health of each backend and which one served the last
+// request.
+func (this *FallbackLLM) Status() ([]FallbackBackendStatus, string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	statuses := []FallbackBackendStatus{}
+	for _, backend := range this.backends {
+		statuses = append(statuses, FallbackBackendStatus{
+			Name:           backend.name,
+			Model:          backend.model,
+			Healthy:        !now.Before(backend.unhealthyUntil),
+			UnhealthyUntil: backend.unhealthyUntil,
+			LastError:      backend.lastError,
+			Served:         backend.served,
+		})
+	}
+
+	return statuses, this.lastServed
+}
+
+// The order in which to try backends: healthy ones first in chain order,
+// then unhealthy ones as a last resort.
+func (this *FallbackLLM) order() []*fallbackBackend {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	healthy := []*fallbackBackend{}
+	unhealthy := []*fallbackBackend{}
+	for _, backend := range this.backends {
+		if now.Before(backend.unhealthyUntil) {
+			unhealthy = append(unhealthy, backend)
+		} else {
+			healthy = append(healthy, backend)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+func (this *FallbackLLM) markFailed(backend *fallbackBackend, err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	backend.unhealthyUntil = time.Now().Add(this.cooldown)
+	backend.lastError = err
+}
+
+func (this *FallbackLLM) markServed(backend *fallbackBackend) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	backend.unhealthyUntil = time.Time{}
+	backend.lastError = nil
+	backend.served++
+	this.lastServed = backend.name
+}
+
+// Decide whether an error means the backend is unavailable, i.e. a 5xx,
+// rate limiting, a network failure, or a timeout. Other errors, like a bad
+// request, would fail the same way on the next backend.
+func IsFailoverError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if status := errorStatusCode(err); status != 0 {
+		return status >= 500 || status == 429
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, ErrTokenTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// A writer that remembers whether anything was written, once a streaming
+// backend has written output we can't cleanly switch to another one.
+type trackingWriter struct {
+	writer  io.Writer
+	written bool
+}
+
+func (this *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		this.written = true
+	}
+	return this.writer.Write(p)
+}
+
+func (this *FallbackLLM) try(
+	ctx context.Context,
+	call func(backend *fallbackBackend) error,
+) error {
+	if len(this.backends) == 0 {
+		return errors.New("No LLM backends configured")
+	}
+
+	var errs []string
+	var lastErr error
+	lastName := ""
+	for _, backend := range this.order() {
+		err := call(backend)
+		if err == nil {
+			this.markServed(backend)
+			return nil
+		}
+
+		// the user cancelled, don't blame the backend
+		if ctx != nil && ctx.Err() == context.Canceled {
+			return err
+		}
+
+		if !IsFailoverError(err) {
+			return err
+		}
+
+		log.Printf("LLM backend %s failed, marking unhealthy for %s: %s", backend.name, this.cooldown, err)
+		this.markFailed(backend, err)
+
+		var stop *stopFallback
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+
+		if lastErr != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s\n", lastName, lastErr))
+		}
+		lastErr = err
+		lastName = backend.name
+	}
+
+	// wrap the last error so callers can still inspect it
+	return fmt.Errorf("All LLM backends failed:\n%s%s: %w",
+		strings.Join(errs, ""), lastName, lastErr)
+}
+
+// Wraps a failover error that happened after output was already streamed,
+// we mark the backend unhealthy but don't try the next one.
+type stopFallback struct {
+	err error
+}
+
+func (this *stopFallback) Error() string { return this.err.Error() }
+func (this *stopFallback) Unwrap() error { return this.err }
+
+func (this *fallbackBackend) request(request *util.CompletionRequest) *util.CompletionRequest {
+	if this.model == "" {
+		return request
+	}
+	copied := *request
+	copied.Model = this.model
+	return &copied
+}
+
+func (this *FallbackLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+	err := this.try(request.Ctx, func(backend *fallbackBackend) error {
+		var err error
+		response, err = backend.llm.Completion(backend.request(request))
+		return err
+	})
+	return response, err
+}
+
+func (this *FallbackLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+	err := this.try(request.Ctx, func(backend *fallbackBackend) error {
+		tracker := &trackingWriter{writer: writer}
+		var err error
+		response, err = backend.llm.CompletionStream(backend.request(request), tracker)
+		if err != nil && tracker.written {
+			return &stopFallback{err}
+		}
+		return err
+	})
+	return response, err
+}
+
+// Note that different backends generally produce embeddings of different
+// sizes, so an embedding chain should only fail over to an equivalent model.
+func (this *FallbackLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	var embeddings [][]float32
+	err := this.try(ctx, func(backend *fallbackBackend) error {
+		var err error
+		embeddings, err = backend.llm.Embeddings(ctx, input, verbose)
+		return err
+	})
+	return embeddings, err
+}
+
+// Model discovery is delegated to the first backend that supports it.
+func (this *FallbackLLM) discoverer() (ModelDiscoverer, *fallbackBackend) {
+	for _, backend := range this.backends {
+		if discoverer, ok := UnwrapLLM[ModelDiscoverer](backend.llm); ok {
+			return discoverer, backend
+		}
+	}
+	return nil, nil
+}
+
+func (this *FallbackLLM) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	discoverer, _ := this.discoverer()
+	if discoverer == nil {
+		return nil, errors.New("No LLM backend in the chain supports listing models")
+	}
+	return discoverer.ListModels(ctx)
+}
+
+// The context window is sized for the primary backend, so we only ask it.
+func (this *FallbackLLM) ContextLength(ctx context.Context, model string) (int, error) {
+	if len(this.backends) == 0 {
+		return 0, errors.New("No LLM backends configured")
+	}
+	primary := this.backends[0]
+	discoverer, ok := UnwrapLLM[ModelDiscoverer](primary.llm)
+	if !ok {
+		return 0, fmt.Errorf("LLM backend %s does not support model discovery", primary.name)
+	}
+	return discoverer.ContextLength(ctx, primary.request(&util.CompletionRequest{Model: model}).Model)
+}
@@ -0,0 +1,135 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// An LLM stand-in that returns a canned error or echoes the model it was
+// asked for
+type fakeLLM struct {
+	err    error
+	output string
+	calls  int
+}
+
+func (this *fakeLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.calls++
+	if this.err != nil {
+		return nil, this.err
+	}
+	return &util.CompletionResponse{Completion: request.Model}, nil
+}
+
+func (this *fakeLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.calls++
+	writer.Write([]byte(this.output))
+	if this.err != nil {
+		return nil, this.err
+	}
+	return &util.CompletionResponse{Completion: request.Model}, nil
+}
+
+func (this *fakeLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	this.calls++
+	return nil, this.err
+}
+
+func TestIsFailoverError(t *testing.T) {
+	assert.True(t, IsFailoverError(&StatusError{Service: "x", StatusCode: 503}))
+	assert.True(t, IsFailoverError(&StatusError{Service: "x", StatusCode: 429}))
+	assert.False(t, IsFailoverError(&StatusError{Service: "x", StatusCode: 400}))
+	assert.True(t, IsFailoverError(NewTokenTimeoutError(time.Second)))
+	assert.False(t, IsFailoverError(errors.New("bad function parameters")))
+	assert.False(t, IsFailoverError(nil))
+}
+
+func TestFallbackLLMFailover(t *testing.T) {
+	primary := &fakeLLM{err: &StatusError{Service: "OpenAI", StatusCode: 502}}
+	secondary := &fakeLLM{}
+
+	fallback := NewFallbackLLM(time.Minute)
+	fallback.AddBackend("openai", primary, "")
+	fallback.AddBackend("ollama", secondary, "llama3:8b")
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Model: "gpt-4-turbo"}
+	resp, err := fallback.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "llama3:8b", resp.Completion)
+	// the caller's request isn't modified by the model override
+	assert.Equal(t, "gpt-4-turbo", request.Model)
+
+	statuses, lastServed := fallback.Status()
+	assert.Equal(t, "ollama", lastServed)
+	assert.False(t, statuses[0].Healthy)
+	assert.True(t, statuses[1].Healthy)
+	assert.Equal(t, 1, statuses[1].Served)
+
+	// the primary is cooling down so it's skipped
+	_, err = fallback.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 2, secondary.calls)
+}
+
+func TestFallbackLLMNoFailover(t *testing.T) {
+	primary := &fakeLLM{err: &StatusError{Service: "OpenAI", StatusCode: 400, Message: "bad request"}}
+	secondary := &fakeLLM{}
+
+	fallback := NewFallbackLLM(time.Minute)
+	fallback.AddBackend("openai", primary, "")
+	fallback.AddBackend("ollama", secondary, "")
+
+	_, err := fallback.Completion(&util.CompletionRequest{Ctx: context.Background()})
+	assert.ErrorContains(t, err, "bad request")
+	assert.Equal(t, 0, secondary.calls)
+}
+
+func TestFallbackLLMStreamAfterOutput(t *testing.T) {
+	primary := &fakeLLM{output: "partial", err: NewTokenTimeoutError(time.Second)}
+	secondary := &fakeLLM{}
+
+	fallback := NewFallbackLLM(time.Minute)
+	fallback.AddBackend("openai", primary, "")
+	fallback.AddBackend("ollama", secondary, "")
+
+	// output was already streamed so we don't retry on the next backend
+	out := new(bytes.Buffer)
+	_, err := fallback.CompletionStream(&util.CompletionRequest{Ctx: context.Background()}, out)
+	assert.ErrorIs(t, err, ErrTokenTimeout)
+	assert.Equal(t, "partial", out.String())
+	assert.Equal(t, 0, secondary.calls)
+
+	statuses, _ := fallback.Status()
+	assert.False(t, statuses[0].Healthy)
+}
+
+func TestInitLLMChain(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.LLMProvider = LLMProviderOllama
+	clients := map[string]LLM{}
+
+	client, err := initLLMChain(config, DefaultModelCatalog(), nil, clients, nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &Ollama{}, client)
+
+	client, err = initLLMChain(config, DefaultModelCatalog(), []string{"ollama:llama3:8b", "ollama:mistral"}, clients, nil)
+	assert.NoError(t, err)
+	fallback := client.(*FallbackLLM)
+	statuses, _ := fallback.Status()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, "llama3:8b", statuses[0].Model)
+	assert.Equal(t, "mistral", statuses[1].Model)
+	assert.Equal(t, 1, len(clients))
+
+	_, err = initLLMChain(config, DefaultModelCatalog(), []string{"ollama", "bogus"}, clients, nil)
+	assert.Error(t, err)
+}
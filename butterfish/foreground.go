@@ -0,0 +1,201 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mitchellh/go-ps"
+)
+
+// How long a foreground check is trusted, so a burst of input like fast
+// typing or a paste only checks once
+const foregroundCacheTTL = 500 * time.Millisecond
+
+// Shells we keep Butterfish on for when they're in the foreground, e.g. if
+// the user starts a nested shell
+var shellNames = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"zsh":  true,
+	"fish": true,
+	"dash": true,
+	"ksh":  true,
+	"mksh": true,
+	"tcsh": true,
+	"csh":  true,
+}
+
+func isShellName(name string) bool {
+	// login shells are named like -bash
+	return shellNames[strings.TrimPrefix(name, "-")]
+}
+
+// ForegroundDetector tells whether a program other than a shell is in the
+// foreground of the child shell's terminal, e.g. vim or a running command,
+// in which case input should go straight to it. We ask the pty for its
+// foreground process group (tcgetpgrp), falling back to /proc, then to
+// walking the process table.
+type ForegroundDetector struct {
+	shellPid int
+
+	// these are replaced in tests
+	foregroundPgrp func() (int, error)
+	processName    func(pid int) (string, error)
+	fallback       func() bool
+	now            func() time.Time
+
+	mutex     sync.Mutex
+	running   bool
+	checkedAt time.Time
+	valid     bool
+}
+
+// Create a detector for a shell running in ptmx, which may be nil if we don't
+// have the pty
+func NewForegroundDetector(ptmx *os.File, shellPid int) *ForegroundDetector {
+	return &ForegroundDetector{
+		shellPid: shellPid,
+		foregroundPgrp: func() (int, error) {
+			if ptmx != nil {
+				pgrp, err := ptyForegroundPgrp(ptmx)
+				if err == nil {
+					return pgrp, nil
+				}
+			}
+			return procForegroundPgrp(shellPid)
+		},
+		processName: processName,
+		fallback:    HasRunningChildren,
+		now:         time.Now,
+	}
+}
+
+// Whether something other than a shell is in the foreground, this may be up
+// to foregroundCacheTTL old unless Invalidate is called
+func (this *ForegroundDetector) Running() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := this.now()
+	if this.valid && now.Sub(this.checkedAt) < foregroundCacheTTL {
+		return this.running
+	}
+
+	this.running = this.check()
+	this.checkedAt = now
+	this.valid = true
+	return this.running
+}
+
+// Check again next time, called when we know the foreground may have changed,
+// e.g. a command was submitted or a prompt was printed
+func (this *ForegroundDetector) Invalidate() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.valid = false
+}
+
+// The name of the program in the foreground, or an empty string if it's a
+// shell or we can't tell. This isn't cached.
+func (this *ForegroundDetector) Name() string {
+	pgrp, err := this.foregroundPgrp()
+	if err != nil || pgrp <= 0 || pgrp == this.shellPid {
+		return ""
+	}
+	name, err := this.processName(pgrp)
+	if err != nil || isShellName(name) {
+		return ""
+	}
+	return name
+}
+
+func (this *ForegroundDetector) check() bool {
+	pgrp, err := this.foregroundPgrp()
+	if err != nil {
+		log.Printf("Could not get the terminal's foreground process, counting child processes instead: %s", err)
+		return this.fallback()
+	}
+	if pgrp <= 0 || pgrp == this.shellPid {
+		return false
+	}
+
+	// a process group is named after its leader
+	name, err := this.processName(pgrp)
+	if err != nil {
+		// the leader may have exited while others in the group run on, either
+		// way we'd rather pass input through than take it from a program
+		return true
+	}
+	return !isShellName(name)
+}
+
+// The foreground process group of the terminal on the other side of a pty
+// master
+func ptyForegroundPgrp(ptmx *os.File) (int, error) {
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var pgrp int32
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+			uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// The foreground process group of a process's controlling terminal, from
+// /proc/<pid>/stat
+func procForegroundPgrp(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseProcStatTpgid(string(data))
+}
+
+// The stat line is "pid (comm) state ppid pgrp session tty_nr tpgid ...",
+// comm may contain spaces and parentheses so we split after the last ")"
+func parseProcStatTpgid(stat string) (int, error) {
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, fmt.Errorf("Could not parse process stat: %s", stat)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 6 {
+		return 0, fmt.Errorf("Could not parse process stat: %s", stat)
+	}
+	return strconv.Atoi(fields[5])
+}
+
+// The executable name of a process, from /proc if we have it
+func processName(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	process, err := ps.FindProcess(pid)
+	if err != nil {
+		return "", err
+	}
+	if process == nil {
+		return "", fmt.Errorf("Process %d not found", pid)
+	}
+	return process.Executable(), nil
+}
@@ -0,0 +1,150 @@
+package butterfish
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A detector over a fake process table and clock
+type fakeForeground struct {
+	pgrp      int
+	pgrpErr   error
+	names     map[int]string
+	checks    int
+	fallbacks int
+	now       time.Time
+}
+
+func (this *fakeForeground) detector(shellPid int) *ForegroundDetector {
+	return &ForegroundDetector{
+		shellPid: shellPid,
+		foregroundPgrp: func() (int, error) {
+			this.checks++
+			return this.pgrp, this.pgrpErr
+		},
+		processName: func(pid int) (string, error) {
+			name, ok := this.names[pid]
+			if !ok {
+				return "", errors.New("no such process")
+			}
+			return name, nil
+		},
+		fallback: func() bool {
+			this.fallbacks++
+			return true
+		},
+		now: func() time.Time { return this.now },
+	}
+}
+
+func TestForegroundDetector(t *testing.T) {
+	fake := &fakeForeground{
+		pgrp:  100,
+		names: map[int]string{100: "bash", 200: "vim", 300: "-zsh", 400: "fish"},
+		now:   time.Now(),
+	}
+	detector := fake.detector(100)
+
+	// the shell itself is in the foreground
+	assert.False(t, detector.Running())
+
+	// a program is, but we use the cached answer until it's invalidated
+	fake.pgrp = 200
+	assert.False(t, detector.Running())
+	assert.Equal(t, 1, fake.checks)
+	detector.Invalidate()
+	assert.True(t, detector.Running())
+	assert.Equal(t, 2, fake.checks)
+
+	// or until it expires
+	fake.pgrp = 100
+	fake.now = fake.now.Add(foregroundCacheTTL / 2)
+	assert.True(t, detector.Running())
+	fake.now = fake.now.Add(foregroundCacheTTL)
+	assert.False(t, detector.Running())
+
+	// nested shells keep butterfish on
+	for _, pgrp := range []int{300, 400} {
+		fake.pgrp = pgrp
+		detector.Invalidate()
+		assert.False(t, detector.Running(), fake.names[pgrp])
+	}
+
+	// a group whose leader has exited is still running
+	fake.pgrp = 500
+	detector.Invalidate()
+	assert.True(t, detector.Running())
+
+	// if we can't ask the terminal we count child processes
+	fake.pgrpErr = errors.New("not a tty")
+	detector.Invalidate()
+	assert.True(t, detector.Running())
+	assert.Equal(t, 1, fake.fallbacks)
+}
+
+func TestParseProcStatTpgid(t *testing.T) {
+	tpgid, err := parseProcStatTpgid("1234 (my (odd) prog) S 1000 1234 1000 34816 5678 4194304 100 0 0 0")
+	assert.Nil(t, err)
+	assert.Equal(t, 5678, tpgid)
+
+	_, err = parseProcStatTpgid("1234 (bash")
+	assert.NotNil(t, err)
+	_, err = parseProcStatTpgid("1234 (bash) S 1")
+	assert.NotNil(t, err)
+}
+
+func TestForegroundDetectorPty(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationPS1, "bash", "--norc", "--noprofile")
+	shell.WaitForPrompt()
+	shellPid := shell.cmd.Process.Pid
+
+	detector := NewForegroundDetector(shell.ptmx, shellPid)
+	detector.fallback = func() bool {
+		t.Fatal("Expected to find the foreground process group")
+		return false
+	}
+	assert.False(t, detector.Running())
+
+	pgrp, err := ptyForegroundPgrp(shell.ptmx)
+	assert.Nil(t, err)
+	assert.Equal(t, shellPid, pgrp)
+	if _, err := os.Stat("/proc"); err == nil {
+		pgrp, err = procForegroundPgrp(shellPid)
+		assert.Nil(t, err)
+		assert.Equal(t, shellPid, pgrp)
+	}
+
+	waitFor := func(running bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			detector.Invalidate()
+			if detector.Running() == running {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for running to be %t", running)
+	}
+
+	shell.Send("sleep 30")
+	waitFor(true)
+
+	// a nested shell isn't a running program
+	shell.ptmx.Write([]byte{0x03})
+	shell.WaitForPrompt()
+	waitFor(false)
+	shell.Send("bash --norc --noprofile")
+	deadline := time.Now().Add(5 * time.Second)
+	for pgrp == shellPid && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		pgrp, err = ptyForegroundPgrp(shell.ptmx)
+		assert.Nil(t, err)
+	}
+	assert.NotEqual(t, shellPid, pgrp)
+	detector.Invalidate()
+	assert.False(t, detector.Running())
+}
@@ -0,0 +1,83 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+func TestDedupeCommands(t *testing.T) {
+	assert.Equal(t,
+		[]string{"ls -l", "ls -la"},
+		dedupeCommands([]string{" ls -l\n", "ls  -l", "", "ls -la", "ls -l"}))
+}
+
+func TestApplyCommandRanking(t *testing.T) {
+	candidates := []string{"a", "b", "c"}
+	assert.Equal(t, []string{"b", "c", "a"}, applyCommandRanking(candidates, "2, 3, 1"))
+	// out of range and repeats are ignored, missing go at the end
+	assert.Equal(t, []string{"c", "a", "b"}, applyCommandRanking(candidates, "3,3,7"))
+	assert.Equal(t, candidates, applyCommandRanking(candidates, "no idea"))
+}
+
+// Answers generate requests with each of its commands in turn and rank
+// requests with ranking, safe to call concurrently
+type gencmdLLM struct {
+	fakeLLM
+	mutex    sync.Mutex
+	commands []string
+	ranking  string
+	requests int
+}
+
+func (this *gencmdLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.requests++
+
+	if strings.Contains(request.Prompt, "Candidates:") {
+		if this.ranking == "" {
+			return nil, errors.New("rank failed")
+		}
+		return &util.CompletionResponse{Completion: this.ranking}, nil
+	}
+	command := this.commands[0]
+	this.commands = this.commands[1:]
+	return &util.CompletionResponse{Completion: command}, nil
+}
+
+func TestGencmdCandidates(t *testing.T) {
+	llm := &gencmdLLM{
+		commands: []string{"ls -l", "ls -l\n", "ls -la"},
+		ranking:  "2,1",
+	}
+	ctx := &ButterfishCtx{
+		Ctx:           context.Background(),
+		Config:        MakeButterfishConfig(),
+		LLMClient:     llm,
+		PromptLibrary: &prompt.DiskPromptLibrary{Prompts: prompt.DefaultPrompts},
+	}
+
+	candidates, err := ctx.gencmdCandidates("list files", 3)
+	assert.Nil(t, err)
+	// the requests run in parallel so generation order isn't fixed
+	assert.ElementsMatch(t, []string{"ls -l", "ls -la"}, candidates)
+	assert.Equal(t, 4, llm.requests)
+
+	// ranking failing keeps the generated order
+	llm.commands = []string{"pwd", "pwd"}
+	llm.ranking = ""
+	llm.requests = 0
+	candidates, err = ctx.gencmdCandidates("where am i", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"pwd"}, candidates)
+	// a single candidate isn't ranked
+	assert.Equal(t, 2, llm.requests)
+}
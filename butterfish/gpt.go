@@ -3,12 +3,12 @@ package butterfish
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math"
+	"net/http"
 	"strings"
 	"time"
 
@@ -19,26 +19,13 @@ import (
 const ERR_429 = "429:insufficient_quota"
 const ERR_429_HELP = "You are likely using a free OpenAI account without a subscription activated, this error means you are out of credits. To resolve it, set up a subscription at https://platform.openai.com/account/billing/overview. This requires a credit card and payment, run `butterfish help` for guidance on managing cost. Once you have a subscription set up you must issue a NEW OpenAI token, your previous token will not reflect the subscription."
 
-var LegacyModelTypes = []string{
-	openai.GPT3TextAda001,
-	openai.GPT3TextBabbage001,
-	openai.GPT3TextCurie001,
-	openai.GPT3TextDavinci001,
-	openai.GPT3TextDavinci002,
-	openai.GPT3TextDavinci003,
-}
-
-func IsLegacyModel(model string) bool {
-	for _, legacyModel := range LegacyModelTypes {
-		if model == legacyModel {
-			return true
-		}
-	}
-	return false
-}
-
 type GPT struct {
 	client *openai.Client
+	// embedding model, defaults to GPTEmbeddingsModel if empty
+	embeddingModel string
+	retry          *RetryPolicy
+	// tells us which models use the legacy completion API
+	models *ModelCatalog
 }
 
 func NewGPT(token, baseUrl string) *GPT {
@@ -46,11 +33,16 @@ func NewGPT(token, baseUrl string) *GPT {
 	if baseUrl != "" {
 		config.BaseURL = baseUrl
 	}
+	config.HTTPClient = &http.Client{
+		Transport: &retryAfterTransport{base: http.DefaultTransport},
+	}
 
 	client := openai.NewClientWithConfig(config)
 
 	return &GPT{
 		client: client,
+		retry:  NewRetryPolicy(),
+		models: DefaultModelCatalog(),
 	}
 }
 
@@ -262,6 +254,10 @@ func ShellHistoryTypeToRole(t int) string {
 
 func ShellHistoryBlockToGPTChat(block *util.HistoryBlock) *openai.ChatCompletionMessage {
 	role := ShellHistoryTypeToRole(block.Type)
+	if role == "user" && len(block.Attachments) > 0 {
+		msg := openaiUserMessage(block.Content, block.Attachments)
+		return &msg
+	}
 	name := ""
 	toolCallId := ""
 	var function *openai.FunctionCall
@@ -334,7 +330,13 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 	var result *util.CompletionResponse
 	var err error
 
-	if IsCompletionModel(request.Model) {
+	if this.models.IsCompletionModel(request.Model) {
+		if request.ResponseSchema != nil {
+			return nil, fmt.Errorf("Model %s uses the legacy completion API, which doesn't support a response schema", request.Model)
+		}
+		if len(util.ImageAttachments(request.Attachments)) > 0 {
+			return nil, fmt.Errorf("Model %s uses the legacy completion API, which doesn't accept images", request.Model)
+		}
 		result, err = this.InstructCompletion(request)
 	} else if request.HistoryBlocks == nil {
 		result, err = this.SimpleChatCompletion(request)
@@ -350,19 +352,16 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 	return result, err
 }
 
-// If the model is legacy or ends with -instruct then it should use completion
-// api, otherwise it should use the chat api.
-func IsCompletionModel(modelName string) bool {
-	return IsLegacyModel(modelName) || strings.HasSuffix(modelName, "-instruct")
-}
-
 // We're doing completions through the chat API by default, this routes
 // to the legacy completion API if the model is the legacy model.
 func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
 	var result *util.CompletionResponse
 	var err error
 
-	if IsCompletionModel(request.Model) {
+	if this.models.IsCompletionModel(request.Model) {
+		if len(util.ImageAttachments(request.Attachments)) > 0 {
+			return nil, fmt.Errorf("Model %s uses the legacy completion API, which doesn't accept images", request.Model)
+		}
 		result, err = this.InstructCompletionStream(request, writer)
 	} else if request.HistoryBlocks == nil {
 		result, err = this.SimpleChatCompletionStream(request, writer)
@@ -380,7 +379,7 @@ func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Wri
 
 func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
 	req := openai.CompletionRequest{
-		Prompt:      []string{request.Prompt},
+		Prompt:      []string{util.PromptWithAttachments(request.Prompt, request.Attachments)},
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
@@ -401,7 +400,17 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 	if request.Verbose {
 		LogCompletionRequest(req)
 	}
-	stream, err := this.client.CreateCompletionStream(request.Ctx, req)
+	var stream *openai.CompletionStream
+	err := this.retry.Do(request.Ctx, func(ctx context.Context) error {
+		var innerErr error
+		stream, innerErr = this.client.CreateCompletionStream(ctx, req)
+		return innerErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
 	var id string
 
 	for {
@@ -442,10 +451,7 @@ func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, wri
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			openaiUserMessage(request.Prompt, request.Attachments),
 		},
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
@@ -501,11 +507,8 @@ func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, write
 		return nil, errors.New("System message required for full chat completion")
 	}
 
-	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+	if request.Prompt != "" || len(request.Attachments) > 0 {
+		gptHistory = append(gptHistory, openaiUserMessage(request.Prompt, request.Attachments))
 	}
 
 	req := openai.ChatCompletionRequest{
@@ -539,36 +542,32 @@ func (this *GPT) doChatStreamCompletion(
 	// i.e. the overall timeout for the whole request is 60s, the timeout
 	// for the first chunk is 5s
 	innerCtx, cancel := context.WithCancel(ctx)
-	gotChunk := make(chan bool)
-	defer close(gotChunk)
+	defer cancel()
 	var chunkTimeoutErr error
 
-	// set a goroutine to wait on a timeout or having received a chunk
-	timeoutRoutine := func() {
-		if tokenTimeout == 0 {
-			panic("should not be called")
-		}
-
-		select {
-		case <-time.After(tokenTimeout):
-			chunkTimeoutErr = fmt.Errorf("Timed out waiting for streaming response, this call set a timeout of %v between streaming token responses, set by the --token-timeout (-z) parameter.", tokenTimeout)
+	// the timer is reset on every chunk, and stopped while we wait to retry
+	// a failed request
+	var timer *time.Timer
+	if tokenTimeout > 0 {
+		timer = time.AfterFunc(tokenTimeout, func() {
+			chunkTimeoutErr = NewTokenTimeoutError(tokenTimeout)
 			cancel()
-
-			// if we get a chunk or the context fininshes we don't do anything
-		case <-innerCtx.Done():
-		case <-gotChunk:
+		})
+		defer timer.Stop()
+	}
+	resetTimer := func() {
+		if timer != nil {
+			timer.Reset(tokenTimeout)
 		}
 	}
-
-	if tokenTimeout > 0 {
-		go timeoutRoutine()
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 
 	callback := func(resp openai.ChatCompletionStreamResponse) {
-		if tokenTimeout > 0 {
-			gotChunk <- true
-			go timeoutRoutine()
-		}
+		resetTimer()
 
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
@@ -638,9 +637,15 @@ func (this *GPT) doChatStreamCompletion(
 	}
 	var stream *openai.ChatCompletionStream
 
-	err := withExponentialBackoff(func() error {
+	// we only retry opening the stream, once chunks have been written to the
+	// user a retry would repeat them
+	err := this.retry.Do(innerCtx, func(ctx context.Context) error {
+		resetTimer()
 		var innerErr error
-		stream, innerErr = this.client.CreateChatCompletionStream(innerCtx, req)
+		stream, innerErr = this.client.CreateChatCompletionStream(ctx, req)
+		if innerErr != nil {
+			stopTimer()
+		}
 		return innerErr
 	})
 
@@ -653,6 +658,7 @@ func (this *GPT) doChatStreamCompletion(
 	if err != nil {
 		return nil, err
 	}
+	defer stream.Close()
 
 	var id string
 	for {
@@ -698,14 +704,19 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
-		Prompt:      request.Prompt,
+		Prompt:      util.PromptWithAttachments(request.Prompt, request.Attachments),
 	}
 
 	if request.Verbose {
 		LogCompletionRequest(req)
 	}
 
-	resp, err := this.client.CreateCompletion(request.Ctx, req)
+	var resp openai.CompletionResponse
+	err := this.retry.Do(request.Ctx, func(ctx context.Context) error {
+		var innerErr error
+		resp, innerErr = this.client.CreateCompletion(ctx, req)
+		return innerErr
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -720,6 +731,10 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 
 	response := util.CompletionResponse{
 		Completion: text,
+		Usage: &util.TokenUsage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		},
 	}
 
 	if request.Verbose {
@@ -731,11 +746,8 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
 	gptHistory := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
 
-	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
+	if request.Prompt != "" || len(request.Attachments) > 0 {
+		gptHistory = append(gptHistory, openaiUserMessage(request.Prompt, request.Attachments))
 	}
 
 	if len(gptHistory) == 0 || gptHistory[0].Role != "system" {
@@ -750,6 +762,7 @@ func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.Comp
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	addOpenaiResponseSchema(&req, request.ResponseSchema)
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
 }
@@ -766,27 +779,81 @@ func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.Co
 				Role:    "system",
 				Content: request.SystemMessage,
 			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
+			openaiUserMessage(request.Prompt, request.Attachments),
 		},
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
 		N:           1,
 		Functions:   convertToOpenaiFunctions(request.Functions),
 	}
+	addOpenaiResponseSchema(&req, request.ResponseSchema)
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
 }
 
+// A user message with text attachments inlined and images as data URLs
+func openaiUserMessage(prompt string, attachments []util.Attachment) openai.ChatCompletionMessage {
+	text := util.PromptWithAttachments(prompt, attachments)
+	images := util.ImageAttachments(attachments)
+	if len(images) == 0 {
+		return openai.ChatCompletionMessage{
+			Role:    "user",
+			Content: text,
+		}
+	}
+
+	parts := []openai.ChatMessagePart{}
+	if text != "" {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: text,
+		})
+	}
+	for _, image := range images {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{
+				URL: "data:" + image.MimeType + ";base64," + base64.StdEncoding.EncodeToString(image.Data),
+			},
+		})
+	}
+
+	return openai.ChatCompletionMessage{
+		Role:         "user",
+		MultiContent: parts,
+	}
+}
+
+// The version of the OpenAI client we use predates json_schema response
+// formats, so we force a call to a single function whose parameters are the
+// schema, which gives the same guarantees.
+func addOpenaiResponseSchema(req *openai.ChatCompletionRequest, schema json.RawMessage) {
+	if schema == nil {
+		return
+	}
+
+	req.Functions = nil
+	req.Tools = []openai.Tool{{
+		Type: openai.ToolTypeFunction,
+		Function: &openai.FunctionDefinition{
+			Name:        schemaFunctionName,
+			Description: schemaFunctionDescription,
+			Parameters:  schema,
+		},
+	}}
+	req.ToolChoice = openai.ToolChoice{
+		Type:     openai.ToolTypeFunction,
+		Function: openai.ToolFunction{Name: schemaFunctionName},
+	}
+}
+
 func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatCompletionRequest, verbose bool) (*util.CompletionResponse, error) {
 	if verbose {
 		LogChatCompletionRequest(request)
 	}
 	var resp openai.ChatCompletionResponse
 
-	err := withExponentialBackoff(func() error {
+	err := this.retry.Do(ctx, func(ctx context.Context) error {
 		var innerErr error
 		resp, innerErr = this.client.CreateChatCompletion(ctx, request)
 		return innerErr
@@ -799,6 +866,10 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 
 	response := util.CompletionResponse{
 		Completion: responseText,
+		Usage: &util.TokenUsage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		},
 	}
 
 	funcCall := resp.Choices[0].Message.FunctionCall
@@ -807,6 +878,18 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		response.FunctionParameters = funcCall.Arguments
 	}
 
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   toolCall.ID,
+			Type: string(toolCall.Type),
+			Function: util.FunctionCall{
+				Name:       toolCall.Function.Name,
+				Parameters: toolCall.Function.Arguments,
+			},
+		})
+	}
+	applySchemaResponse(&response)
+
 	if verbose {
 		LogCompletionResponse(response, resp.ID)
 	}
@@ -816,29 +899,15 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 const GPTEmbeddingsMaxTokens = 8192
 const GPTEmbeddingsModel = openai.AdaEmbeddingV2
 
-func withExponentialBackoff(f func() error) error {
-	for i := 0; ; i++ {
-		err := f()
-
-		if err != nil && strings.Contains(err.Error(), "429") {
-			// TODO should probably have a better error detection
-			sleepTime := time.Duration(math.Pow(1.6, float64(i+1))) * time.Second
-			log.Printf("Rate limited, sleeping for %s\n", sleepTime)
-			time.Sleep(sleepTime)
-
-			if i > 3 {
-				return fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries", i)
-			}
-			continue
-		}
-		return err
+func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	model := GPTEmbeddingsModel
+	if this.embeddingModel != "" {
+		model = openai.EmbeddingModel(this.embeddingModel)
 	}
-}
 
-func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
 	req := openai.EmbeddingRequest{
 		Input: input,
-		Model: GPTEmbeddingsModel,
+		Model: model,
 	}
 
 	if verbose {
@@ -857,7 +926,7 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 
 	result := [][]float32{}
 
-	err := withExponentialBackoff(func() error {
+	err := this.retry.Do(ctx, func(ctx context.Context) error {
 		resp, err := this.client.CreateEmbeddings(ctx, req)
 		if err != nil {
 			return err
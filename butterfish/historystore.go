@@ -0,0 +1,361 @@
+package butterfish
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default for how long shell history is kept
+const DefaultHistoryRetention = 30 * 24 * time.Hour
+
+// A session file is compacted to this many blocks when it's opened
+const maxStoredSessionBlocks = 2000
+
+// One block of persisted shell history. Content is stored as it was sent
+// to the LLM, i.e. after redaction.
+type StoredBlock struct {
+	Time           time.Time `json:"time"`
+	Type           int       `json:"type"`
+	Content        string    `json:"content,omitempty"`
+	FunctionName   string    `json:"function_name,omitempty"`
+	FunctionParams string    `json:"function_params,omitempty"`
+}
+
+// Describes a stored session, written as the first line of its file
+type SessionInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// filled in when listing
+	Path    string    `json:"-"`
+	Blocks  int       `json:"-"`
+	Updated time.Time `json:"-"`
+	// number of blocks dropped for being past retention
+	expired int
+}
+
+// A line of a session file, either the header or a block
+type storedLine struct {
+	Session *SessionInfo `json:"session,omitempty"`
+	Block   *StoredBlock `json:"block,omitempty"`
+}
+
+// HistoryStore keeps shell history across Butterfish sessions, one JSONL
+// file per session in a directory. A session is named by the user or is
+// the working directory the shell was started in. Blocks and sessions older
+// than the retention period are dropped.
+type HistoryStore struct {
+	dir       string
+	retention time.Duration
+}
+
+func NewHistoryStore(dir string, retention time.Duration) *HistoryStore {
+	return &HistoryStore{
+		dir:       dir,
+		retention: retention,
+	}
+}
+
+func (this *HistoryStore) sessionPath(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return filepath.Join(this.dir, hex.EncodeToString(sum[:8])+".jsonl")
+}
+
+func (this *HistoryStore) expired(t time.Time) bool {
+	return this.retention > 0 && time.Since(t) > this.retention
+}
+
+// Read a session file, returning its header and blocks within retention
+func (this *HistoryStore) readSession(path string) (*SessionInfo, []StoredBlock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var info *SessionInfo
+	blocks := []StoredBlock{}
+	expired := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := storedLine{}
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			// skip lines that were partially written
+			continue
+		}
+		if line.Session != nil && info == nil {
+			info = line.Session
+		}
+		if line.Block == nil {
+			continue
+		}
+		if this.expired(line.Block.Time) {
+			expired++
+		} else {
+			blocks = append(blocks, *line.Block)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if info == nil {
+		// the file was created by an append after it was deleted
+		info = &SessionInfo{}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Path = path
+	info.Blocks = len(blocks)
+	info.expired = expired
+	info.Updated = stat.ModTime()
+	return info, blocks, nil
+}
+
+// Delete sessions that haven't been written to within the retention period
+func (this *HistoryStore) Prune() error {
+	if this.retention <= 0 {
+		return nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(this.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err == nil && this.expired(stat.ModTime()) {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// Stored sessions, most recently updated first
+func (this *HistoryStore) Sessions() ([]*SessionInfo, error) {
+	err := this.Prune()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(this.dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*SessionInfo{}
+	for _, path := range paths {
+		info, _, err := this.readSession(path)
+		if err != nil {
+			log.Printf("Skipping history session: %s", err)
+			continue
+		}
+		if info.Name == "" {
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions, nil
+}
+
+// Find a stored session by name, or by its 1-based position in Sessions()
+func (this *HistoryStore) Find(nameOrIndex string) (*SessionInfo, error) {
+	sessions, err := this.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	if index, err := strconv.Atoi(nameOrIndex); err == nil {
+		if index < 1 || index > len(sessions) {
+			return nil, nil
+		}
+		return sessions[index-1], nil
+	}
+
+	for _, session := range sessions {
+		if session.Name == nameOrIndex {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
+// Open a session to load and append history, creating it if it doesn't
+// exist. Expired blocks are dropped and long sessions are compacted.
+func (this *HistoryStore) Open(name string) (*HistorySession, error) {
+	err := this.Prune()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(this.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &HistorySession{
+		name: name,
+		path: this.sessionPath(name),
+	}
+
+	info, blocks, err := this.readSession(session.path)
+	if os.IsNotExist(err) {
+		info = &SessionInfo{Name: name, Created: time.Now()}
+		return session, session.rewrite(info, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rewrite := info.expired > 0
+	if info.Name == "" {
+		info.Name = name
+		info.Created = time.Now()
+		rewrite = true
+	}
+	if len(blocks) > maxStoredSessionBlocks {
+		blocks = blocks[len(blocks)-maxStoredSessionBlocks:]
+		rewrite = true
+	}
+
+	if rewrite {
+		err = session.rewrite(info, blocks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	session.blocks = blocks
+	return session, nil
+}
+
+// Delete a stored session
+func (this *HistoryStore) Wipe(name string) error {
+	err := os.Remove(this.sessionPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Delete every stored session
+func (this *HistoryStore) WipeAll() error {
+	paths, err := filepath.Glob(filepath.Join(this.dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An open stored session, see HistoryStore.Open
+type HistorySession struct {
+	name   string
+	path   string
+	blocks []StoredBlock
+	mutex  sync.Mutex
+}
+
+func (this *HistorySession) Name() string {
+	return this.name
+}
+
+// The blocks stored when the session was opened, oldest first
+func (this *HistorySession) Blocks() []StoredBlock {
+	return this.blocks
+}
+
+// Rewrite the session file with just these blocks
+func (this *HistorySession) rewrite(info *SessionInfo, blocks []StoredBlock) error {
+	builder := strings.Builder{}
+	for i := -1; i < len(blocks); i++ {
+		line := storedLine{Session: info}
+		if i >= 0 {
+			line = storedLine{Block: &blocks[i]}
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		builder.Write(data)
+		builder.WriteString("\n")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(this.path), ".session-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(builder.String())
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (this *HistorySession) Append(block StoredBlock) error {
+	data, err := json.Marshal(storedLine{Block: &block})
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// The most recent blocks that fit in maxTokens, each truncated to
+// maxBlockTokens, oldest first
+func recentStoredBlocks(
+	blocks []StoredBlock,
+	tokenizer Tokenizer,
+	maxBlockTokens int,
+	maxTokens int,
+) []StoredBlock {
+	selected := []StoredBlock{}
+	usedTokens := 0
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+		numTokens, content, _ := tokenizer.Truncate(block.Content, maxBlockTokens)
+		numTokens += tokenizer.Count(block.FunctionName) + tokenizer.Count(block.FunctionParams)
+		if usedTokens+numTokens > maxTokens {
+			break
+		}
+		usedTokens += numTokens
+		block.Content = content
+		selected = append([]StoredBlock{block}, selected...)
+	}
+
+	return selected
+}
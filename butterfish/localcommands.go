@@ -0,0 +1,589 @@
+package butterfish
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// LocalCommand is a command typed at the shell prompt that Butterfish
+// handles itself rather than sending to the LLM, e.g. "Status". Commands
+// are matched on the first word of the prompt, ignoring case.
+type LocalCommand struct {
+	Name string
+	// arguments for the help text, e.g. "[n]"
+	Args string
+	Help string
+	// Run the command with the rest of the prompt after the name. Returns
+	// false if the arguments don't fit the command, in which case the prompt
+	// is sent to the LLM as usual, e.g. "Clear up this error for me".
+	Run func(state *ShellState, args string) bool
+	// Completions for a partially typed argument, used for autosuggest.
+	// Optional.
+	Complete func(state *ShellState, arg string) []string
+}
+
+// Wraps a command that takes no arguments, if there are any the prompt goes
+// to the LLM
+func noArgs(run func(state *ShellState)) func(*ShellState, string) bool {
+	return func(state *ShellState, args string) bool {
+		if args != "" {
+			return false
+		}
+		run(state)
+		return true
+	}
+}
+
+// Wraps a command that takes at most one word as an argument
+func oneArg(run func(state *ShellState, arg string) bool) func(*ShellState, string) bool {
+	return func(state *ShellState, args string) bool {
+		if strings.ContainsAny(args, " \t") {
+			return false
+		}
+		return run(state, args)
+	}
+}
+
+// The local commands in shell mode, in the order they're listed in help
+func DefaultLocalCommands() []*LocalCommand {
+	return []*LocalCommand{
+		{
+			Name: "help",
+			Help: "Show how to use shell mode and these commands",
+			Run:  noArgs((*ShellState).PrintHelp),
+		},
+		{
+			Name: "status",
+			Help: "Show the current Butterfish configuration",
+			Run:  noArgs((*ShellState).PrintStatus),
+		},
+		{
+			Name: "history",
+			Help: "Show the history that will be sent to the LLM and any secrets masked in it",
+			Run:  noArgs((*ShellState).PrintHistory),
+		},
+		{
+			Name: "tokens",
+			Help: "Show how the prompt window is used by history, pinned files, and the system message",
+			Run:  noArgs((*ShellState).PrintTokens),
+		},
+		{
+			Name: "clear",
+			Help: "Clear the history sent to the LLM, saved sessions aren't changed",
+			Run:  noArgs((*ShellState).ClearCommand),
+		},
+		{
+			Name: "drop",
+			Args: "[n]",
+			Help: "Drop the last n blocks of history, default 1",
+			Run:  oneArg((*ShellState).DropCommand),
+		},
+		{
+			Name:     "model",
+			Args:     "[name]",
+			Help:     "Show or switch the prompting model",
+			Run:      oneArg((*ShellState).ModelCommand),
+			Complete: completeModel,
+		},
+		{
+			Name:     "autosuggest",
+			Args:     "[on|off]",
+			Help:     "Turn autosuggest on or off, or toggle it",
+			Run:      oneArg((*ShellState).AutosuggestCommand),
+			Complete: completeWords("on", "off"),
+		},
+		{
+			Name:     "pin",
+			Args:     "[file]",
+			Help:     "Add a file to every prompt, or list pinned files",
+			Run:      oneArg((*ShellState).PinCommand),
+			Complete: completePath,
+		},
+		{
+			Name:     "unpin",
+			Args:     "[file|all]",
+			Help:     "Stop adding a file to prompts, by default the last one pinned",
+			Run:      oneArg((*ShellState).UnpinCommand),
+			Complete: completePinned,
+		},
+		{
+			Name:     "export",
+			Args:     "[file.md]",
+			Help:     "Export the history of this shell to a markdown file",
+			Run:      oneArg((*ShellState).ExportCommand),
+			Complete: completePath,
+		},
+		{
+			Name: "sessions",
+			Help: "List saved history sessions",
+			Run:  noArgs((*ShellState).PrintSessions),
+		},
+		{
+			Name:     "resume",
+			Args:     "<session>",
+			Help:     "Load a saved session's history and continue it",
+			Run:      (*ShellState).ResumeCommand,
+			Complete: completeSession,
+		},
+		{
+			Name:     "wipe",
+			Args:     "[session|all]",
+			Help:     "Delete saved history, by default this session's",
+			Run:      (*ShellState).WipeCommand,
+			Complete: completeSession,
+		},
+		{
+			Name: "recall",
+			Args: "<query>",
+			Help: "Search older history by meaning",
+			Run: func(state *ShellState, args string) bool {
+				if args == "" {
+					return false
+				}
+				state.PrintRecall(args)
+				return true
+			},
+		},
+	}
+}
+
+// How the command is typed, for help text, e.g. "Drop [n]"
+func (this *LocalCommand) Usage() string {
+	usage := strings.ToUpper(this.Name[:1]) + this.Name[1:]
+	if this.Args != "" {
+		usage += " " + this.Args
+	}
+	return usage
+}
+
+func (this *ShellState) localCommands() []*LocalCommand {
+	if this.LocalCommands == nil {
+		this.LocalCommands = DefaultLocalCommands()
+	}
+	return this.LocalCommands
+}
+
+func (this *ShellState) findLocalCommand(name string) *LocalCommand {
+	name = strings.ToLower(name)
+	for _, command := range this.localCommands() {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// Run the prompt as a local command if it is one, returns false if it
+// should be sent to the LLM
+func (this *ShellState) HandleLocalPrompt() bool {
+	promptStr := strings.TrimSpace(this.Prompt.String())
+	name, args, _ := strings.Cut(promptStr, " ")
+
+	command := this.findLocalCommand(name)
+	if command == nil {
+		return false
+	}
+	return command.Run(this, strings.TrimSpace(args))
+}
+
+// Complete a partially typed local command for autosuggest. Returns the
+// full text of the prompt with the completion, or "" if we have nothing to
+// suggest.
+func (this *ShellState) completeLocalCommand(text string) string {
+	if strings.HasPrefix(text, promptOverridePrefix) {
+		return completePromptOverride(this.Butterfish.Models, text)
+	}
+
+	name, arg, hasArg := strings.Cut(text, " ")
+	if name == "" {
+		return ""
+	}
+
+	if !hasArg {
+		lowerName := strings.ToLower(name)
+		for _, command := range this.localCommands() {
+			if strings.HasPrefix(command.Name, lowerName) && command.Name != lowerName {
+				return text + command.Name[len(name):]
+			}
+		}
+		return ""
+	}
+
+	command := this.findLocalCommand(name)
+	if command == nil || command.Complete == nil || strings.ContainsAny(arg, " \t") {
+		return ""
+	}
+	for _, candidate := range command.Complete(this, arg) {
+		if strings.HasPrefix(candidate, arg) && candidate != arg {
+			return text + candidate[len(arg):]
+		}
+	}
+	return ""
+}
+
+func completeWords(words ...string) func(*ShellState, string) []string {
+	return func(state *ShellState, arg string) []string {
+		return words
+	}
+}
+
+func completeModel(state *ShellState, arg string) []string {
+	return state.Butterfish.Models.Names()
+}
+
+// Files and directories starting with arg, relative to the shell's working
+// directory
+func completePath(state *ShellState, arg string) []string {
+	if arg == "" {
+		return nil
+	}
+	path, err := homedir.Expand(arg)
+	if err != nil {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(state.childWorkingDir(), path)
+		// Join drops a trailing slash, which we need to list a directory
+		if strings.HasSuffix(arg, "/") {
+			path += "/"
+		}
+	}
+
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		return nil
+	}
+	completions := []string{}
+	for _, match := range matches {
+		// keep what the user typed and add the rest of the match
+		completion := arg + match[len(path):]
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			completion += "/"
+		}
+		completions = append(completions, completion)
+	}
+	return completions
+}
+
+func completePinned(state *ShellState, arg string) []string {
+	return append(append([]string{}, state.PinnedFiles...), "all")
+}
+
+func completeSession(state *ShellState, arg string) []string {
+	if state.HistoryStore == nil {
+		return nil
+	}
+	sessions, err := state.HistoryStore.Sessions()
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, session := range sessions {
+		names = append(names, session.Name)
+	}
+	return names
+}
+
+// Print output of a local command, it isn't added to history
+func (this *ShellState) printLocalOutput(text string) {
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+func (this *ShellState) ClearCommand() {
+	numBlocks := this.History.DropLast(math.MaxInt)
+	this.printLocalOutput(fmt.Sprintf("Cleared %d blocks of history\n", numBlocks))
+}
+
+func (this *ShellState) DropCommand(arg string) bool {
+	n := 1
+	if arg != "" {
+		var err error
+		n, err = strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return false
+		}
+	}
+
+	numBlocks := this.History.DropLast(n)
+	this.printLocalOutput(fmt.Sprintf("Dropped %d blocks of history\n", numBlocks))
+	return true
+}
+
+// Switch the model used for prompts and recalculate the token limits that
+// depend on it
+func (this *ShellState) SetPromptModel(model string) {
+	this.Butterfish.Config.ShellPromptModel = model
+	this.PromptMaxTokens = this.Butterfish.ContextLengthForModel(this.Butterfish.LLMClient, model)
+	this.PromptTokenizer = nil
+}
+
+func (this *ShellState) ModelCommand(arg string) bool {
+	if arg != "" {
+		// a prompt like "Model checking" isn't a model, send it to the LLM
+		if !this.Butterfish.IsKnownModel(this.Butterfish.LLMClient, arg) {
+			return false
+		}
+		this.SetPromptModel(arg)
+	}
+	this.printLocalOutput(fmt.Sprintf("Prompting model is %s, with a %d token history window\n",
+		this.Butterfish.Config.ShellPromptModel, this.PromptMaxTokens))
+	return true
+}
+
+func (this *ShellState) AutosuggestCommand(arg string) bool {
+	switch strings.ToLower(arg) {
+	case "":
+		this.AutosuggestEnabled = !this.AutosuggestEnabled
+	case "on":
+		this.AutosuggestEnabled = true
+	case "off":
+		this.AutosuggestEnabled = false
+	default:
+		return false
+	}
+
+	this.Butterfish.Config.ShellAutosuggestEnabled = this.AutosuggestEnabled
+	if !this.AutosuggestEnabled && this.AutosuggestCancel != nil {
+		this.AutosuggestCancel()
+	}
+
+	state := "off"
+	if this.AutosuggestEnabled {
+		state = "on"
+	}
+	this.printLocalOutput(fmt.Sprintf("Autosuggest is %s\n", state))
+	return true
+}
+
+// Resolve a path typed at the prompt against the shell's working directory
+func (this *ShellState) localPath(name string) (string, error) {
+	path, err := homedir.Expand(name)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(this.childWorkingDir(), path)
+	}
+	return filepath.Clean(path), nil
+}
+
+func (this *ShellState) PinCommand(arg string) bool {
+	if arg == "" {
+		text := "No pinned files, use \"Pin <file>\" to add a file to every prompt\n"
+		if len(this.PinnedFiles) > 0 {
+			text = "Pinned files:\n  " + strings.Join(this.PinnedFiles, "\n  ") + "\n"
+		}
+		this.printLocalOutput(text)
+		return true
+	}
+
+	path, err := this.localPath(arg)
+	if err != nil {
+		return false
+	}
+	// a prompt like "Pin this down" isn't a file, send it to the LLM
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	// check it can be attached now rather than on the next prompt
+	if _, err := LoadAttachment(path); err != nil {
+		this.PrintError(err)
+		return true
+	}
+
+	for _, pinned := range this.PinnedFiles {
+		if pinned == path {
+			this.printLocalOutput(fmt.Sprintf("%s is already pinned\n", path))
+			return true
+		}
+	}
+	this.PinnedFiles = append(this.PinnedFiles, path)
+	this.printLocalOutput(fmt.Sprintf("Pinned %s, it will be added to every prompt\n", path))
+	return true
+}
+
+func (this *ShellState) UnpinCommand(arg string) bool {
+	if len(this.PinnedFiles) == 0 {
+		if arg == "" || strings.ToLower(arg) == "all" {
+			this.printLocalOutput("No pinned files\n")
+			return true
+		}
+		return false
+	}
+
+	var unpinned []string
+	switch {
+	case arg == "":
+		unpinned = this.PinnedFiles[len(this.PinnedFiles)-1:]
+		this.PinnedFiles = this.PinnedFiles[:len(this.PinnedFiles)-1]
+	case strings.ToLower(arg) == "all":
+		unpinned = this.PinnedFiles
+		this.PinnedFiles = nil
+	default:
+		path, err := this.localPath(arg)
+		if err != nil {
+			return false
+		}
+		remaining := []string{}
+		for _, pinned := range this.PinnedFiles {
+			if pinned == path || pinned == arg {
+				unpinned = append(unpinned, pinned)
+			} else {
+				remaining = append(remaining, pinned)
+			}
+		}
+		if len(unpinned) == 0 {
+			return false
+		}
+		this.PinnedFiles = remaining
+	}
+
+	this.printLocalOutput(fmt.Sprintf("Unpinned %s\n", strings.Join(unpinned, ", ")))
+	return true
+}
+
+// Load the pinned files to attach to a prompt, a file that can't be read
+// any more is skipped
+func (this *ShellState) pinnedAttachments() []util.Attachment {
+	attachments := []util.Attachment{}
+	for _, path := range this.PinnedFiles {
+		attachment, err := LoadAttachment(path)
+		if err != nil {
+			this.PrintError(err)
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments
+}
+
+func (this *ShellState) ExportCommand(arg string) bool {
+	name := arg
+	if name == "" {
+		name = fmt.Sprintf("butterfish-%s.md", time.Now().Format("20060102-150405"))
+	} else if ext := strings.ToLower(filepath.Ext(name)); ext != ".md" && ext != ".markdown" {
+		// a prompt like "Export PATH" isn't asking for a file
+		return false
+	}
+
+	path, err := this.localPath(name)
+	if err != nil {
+		this.PrintError(err)
+		return true
+	}
+
+	markdown := historyToMarkdown(this.History, time.Now())
+	err = os.WriteFile(path, []byte(markdown), 0600)
+	if err != nil {
+		this.PrintError(err)
+		return true
+	}
+	this.printLocalOutput(fmt.Sprintf("Exported history to %s\n", path))
+	return true
+}
+
+// Render shell history as a markdown document, commands and output are in
+// code blocks and LLM answers are left as they are
+func historyToMarkdown(history *ShellHistory, exported time.Time) string {
+	blocks := []*HistoryBuffer{}
+	history.IterateBlocks(func(block *HistoryBuffer) bool {
+		blocks = append([]*HistoryBuffer{block}, blocks...)
+		return true
+	})
+
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("# Butterfish shell history, %s\n", exported.Format("2006-01-02 15:04")))
+
+	fence := func(lang, content string) {
+		content = strings.TrimRight(content, "\n")
+		marker := "```"
+		for strings.Contains(content, marker) {
+			marker += "`"
+		}
+		builder.WriteString(fmt.Sprintf("\n%s%s\n%s\n%s\n", marker, lang, content, marker))
+	}
+
+	for _, block := range blocks {
+		content := sanitizeTTYString(block.String())
+		if strings.TrimSpace(content) == "" && block.FunctionName == "" {
+			continue
+		}
+
+		switch {
+		case block.Type == historyTypeShellInput:
+			builder.WriteString("\n## Command\n")
+			fence("shell", content)
+		case block.Type == historyTypeShellOutput:
+			builder.WriteString("\n## Output\n")
+			fence("", content)
+		case block.Type == historyTypePrompt:
+			builder.WriteString("\n## Prompt\n\n")
+			builder.WriteString(strings.TrimSpace(content) + "\n")
+		case block.FunctionName != "" && block.Type == historyTypeLLMOutput:
+			builder.WriteString(fmt.Sprintf("\n## Function call: %s\n", block.FunctionName))
+			if strings.TrimSpace(content) != "" {
+				builder.WriteString("\n" + strings.TrimSpace(content) + "\n")
+			}
+			fence("json", block.FunctionParams)
+		case block.FunctionName != "":
+			builder.WriteString(fmt.Sprintf("\n## Function output: %s\n", block.FunctionName))
+			fence("", content)
+		default:
+			builder.WriteString("\n## Answer\n\n")
+			builder.WriteString(strings.TrimSpace(content) + "\n")
+		}
+	}
+
+	return builder.String()
+}
+
+// Show how the prompt window is used, the same budgeting as AssembleChat
+func (this *ShellState) PrintTokens() {
+	tokenizer := this.getPromptTokenizer()
+	total := this.PromptMaxTokens
+	reserved := this.Butterfish.Config.ShellMaxResponseTokens
+
+	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
+		prompt.ShellSystemMessage, "sysinfo", GetSystemInfo())
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+	sysTokens := tokenizer.Count(sysMsg)
+	pinnedTokens := attachmentTokens(this.pinnedAttachments(), tokenizer)
+
+	available := total - reserved - sysTokens - pinnedTokens
+	historyBlocks, historyTokens := 0, 0
+	if available > 0 {
+		var blocks []util.HistoryBlock
+		blocks, historyTokens = getHistoryBlocksByTokens(this.History, tokenizer,
+			this.Butterfish.Config.ShellMaxHistoryBlockTokens, available,
+			this.Butterfish.Models.TokensPerMessage(this.Butterfish.Config.ShellPromptModel))
+		historyBlocks = len(blocks)
+	}
+
+	numBlocks := 0
+	this.History.IterateBlocks(func(block *HistoryBuffer) bool {
+		numBlocks++
+		return true
+	})
+
+	text := fmt.Sprintf("Model:            %s (%s tokenizer)\n", this.Butterfish.Config.ShellPromptModel, tokenizer.Name())
+	text += fmt.Sprintf("Prompt window:    %d tokens\n", total)
+	text += fmt.Sprintf("Answer reserve:   %d tokens\n", reserved)
+	text += fmt.Sprintf("System message:   %d tokens\n", sysTokens)
+	text += fmt.Sprintf("Pinned files:     %d tokens (%d files)\n", pinnedTokens, len(this.PinnedFiles))
+	text += fmt.Sprintf("History sent:     %d tokens (%d of %d blocks)\n", historyTokens, historyBlocks, numBlocks)
+	text += fmt.Sprintf("Free for prompt:  %d tokens\n", max(0, available-historyTokens))
+	this.printLocalOutput(text)
+}
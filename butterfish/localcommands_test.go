@@ -0,0 +1,187 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestShellState() (*ShellState, *bytes.Buffer) {
+	config := MakeButterfishConfig()
+	config.ShellPromptModel = "gpt-4"
+	out := &bytes.Buffer{}
+	state := &ShellState{
+		Butterfish: &ButterfishCtx{
+			Config:        config,
+			PromptLibrary: &prompt.DiskPromptLibrary{Prompts: prompt.DefaultPrompts},
+			Models:        DefaultModelCatalog(),
+		},
+		PromptAnswerWriter: out,
+		PromptOutputChan:   make(chan *util.CompletionResponse, 16),
+		PrintErrorChan:     make(chan error, 16),
+		History:            NewShellHistory(),
+		Prompt:             NewShellBuffer(),
+		Color:              DarkShellColorScheme,
+		PromptMaxTokens:    DefaultModelCatalog().NumTokens("gpt-4"),
+		AutosuggestEnabled: true,
+		PromptTokenizer:    NewHeuristicTokenizer(),
+	}
+	return state, out
+}
+
+// Type a prompt and run it as a local command
+func runLocalPrompt(state *ShellState, text string) bool {
+	state.Prompt = NewShellBuffer()
+	state.Prompt.Write(text)
+	return state.HandleLocalPrompt()
+}
+
+func TestLocalCommandMatching(t *testing.T) {
+	state, out := newTestShellState()
+
+	assert.True(t, runLocalPrompt(state, "Status"))
+	assert.Contains(t, out.String(), "Prompting model:       gpt-4")
+
+	// prompts that start like a command but don't fit it go to the LLM
+	assert.False(t, runLocalPrompt(state, "Clear up this error for me"))
+	assert.False(t, runLocalPrompt(state, "Drop the table"))
+	assert.False(t, runLocalPrompt(state, "Model this as a state machine"))
+	assert.False(t, runLocalPrompt(state, "Pin this down"))
+	assert.False(t, runLocalPrompt(state, "Export PATH"))
+	assert.False(t, runLocalPrompt(state, "What is this?"))
+
+	out.Reset()
+	assert.True(t, runLocalPrompt(state, "Help"))
+	assert.Contains(t, out.String(), "Drop [n]")
+	assert.Contains(t, out.String(), "Pin [file]")
+	assert.Equal(t, "Drop [n]", state.findLocalCommand("drop").Usage())
+	assert.Equal(t, "Status", state.findLocalCommand("status").Usage())
+}
+
+func TestLocalCommandHistory(t *testing.T) {
+	state, _ := newTestShellState()
+	state.History.Append(historyTypeShellInput, "ls")
+	state.History.Append(historyTypeShellOutput, "main.go\n")
+	state.History.Append(historyTypePrompt, "What's in main.go?")
+
+	assert.True(t, runLocalPrompt(state, "Drop"))
+	assert.Equal(t, 2, len(state.History.Blocks))
+	assert.True(t, runLocalPrompt(state, "Drop 5"))
+	assert.Equal(t, 0, len(state.History.Blocks))
+
+	state.History.Append(historyTypeShellInput, "ls")
+	assert.True(t, runLocalPrompt(state, "Clear"))
+	assert.Equal(t, 0, len(state.History.Blocks))
+	// new output starts a new block after a drop
+	state.History.Append(historyTypeShellInput, "pwd")
+	assert.Equal(t, 1, len(state.History.Blocks))
+}
+
+func TestLocalCommandSettings(t *testing.T) {
+	state, out := newTestShellState()
+
+	assert.True(t, runLocalPrompt(state, "Model gpt-3.5-turbo"))
+	assert.Equal(t, "gpt-3.5-turbo", state.Butterfish.Config.ShellPromptModel)
+	assert.Equal(t, state.Butterfish.Models.NumTokens("gpt-3.5-turbo"), state.PromptMaxTokens)
+	assert.Nil(t, state.PromptTokenizer)
+
+	// words that aren't models go to the LLM
+	assert.False(t, runLocalPrompt(state, "Model checking"))
+	assert.Equal(t, "gpt-3.5-turbo", state.Butterfish.Config.ShellPromptModel)
+
+	assert.True(t, runLocalPrompt(state, "Autosuggest"))
+	assert.False(t, state.AutosuggestEnabled)
+	assert.False(t, state.Butterfish.Config.ShellAutosuggestEnabled)
+	assert.True(t, runLocalPrompt(state, "Autosuggest on"))
+	assert.True(t, state.AutosuggestEnabled)
+	assert.False(t, runLocalPrompt(state, "Autosuggest everything"))
+
+	state.PromptTokenizer = NewHeuristicTokenizer()
+	out.Reset()
+	assert.True(t, runLocalPrompt(state, "Tokens"))
+	assert.Contains(t, out.String(), fmt.Sprintf("Prompt window:    %d tokens", state.PromptMaxTokens))
+	assert.Contains(t, out.String(), "(heuristic tokenizer)")
+}
+
+func TestLocalCommandModelOnServer(t *testing.T) {
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	state, _ := newTestShellState()
+	state.Butterfish.Ctx = context.Background()
+	state.Butterfish.LLMClient = NewOllama(server.URL, "")
+
+	// models the server lists can be picked even if the catalog doesn't know
+	// them
+	assert.True(t, runLocalPrompt(state, "Model llama3:8b"))
+	assert.Equal(t, "llama3:8b", state.Butterfish.Config.ShellPromptModel)
+	assert.Equal(t, OllamaMaxContextLength, state.PromptMaxTokens)
+	assert.False(t, runLocalPrompt(state, "Model mistral"))
+	assert.Equal(t, "llama3:8b", state.Butterfish.Config.ShellPromptModel)
+}
+
+func TestLocalCommandPin(t *testing.T) {
+	state, out := newTestShellState()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("remember the milk"), 0600))
+
+	assert.True(t, runLocalPrompt(state, "Pin "+path))
+	assert.Equal(t, []string{path}, state.PinnedFiles)
+	attachments := state.pinnedAttachments()
+	assert.Equal(t, 1, len(attachments))
+	assert.Equal(t, "remember the milk", string(attachments[0].Data))
+
+	out.Reset()
+	assert.True(t, runLocalPrompt(state, "Pin"))
+	assert.Contains(t, out.String(), path)
+
+	assert.False(t, runLocalPrompt(state, "Unpin "+filepath.Join(dir, "other.txt")))
+	assert.True(t, runLocalPrompt(state, "Unpin "+path))
+	assert.Equal(t, 0, len(state.PinnedFiles))
+}
+
+func TestLocalCommandCompletion(t *testing.T) {
+	state, _ := newTestShellState()
+
+	assert.Equal(t, "Status", state.completeLocalCommand("Sta"))
+	assert.Equal(t, "Autosuggest", state.completeLocalCommand("Auto"))
+	assert.Equal(t, "Autosuggest off", state.completeLocalCommand("Autosuggest of"))
+	assert.Equal(t, "", state.completeLocalCommand("Status"))
+	assert.Equal(t, "", state.completeLocalCommand("What"))
+	assert.Equal(t, "", state.completeLocalCommand("Model gpt-4 please"))
+	assert.True(t, strings.HasPrefix(state.completeLocalCommand("Model gpt-3"), "Model gpt-3"))
+
+	dir := t.TempDir()
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "src"), 0700))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "src", "main.go"), nil, 0600))
+	assert.Equal(t, "Pin "+dir+"/src/", state.completeLocalCommand("Pin "+dir+"/sr"))
+	assert.Equal(t, "Pin "+dir+"/src/main.go", state.completeLocalCommand("Pin "+dir+"/src/"))
+}
+
+func TestHistoryToMarkdown(t *testing.T) {
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "go test ./...")
+	history.Append(historyTypeShellOutput, "FAIL\n")
+	history.Append(historyTypePrompt, "Why did it fail?")
+	history.Append(historyTypeLLMOutput, "The test expects ```json``` output.")
+	history.AddFunctionCall("command", `{"cmd":"go test -v"}`)
+
+	exported := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	assert.Equal(t, "# Butterfish shell history, 2024-05-01 12:30\n"+
+		"\n## Command\n\n```shell\ngo test ./...\n```\n"+
+		"\n## Output\n\n```\nFAIL\n```\n"+
+		"\n## Prompt\n\nWhy did it fail?\n"+
+		"\n## Answer\n\nThe test expects ```json``` output.\n"+
+		"\n## Function call: command\n\n```json\n{\"cmd\":\"go test -v\"}\n```\n",
+		historyToMarkdown(history, exported))
+}
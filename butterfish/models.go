@@ -0,0 +1,287 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Ways a model is called
+const (
+	EndpointChat       = "chat"
+	EndpointCompletion = "completion"
+	EndpointEmbedding  = "embedding"
+)
+
+// Tokenizer for models we can't tokenize locally, which estimates tokens
+// from the text length
+const TokenizerHeuristic = "heuristic"
+
+// Tokenizer that estimates tokens from length but learns the real ratio
+// from token counts reported by the provider's API
+const TokenizerProvider = "provider"
+
+// Catalog entry used for models we don't know about
+const defaultModelName = "default"
+
+// What we know about a model
+type ModelSpec struct {
+	// context window size in tokens
+	ContextWindow int `yaml:"context_window"`
+	// most tokens the model will generate in one response, 0 if unknown
+	MaxOutput int `yaml:"max_output"`
+	// how we count tokens, a tiktoken encoding (cl100k_base, p50k_base,
+	// r50k_base), "heuristic" to estimate from length, or "provider" to
+	// estimate and calibrate against the counts the API reports
+	Tokenizer string `yaml:"tokenizer"`
+	// overhead tokens for each chat message, see
+	// https://github.com/pkoukk/tiktoken-go#counting-tokens-for-chat-api-calls
+	TokensPerMessage int `yaml:"tokens_per_message"`
+	// "chat", "completion" for the legacy completion API, or "embedding"
+	Endpoint string `yaml:"endpoint"`
+	// whether the model can call functions and tools
+	Tools bool `yaml:"tools"`
+	// nil if the model is free, e.g. a local model
+	Price *ModelPrice `yaml:"price,omitempty"`
+}
+
+// Price in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// Built-in model specs, fields are context window, max output, tokenizer,
+// tokens per message, endpoint, tools, price.
+// See https://platform.openai.com/docs/models/overview,
+// https://openai.com/api/pricing and https://www.anthropic.com/pricing
+var defaultModelSpecs = map[string]*ModelSpec{
+	defaultModelName:              {2048, 0, TokenizerHeuristic, 5, EndpointChat, false, nil},
+	"gpt-4o":                      {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{5, 15}},
+	"gpt-4o-mini":                 {128000, 16384, "cl100k_base", 3, EndpointChat, true, &ModelPrice{0.15, 0.6}},
+	"gpt-4":                       {8192, 8192, "cl100k_base", 3, EndpointChat, true, &ModelPrice{30, 60}},
+	"gpt-4-1106":                  {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{10, 30}},
+	"gpt-4-0125-preview":          {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{10, 30}},
+	"gpt-4-vision":                {128000, 4096, "cl100k_base", 3, EndpointChat, false, &ModelPrice{10, 30}},
+	"gpt-4-0314":                  {8192, 8192, "cl100k_base", 3, EndpointChat, false, &ModelPrice{30, 60}},
+	"gpt-4-0613":                  {8192, 8192, "cl100k_base", 3, EndpointChat, true, &ModelPrice{30, 60}},
+	"gpt-4-32k":                   {32768, 8192, "cl100k_base", 3, EndpointChat, true, &ModelPrice{60, 120}},
+	"gpt-4-32k-0314":              {32768, 8192, "cl100k_base", 3, EndpointChat, false, &ModelPrice{60, 120}},
+	"gpt-4-32k-0613":              {32768, 8192, "cl100k_base", 3, EndpointChat, true, &ModelPrice{60, 120}},
+	"gpt-4-turbo":                 {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{10, 30}},
+	"gpt-4-turbo-preview":         {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{10, 30}},
+	"gpt-4-turbo-2024-04-09":      {128000, 4096, "cl100k_base", 3, EndpointChat, true, &ModelPrice{10, 30}},
+	"gpt-3.5-turbo":               {16384, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{0.5, 1.5}},
+	"gpt-3.5-turbo-0301":          {4096, 4096, "cl100k_base", 4, EndpointChat, false, &ModelPrice{1.5, 2}},
+	"gpt-3.5-turbo-0613":          {4096, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{1.5, 2}},
+	"gpt-3.5-turbo-1106":          {16384, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{1, 2}},
+	"gpt-3.5-turbo-0125":          {16384, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{0.5, 1.5}},
+	"gpt-3.5-turbo-16k":           {16384, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{3, 4}},
+	"gpt-3.5-turbo-16k-0613":      {16384, 4096, "cl100k_base", 4, EndpointChat, true, &ModelPrice{3, 4}},
+	"gpt-3.5-turbo-instruct":      {4096, 4096, "cl100k_base", 4, EndpointCompletion, false, &ModelPrice{1.5, 2}},
+	"gpt-3.5-turbo-instruct-0913": {4096, 4096, "cl100k_base", 4, EndpointCompletion, false, &ModelPrice{1.5, 2}},
+	"text-davinci-003":            {2047, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"text-davinci-002":            {2047, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"text-davinci-001":            {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"code-davinci-002":            {8001, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"code-davinci-001":            {8001, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"code-cushman-002":            {2048, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"code-cushman-001":            {2048, 0, "p50k_base", 0, EndpointCompletion, false, nil},
+	"text-curie-001":              {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"text-babbage-001":            {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"text-ada-001":                {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"davinci":                     {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"curie":                       {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"babbage":                     {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"ada":                         {2049, 0, "r50k_base", 0, EndpointCompletion, false, nil},
+	"text-embedding-ada-002":      {8191, 0, "cl100k_base", 0, EndpointEmbedding, false, &ModelPrice{0.1, 0}},
+	"text-embedding-3-small":      {8191, 0, "cl100k_base", 0, EndpointEmbedding, false, &ModelPrice{0.02, 0}},
+	"text-embedding-3-large":      {8191, 0, "cl100k_base", 0, EndpointEmbedding, false, &ModelPrice{0.13, 0}},
+	"claude-3-opus":               {200000, 4096, TokenizerProvider, 5, EndpointChat, true, &ModelPrice{15, 75}},
+	"claude-3-sonnet":             {200000, 4096, TokenizerProvider, 5, EndpointChat, true, &ModelPrice{3, 15}},
+	"claude-3-5-sonnet":           {200000, 8192, TokenizerProvider, 5, EndpointChat, true, &ModelPrice{3, 15}},
+	"claude-3-haiku":              {200000, 4096, TokenizerProvider, 5, EndpointChat, true, &ModelPrice{0.25, 1.25}},
+}
+
+// Model used by gencmd, exec and summarize unless the catalog says otherwise
+const BestCompletionModel = "gpt-3.5-turbo"
+
+// A ModelCatalog describes the models we know about. The defaults are
+// compiled in and can be extended or overridden with a YAML file, so a new
+// model doesn't need a new release, e.g.
+//
+//	best_completion_model: gpt-4o-mini
+//	models:
+//	  llama3:
+//	    context_window: 8192
+//	    tokenizer: heuristic
+//	  gpt-4o:
+//	    price:
+//	      input: 2.5
+//	      output: 10
+//
+// An entry only needs the fields that differ. A new model starts from the
+// entry its name extends (gpt-4o-2024-08-06 starts from gpt-4o), or from
+// the "default" entry, which is also what unknown models get.
+type ModelCatalog struct {
+	BestCompletionModel string
+	specs               map[string]*ModelSpec
+
+	// one tokenizer per model, so a provider tokenizer keeps its calibration
+	// when we switch models and back
+	tokenizers     map[string]Tokenizer
+	tokenizerMutex sync.Mutex
+}
+
+func DefaultModelCatalog() *ModelCatalog {
+	specs := map[string]*ModelSpec{}
+	for name, spec := range defaultModelSpecs {
+		specs[name] = spec.copy()
+	}
+
+	return &ModelCatalog{
+		BestCompletionModel: BestCompletionModel,
+		specs:               specs,
+		tokenizers:          map[string]Tokenizer{},
+	}
+}
+
+func (this *ModelSpec) copy() *ModelSpec {
+	spec := *this
+	if this.Price != nil {
+		price := *this.Price
+		spec.Price = &price
+	}
+	return &spec
+}
+
+// Load the default catalog plus the YAML file at path, if it exists
+func LoadModelCatalog(path string) (*ModelCatalog, error) {
+	catalog := DefaultModelCatalog()
+	if path == "" {
+		return catalog, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := struct {
+		BestCompletionModel string                 `yaml:"best_completion_model"`
+		Models              map[string]interface{} `yaml:"models"`
+	}{}
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing model catalog %s: %s", path, err)
+	}
+
+	if file.BestCompletionModel != "" {
+		catalog.BestCompletionModel = file.BestCompletionModel
+	}
+
+	for name, fields := range file.Models {
+		// decode the entry's fields over a copy of the spec it extends
+		base, _ := catalog.Lookup(name)
+		spec := base.copy()
+
+		entry, err := yaml.Marshal(fields)
+		if err == nil {
+			err = yaml.UnmarshalStrict(entry, spec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing model %s in catalog %s: %s", name, path, err)
+		}
+		catalog.specs[name] = spec
+	}
+
+	return catalog, nil
+}
+
+// Find the spec for a model, matching on the longest known prefix of its
+// dash-separated name, e.g. gpt-4-32k-0613 matches gpt-4-32k. Returns the
+// default spec and false if the model is unknown.
+func (this *ModelCatalog) Lookup(model string) (*ModelSpec, bool) {
+	foundModel, spec := findModelValue(model, this.specs)
+	if foundModel == "" || foundModel == defaultModelName {
+		return this.specs[defaultModelName], false
+	}
+	return spec, true
+}
+
+// Names of the models in the catalog, sorted
+func (this *ModelCatalog) Names() []string {
+	names := []string{}
+	for name := range this.specs {
+		if name != defaultModelName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Price of each model that isn't free, for the usage ledger
+func (this *ModelCatalog) Prices() map[string]ModelPrice {
+	prices := map[string]ModelPrice{}
+	for name, spec := range this.specs {
+		if spec.Price != nil {
+			prices[name] = *spec.Price
+		}
+	}
+	return prices
+}
+
+// Context window size for a model, falling back to the default entry for
+// unknown models
+func (this *ModelCatalog) NumTokens(model string) int {
+	foundModel, spec := findModelValue(model, this.specs)
+
+	// couldn't find model
+	if foundModel == "" || foundModel == defaultModelName {
+		spec = this.specs[defaultModelName]
+		log.Printf("WARNING: Unknown model %s, using default context window size of %d tokens, add it to the model catalog to fix this", model, spec.ContextWindow)
+		return spec.ContextWindow
+	}
+
+	// found simpler model
+	if foundModel != model {
+		log.Printf("WARNING: Unknown model %s, using model %s settings instead with context window size of %d tokens", model, foundModel, spec.ContextWindow)
+		return spec.ContextWindow
+	}
+
+	log.Printf("Found model %s context window size of %d tokens", model, spec.ContextWindow)
+
+	// normal
+	return spec.ContextWindow
+}
+
+func (this *ModelCatalog) TokensPerMessage(model string) int {
+	spec, _ := this.Lookup(model)
+	return spec.TokensPerMessage
+}
+
+// Whether the model uses the legacy completion API rather than the chat
+// API. Unknown models ending in -instruct are assumed to.
+func (this *ModelCatalog) IsCompletionModel(model string) bool {
+	spec, found := this.Lookup(model)
+	if !found {
+		return strings.HasSuffix(model, "-instruct")
+	}
+	return spec.Endpoint == EndpointCompletion
+}
+
+// Whether the model can call tools, unknown models are given the benefit of
+// the doubt
+func (this *ModelCatalog) SupportsTools(model string) bool {
+	spec, found := this.Lookup(model)
+	return !found || spec.Tools
+}
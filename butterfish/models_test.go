@@ -0,0 +1,89 @@
+package butterfish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelCatalogLookup(t *testing.T) {
+	catalog := DefaultModelCatalog()
+
+	spec, found := catalog.Lookup("gpt-4-32k-0613")
+	assert.True(t, found)
+	assert.Equal(t, 32768, spec.ContextWindow)
+
+	// dated names match their base model
+	spec, found = catalog.Lookup("claude-3-haiku-20240307")
+	assert.True(t, found)
+	assert.Equal(t, 200000, spec.ContextWindow)
+
+	spec, found = catalog.Lookup("llama3:8b")
+	assert.False(t, found)
+	assert.Equal(t, TokenizerHeuristic, spec.Tokenizer)
+}
+
+func TestLoadModelCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	os.WriteFile(path, []byte(`
+best_completion_model: gpt-4o-mini
+models:
+  default:
+    context_window: 8192
+  gpt-4o:
+    price:
+      input: 2.5
+  gpt-4o-2024-08-06:
+    max_output: 16384
+  llama3:
+    context_window: 8192
+    tools: true
+`), 0600)
+
+	catalog, err := LoadModelCatalog(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4o-mini", catalog.BestCompletionModel)
+
+	// only the given fields change
+	spec, _ := catalog.Lookup("gpt-4o")
+	assert.Equal(t, ModelPrice{2.5, 15}, *spec.Price)
+	assert.Equal(t, 128000, spec.ContextWindow)
+	assert.Equal(t, ModelPrice{5, 15}, *DefaultModelCatalog().specs["gpt-4o"].Price)
+
+	// a new model starts from the model it extends
+	spec, found := catalog.Lookup("gpt-4o-2024-08-06")
+	assert.True(t, found)
+	assert.Equal(t, 16384, spec.MaxOutput)
+	assert.Equal(t, EndpointChat, spec.Endpoint)
+
+	// or from the default entry
+	spec, found = catalog.Lookup("llama3")
+	assert.True(t, found)
+	assert.Equal(t, 8192, spec.ContextWindow)
+	assert.Equal(t, TokenizerHeuristic, spec.Tokenizer)
+	assert.Nil(t, spec.Price)
+
+	spec, _ = catalog.Lookup("mistral")
+	assert.Equal(t, 8192, spec.ContextWindow)
+
+	// typos are errors rather than silently ignored
+	os.WriteFile(path, []byte("models:\n  llama3:\n    context: 8192\n"), 0600)
+	_, err = LoadModelCatalog(path)
+	assert.ErrorContains(t, err, "llama3")
+
+	// a missing file just means defaults
+	catalog, err = LoadModelCatalog(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, BestCompletionModel, catalog.BestCompletionModel)
+}
+
+func TestIsCompletionModel(t *testing.T) {
+	catalog := DefaultModelCatalog()
+	assert.True(t, catalog.IsCompletionModel("gpt-3.5-turbo-instruct"))
+	assert.True(t, catalog.IsCompletionModel("text-davinci-003"))
+	assert.True(t, catalog.IsCompletionModel("some-local-model-instruct"))
+	assert.False(t, catalog.IsCompletionModel("gpt-4-turbo"))
+	assert.False(t, catalog.IsCompletionModel("llama3:8b"))
+}
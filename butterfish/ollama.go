@@ -0,0 +1,625 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const OllamaDefaultBaseURL = "http://localhost:11434"
+const OllamaDefaultEmbeddingModel = "nomic-embed-text"
+
+// Local models often advertise huge context windows, but allocating the
+// whole window is slow and memory hungry on a laptop, so we cap what we ask
+// the server for.
+const OllamaMaxContextLength = 32768
+
+// Ollama implements the LLM interface against a local Ollama server using
+// its native API (https://github.com/ollama/ollama/blob/main/docs/api.md).
+// Unlike the OpenAI-compatible endpoints, the native API lets us discover
+// which models are installed and how large their context windows are.
+// If the server turns out to be a llama.cpp server we fall back to its
+// /props endpoint for the context length.
+type Ollama struct {
+	baseURL        string
+	embeddingModel string
+	client         *http.Client
+
+	// cache of model name to context length, populated lazily
+	contextLengths map[string]int
+	mutex          sync.Mutex
+}
+
+func NewOllama(baseUrl, embeddingModel string) *Ollama {
+	if baseUrl == "" {
+		baseUrl = OllamaDefaultBaseURL
+	}
+	if embeddingModel == "" {
+		embeddingModel = OllamaDefaultEmbeddingModel
+	}
+
+	return &Ollama{
+		baseURL:        strings.TrimSuffix(baseUrl, "/"),
+		embeddingModel: embeddingModel,
+		client:         &http.Client{},
+		contextLengths: make(map[string]int),
+	}
+}
+
+// Wire types for the Ollama API
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	// base64 encoded images for multimodal models
+	Images []string `json:"images,omitempty"`
+}
+
+type ollamaOptions struct {
+	Temperature float32 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"`
+	NumCtx      int     `json:"num_ctx,omitempty"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Tools    []any           `json:"tools,omitempty"`
+	// a JSON schema for structured output, or "json" for JSON mode
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options ollamaOptions   `json:"options"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		Name    string `json:"name"`
+		Size    int64  `json:"size"`
+		Details struct {
+			Family            string `json:"family"`
+			ParameterSize     string `json:"parameter_size"`
+			QuantizationLevel string `json:"quantization_level"`
+		} `json:"details"`
+	} `json:"models"`
+}
+
+type ollamaShowResponse struct {
+	Parameters string         `json:"parameters"`
+	ModelInfo  map[string]any `json:"model_info"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+func (this *Ollama) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, this.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not reach local model server at %s, is it running? %w", this.baseURL, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &errResp) == nil && errResp.Error != "" {
+			return nil, &StatusError{
+				Service:    "Local model server",
+				StatusCode: resp.StatusCode,
+				Message:    errResp.Error,
+			}
+		}
+		return nil, &StatusError{
+			Service:    "Local model server",
+			StatusCode: resp.StatusCode,
+			Message:    string(respBody),
+		}
+	}
+
+	return resp, nil
+}
+
+// List the models installed on the server
+func (this *Ollama) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	resp, err := this.do(ctx, http.MethodGet, "/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tags ollamaTagsResponse
+	err = json.NewDecoder(resp.Body).Decode(&tags)
+	if err != nil {
+		return nil, err
+	}
+
+	models := []ModelInfo{}
+	for _, model := range tags.Models {
+		contextLength, err := this.ContextLength(ctx, model.Name)
+		if err != nil {
+			log.Printf("Could not get context length for %s: %s", model.Name, err)
+		}
+
+		details := strings.TrimSpace(strings.Join([]string{
+			model.Details.Family,
+			model.Details.ParameterSize,
+			model.Details.QuantizationLevel}, " "))
+
+		models = append(models, ModelInfo{
+			Name:          model.Name,
+			ContextLength: contextLength,
+			Details:       details,
+		})
+	}
+
+	return models, nil
+}
+
+// Parse the context length out of an /api/show response. The model_info map
+// has architecture-prefixed keys, e.g. llama.context_length, and a num_ctx
+// parameter in the modelfile overrides it.
+func parseOllamaContextLength(show *ollamaShowResponse) int {
+	for _, line := range strings.Split(show.Parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			var numCtx int
+			if _, err := fmt.Sscanf(fields[1], "%d", &numCtx); err == nil && numCtx > 0 {
+				return numCtx
+			}
+		}
+	}
+
+	for key, value := range show.ModelInfo {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if number, ok := value.(float64); ok && number > 0 {
+			return int(number)
+		}
+	}
+
+	return 0
+}
+
+// Find the context length for a model, capped at OllamaMaxContextLength.
+func (this *Ollama) ContextLength(ctx context.Context, model string) (int, error) {
+	this.mutex.Lock()
+	cached, ok := this.contextLengths[model]
+	this.mutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	contextLength, err := this.fetchContextLength(ctx, model)
+	if err != nil {
+		return 0, err
+	}
+	if contextLength > OllamaMaxContextLength {
+		contextLength = OllamaMaxContextLength
+	}
+
+	this.mutex.Lock()
+	this.contextLengths[model] = contextLength
+	this.mutex.Unlock()
+
+	return contextLength, nil
+}
+
+func (this *Ollama) fetchContextLength(ctx context.Context, model string) (int, error) {
+	resp, err := this.do(ctx, http.MethodPost, "/api/show", map[string]string{"model": model})
+	if err == nil {
+		defer resp.Body.Close()
+		var show ollamaShowResponse
+		err = json.NewDecoder(resp.Body).Decode(&show)
+		if err != nil {
+			return 0, err
+		}
+
+		contextLength := parseOllamaContextLength(&show)
+		if contextLength == 0 {
+			return 0, fmt.Errorf("Model %s does not report a context length", model)
+		}
+		return contextLength, nil
+	}
+
+	// llama.cpp's server serves a single model and reports its context
+	// size on /props
+	propsResp, propsErr := this.do(ctx, http.MethodGet, "/props", nil)
+	if propsErr != nil {
+		return 0, err
+	}
+	defer propsResp.Body.Close()
+
+	var props struct {
+		DefaultGenerationSettings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+	}
+	err = json.NewDecoder(propsResp.Body).Decode(&props)
+	if err != nil {
+		return 0, err
+	}
+	if props.DefaultGenerationSettings.NCtx == 0 {
+		return 0, fmt.Errorf("Server at %s does not report a context length", this.baseURL)
+	}
+	return props.DefaultGenerationSettings.NCtx, nil
+}
+
+func ShellHistoryBlocksToOllamaChat(systemMsg string, blocks []util.HistoryBlock) []ollamaMessage {
+	out := []ollamaMessage{}
+	if systemMsg != "" && systemMsg != "N/A" {
+		out = append(out, ollamaMessage{
+			Role:    "system",
+			Content: systemMsg,
+		})
+	}
+
+	for _, block := range blocks {
+		if block.Content == "" && block.FunctionName == "" && block.ToolCalls == nil {
+			// skip empty blocks
+			continue
+		}
+
+		role := ShellHistoryTypeToRole(block.Type)
+		msg := ollamaMessage{
+			Role:    role,
+			Content: block.Content,
+		}
+		if role == "user" && len(block.Attachments) > 0 {
+			msg = ollamaUserMessage(block.Content, block.Attachments)
+		}
+
+		switch role {
+		case "function":
+			// Ollama has no separate function role, results go back as tools
+			msg.Role = "tool"
+		case "assistant":
+			if block.FunctionName != "" {
+				call := ollamaToolCall{}
+				call.Function.Name = block.FunctionName
+				call.Function.Arguments = anthropicToolInput(block.FunctionParams)
+				msg.ToolCalls = append(msg.ToolCalls, call)
+			}
+			for _, toolCall := range block.ToolCalls {
+				call := ollamaToolCall{}
+				call.Function.Name = toolCall.Function.Name
+				call.Function.Arguments = anthropicToolInput(toolCall.Function.Parameters)
+				msg.ToolCalls = append(msg.ToolCalls, call)
+			}
+		}
+
+		out = append(out, msg)
+	}
+
+	return out
+}
+
+// A user message with text attachments inlined and images base64 encoded
+func ollamaUserMessage(prompt string, attachments []util.Attachment) ollamaMessage {
+	msg := ollamaMessage{
+		Role:    "user",
+		Content: util.PromptWithAttachments(prompt, attachments),
+	}
+	for _, image := range util.ImageAttachments(attachments) {
+		msg.Images = append(msg.Images, base64.StdEncoding.EncodeToString(image.Data))
+	}
+	return msg
+}
+
+func convertToOllamaTools(funcs []util.FunctionDefinition, tools []util.ToolDefinition) []any {
+	out := []any{}
+	for _, f := range funcs {
+		out = append(out, util.ToolDefinition{Type: "function", Function: f})
+	}
+	for _, t := range tools {
+		out = append(out, t)
+	}
+
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func (this *Ollama) buildRequest(request *util.CompletionRequest, stream bool) *ollamaChatRequest {
+	msgs := ShellHistoryBlocksToOllamaChat(request.SystemMessage, request.HistoryBlocks)
+	if request.Prompt != "" || len(request.Attachments) > 0 {
+		msgs = append(msgs, ollamaUserMessage(request.Prompt, request.Attachments))
+	}
+
+	// Ask for the full (capped) context window, otherwise the server uses
+	// a small default and silently truncates our history
+	numCtx, err := this.ContextLength(request.Ctx, request.Model)
+	if err != nil {
+		log.Printf("Could not get context length for %s: %s", request.Model, err)
+		numCtx = 0
+	}
+
+	return &ollamaChatRequest{
+		Model:    request.Model,
+		Messages: msgs,
+		Stream:   stream,
+		Tools:    convertToOllamaTools(request.Functions, request.Tools),
+		Format:   request.ResponseSchema,
+		Options: ollamaOptions{
+			Temperature: request.Temperature,
+			NumPredict:  request.MaxTokens,
+			NumCtx:      numCtx,
+		},
+	}
+}
+
+func LogOllamaRequest(req *ollamaChatRequest) {
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nnum_predict: %d\nnum_ctx:     %d",
+		req.Model, req.Options.Temperature, req.Options.NumPredict, req.Options.NumCtx)
+
+	messageBoxes := []LoggingBox{}
+	for _, msg := range req.Messages {
+		color := 4
+		switch msg.Role {
+		case "assistant":
+			color = 5
+		case "system":
+			color = 6
+		case "tool":
+			color = 3
+		}
+
+		box := LoggingBox{
+			Title:   msg.Role,
+			Content: msg.Content,
+			Color:   color,
+		}
+		for _, call := range msg.ToolCalls {
+			box.Children = append(box.Children, LoggingBox{
+				Title:   "Tool Call",
+				Content: fmt.Sprintf("%s\n%s", call.Function.Name, string(call.Function.Arguments)),
+				Color:   3,
+			})
+		}
+		messageBoxes = append(messageBoxes, box)
+	}
+
+	PrintLoggingBox(LoggingBox{
+		Title:   "Local Model Request /api/chat",
+		Content: meta,
+		Color:   0,
+		Children: []LoggingBox{
+			{
+				Title:    "Messages",
+				Children: messageBoxes,
+				Color:    1,
+			},
+		},
+	})
+}
+
+// Convert the accumulated tool calls to a response. Ollama doesn't assign
+// ids to tool calls so we make them up. Like the Anthropic backend, legacy
+// function requests get the first call as FunctionName/FunctionParameters.
+func ollamaToolCallsToResponse(response *util.CompletionResponse, calls []ollamaToolCall, legacyFunctions bool) {
+	for i, call := range calls {
+		params := string(call.Function.Arguments)
+		if legacyFunctions {
+			if response.FunctionName == "" {
+				response.FunctionName = call.Function.Name
+				response.FunctionParameters = params
+			}
+			continue
+		}
+
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   fmt.Sprintf("call_%d", i),
+			Type: "function",
+			Function: util.FunctionCall{
+				Name:       call.Function.Name,
+				Parameters: params,
+			},
+		})
+	}
+}
+
+func (this *Ollama) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	req := this.buildRequest(request, false)
+	if request.Verbose {
+		LogOllamaRequest(req)
+	}
+
+	resp, err := this.do(request.Ctx, http.MethodPost, "/api/chat", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result ollamaChatResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+
+	response := &util.CompletionResponse{
+		Completion: strings.TrimSpace(result.Message.Content),
+		Usage: &util.TokenUsage{
+			PromptTokens:     result.PromptEvalCount,
+			CompletionTokens: result.EvalCount,
+		},
+	}
+	ollamaToolCallsToResponse(response, result.Message.ToolCalls, len(request.Functions) > 0)
+
+	if request.Verbose {
+		LogCompletionResponse(*response, result.Model)
+	}
+	return response, nil
+}
+
+func (this *Ollama) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	req := this.buildRequest(request, true)
+	if request.Verbose {
+		LogOllamaRequest(req)
+	}
+
+	// Local models can take a while to load, but once they're streaming we
+	// still want to time out if tokens stop arriving
+	innerCtx, cancel := context.WithCancel(request.Ctx)
+	defer cancel()
+	tokenTimeout := request.TokenTimeout
+	var chunkTimeoutErr error
+	var timer *time.Timer
+
+	resp, err := this.do(innerCtx, http.MethodPost, "/api/chat", req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if tokenTimeout > 0 {
+		timer = time.AfterFunc(tokenTimeout, func() {
+			chunkTimeoutErr = NewTokenTimeoutError(tokenTimeout)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	content := strings.Builder{}
+	toolCalls := []ollamaToolCall{}
+	var usage *util.TokenUsage
+
+	// the stream is newline-delimited JSON
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if timer != nil {
+			timer.Reset(tokenTimeout)
+		}
+
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var chunk ollamaChatResponse
+		err := json.Unmarshal(line, &chunk)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing local model stream: %s", err)
+		}
+		if chunk.Error != "" {
+			return nil, errors.New(chunk.Error)
+		}
+
+		if chunk.Message.Content != "" {
+			writer.Write([]byte(chunk.Message.Content))
+			content.WriteString(chunk.Message.Content)
+		}
+
+		for _, call := range chunk.Message.ToolCalls {
+			fmt.Fprintf(writer, "%s(%s)", call.Function.Name, string(call.Function.Arguments))
+			toolCalls = append(toolCalls, call)
+		}
+
+		if chunk.Done {
+			// token counts are only sent on the final chunk
+			usage = &util.TokenUsage{
+				PromptTokens:     chunk.PromptEvalCount,
+				CompletionTokens: chunk.EvalCount,
+			}
+			break
+		}
+	}
+
+	if chunkTimeoutErr != nil {
+		return nil, chunkTimeoutErr
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(writer, "\n")
+
+	response := &util.CompletionResponse{
+		Completion: content.String(),
+		Usage:      usage,
+	}
+	ollamaToolCallsToResponse(response, toolCalls, len(request.Functions) > 0)
+
+	if request.Verbose {
+		LogCompletionResponse(*response, request.Model)
+	}
+	return response, nil
+}
+
+func (this *Ollama) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	if verbose {
+		log.Printf("Embedding %d strings with %s", len(input), this.embeddingModel)
+	}
+
+	resp, err := this.do(ctx, http.MethodPost, "/api/embed", map[string]any{
+		"model": this.embeddingModel,
+		"input": input,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result ollamaEmbedResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Embeddings) != len(input) {
+		return nil, fmt.Errorf("Expected %d embeddings from local model server, got %d", len(input), len(result.Embeddings))
+	}
+
+	return result.Embeddings, nil
+}
@@ -0,0 +1,140 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestParseOllamaContextLength(t *testing.T) {
+	show := &ollamaShowResponse{
+		ModelInfo: map[string]any{
+			"general.architecture": "llama",
+			"llama.context_length": float64(131072),
+		},
+	}
+	assert.Equal(t, 131072, parseOllamaContextLength(show))
+
+	// num_ctx in the modelfile overrides the architecture's default
+	show.Parameters = "stop \"<|eot_id|>\"\nnum_ctx 8192"
+	assert.Equal(t, 8192, parseOllamaContextLength(show))
+
+	assert.Equal(t, 0, parseOllamaContextLength(&ollamaShowResponse{}))
+}
+
+func newOllamaTestServer(t *testing.T, chat func(req *ollamaChatRequest, w http.ResponseWriter)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models":[{"name":"llama3:8b","details":{"family":"llama","parameter_size":"8.0B","quantization_level":"Q4_0"}}]}`))
+		case "/api/show":
+			w.Write([]byte(`{"parameters":"","model_info":{"llama.context_length":131072}}`))
+		case "/api/embed":
+			var req struct {
+				Model string   `json:"model"`
+				Input []string `json:"input"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, OllamaDefaultEmbeddingModel, req.Model)
+			w.Write([]byte(`{"embeddings":[[0.1,0.2],[0.3,0.4]]}`))
+		case "/api/chat":
+			var req ollamaChatRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			chat(&req, w)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestOllamaListModels(t *testing.T) {
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	client := NewOllama(server.URL, "")
+	models, err := client.ListModels(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(models))
+	assert.Equal(t, "llama3:8b", models[0].Name)
+	assert.Equal(t, OllamaMaxContextLength, models[0].ContextLength)
+	assert.Equal(t, "llama 8.0B Q4_0", models[0].Details)
+}
+
+func TestOllamaCompletionStream(t *testing.T) {
+	server := newOllamaTestServer(t, func(req *ollamaChatRequest, w http.ResponseWriter) {
+		assert.True(t, req.Stream)
+		assert.Equal(t, OllamaMaxContextLength, req.Options.NumCtx)
+		assert.Equal(t, 64, req.Options.NumPredict)
+		assert.Equal(t, "system", req.Messages[0].Role)
+		assert.Equal(t, "user", req.Messages[len(req.Messages)-1].Role)
+		assert.Equal(t, 1, len(req.Tools))
+
+		for _, chunk := range []string{
+			`{"message":{"role":"assistant","content":"Hello"},"done":false}`,
+			`{"message":{"role":"assistant","content":" world"},"done":false}`,
+			`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"edit","arguments":{"range_start":1}}}]},"done":false}`,
+			`{"message":{"role":"assistant","content":""},"done":true}`,
+		} {
+			fmt.Fprintf(w, "%s\n", chunk)
+		}
+	})
+	defer server.Close()
+
+	client := NewOllama(server.URL, "")
+	out := new(bytes.Buffer)
+	resp, err := client.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		Model:         "llama3:8b",
+		MaxTokens:     64,
+		SystemMessage: "be brief",
+		Tools:         EditTools,
+	}, out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello world", resp.Completion)
+	assert.Equal(t, 1, len(resp.ToolCalls))
+	assert.Equal(t, "edit", resp.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"range_start":1}`, resp.ToolCalls[0].Function.Parameters)
+	assert.Equal(t, "Hello worldedit({\"range_start\":1})\n", out.String())
+}
+
+func TestOllamaCompletionLegacyFunctions(t *testing.T) {
+	server := newOllamaTestServer(t, func(req *ollamaChatRequest, w http.ResponseWriter) {
+		assert.False(t, req.Stream)
+		assert.Equal(t, 3, len(req.Tools))
+		w.Write([]byte(`{"message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"command","arguments":{"cmd":"ls"}}}]},"done":true}`))
+	})
+	defer server.Close()
+
+	client := NewOllama(server.URL, "")
+	resp, err := client.Completion(&util.CompletionRequest{
+		Ctx:       context.Background(),
+		Prompt:    "hi",
+		Model:     "llama3:8b",
+		MaxTokens: 64,
+		Functions: goalModeFunctions,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "command", resp.FunctionName)
+	assert.Equal(t, `{"cmd":"ls"}`, resp.FunctionParameters)
+}
+
+func TestOllamaEmbeddings(t *testing.T) {
+	server := newOllamaTestServer(t, nil)
+	defer server.Close()
+
+	client := NewOllama(server.URL, "")
+	embeddings, err := client.Embeddings(context.Background(), []string{"a", "b"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{0.1, 0.2}, {0.3, 0.4}}, embeddings)
+}
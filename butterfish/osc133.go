@@ -0,0 +1,138 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ways Butterfish can find the shell prompt in the child shell's output
+const (
+	// Wrap the prompt (PS1, or fish_prompt) in markers, this also adds the
+	// emoji to the prompt
+	PromptIntegrationPS1 = "ps1"
+	// Emit OSC 133 semantic prompt sequences from shell hooks, which works
+	// with prompt frameworks like starship or powerlevel10k that rewrite PS1
+	// each time the prompt is rendered
+	PromptIntegrationOSC133 = "osc133"
+)
+
+// The application id we put on our OSC 133 sequences so we can tell them
+// apart from sequences the user's own shell integration emits
+const osc133App = "butterfish"
+
+// Shell hooks that emit OSC 133 sequences. Before each prompt we send D with
+// the last exit code followed by A, and before each command we send C with
+// the command text. We hook in ahead of existing hooks and hand $? on so a
+// prompt framework still sees the exit code.
+var osc133Hooks = map[string]string{
+	// bash has no preexec. PS0 is expanded after a command is read and before
+	// it runs (bash 4.4+), it sets a flag as a side effect so a DEBUG trap
+	// reports the command once. We take the command's text from history
+	// if it was added there, and otherwise from $BASH_COMMAND, e.g. with
+	// HISTCONTROL=ignorespace, which only has the first simple command.
+	// An existing DEBUG trap is kept and runs first.
+	"bash": `__butterfish_precmd() { local s=$?; __butterfish_last=$(HISTTIMEFORMAT= builtin history 1); printf '\033]133;D;%s;aid=butterfish\007\033]133;A;aid=butterfish\007' "$s"; return $s; }; ` +
+		`__butterfish_preexec() { [ -n "${__butterfish_ready:-}" ] || return 0; __butterfish_ready=; ` +
+		`[ "$BASH_COMMAND" = __butterfish_precmd ] && return 0; ` +
+		`local cmd=$BASH_COMMAND entry text re='^ *[0-9]+[* ] *(.*)$'; entry=$(HISTTIMEFORMAT= builtin history 1); ` +
+		`[[ $entry =~ $re ]] && text=${BASH_REMATCH[1]}; ` +
+		`if [ "$entry" != "${__butterfish_last:-}" ] || [[ $text == "$cmd"* ]]; then cmd=$text; fi; ` +
+		`printf '\033]133;C;aid=butterfish;cmdline=%s\007' "$cmd"; return 0; }; ` +
+		`__butterfish_trap() { [ $# -eq 4 ] && __butterfish_old_debug=$3; }; eval "__butterfish_trap $(trap -p DEBUG)"; ` +
+		`trap "${__butterfish_old_debug:+$__butterfish_old_debug; }__butterfish_preexec" DEBUG; __butterfish_arm=(); ` +
+		`PROMPT_COMMAND="__butterfish_precmd;${PROMPT_COMMAND}"; PS0="${PS0}"'${__butterfish_arm[__butterfish_ready=1]:-}'` + "\n",
+
+	"zsh": `__butterfish_precmd() { local s=$?; printf '\033]133;D;%s;aid=butterfish\007\033]133;A;aid=butterfish\007' "$s"; return $s; }; ` +
+		`__butterfish_preexec() { printf '\033]133;C;aid=butterfish;cmdline=%s\007' "$1"; }; ` +
+		`precmd_functions=(__butterfish_precmd $precmd_functions); preexec_functions+=(__butterfish_preexec)` + "\n",
+
+	"fish": `set -g __butterfish_status 0; ` +
+		`function __butterfish_postexec --on-event fish_postexec; set -g __butterfish_status $status; end; ` +
+		`function __butterfish_precmd --on-event fish_prompt; printf '\033]133;D;%s;aid=butterfish\007\033]133;A;aid=butterfish\007' $__butterfish_status; end; ` +
+		`function __butterfish_preexec --on-event fish_preexec; printf '\033]133;C;aid=butterfish;cmdline=%s\007' "$argv[1]"; end` + "\n",
+}
+
+// Set up the child shell so Butterfish can find prompts in its output,
+// returning the integration used. We fall back to PS1 markers if the shell
+// doesn't support the configured integration.
+func (this *ButterfishCtx) SetShellIntegration(childIn io.Writer) string {
+	if this.Config.ShellPromptIntegration == PromptIntegrationOSC133 {
+		shell := this.Config.ParseShell()
+		hooks, ok := osc133Hooks[shell]
+		if ok {
+			fmt.Fprint(childIn, hooks)
+			return PromptIntegrationOSC133
+		}
+		log.Printf("OSC 133 prompt integration isn't supported for %s, using PS1 instead", shell)
+	}
+
+	this.SetPS1(childIn)
+	return PromptIntegrationPS1
+}
+
+// An OSC 133 sequence, ESC ] 133 ; <kind> [; <params>] terminated by BEL or
+// ESC \
+var osc133Regex = regexp.MustCompile("\x1b\\]133;([A-D])((?:;[^\x07\x1b]*)?)(?:\x07|\x1b\\\\)")
+
+// Given a string of terminal output, find the OSC 133 sequences our hooks
+// emitted.
+// Returns:
+//   - The last exit code seen in the string.
+//   - The number of prompts started in the string.
+//   - The text of commands that were started, in order.
+//   - The string with our sequences removed, other OSC 133 sequences are
+//     left alone.
+func ParseOSC133(data string) (int, int, []string, string) {
+	if !strings.Contains(data, "\x1b]133;") {
+		return 0, 0, nil, data
+	}
+
+	lastStatus := 0
+	prompts := 0
+	commands := []string{}
+
+	cleaned := osc133Regex.ReplaceAllStringFunc(data, func(sequence string) string {
+		match := osc133Regex.FindStringSubmatch(sequence)
+		kind, params := match[1], strings.TrimPrefix(match[2], ";")
+
+		// the command line may contain semicolons so it's always last
+		params, cmdline, hasCmdline := strings.Cut(params, "cmdline=")
+		isOurs := false
+		fields := []string{}
+		for _, field := range strings.Split(params, ";") {
+			if field == "aid="+osc133App {
+				isOurs = true
+			} else if field != "" {
+				fields = append(fields, field)
+			}
+		}
+		if !isOurs {
+			return sequence
+		}
+
+		switch kind {
+		case "A":
+			prompts++
+		case "C":
+			if hasCmdline {
+				// the pty turns newlines in a multiline command into \r\n
+				commands = append(commands, strings.ReplaceAll(cmdline, "\r\n", "\n"))
+			}
+		case "D":
+			if len(fields) > 0 {
+				status, err := strconv.Atoi(fields[0])
+				if err != nil {
+					log.Printf("Error parsing OSC 133 exit code: %s", err)
+				}
+				lastStatus = status
+			}
+		}
+		return ""
+	})
+
+	return lastStatus, prompts, commands, cleaned
+}
@@ -0,0 +1,83 @@
+package butterfish
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A prompt starting with this sends a single question with different
+// settings, e.g. "@gpt-4o How do I..." or "@gpt-4o,t=0.2 How do I..."
+const promptOverridePrefix = "@"
+
+// The temperature used for shell prompts unless a prompt overrides it
+const shellPromptTemperature = 0.7
+
+// Settings for a single prompt
+type promptOverride struct {
+	// empty to use the current prompting model
+	Model string
+	// negative to use the default temperature
+	Temperature float32
+}
+
+// Split the override prefix from a prompt. If the prompt doesn't start with
+// one we return a nil override and the prompt unchanged. A prefix without a
+// setting like t=0.2 must start with a model that isModel accepts, so a
+// prompt like "@main.go why does this fail?" attaches the file instead.
+func parsePromptOverride(prompt string, isModel func(string) bool) (*promptOverride, string, error) {
+	if !strings.HasPrefix(prompt, promptOverridePrefix) {
+		return nil, prompt, nil
+	}
+
+	spec, rest, _ := strings.Cut(prompt[len(promptOverridePrefix):], " ")
+	rest = strings.TrimSpace(rest)
+	model, _, _ := strings.Cut(spec, ",")
+	if model != "" && !strings.Contains(spec, "=") && !isModel(model) {
+		return nil, prompt, nil
+	}
+	if spec == "" {
+		return nil, "", fmt.Errorf("Expected a model or temperature after %s, e.g. %sgpt-4o,t=0.2",
+			promptOverridePrefix, promptOverridePrefix)
+	}
+	if rest == "" {
+		return nil, "", fmt.Errorf("Expected a prompt after %s%s", promptOverridePrefix, spec)
+	}
+
+	override := &promptOverride{Temperature: -1}
+	for _, option := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(option, "=")
+
+		switch {
+		case !hasValue && option != "" && override.Model == "":
+			override.Model = option
+
+		case hasValue && (key == "t" || key == "temp" || key == "temperature"):
+			temperature, err := strconv.ParseFloat(value, 32)
+			if err != nil || temperature < 0 || temperature > 2 {
+				return nil, "", fmt.Errorf("Invalid temperature %s, expected a number from 0 to 2", value)
+			}
+			override.Temperature = float32(temperature)
+
+		default:
+			return nil, "", fmt.Errorf("Invalid prompt option %s, expected a model or t=<temperature>, e.g. %sgpt-4o,t=0.2",
+				option, promptOverridePrefix)
+		}
+	}
+
+	return override, rest, nil
+}
+
+// Complete the model name of an override prefix from the catalog
+func completePromptOverride(catalog *ModelCatalog, text string) string {
+	spec := strings.TrimPrefix(text, promptOverridePrefix)
+	if spec == "" || strings.ContainsAny(spec, " ,=") {
+		return ""
+	}
+	for _, name := range catalog.Names() {
+		if strings.HasPrefix(name, spec) && name != spec {
+			return text + name[len(spec):]
+		}
+	}
+	return ""
+}
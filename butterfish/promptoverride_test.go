@@ -0,0 +1,150 @@
+package butterfish
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func isCatalogModel(model string) bool {
+	_, found := DefaultModelCatalog().Lookup(model)
+	return found
+}
+
+func TestParsePromptOverride(t *testing.T) {
+	override, prompt, err := parsePromptOverride("How do I list files?", isCatalogModel)
+	assert.Nil(t, err)
+	assert.Nil(t, override)
+	assert.Equal(t, "How do I list files?", prompt)
+
+	override, prompt, err = parsePromptOverride("@gpt-4o How do I list files?", isCatalogModel)
+	assert.Nil(t, err)
+	assert.Equal(t, &promptOverride{Model: "gpt-4o", Temperature: -1}, override)
+	assert.Equal(t, "How do I list files?", prompt)
+
+	override, prompt, err = parsePromptOverride("@llama3:8b,t=0.2  Write a haiku", isCatalogModel)
+	assert.Nil(t, err)
+	assert.Equal(t, &promptOverride{Model: "llama3:8b", Temperature: 0.2}, override)
+	assert.Equal(t, "Write a haiku", prompt)
+
+	override, _, err = parsePromptOverride("@temperature=1.5 Write a haiku", isCatalogModel)
+	assert.Nil(t, err)
+	assert.Equal(t, &promptOverride{Temperature: 1.5}, override)
+
+	// a prefix that isn't a model is a file to attach
+	override, prompt, err = parsePromptOverride("@main.go why does this fail?", isCatalogModel)
+	assert.Nil(t, err)
+	assert.Nil(t, override)
+	assert.Equal(t, "@main.go why does this fail?", prompt)
+
+	for _, bad := range []string{
+		"@ How do I list files?",
+		"@gpt-4o",
+		"@t=hot Write a haiku",
+		"@t=3 Write a haiku",
+		"@gpt-4o,gpt-4 Write a haiku",
+		"@top_p=0.5 Write a haiku",
+	} {
+		_, _, err = parsePromptOverride(bad, isCatalogModel)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestCompletePromptOverride(t *testing.T) {
+	state, _ := newTestShellState()
+	assert.Equal(t, "@gpt-3.5-turbo", state.completeLocalCommand("@gpt-3.5-tur"))
+	assert.Equal(t, "", state.completeLocalCommand("@gpt-4o,t=0"))
+	assert.Equal(t, "", state.completeLocalCommand("@gpt-4o How"))
+	assert.Equal(t, "", state.completeLocalCommand("@"))
+
+	// models come from this session's catalog, including the user's file
+	path := filepath.Join(t.TempDir(), "models.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("models:\n  llama3:\n    tools: true\n"), 0600))
+	catalog, err := LoadModelCatalog(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "", state.completeLocalCommand("@llam"))
+	state.Butterfish.Models = catalog
+	assert.Equal(t, "@llama3", state.completeLocalCommand("@llam"))
+	assert.Contains(t, completeModel(state, ""), "llama3")
+	other, _ := newTestShellState()
+	assert.NotContains(t, completeModel(other, ""), "llama3")
+}
+
+// Records the last streamed request
+type requestRecordingLLM struct {
+	fakeLLM
+	request *util.CompletionRequest
+}
+
+func (this *requestRecordingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.request = request
+	return &util.CompletionResponse{Completion: "ok"}, nil
+}
+
+// Also lists models like a local model server, and counts how often
+type modelListingLLM struct {
+	requestRecordingLLM
+	listCalls int
+}
+
+func (this *modelListingLLM) ListModels(ctx context.Context) ([]ModelInfo, error) {
+	this.listCalls++
+	return []ModelInfo{{Name: "llama3:8b"}}, nil
+}
+
+func (this *modelListingLLM) ContextLength(ctx context.Context, model string) (int, error) {
+	return 8192, nil
+}
+
+func TestSendPromptOverride(t *testing.T) {
+	state, _ := newTestShellState()
+	state.Butterfish.Ctx = context.Background()
+	llm := &modelListingLLM{}
+	state.Butterfish.LLMClient = llm
+
+	send := func(text string) {
+		state.Prompt = NewShellBuffer()
+		state.Prompt.Write(text)
+		state.SendPrompt()
+		// as the main loop would
+		output := <-state.PromptOutputChan
+		state.History.Append(historyTypeLLMOutput, output.Completion)
+	}
+
+	send("How do I list files?")
+	assert.Equal(t, "gpt-4", llm.request.Model)
+	assert.Equal(t, float32(shellPromptTemperature), llm.request.Temperature)
+
+	send("@gpt-3.5-turbo,t=0.1 How do I list hidden files?")
+	assert.Equal(t, "gpt-3.5-turbo", llm.request.Model)
+	assert.Equal(t, float32(0.1), llm.request.Temperature)
+	assert.Equal(t, "How do I list hidden files?", llm.request.Prompt)
+
+	// the override only applies to one prompt, and isn't kept in history
+	assert.Equal(t, "gpt-4", state.Butterfish.Config.ShellPromptModel)
+	assert.Equal(t, state.Butterfish.Models.NumTokens("gpt-4"), state.PromptMaxTokens)
+	assert.Equal(t, "How do I list hidden files?",
+		state.History.Blocks[len(state.History.Blocks)-2].String())
+
+	// a prompt starting with a file attaches it and uses the prompting model
+	send("@promptoverride.go why does this fail?")
+	assert.Equal(t, "gpt-4", llm.request.Model)
+	assert.Equal(t, 1, len(llm.request.Attachments))
+	assert.Equal(t, "promptoverride.go", llm.request.Attachments[0].Path)
+	// without asking the server about it
+	assert.Equal(t, 0, llm.listCalls)
+
+	// models on the server work too, and the server's list is reused
+	send("@llama3:8b Write a haiku")
+	assert.Equal(t, "llama3:8b", llm.request.Model)
+	send("@someone said hi")
+	assert.Equal(t, "gpt-4", llm.request.Model)
+	assert.Equal(t, "@someone said hi", llm.request.Prompt)
+	assert.Equal(t, 1, llm.listCalls)
+}
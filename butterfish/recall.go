@@ -0,0 +1,438 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/drewlanenga/govector"
+)
+
+// Default similarity a recalled block needs, tuned for OpenAI's ada-002
+// embeddings where unrelated text still scores around 0.7
+const DefaultRecallMinScore = 0.8
+
+const (
+	// blocks shorter than this, like "ls", aren't worth recalling
+	minRecallChars = 8
+	// blocks are truncated to this before they're embedded
+	maxRecallChars = 4000
+	// the index is compacted to this many entries when it's loaded
+	maxRecallEntries = 5000
+	// number of blocks embedded per call
+	recallBatchSize = 32
+	// queued blocks are embedded this long after the first is queued, or
+	// sooner if a batch fills up or the user sends a prompt
+	recallFlushDelay = 30 * time.Second
+)
+
+// One embedded block of shell history
+type RecallEntry struct {
+	Time time.Time `json:"time"`
+	// the history session the block was recorded in, if any
+	Session string    `json:"session,omitempty"`
+	Type    int       `json:"type"`
+	Content string    `json:"content"`
+	Vector  []float32 `json:"vector"`
+}
+
+type RecallResult struct {
+	Entry *RecallEntry
+	Score float64
+}
+
+// RecallIndex embeds shell history blocks as they're finished so that
+// older history, which has fallen out of the prompt window or is from a past
+// session, can be searched by meaning. Entries are kept in memory and
+// appended to a JSONL file. Blocks are redacted before they're embedded.
+type RecallIndex struct {
+	path      string
+	embedder  embedding.Embedder
+	retention time.Duration
+
+	entries  []*RecallEntry
+	pending  []*RecallEntry
+	contents map[string]bool
+	mutex    sync.Mutex
+	// set while a flush of pending blocks is scheduled
+	flushTimer *time.Timer
+	// held while embedding so flushes happen one at a time
+	flushMutex sync.Mutex
+}
+
+func NewRecallIndex(path string, embedder embedding.Embedder, retention time.Duration) *RecallIndex {
+	return &RecallIndex{
+		path:      path,
+		embedder:  embedder,
+		retention: retention,
+		contents:  map[string]bool{},
+	}
+}
+
+// The text we embed for a block, also used to match blocks against recent
+// history
+func recallText(content string) string {
+	content = strings.TrimSpace(content)
+	if len(content) > maxRecallChars {
+		content = content[:maxRecallChars]
+	}
+	return content
+}
+
+// Load the index from disk, dropping entries past retention
+func (this *RecallIndex) Load() error {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := []*RecallEntry{}
+	dropped := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		entry := &RecallEntry{}
+		err := json.Unmarshal(scanner.Bytes(), entry)
+		if err != nil {
+			// skip lines that were partially written
+			dropped++
+			continue
+		}
+		if this.retention > 0 && time.Since(entry.Time) > this.retention {
+			dropped++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(entries) > maxRecallEntries {
+		dropped += len(entries) - maxRecallEntries
+		entries = entries[len(entries)-maxRecallEntries:]
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.entries = entries
+	this.contents = map[string]bool{}
+	for _, entry := range entries {
+		this.contents[entry.Content] = true
+	}
+	if dropped > 0 {
+		return this.rewrite()
+	}
+	return nil
+}
+
+// Rewrite the index file with the current entries, the caller holds the
+// mutex
+func (this *RecallIndex) rewrite() error {
+	builder := strings.Builder{}
+	for _, entry := range this.entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		builder.Write(data)
+		builder.WriteString("\n")
+	}
+
+	err := os.MkdirAll(filepath.Dir(this.path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(this.path), ".recall-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(builder.String())
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Queue a finished history block to be embedded by Flush, which runs in the
+// background once a batch is full or after recallFlushDelay. Short blocks
+// and blocks we've already indexed are skipped.
+func (this *RecallIndex) Add(session string, block StoredBlock) {
+	content := recallText(block.Content)
+	if len(content) < minRecallChars {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.contents[content] {
+		return
+	}
+	this.contents[content] = true
+	this.pending = append(this.pending, &RecallEntry{
+		Time:    block.Time,
+		Session: session,
+		Type:    block.Type,
+		Content: content,
+	})
+
+	if len(this.pending) >= recallBatchSize {
+		this.stopFlushTimer()
+		go flushRecall(this)
+	} else if this.flushTimer == nil {
+		this.flushTimer = time.AfterFunc(recallFlushDelay, func() {
+			flushRecall(this)
+		})
+	}
+}
+
+// The caller holds the mutex
+func (this *RecallIndex) stopFlushTimer() {
+	if this.flushTimer != nil {
+		this.flushTimer.Stop()
+		this.flushTimer = nil
+	}
+}
+
+// Whether there are blocks waiting to be embedded
+func (this *RecallIndex) HasPending() bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.pending) > 0
+}
+
+// Embed queued blocks and save them. Blocks that fail to embed are dropped
+// rather than retried, they'll be queued again if they're added again, e.g.
+// when the same command is run.
+func (this *RecallIndex) Flush(ctx context.Context) error {
+	this.flushMutex.Lock()
+	defer this.flushMutex.Unlock()
+
+	this.mutex.Lock()
+	pending := this.pending
+	this.pending = nil
+	this.stopFlushTimer()
+	this.mutex.Unlock()
+
+	for start := 0; start < len(pending); start += recallBatchSize {
+		end := start + recallBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[start:end]
+
+		err := this.embed(ctx, batch)
+		if err != nil {
+			this.forgetContents(pending[start:])
+			return err
+		}
+		// the batch is in memory even if we can't save it
+		err = this.append(batch)
+		if err != nil {
+			this.forgetContents(pending[end:])
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *RecallIndex) embed(ctx context.Context, batch []*RecallEntry) error {
+	input := make([]string, len(batch))
+	for i, entry := range batch {
+		input[i] = entry.Content
+	}
+	vectors, err := this.embedder.CalculateEmbeddings(WithFeature(ctx, FeatureRecall), input)
+	if err != nil {
+		return err
+	}
+	if len(vectors) != len(batch) {
+		return fmt.Errorf("Expected %d embeddings, got %d", len(batch), len(vectors))
+	}
+
+	for i, entry := range batch {
+		entry.Vector = vectors[i]
+	}
+	return nil
+}
+
+// Forget that entries were queued so they can be added again
+func (this *RecallIndex) forgetContents(entries []*RecallEntry) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, entry := range entries {
+		delete(this.contents, entry.Content)
+	}
+}
+
+func (this *RecallIndex) append(entries []*RecallEntry) error {
+	builder := strings.Builder{}
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		builder.Write(data)
+		builder.WriteString("\n")
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.entries = append(this.entries, entries...)
+
+	err := os.MkdirAll(filepath.Dir(this.path), 0700)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(builder.String())
+	return err
+}
+
+// Find the numResults entries closest to query with a score of at least
+// minScore, best first. Entries whose text is in exclude are skipped, e.g.
+// blocks that are already in the prompt.
+func (this *RecallIndex) Search(
+	ctx context.Context,
+	query string,
+	numResults int,
+	minScore float64,
+	exclude map[string]bool,
+) ([]*RecallResult, error) {
+	vectors, err := this.embedder.CalculateEmbeddings(WithFeature(ctx, FeatureRecall), []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, fmt.Errorf("Expected 1 embedding, got %d", len(vectors))
+	}
+	queryVector, err := govector.AsVector(vectors[0])
+	if err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	entries := this.entries
+	this.mutex.Unlock()
+
+	results := []*RecallResult{}
+	for _, entry := range entries {
+		if exclude[entry.Content] || len(entry.Vector) != len(queryVector) {
+			// vectors of a different length are from another embedding model
+			continue
+		}
+		vector, err := govector.AsVector(entry.Vector)
+		if err != nil {
+			continue
+		}
+		score, err := govector.Cosine(queryVector, vector)
+		if err != nil || score < minScore {
+			continue
+		}
+		results = append(results, &RecallResult{Entry: entry, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > numResults {
+		results = results[:numResults]
+	}
+	return results, nil
+}
+
+// Remove entries recorded in a history session, or every entry if session
+// is empty
+func (this *RecallIndex) Forget(session string) error {
+	this.flushMutex.Lock()
+	defer this.flushMutex.Unlock()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entries := []*RecallEntry{}
+	this.contents = map[string]bool{}
+	for _, entry := range this.entries {
+		if session == "" || entry.Session == session {
+			continue
+		}
+		entries = append(entries, entry)
+		this.contents[entry.Content] = true
+	}
+	this.entries = entries
+
+	pending := []*RecallEntry{}
+	for _, entry := range this.pending {
+		if session != "" && entry.Session != session {
+			pending = append(pending, entry)
+			this.contents[entry.Content] = true
+		}
+	}
+	this.pending = pending
+
+	return this.rewrite()
+}
+
+// Describe recalled blocks for the system message of a prompt, using at
+// most maxTokens
+func recallContext(results []*RecallResult, tokenizer Tokenizer, maxTokens int) string {
+	if len(results) == 0 {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString("\n\nThese blocks from the user's earlier shell history may be relevant, they are not part of the recent history:\n")
+	usedTokens := tokenizer.Count(builder.String())
+	added := 0
+
+	for _, result := range results {
+		header := fmt.Sprintf("--- %s, %s\n", result.Entry.Time.Format("2006-01-02 15:04"),
+			HistoryTypeToString(result.Entry.Type))
+		remaining := maxTokens - usedTokens - tokenizer.Count(header)
+		if remaining <= 0 {
+			break
+		}
+		numTokens, content, _ := tokenizer.Truncate(result.Entry.Content, remaining)
+		builder.WriteString(header)
+		builder.WriteString(content)
+		builder.WriteString("\n")
+		usedTokens += tokenizer.Count(header) + numTokens
+		added++
+	}
+
+	if added == 0 {
+		return ""
+	}
+	return builder.String()
+}
+
+// Log errors from a background flush
+func flushRecall(index *RecallIndex) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := index.Flush(ctx)
+	if err != nil {
+		log.Printf("Error embedding history for recall: %s", err)
+	}
+}
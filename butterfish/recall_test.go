@@ -0,0 +1,190 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Embeds text as counts of a few keywords, so texts about the same thing
+// are similar
+type keywordEmbedder struct {
+	calls int
+	// returned instead of embeddings if set
+	err error
+	// the feature the last call was tagged with
+	feature string
+	mutex   sync.Mutex
+}
+
+var testRecallKeywords = []string{"docker", "network", "git", "rebase", "python", "venv"}
+
+func (this *keywordEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	this.mutex.Lock()
+	this.calls++
+	this.feature = featureFromContext(ctx, "")
+	err := this.err
+	this.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := [][]float32{}
+	for _, text := range content {
+		// a small constant so no vector is all zeros
+		vector := []float32{0.01}
+		for _, keyword := range testRecallKeywords {
+			vector = append(vector, float32(strings.Count(strings.ToLower(text), keyword)))
+		}
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
+
+func TestRecallIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recall.jsonl")
+	embedder := &keywordEmbedder{}
+	index := NewRecallIndex(path, embedder, DefaultHistoryRetention)
+
+	now := time.Now()
+	index.Add("work", StoredBlock{Time: now, Type: historyTypeShellInput, Content: "docker network prune -f"})
+	index.Add("work", StoredBlock{Time: now, Type: historyTypeShellInput, Content: "git rebase -i HEAD~3"})
+	index.Add("home", StoredBlock{Time: now, Type: historyTypeShellOutput, Content: "python -m venv .venv"})
+	// too short, and a duplicate
+	index.Add("work", StoredBlock{Time: now, Type: historyTypeShellInput, Content: "ls"})
+	index.Add("work", StoredBlock{Time: now, Type: historyTypeShellInput, Content: "git rebase -i HEAD~3"})
+	assert.Nil(t, index.Flush(context.Background()))
+	assert.Equal(t, 1, embedder.calls)
+	assert.Equal(t, FeatureRecall, embedder.feature)
+
+	results, err := index.Search(context.Background(), "how did I fix the docker network", 3, 0.5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "docker network prune -f", results[0].Entry.Content)
+	assert.Equal(t, "work", results[0].Entry.Session)
+
+	// blocks in the recent history aren't recalled again
+	results, err = index.Search(context.Background(), "docker network", 3, 0.5,
+		map[string]bool{"docker network prune -f": true})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+
+	// entries are loaded from disk
+	loaded := NewRecallIndex(path, embedder, DefaultHistoryRetention)
+	assert.Nil(t, loaded.Load())
+	results, err = loaded.Search(context.Background(), "python venv", 3, 0.5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, historyTypeShellOutput, results[0].Entry.Type)
+
+	// forgetting a session removes its entries from disk too
+	assert.Nil(t, loaded.Forget("work"))
+	loaded = NewRecallIndex(path, embedder, DefaultHistoryRetention)
+	assert.Nil(t, loaded.Load())
+	results, err = loaded.Search(context.Background(), "git rebase", 3, 0.5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+
+	assert.Nil(t, loaded.Forget(""))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "", string(data))
+}
+
+func TestRecallIndexRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recall.jsonl")
+	index := NewRecallIndex(path, &keywordEmbedder{}, time.Hour)
+	index.Add("", StoredBlock{Time: time.Now().Add(-2 * time.Hour), Content: "docker network ls"})
+	index.Add("", StoredBlock{Time: time.Now(), Content: "git rebase main"})
+	assert.Nil(t, index.Flush(context.Background()))
+
+	loaded := NewRecallIndex(path, &keywordEmbedder{}, time.Hour)
+	assert.Nil(t, loaded.Load())
+	assert.Equal(t, 1, len(loaded.entries))
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+}
+
+func TestRecallShellHistory(t *testing.T) {
+	index := NewRecallIndex(filepath.Join(t.TempDir(), "recall.jsonl"), &keywordEmbedder{}, 0)
+	history := NewShellHistory()
+	history.SetRecall(index)
+
+	history.Append(historyTypeShellInput, "docker network create dev")
+	history.Append(historyTypeShellOutput, "Error: network with name dev already exists\n")
+	history.Close()
+
+	results, err := index.Search(context.Background(), "docker network", 3, 0.5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+}
+
+func TestRecallIndexBatching(t *testing.T) {
+	embedder := &keywordEmbedder{}
+	index := NewRecallIndex(filepath.Join(t.TempDir(), "recall.jsonl"), embedder, 0)
+	history := NewShellHistory()
+	history.SetRecall(index)
+
+	// finished blocks are queued rather than embedded one at a time
+	for i := 0; i < recallBatchSize-1; i++ {
+		history.Append(historyTypeShellInput, fmt.Sprintf("docker network inspect net%d", i))
+		// too short to be indexed
+		history.Append(historyTypeShellOutput, "ok\n")
+	}
+	assert.True(t, index.HasPending())
+	assert.Equal(t, 0, embedder.calls)
+
+	// until a batch fills up
+	history.Append(historyTypeShellInput, "git rebase main")
+	history.Append(historyTypeShellOutput, "ok\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for index.HasPending() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	history.Close()
+	assert.Equal(t, 1, embedder.calls)
+	assert.Equal(t, recallBatchSize, len(index.entries))
+}
+
+func TestRecallIndexFlushError(t *testing.T) {
+	embedder := &keywordEmbedder{err: errors.New("rate limited")}
+	index := NewRecallIndex(filepath.Join(t.TempDir(), "recall.jsonl"), embedder, 0)
+
+	block := StoredBlock{Time: time.Now(), Content: "docker network prune -f"}
+	index.Add("", block)
+	assert.NotNil(t, index.Flush(context.Background()))
+	assert.False(t, index.HasPending())
+
+	// the failed block can be queued again
+	embedder.err = nil
+	index.Add("", block)
+	assert.True(t, index.HasPending())
+	assert.Nil(t, index.Flush(context.Background()))
+	results, err := index.Search(context.Background(), "docker network", 3, 0.5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+}
+
+func TestRecallContext(t *testing.T) {
+	tokenizer := NewHeuristicTokenizer()
+	assert.Equal(t, "", recallContext(nil, tokenizer, 100))
+
+	results := []*RecallResult{
+		{Entry: &RecallEntry{Type: historyTypeShellInput, Content: "docker network prune -f"}},
+		{Entry: &RecallEntry{Type: historyTypeShellOutput, Content: strings.Repeat("x", 4000)}},
+	}
+	context := recallContext(results, tokenizer, 100)
+	assert.Contains(t, context, "Shell Input\ndocker network prune -f\n")
+	// the long block is truncated to fit
+	assert.True(t, tokenizer.Count(context) <= 100)
+	assert.Contains(t, context, "Shell Output\nxxx")
+}
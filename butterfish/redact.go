@@ -0,0 +1,289 @@
+package butterfish
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A secret we masked in shell history
+type Redaction struct {
+	Time     time.Time
+	Detector string
+	// the first few characters of the secret so the user can tell what was
+	// masked, e.g. "AKIA…"
+	Preview string
+}
+
+// Finds one kind of secret. If the regex has a capture group only the first
+// group is masked, e.g. the value in KEY=value, otherwise the whole match.
+// Built-in regexes use non-capturing groups for anything else.
+type redactionDetector struct {
+	Name  string
+	Regex *regexp.Regexp
+	// if set, matches are only masked when this returns true
+	Check func(secret string) bool
+}
+
+const (
+	redactPrivateKey  = "private key"
+	redactHighEntropy = "high entropy"
+)
+
+var privateKeyBeginRegex = regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----`)
+var privateKeyEndRegex = regexp.MustCompile(`-----END [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----`)
+
+// The built-in detectors, in the order they're applied. Users can turn
+// these off by name in the redaction config.
+func builtinRedactionDetectors() []*redactionDetector {
+	return []*redactionDetector{
+		{
+			// a key with no end marker yet is masked to the end of the text
+			Name:  redactPrivateKey,
+			Regex: regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----.*?(?:-----END [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----|$)`),
+		},
+		{
+			Name:  "url credentials",
+			Regex: regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`),
+		},
+		{Name: "anthropic key", Regex: regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]{20,}`)},
+		{Name: "openai key", Regex: regexp.MustCompile(`sk-[A-Za-z0-9_-]{20,}`)},
+		{Name: "aws access key", Regex: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{Name: "github token", Regex: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`)},
+		{Name: "gitlab token", Regex: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`)},
+		{Name: "slack token", Regex: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+		{Name: "google api key", Regex: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+		{Name: "stripe key", Regex: regexp.MustCompile(`\b[rs]k_(?:live|test)_[0-9A-Za-z]{16,}`)},
+		{Name: "jwt", Regex: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+		{
+			// e.g. export AWS_SECRET_ACCESS_KEY=... or a line of a .env file,
+			// values that are variable references like $TOKEN or that were
+			// already masked are left alone
+			Name:  "secret assignment",
+			Regex: regexp.MustCompile(`(?i)\b[A-Z0-9_.-]*(?:SECRET|TOKEN|PASSWORD|PASSWD|API_?KEY|ACCESS_?KEY|PRIVATE_?KEY|CREDENTIALS?)[A-Z0-9_]*["']?\s*[=:]\s*["']?([^\s"'#$\[][^\s"'#]{7,})`),
+		},
+		{
+			Name:  redactHighEntropy,
+			Regex: regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`),
+			Check: isHighEntropy,
+		},
+	}
+}
+
+// Shannon entropy in bits per character
+func shannonEntropy(str string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range str {
+		counts[r]++
+		total++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Whether a string looks like a random key rather than a word, path, or
+// hash. Requiring upper and lower case letters and digits skips hex hashes
+// and UUIDs, which are common in output and rarely secret.
+func isHighEntropy(str string) bool {
+	var upper, lower, digit bool
+	for _, r := range str {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+	return shannonEntropy(str) >= 4.0
+}
+
+// Redactor masks secrets in text before it's sent to an LLM. A nil
+// Redactor leaves text alone.
+type Redactor struct {
+	detectors []*redactionDetector
+}
+
+// User configuration for redaction, loaded from YAML:
+//
+//	patterns:
+//	  - name: internal token
+//	    regex: 'corp_[a-z0-9]{32}'
+//	disable:
+//	  - high entropy
+type RedactionConfig struct {
+	Patterns []struct {
+		Name  string `yaml:"name"`
+		Regex string `yaml:"regex"`
+	} `yaml:"patterns"`
+	// names of built-in detectors to turn off
+	Disable []string `yaml:"disable"`
+}
+
+// A Redactor with just the built-in detectors
+func NewRedactor() *Redactor {
+	return &Redactor{detectors: builtinRedactionDetectors()}
+}
+
+// Load a Redactor with the built-in detectors plus the user's config at
+// path, if it exists
+func LoadRedactor(path string) (*Redactor, error) {
+	redactor := NewRedactor()
+	if path == "" {
+		return redactor, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return redactor, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := RedactionConfig{}
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing redaction config %s: %s", path, err)
+	}
+
+	disabled := map[string]bool{}
+	for _, name := range config.Disable {
+		disabled[name] = true
+	}
+	detectors := []*redactionDetector{}
+	for _, detector := range redactor.detectors {
+		if !disabled[detector.Name] {
+			detectors = append(detectors, detector)
+		}
+	}
+
+	for _, pattern := range config.Patterns {
+		regex, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern %s in %s: %s", pattern.Name, path, err)
+		}
+		name := pattern.Name
+		if name == "" {
+			name = "custom"
+		}
+		detectors = append(detectors, &redactionDetector{Name: name, Regex: regex})
+	}
+
+	redactor.detectors = detectors
+	return redactor, nil
+}
+
+func redactionMask(name string) string {
+	return "[REDACTED:" + name + "]"
+}
+
+func redactionPreview(secret string) string {
+	runes := []rune(secret)
+	if len(runes) < 12 {
+		return "…"
+	}
+	return string(runes[:4]) + "…"
+}
+
+// Mask secrets in text, returning the masked text and what was masked
+func (this *Redactor) Redact(text string) (string, []Redaction) {
+	if this == nil {
+		return text, nil
+	}
+
+	var redactions []Redaction
+	for _, detector := range this.detectors {
+		matches := detector.Regex.FindAllStringSubmatchIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		type span struct{ start, end int }
+		spans := []span{}
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			if detector.Regex.NumSubexp() > 0 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			if start == end {
+				continue
+			}
+			if detector.Check != nil && !detector.Check(text[start:end]) {
+				continue
+			}
+			spans = append(spans, span{start, end})
+		}
+
+		// replace from the end so earlier offsets stay valid
+		sort.Slice(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+		for _, span := range spans {
+			redactions = append(redactions, Redaction{
+				Time:     time.Now(),
+				Detector: detector.Name,
+				Preview:  redactionPreview(text[span.start:span.end]),
+			})
+			text = text[:span.start] + redactionMask(detector.Name) + text[span.end:]
+		}
+	}
+
+	return text, redactions
+}
+
+// Whether line starts a private key that continues onto later lines, which
+// the caller needs to mask until the end marker
+func (this *Redactor) opensPrivateKey(line string) bool {
+	if this == nil || !this.hasDetector(redactPrivateKey) {
+		return false
+	}
+	begins := privateKeyBeginRegex.FindAllStringIndex(line, -1)
+	if len(begins) == 0 {
+		return false
+	}
+	ends := privateKeyEndRegex.FindAllStringIndex(line, -1)
+	return len(ends) == 0 || ends[len(ends)-1][0] < begins[len(begins)-1][0]
+}
+
+func (this *Redactor) hasDetector(name string) bool {
+	for _, detector := range this.detectors {
+		if detector.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Summarize redactions by detector, e.g. "2 openai key, 1 private key"
+func summarizeRedactions(redactions []Redaction) string {
+	counts := map[string]int{}
+	names := []string{}
+	for _, redaction := range redactions {
+		if counts[redaction.Detector] == 0 {
+			names = append(names, redaction.Detector)
+		}
+		counts[redaction.Detector]++
+	}
+
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[name], name))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,233 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// RetryPolicy retries API calls that fail with rate limiting, a transient
+// server error, or a dropped connection. Delays grow exponentially with
+// jitter, unless the server tells us how long to wait with a Retry-After
+// header. Callers are responsible for never retrying once streamed output
+// has been shown to the user, i.e. only the call that opens a stream should
+// be retried.
+type RetryPolicy struct {
+	// total number of tries including the first
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// if the server asks us to wait longer than this we give up instead
+	MaxRetryAfter time.Duration
+
+	// replaceable for tests
+	sleep  func(ctx context.Context, delay time.Duration) error
+	jitter func(delay time.Duration) time.Duration
+}
+
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:   5,
+		BaseDelay:     time.Second,
+		MaxDelay:      30 * time.Second,
+		MaxRetryAfter: 60 * time.Second,
+		sleep:         sleepContext,
+		jitter:        randomJitter,
+	}
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A random delay between half and all of the given delay, so clients that
+// failed together don't all retry together
+func randomJitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// HTTP status code of an API error from any of our clients, or 0
+func errorStatusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// Whether an error is likely to go away if we try again. Rate limits, 5xx
+// responses and dropped connections are, but an exhausted quota or a bad
+// request won't be, nor will a timeout or cancellation since the user has
+// already waited long enough.
+func IsRetryableError(err error) bool {
+	if err == nil ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrTokenTimeout) {
+		return false
+	}
+
+	// OpenAI returns 429 both for rate limits and for running out of credits
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && (apiErr.Code == "insufficient_quota" || apiErr.Type == "insufficient_quota") {
+		return false
+	}
+
+	status := errorStatusCode(err)
+	if status != 0 {
+		return status == http.StatusRequestTimeout ||
+			status == http.StatusTooManyRequests ||
+			status >= 500
+	}
+
+	// the server dropped the connection, e.g. a load balancer closing an idle
+	// keep-alive connection just as we sent the request
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && errors.Is(err, io.EOF) {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// Run call until it succeeds, fails with an error that isn't retryable, or
+// we run out of attempts. The context passed to call carries a slot for the
+// Retry-After value of a failed response, see retryAfterTransport.
+func (this *RetryPolicy) Do(ctx context.Context, call func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 1; ; attempt++ {
+		hint := &retryHint{}
+		err := call(context.WithValue(ctx, retryHintKey{}, hint))
+		if !IsRetryableError(err) {
+			return err
+		}
+
+		status := errorStatusCode(err)
+		if attempt >= this.MaxAttempts {
+			if status == http.StatusTooManyRequests {
+				return fmt.Errorf("Getting 429s from the API, this means you're hitting the rate limit, giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+
+		delay := hint.get()
+		if delay > this.MaxRetryAfter {
+			return fmt.Errorf("The API asked us to retry after %s, giving up: %w", delay, err)
+		}
+		if delay <= 0 {
+			delay = this.BaseDelay << (attempt - 1)
+			if delay > this.MaxDelay || delay <= 0 {
+				delay = this.MaxDelay
+			}
+			delay = this.jitter(delay)
+		}
+
+		reason := "Request failed"
+		if status == http.StatusTooManyRequests {
+			reason = "Rate limited"
+		}
+		log.Printf("%s (%s), retrying in %s\n", reason, err, delay)
+
+		if sleepErr := this.sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+type retryHintKey struct{}
+
+// Where retryAfterTransport leaves the server's requested delay for the
+// retry policy, one per attempt
+type retryHint struct {
+	mutex sync.Mutex
+	delay time.Duration
+}
+
+func (this *retryHint) set(delay time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.delay = delay
+}
+
+func (this *retryHint) get() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.delay
+}
+
+// Parse how long the server wants us to wait, from the retry-after-ms
+// header OpenAI sends or the standard Retry-After header, which is either a
+// number of seconds or an HTTP date. Returns 0 if there's no usable header.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// The OpenAI client doesn't expose response headers on errors, so we catch
+// Retry-After on the way through and hand it to the retry policy via the
+// request context.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (this *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := this.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+
+	if hint, ok := req.Context().Value(retryHintKey{}).(*retryHint); ok {
+		hint.set(parseRetryAfter(resp.Header, time.Now()))
+	}
+	return resp, err
+}
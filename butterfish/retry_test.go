@@ -0,0 +1,149 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	assert.True(t, IsRetryableError(&openai.APIError{HTTPStatusCode: 429, Type: "requests"}))
+	assert.True(t, IsRetryableError(&openai.APIError{HTTPStatusCode: 503}))
+	assert.True(t, IsRetryableError(&openai.RequestError{HTTPStatusCode: 502}))
+	assert.True(t, IsRetryableError(&StatusError{Service: "x", StatusCode: 529}))
+	assert.True(t, IsRetryableError(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	assert.True(t, IsRetryableError(&url.Error{Op: "Post", URL: "x", Err: io.EOF}))
+
+	assert.False(t, IsRetryableError(nil))
+	assert.False(t, IsRetryableError(&openai.APIError{HTTPStatusCode: 429, Type: "insufficient_quota"}))
+	assert.False(t, IsRetryableError(&openai.APIError{HTTPStatusCode: 400}))
+	assert.False(t, IsRetryableError(context.Canceled))
+	assert.False(t, IsRetryableError(NewTokenTimeoutError(time.Second)))
+	assert.False(t, IsRetryableError(errors.New("something else")))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := http.Header{}
+	assert.Equal(t, time.Duration(0), parseRetryAfter(header, now))
+
+	header.Set("Retry-After", "3")
+	assert.Equal(t, 3*time.Second, parseRetryAfter(header, now))
+	header.Set("Retry-After", now.Add(10*time.Second).Format(http.TimeFormat))
+	assert.Equal(t, 10*time.Second, parseRetryAfter(header, now))
+
+	// the millisecond header is more precise so it wins
+	header.Set("Retry-After-Ms", "1500")
+	assert.Equal(t, 1500*time.Millisecond, parseRetryAfter(header, now))
+}
+
+// A GPT client pointed at a test server that doesn't actually sleep,
+// returning the delays it would have slept for
+func testRetryGPT(t *testing.T, handler http.HandlerFunc) (*GPT, *[]time.Duration) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	gpt := NewGPT("token", server.URL)
+	delays := []time.Duration{}
+	gpt.retry.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+	gpt.retry.jitter = func(delay time.Duration) time.Duration { return delay }
+	return gpt, &delays
+}
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	calls := 0
+	gpt, delays := testRetryGPT(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(429)
+			w.Write([]byte(`{"error":{"message":"slow down","type":"requests"}}`))
+		case 2:
+			w.WriteHeader(503)
+			w.Write([]byte(`{"error":{"message":"overloaded","type":"server_error"}}`))
+		default:
+			w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+		}
+	})
+
+	response, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "gpt-4",
+		Prompt:        "hello",
+		SystemMessage: "sys",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", response.Completion)
+	assert.Equal(t, 3, calls)
+	// the server's delay, then our own backoff for the second attempt
+	assert.Equal(t, []time.Duration{7 * time.Second, 2 * time.Second}, *delays)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	calls := 0
+	gpt, delays := testRetryGPT(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(429)
+		w.Write([]byte(`{"error":{"message":"slow down","type":"requests"}}`))
+	})
+
+	_, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "gpt-4",
+		Prompt:        "hello",
+		SystemMessage: "sys",
+	})
+	assert.ErrorContains(t, err, "giving up after 5 attempts")
+	// still failover-able since the status code is preserved
+	assert.True(t, IsFailoverError(err))
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, *delays)
+}
+
+func TestRetryNotAfterStreamedOutput(t *testing.T) {
+	calls := 0
+	gpt, _ := testRetryGPT(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(502)
+			return
+		}
+
+		// send a chunk then drop the connection
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"partial\"}}]}\n\n"))
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+
+	output := &trackingWriter{writer: io.Discard}
+	_, err := gpt.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "gpt-4",
+		Prompt:        "hello",
+		SystemMessage: "sys",
+	}, output)
+
+	assert.Error(t, err)
+	assert.True(t, output.written)
+	// one retry for the 502 when opening the stream, none after the chunk
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,328 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Name of the function we force the model to call when a provider doesn't
+// have a structured output mode, the arguments are the response
+const schemaFunctionName = "respond"
+
+// Description of the function we force the model to call
+const schemaFunctionDescription = "Respond to the user with JSON matching the schema."
+
+// If the response came back as a forced call to the schema function, move
+// the arguments into Completion where callers expect the JSON
+func applySchemaResponse(response *util.CompletionResponse) {
+	for i, toolCall := range response.ToolCalls {
+		if toolCall.Function.Name != schemaFunctionName {
+			continue
+		}
+		response.Completion = toolCall.Function.Parameters
+		response.ToolCalls = append(response.ToolCalls[:i], response.ToolCalls[i+1:]...)
+		if len(response.ToolCalls) == 0 {
+			response.ToolCalls = nil
+		}
+		return
+	}
+}
+
+// Pull a JSON value out of a model response, models in JSON mode sometimes
+// still wrap their answer in a markdown code block
+func extractJSON(text string) string {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+	return strings.TrimSpace(text)
+}
+
+// SchemaError lists every way a document fails to match a schema
+type SchemaError struct {
+	Problems []string
+}
+
+func (this *SchemaError) Error() string {
+	return "JSON does not match schema:\n  " + strings.Join(this.Problems, "\n  ")
+}
+
+// Validate a JSON document against a JSON schema. This covers the keywords
+// that matter for describing LLM output: type, enum, const, properties,
+// required, additionalProperties, items, the min/max length, item, and
+// value constraints, pattern, allOf/anyOf/oneOf/not, and local $refs.
+// Other keywords are ignored. Returns a *SchemaError if the document
+// doesn't match.
+func ValidateJSONSchema(schema, document []byte) error {
+	var root any
+	err := json.Unmarshal(schema, &root)
+	if err != nil {
+		return fmt.Errorf("Invalid JSON schema: %s", err)
+	}
+
+	var value any
+	err = json.Unmarshal(document, &value)
+	if err != nil {
+		return &SchemaError{Problems: []string{fmt.Sprintf("invalid JSON: %s", err)}}
+	}
+
+	validator := &schemaValidator{root: root}
+	validator.validate(root, value, "$")
+	if len(validator.problems) > 0 {
+		return &SchemaError{Problems: validator.problems}
+	}
+	return nil
+}
+
+type schemaValidator struct {
+	root     any
+	problems []string
+}
+
+func (this *schemaValidator) fail(path, format string, a ...any) {
+	this.problems = append(this.problems, path+": "+fmt.Sprintf(format, a...))
+}
+
+// Resolve a local reference like #/$defs/item
+func (this *schemaValidator) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local $refs are supported, got %s", ref)
+	}
+
+	node := this.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("can't resolve $ref %s", ref)
+		}
+		node, ok = obj[part]
+		if !ok {
+			return nil, fmt.Errorf("can't resolve $ref %s", ref)
+		}
+	}
+	return node, nil
+}
+
+func jsonTypeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func typeMatches(wanted, actual string) bool {
+	return wanted == actual || (wanted == "number" && actual == "integer")
+}
+
+func (this *schemaValidator) validate(schemaNode any, value any, path string) {
+	// true accepts anything, false accepts nothing
+	if allowed, ok := schemaNode.(bool); ok {
+		if !allowed {
+			this.fail(path, "not allowed")
+		}
+		return
+	}
+	schema, ok := schemaNode.(map[string]any)
+	if !ok {
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := this.resolve(ref)
+		if err != nil {
+			this.fail(path, "%s", err)
+			return
+		}
+		this.validate(resolved, value, path)
+	}
+
+	actual := jsonTypeOf(value)
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		matched := false
+		for _, wanted := range types {
+			matched = matched || typeMatches(wanted, actual)
+		}
+		if !matched {
+			this.fail(path, "expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, option := range enum {
+			found = found || reflect.DeepEqual(option, value)
+		}
+		if !found {
+			this.fail(path, "must be one of %s", JSONString(enum))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		this.fail(path, "must be %s", JSONString(constant))
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		this.validateObject(schema, v, path)
+	case []any:
+		this.validateArray(schema, v, path)
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := schema["minLength"].(float64); ok && length < min {
+			this.fail(path, "must be at least %v characters", min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && length > max {
+			this.fail(path, "must be at most %v characters", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(v) {
+				this.fail(path, "must match pattern %s", pattern)
+			}
+		}
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && v < min {
+			this.fail(path, "must be >= %v", min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && v > max {
+			this.fail(path, "must be <= %v", max)
+		}
+		if min, ok := schema["exclusiveMinimum"].(float64); ok && v <= min {
+			this.fail(path, "must be > %v", min)
+		}
+		if max, ok := schema["exclusiveMaximum"].(float64); ok && v >= max {
+			this.fail(path, "must be < %v", max)
+		}
+	}
+
+	this.validateCombinators(schema, value, path)
+}
+
+func schemaTypes(node any) []string {
+	switch t := node.(type) {
+	case string:
+		return []string{t}
+	case []any:
+		types := []string{}
+		for _, item := range t {
+			if str, ok := item.(string); ok {
+				types = append(types, str)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func (this *schemaValidator) validateObject(schema map[string]any, obj map[string]any, path string) {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if str, ok := name.(string); ok {
+				if _, present := obj[str]; !present {
+					this.fail(path, "missing required property %q", str)
+				}
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+
+	// sort keys so problems are reported in a stable order
+	keys := []string{}
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "." + key
+		if propSchema, ok := properties[key]; ok {
+			this.validate(propSchema, obj[key], childPath)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				this.fail(path, "unexpected property %q", key)
+			}
+		case map[string]any:
+			this.validate(additional, obj[key], childPath)
+		}
+	}
+}
+
+func (this *schemaValidator) validateArray(schema map[string]any, arr []any, path string) {
+	length := float64(len(arr))
+	if min, ok := schema["minItems"].(float64); ok && length < min {
+		this.fail(path, "must have at least %v items", min)
+	}
+	if max, ok := schema["maxItems"].(float64); ok && length > max {
+		this.fail(path, "must have at most %v items", max)
+	}
+
+	if items, ok := schema["items"]; ok {
+		for i, item := range arr {
+			this.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// Check value against each subschema without recording problems, returning
+// how many it matched
+func (this *schemaValidator) countMatches(subschemas []any, value any, path string) int {
+	matches := 0
+	for _, subschema := range subschemas {
+		sub := &schemaValidator{root: this.root}
+		sub.validate(subschema, value, path)
+		if len(sub.problems) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func (this *schemaValidator) validateCombinators(schema map[string]any, value any, path string) {
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for _, subschema := range allOf {
+			this.validate(subschema, value, path)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok && this.countMatches(anyOf, value, path) == 0 {
+		this.fail(path, "must match at least one schema in anyOf")
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok && this.countMatches(oneOf, value, path) != 1 {
+		this.fail(path, "must match exactly one schema in oneOf")
+	}
+	if not, ok := schema["not"]; ok && this.countMatches([]any{not}, value, path) == 1 {
+		this.fail(path, "must not match schema in not")
+	}
+}
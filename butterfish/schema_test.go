@@ -0,0 +1,136 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const testSchema = `{
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "count": {"type": "integer", "minimum": 0},
+    "tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2},
+    "kind": {"enum": ["file", "dir"]}
+  },
+  "required": ["name", "count"],
+  "additionalProperties": false,
+  "$defs": {
+    "tag": {"type": "string", "pattern": "^[a-z]+$"}
+  }
+}`
+
+func TestValidateJSONSchema(t *testing.T) {
+	valid := `{"name": "a", "count": 2, "tags": ["x", "y"], "kind": "dir"}`
+	assert.NoError(t, ValidateJSONSchema([]byte(testSchema), []byte(valid)))
+
+	err := ValidateJSONSchema([]byte(testSchema),
+		[]byte(`{"name": "", "count": 1.5, "tags": ["x", "Y", "z"], "kind": "link", "extra": 1}`))
+	var schemaErr *SchemaError
+	assert.True(t, errors.As(err, &schemaErr))
+	assert.Equal(t, []string{
+		"$.count: expected integer, got number",
+		"$: unexpected property \"extra\"",
+		"$.kind: must be one of [\"file\",\"dir\"]",
+		"$.name: must be at least 1 characters",
+		"$.tags: must have at most 2 items",
+		"$.tags[1]: must match pattern ^[a-z]+$",
+	}, schemaErr.Problems)
+
+	err = ValidateJSONSchema([]byte(testSchema), []byte(`{"name": "a"}`))
+	assert.EqualError(t, err, "JSON does not match schema:\n  $: missing required property \"count\"")
+
+	err = ValidateJSONSchema([]byte(testSchema), []byte(`Sure! Here's the JSON`))
+	assert.True(t, errors.As(err, &schemaErr))
+
+	oneOf := `{"oneOf": [{"type": "string"}, {"type": "number"}]}`
+	assert.NoError(t, ValidateJSONSchema([]byte(oneOf), []byte(`3`)))
+	assert.Error(t, ValidateJSONSchema([]byte(oneOf), []byte(`true`)))
+}
+
+func TestExtractJSON(t *testing.T) {
+	assert.Equal(t, `{"a":1}`, extractJSON(" {\"a\":1}\n"))
+	assert.Equal(t, `{"a":1}`, extractJSON("```json\n{\"a\":1}\n```"))
+}
+
+func TestApplySchemaResponse(t *testing.T) {
+	response := &util.CompletionResponse{
+		ToolCalls: []*util.ToolCall{{
+			Function: util.FunctionCall{Name: schemaFunctionName, Parameters: `{"a":1}`},
+		}},
+	}
+	applySchemaResponse(response)
+	assert.Equal(t, `{"a":1}`, response.Completion)
+	assert.Nil(t, response.ToolCalls)
+}
+
+// Returns each of its responses in turn
+type scriptedLLM struct {
+	fakeLLM
+	responses []string
+	requests  []*util.CompletionRequest
+}
+
+func (this *scriptedLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	copied := *request
+	this.requests = append(this.requests, &copied)
+	response := this.responses[0]
+	this.responses = this.responses[1:]
+	return &util.CompletionResponse{Completion: response}, nil
+}
+
+func TestPromptSchema(t *testing.T) {
+	schemaPath := filepath.Join(t.TempDir(), "schema.json")
+	os.WriteFile(schemaPath, []byte(testSchema), 0600)
+
+	llm := &scriptedLLM{responses: []string{
+		`{"name": "a"}`,
+		"```json\n{\"name\": \"a\", \"count\": 1}\n```",
+	}}
+	out := new(bytes.Buffer)
+	ctx := &ButterfishCtx{
+		Ctx:       context.Background(),
+		Config:    MakeButterfishConfig(),
+		LLMClient: llm,
+		Out:       out,
+	}
+	cmd := &promptCommand{Prompt: "count things", SysMsg: "sys", Model: "gpt-4"}
+
+	// the first response is missing a field so we ask for a repair
+	_, err := ctx.PromptSchema(cmd, schemaPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"name\":\"a\",\"count\":1}\n", out.String())
+	assert.Equal(t, 2, len(llm.requests))
+	assert.JSONEq(t, testSchema, string(llm.requests[0].ResponseSchema))
+	repair := llm.requests[1]
+	assert.Equal(t, 2, len(repair.HistoryBlocks))
+	assert.Equal(t, `{"name": "a"}`, repair.HistoryBlocks[1].Content)
+	assert.Contains(t, repair.Prompt, `missing required property "count"`)
+
+	// give up after one repair
+	out.Reset()
+	llm.responses = []string{`{}`, `{}`}
+	_, err = ctx.PromptSchema(cmd, schemaPath)
+	assert.Error(t, err)
+	assert.Equal(t, "", out.String())
+}
+
+func TestAnthropicResponseSchema(t *testing.T) {
+	anthropic := NewAnthropic("token", "")
+	req, err := anthropic.buildRequest(&util.CompletionRequest{
+		Model:          "claude-3-haiku-20240307",
+		Prompt:         "hi",
+		ResponseSchema: []byte(testSchema),
+	}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, schemaFunctionName, req.Tools[0].Name)
+	assert.Equal(t, map[string]string{"type": "tool", "name": schemaFunctionName}, req.ToolChoice)
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -21,7 +22,7 @@ import (
 	"github.com/bakks/butterfish/util"
 	"github.com/sashabaranov/go-openai/jsonschema"
 
-	"github.com/bakks/tiktoken-go"
+	"github.com/mitchellh/go-homedir"
 	"github.com/mitchellh/go-ps"
 	"golang.org/x/term"
 )
@@ -73,7 +74,7 @@ var LightShellColorScheme = &ShellColorScheme{
 func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	envVars := []string{"BUTTERFISH_SHELL=1"}
 
-	ptmx, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
+	ptmx, childPid, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
 	if err != nil {
 		return err
 	}
@@ -85,7 +86,7 @@ func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	}
 	//fmt.Println("Starting butterfish shell")
 
-	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout)
+	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout, childPid)
 	return nil
 }
 
@@ -135,6 +136,129 @@ type HistoryBuffer struct {
 	// This is to cache tokenization plus truncation of the content
 	// It maps from encoding name to the tokenization of the output
 	Tokenizations map[string]Tokenization
+
+	// masks secrets as they're written, nil if redaction is disabled
+	redactor *Redactor
+	// Written data is redacted a line at a time so a secret split across
+	// writes is still caught, this holds the incomplete last line
+	pending string
+	// true while we're inside a multi-line private key
+	inPrivateKey bool
+	// true once the block has been saved to a history session, or if it was
+	// loaded from one
+	stored bool
+	// shell and function output is written to a virtual terminal so we keep
+	// what the user saw rather than every redraw, rows are redacted as they
+	// scroll off its screen. This is nil for other blocks.
+	screen *VirtualTerminal
+}
+
+// Longest incomplete line we hold back before redacting it anyway, e.g. a
+// block without a virtual terminal that never ends the line
+const maxPendingHistoryBytes = 4096
+
+// Write data to the content, masking secrets with the block's redactor.
+// Returns what was masked.
+func (this *HistoryBuffer) write(data string) []Redaction {
+	if this.screen != nil {
+		this.screen.Write(data)
+		data = this.screen.Flush()
+		// the screen can change without changing size, e.g. a progress bar
+		this.Tokenizations = nil
+	}
+
+	if this.redactor == nil {
+		this.Content.Write(data)
+		return nil
+	}
+
+	this.pending += data
+	end := strings.LastIndexByte(this.pending, '\n')
+	if end < 0 {
+		if len(this.pending) < maxPendingHistoryBytes {
+			return nil
+		}
+		end = len(this.pending) - 1
+	}
+
+	lines := this.pending[:end+1]
+	this.pending = this.pending[end+1:]
+	return this.writeLines(lines)
+}
+
+// Redact and write the incomplete last line, called when the block is done
+func (this *HistoryBuffer) flush() []Redaction {
+	if this.screen != nil {
+		this.pending += this.screen.String()
+		this.screen = nil
+	}
+	if this.redactor == nil {
+		this.Content.Write(this.pending)
+		this.pending = ""
+		return nil
+	}
+
+	lines := this.pending
+	this.pending = ""
+	return this.writeLines(lines)
+}
+
+func (this *HistoryBuffer) writeLines(data string) []Redaction {
+	var redactions []Redaction
+
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			continue
+		}
+		if this.inPrivateKey {
+			// the key was masked when it began, drop it up to the end marker
+			loc := privateKeyEndRegex.FindStringIndex(line)
+			if loc == nil {
+				continue
+			}
+			this.inPrivateKey = false
+			line = line[loc[1]:]
+		}
+
+		redacted, found := this.redactor.Redact(line)
+		redactions = append(redactions, found...)
+		this.inPrivateKey = this.redactor.opensPrivateKey(line)
+		this.Content.Write(redacted)
+	}
+
+	return redactions
+}
+
+// The content including any incomplete line and the screen, redacted
+func (this *HistoryBuffer) String() string {
+	content := this.Content.String()
+	rest := this.pending
+	if this.screen != nil {
+		rest += this.screen.String()
+	}
+	if this.inPrivateKey {
+		// the key was masked when it began
+		loc := privateKeyEndRegex.FindStringIndex(rest)
+		if loc == nil {
+			return content
+		}
+		rest = rest[loc[1]:]
+	}
+	if rest == "" {
+		return content
+	}
+	rest, _ = this.redactor.Redact(rest)
+	return content + rest
+}
+
+// Size of the content plus any incomplete line and the screen, this changes
+// whenever the block is written to unless it has a screen
+func (this *HistoryBuffer) Size() int {
+	size := this.Content.Size() + len(this.pending)
+	if this.screen != nil {
+		size += this.screen.Size()
+	}
+	return size
 }
 
 func (this *HistoryBuffer) SetTokenization(encoding string, inputLength int, numTokens int, data string) {
@@ -169,22 +293,193 @@ func (this *HistoryBuffer) GetTokenization(encoding string, length int) (string,
 // HistoryBlocks.
 type ShellHistory struct {
 	Blocks []*HistoryBuffer
-	mutex  sync.Mutex
+	// masks secrets in new blocks, nil if redaction is disabled
+	redactor *Redactor
+	// secrets masked by redactor, most recent last
+	Redactions []Redaction
+	// if set, blocks are saved to this session as they're finished
+	session *HistorySession
+	// if set, finished blocks are embedded so they can be recalled later
+	recall *RecallIndex
+	// the width of the screen output blocks are rendered on, 0 if unknown
+	terminalWidth int
+	mutex         sync.Mutex
+}
+
+// Keep this many redactions to show in History
+const maxHistoryRedactions = 100
+
+func (this *ShellHistory) recordRedactions(redactions []Redaction) {
+	if len(redactions) == 0 {
+		return
+	}
+	this.Redactions = append(this.Redactions, redactions...)
+	if len(this.Redactions) > maxHistoryRedactions {
+		this.Redactions = this.Redactions[len(this.Redactions)-maxHistoryRedactions:]
+	}
+}
+
+func (this *ShellHistory) GetRedactions() []Redaction {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]Redaction{}, this.Redactions...)
 }
 
 func NewShellHistory() *ShellHistory {
 	return &ShellHistory{
-		Blocks: make([]*HistoryBuffer, 0),
+		Blocks:   make([]*HistoryBuffer, 0),
+		redactor: NewRedactor(),
+	}
+}
+
+func (this *ShellHistory) Redactor() *Redactor {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.redactor
+}
+
+// Set the redactor for blocks added from now on, nil turns redaction off
+func (this *ShellHistory) SetRedactor(redactor *Redactor) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.redactor = redactor
+}
+
+// The last block is done, redact its incomplete line, save it to the
+// session and queue it for recall if we have them. Blocks aren't written to
+// after this.
+func (this *ShellHistory) finishLastBlock() {
+	numBlocks := len(this.Blocks)
+	if numBlocks == 0 {
+		return
+	}
+	block := this.Blocks[numBlocks-1]
+	this.recordRedactions(block.flush())
+
+	if block.stored || (this.session == nil && this.recall == nil) {
+		return
+	}
+	block.stored = true
+	stored := StoredBlock{
+		Time:           time.Now(),
+		Type:           block.Type,
+		Content:        sanitizeTTYString(block.String()),
+		FunctionName:   block.FunctionName,
+		FunctionParams: block.FunctionParams,
+	}
+
+	sessionName := ""
+	if this.session != nil {
+		sessionName = this.session.Name()
+		err := this.session.Append(stored)
+		if err != nil {
+			log.Printf("Error saving history block: %s", err)
+		}
+	}
+	if this.recall != nil {
+		this.recall.Add(sessionName, stored)
+	}
+}
+
+// Embed finished blocks in index so they can be recalled
+func (this *ShellHistory) SetRecall(index *RecallIndex) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.recall = index
+}
+
+// Save the last block, called when the shell exits
+func (this *ShellHistory) Close() {
+	this.mutex.Lock()
+	this.finishLastBlock()
+	recall := this.recall
+	this.mutex.Unlock()
+
+	// wait for blocks to be embedded before we exit
+	if recall != nil {
+		flushRecall(recall)
+	}
+}
+
+// Replace the history with blocks loaded from a session and save new blocks
+// to that session. A nil session turns saving off. Loaded blocks are redacted
+// again, the session may have been saved with redaction off or before a
+// pattern was added.
+func (this *ShellHistory) SetSession(session *HistorySession, blocks []StoredBlock) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.finishLastBlock()
+	this.session = session
+	this.Blocks = make([]*HistoryBuffer, 0, len(blocks))
+	for _, stored := range blocks {
+		params, redactions := this.redactor.Redact(stored.FunctionParams)
+		this.recordRedactions(redactions)
+		buffer := &HistoryBuffer{
+			Type:           stored.Type,
+			Content:        NewShellBuffer(),
+			FunctionName:   stored.FunctionName,
+			FunctionParams: params,
+			redactor:       this.redactor,
+			stored:         true,
+		}
+		this.recordRedactions(buffer.write(stored.Content))
+		this.recordRedactions(buffer.flush())
+		this.Blocks = append(this.Blocks, buffer)
+	}
+}
+
+// Drop all history without saving the last block, e.g. after its session
+// was deleted
+func (this *ShellHistory) Clear() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.session = nil
+	this.Blocks = make([]*HistoryBuffer, 0)
+}
+
+// Remove the last n blocks, or all of them if there are fewer, returning
+// how many were removed. The last block is saved first so a session keeps
+// everything, this only changes what we send to the LLM.
+func (this *ShellHistory) DropLast(n int) int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.finishLastBlock()
+	if n > len(this.Blocks) {
+		n = len(this.Blocks)
 	}
+	this.Blocks = this.Blocks[:len(this.Blocks)-n]
+	return n
+}
+
+func (this *ShellHistory) Session() *HistorySession {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.session
+}
+
+// Set the width of the terminal output is shown on, so we wrap it like the
+// terminal did. This applies to blocks added after it's called.
+func (this *ShellHistory) SetTerminalWidth(width int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.terminalWidth = width
 }
 
 func (this *ShellHistory) add(historyType int, block string) {
-	buffer := NewShellBuffer()
-	buffer.Write(block)
-	this.Blocks = append(this.Blocks, &HistoryBuffer{
-		Type:    historyType,
-		Content: buffer,
-	})
+	this.finishLastBlock()
+
+	buffer := &HistoryBuffer{
+		Type:     historyType,
+		Content:  NewShellBuffer(),
+		redactor: this.redactor,
+	}
+	if historyType == historyTypeShellOutput || historyType == historyTypeFunctionOutput {
+		buffer.screen = NewVirtualTerminal(this.terminalWidth, defaultVirtualTerminalRows)
+	}
+	this.recordRedactions(buffer.write(block))
+	this.Blocks = append(this.Blocks, buffer)
 }
 
 func (this *ShellHistory) Append(historyType int, data string) {
@@ -201,8 +496,9 @@ func (this *ShellHistory) Append(historyType int, data string) {
 	if numBlocks > 0 {
 		lastBlock := this.Blocks[numBlocks-1]
 
-		if lastBlock.Type == historyType {
-			lastBlock.Content.Write(data)
+		// stored blocks are finished, e.g. if they were loaded from a session
+		if lastBlock.Type == historyType && !lastBlock.stored {
+			this.recordRedactions(lastBlock.write(data))
 			return
 		}
 	}
@@ -215,6 +511,8 @@ func (this *ShellHistory) AddFunctionCall(name, params string) {
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
+	this.finishLastBlock()
+
 	this.Blocks = append(this.Blocks, &HistoryBuffer{
 		Type:           historyTypeLLMOutput,
 		FunctionName:   name,
@@ -237,8 +535,9 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	// if we have a block already, and it matches the type, append to it
 	if numBlocks > 0 {
 		lastBlock = this.Blocks[numBlocks-1]
-		if lastBlock.Type == historyTypeFunctionOutput && lastBlock.FunctionName == name {
-			lastBlock.Content.Write(data)
+		if lastBlock.Type == historyTypeFunctionOutput && lastBlock.FunctionName == name &&
+			!lastBlock.stored {
+			this.recordRedactions(lastBlock.write(data))
 			return
 		}
 	}
@@ -258,7 +557,7 @@ func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util
 
 	for i := len(this.Blocks) - 1; i >= 0 && numBytes > 0; i-- {
 		block := this.Blocks[i]
-		content := sanitizeTTYString(block.Content.String())
+		content := sanitizeTTYString(block.String())
 		if len(content) > truncateLength {
 			content = content[:truncateLength]
 		}
@@ -305,7 +604,10 @@ func (this *ShellHistory) LogRecentHistory() {
 	log.Printf("=======================================")
 }
 
-func HistoryBlocksToString(blocks []util.HistoryBlock) string {
+// Join history blocks into a string for a prompt. History is redacted as
+// it's recorded, but we mask with redactor again in case a block got in some
+// other way.
+func HistoryBlocksToString(blocks []util.HistoryBlock, redactor *Redactor) string {
 	var sb strings.Builder
 	for i, block := range blocks {
 		if i > 0 {
@@ -313,7 +615,8 @@ func HistoryBlocksToString(blocks []util.HistoryBlock) string {
 		}
 		sb.WriteString(block.Content)
 	}
-	return sb.String()
+	redacted, _ := redactor.Redact(sb.String())
+	return redacted
 }
 
 const (
@@ -351,7 +654,9 @@ type ShellState struct {
 	Butterfish *ButterfishCtx
 	ParentOut  io.Writer
 	ChildIn    io.Writer
-	Sigwinch   chan os.Signal
+	// pid of the wrapped shell, 0 if unknown
+	ChildPid int
+	Sigwinch chan os.Signal
 
 	// set based on model
 	PromptMaxTokens      int
@@ -365,6 +670,10 @@ type ShellState struct {
 	GoalModeUnsafe       bool
 	ActiveFunction       string
 	PromptSuffixCounter  int
+	PromptIntegration    string // PromptIntegrationPS1 or PromptIntegrationOSC133
+	ReportsCommands      bool   // the shell reports the commands it runs
+	Foreground           *ForegroundDetector
+	AltScreen            *AltScreenTracker // keeps full-screen programs out of history
 	ChildOutReader       chan *byteMsg
 	ParentInReader       chan *byteMsg
 	CursorPosChan        chan *cursorPosition
@@ -372,6 +681,10 @@ type ShellState struct {
 	PrintErrorChan       chan error
 	AutosuggestChan      chan *AutosuggestResult
 	History              *ShellHistory
+	HistoryStore         *HistoryStore // saved history sessions, may be nil
+	Recall               *RecallIndex  // embedded past history, may be nil
+	LocalCommands        []*LocalCommand
+	PinnedFiles          []string // added to every prompt, see PinCommand
 	PromptAnswerWriter   io.Writer
 	StyleWriter          *util.StyleCodeblocksWriter
 	Prompt               *ShellBuffer
@@ -382,8 +695,13 @@ type ShellState struct {
 	LastTabPassthrough   time.Time
 	parentInBuffer       []byte
 	// these are used to estimate number of tokens
-	AutosuggestEncoder *tiktoken.Tiktoken
-	PromptEncoder      *tiktoken.Tiktoken
+	AutosuggestTokenizer Tokenizer
+	PromptTokenizer      Tokenizer
+	// characters in the last prompt request and the tokenizer used to
+	// budget it, to calibrate a ProviderTokenizer against the count the API
+	// reports
+	promptRequestChars     int
+	promptRequestTokenizer Tokenizer
 
 	// autosuggest config
 	AutosuggestEnabled bool
@@ -391,6 +709,8 @@ type ShellState struct {
 	AutosuggestCtx     context.Context
 	AutosuggestCancel  context.CancelFunc
 	AutosuggestBuffer  *ShellBuffer
+	// true once we've told the user the autosuggest budget is spent
+	AutosuggestBudgetNoticed bool
 }
 
 func (this *ShellState) setState(state int) {
@@ -458,6 +778,16 @@ Please submit an issue to https://github.com/bakks/butterfish.`)
 	}
 }
 
+// fish has no PS1, the prompt is printed by the fish_prompt function. We keep
+// the user's function as __butterfish_fish_prompt and wrap it, restoring
+// $status first so the user's prompt still sees the last exit code. The
+// copy is skipped if it already exists, e.g. if we're nested in butterfish.
+const fishPromptFormat = "functions -q __butterfish_fish_prompt; or functions -c fish_prompt __butterfish_fish_prompt; " +
+	"function __butterfish_status; return $argv[1]; end; " +
+	"function fish_prompt; set -l butterfish_status $status; printf '%s'; " +
+	"__butterfish_status $butterfish_status; __butterfish_fish_prompt; " +
+	"printf '%s %%s%s ' $butterfish_status; end\n"
+
 // This sets the PS1 shell variable, which is the prompt that the shell
 // displays before each command.
 // We need to be able to parse the child shell's prompt to determine where
@@ -477,6 +807,8 @@ func (this *ButterfishCtx) SetPS1(childIn io.Writer) {
 		// the %%{ and %%} are zsh-specific and tell zsh to not count the enclosed
 		// characters when calculating the cursor position
 		ps1 = "PS1=$'%%{%s%%}'$PS1$'%s%%{ %%?%s%%} '\n"
+	case "fish":
+		ps1 = fishPromptFormat
 	default:
 		log.Printf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command, used for certain features. Create an issue at https://github.com/bakks/butterfish.", shell)
 		return
@@ -566,9 +898,11 @@ func (this *ShellState) FilterChildOut(data string) bool {
 
 func (this *ButterfishCtx) ShellMultiplexer(
 	childIn io.Writer, childOut io.Reader,
-	parentIn io.Reader, parentOut io.Writer) {
+	parentIn io.Reader, parentOut io.Writer,
+	childPid int) {
 
-	this.SetPS1(childIn)
+	promptIntegration := this.SetShellIntegration(childIn)
+	ptmx, _ := childIn.(*os.File)
 
 	colorScheme := DarkShellColorScheme
 	if !this.Config.ShellColorDark {
@@ -599,6 +933,7 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		Butterfish:           this,
 		ParentOut:            parentOut,
 		ChildIn:              childIn,
+		ChildPid:             childPid,
 		Sigwinch:             sigwinch,
 		State:                stateNormal,
 		ChildOutReader:       childOutReader,
@@ -613,16 +948,52 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		Prompt:               NewShellBuffer(),
 		TerminalWidth:        termWidth,
 		AutosuggestEnabled:   this.Config.ShellAutosuggestEnabled,
+		LocalCommands:        DefaultLocalCommands(),
 		AutosuggestChan:      make(chan *AutosuggestResult),
 		Color:                colorScheme,
+		PromptIntegration:    promptIntegration,
+		Foreground:           NewForegroundDetector(ptmx, childPid),
+		AltScreen:            NewAltScreenTracker(),
 		parentInBuffer:       []byte{},
-		PromptMaxTokens:      NumTokensForModel(this.Config.ShellPromptModel),
-		AutosuggestMaxTokens: NumTokensForModel(this.Config.ShellAutosuggestModel),
+		PromptMaxTokens:      this.ContextLengthForModel(this.LLMClient, this.Config.ShellPromptModel),
+		AutosuggestMaxTokens: this.ContextLengthForModel(this.AutosuggestLLMClient, this.Config.ShellAutosuggestModel),
 	}
+	shellState.History.SetRedactor(this.HistoryRedactor)
 
+	shellState.History.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetColor(colorScheme.Prompt)
 
+	if this.Config.ShellHistoryPath != "" {
+		storePath, err := homedir.Expand(this.Config.ShellHistoryPath)
+		if err != nil {
+			log.Printf("Error expanding history store path: %s", err)
+		} else {
+			shellState.HistoryStore = NewHistoryStore(storePath, this.Config.ShellHistoryRetention)
+		}
+	}
+	if this.Config.ShellRecallEnabled && this.Config.ShellRecallPath != "" {
+		recallPath, err := homedir.Expand(this.Config.ShellRecallPath)
+		if err != nil {
+			log.Printf("Error expanding recall index path: %s", err)
+		} else {
+			shellState.Recall = NewRecallIndex(recallPath, this, this.Config.ShellHistoryRetention)
+			err = shellState.Recall.Load()
+			if err != nil {
+				log.Printf("Error loading recall index: %s", err)
+			}
+			shellState.History.SetRecall(shellState.Recall)
+		}
+	}
+	if this.Config.ShellHistorySession != "" && shellState.HistoryStore != nil {
+		numBlocks, err := shellState.ResumeSession(this.Config.ShellHistorySession)
+		if err != nil {
+			log.Printf("Error loading history session: %s", err)
+		} else {
+			log.Printf("Loaded %d history blocks from session %s", numBlocks, this.Config.ShellHistorySession)
+		}
+	}
+
 	go readerToChannel(childOut, childOutReader)
 	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan)
 
@@ -631,6 +1002,25 @@ func (this *ButterfishCtx) ShellMultiplexer(
 
 	// start
 	shellState.Mux()
+
+	// the shell has exited, save the last block
+	shellState.History.Close()
+}
+
+// Load recent history from a saved session, as much as fits in the prompt
+// history window, and save new history to the session. Returns the number
+// of blocks loaded.
+func (this *ShellState) ResumeSession(name string) (int, error) {
+	session, err := this.HistoryStore.Open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	maxTokens := this.PromptMaxTokens - this.Butterfish.Config.ShellMaxResponseTokens
+	blocks := recentStoredBlocks(session.Blocks(), this.getPromptTokenizer(),
+		this.Butterfish.Config.ShellMaxHistoryBlockTokens, maxTokens)
+	this.History.SetSession(session, blocks)
+	return len(blocks), nil
 }
 
 func (this *ShellState) Errorf(format string, args ...any) {
@@ -703,6 +1093,8 @@ func parseFinishParams(params string) (bool, error) {
 func (this *ShellState) Mux() {
 	log.Printf("Started shell mux")
 	childOutBuffer := []byte{}
+	// what the buffered child output adds to history
+	childHistoryBuffer := ""
 
 	for {
 		select {
@@ -736,6 +1128,7 @@ func (this *ShellState) Mux() {
 				log.Printf("Got SIGWINCH with new width %d", termWidth)
 			}
 			this.TerminalWidth = termWidth
+			this.History.SetTerminalWidth(termWidth)
 			this.Prompt.SetTerminalWidth(termWidth)
 			this.StyleWriter.SetTerminalWidth(termWidth)
 			if this.AutosuggestBuffer != nil {
@@ -769,6 +1162,10 @@ func (this *ShellState) Mux() {
 		// We got an LLM prompt response, handle the response by adding to history,
 		// calling functions returned, etc.
 		case output := <-this.PromptOutputChan:
+			if tokenizer, ok := this.promptRequestTokenizer.(*ProviderTokenizer); ok && output.Usage != nil {
+				tokenizer.Observe(this.promptRequestChars, output.Usage.PromptTokens)
+			}
+
 			historyData := output.Completion
 			if historyData != "" {
 				this.History.Append(historyTypeLLMOutput, historyData)
@@ -780,8 +1177,9 @@ func (this *ShellState) Mux() {
 			// If there is child output waiting to be printed, print that now
 			if len(childOutBuffer) > 0 {
 				this.ParentOut.Write(childOutBuffer)
-				this.History.Append(historyTypeShellOutput, string(childOutBuffer))
+				this.History.Append(historyTypeShellOutput, childHistoryBuffer)
 				childOutBuffer = []byte{}
+				childHistoryBuffer = ""
 			}
 
 			// Get a new prompt
@@ -810,8 +1208,39 @@ func (this *ShellState) Mux() {
 				log.Printf("Child out: %x", string(childOutMsg.Data))
 			}
 
-			lastStatus, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
+			var lastStatus, prompts int
+			var commands []string
+			var childOutStr string
+			if this.PromptIntegration == PromptIntegrationOSC133 {
+				lastStatus, prompts, commands, childOutStr = ParseOSC133(string(childOutMsg.Data))
+			} else {
+				lastStatus, prompts, childOutStr = this.ParsePS1(string(childOutMsg.Data))
+			}
 			this.PromptSuffixCounter += prompts
+			if prompts > 0 {
+				// a command has finished
+				this.invalidateForeground()
+			}
+
+			// what the output adds to history and goal mode function output,
+			// without anything drawn by full-screen programs
+			historyOutStr := this.AltScreen.Filter(childOutStr, this.fullScreenAppName)
+			if prompts > 0 {
+				// the shell is back, so a program that's still on the alternate
+				// screen exited without switching back
+				historyOutStr += this.AltScreen.End()
+			}
+
+			// the shell told us what command it's running, goal mode commands
+			// are already in history as function calls
+			if len(commands) > 0 {
+				this.ReportsCommands = true
+				if !this.GoalMode && this.ActiveFunction == "" {
+					for _, command := range commands {
+						this.History.Append(historyTypeShellInput, command)
+					}
+				}
+			}
 
 			if prompts > 0 && this.State == stateNormal && !this.GoalMode {
 				// If we get a prompt and we're at the start of a command
@@ -827,13 +1256,14 @@ func (this *ShellState) Mux() {
 				// In goal mode we throw it away
 				if !this.GoalMode {
 					childOutBuffer = append(childOutBuffer, childOutStr...)
+					childHistoryBuffer += historyOutStr
 				}
 				continue
 			}
 
 			endOfFunctionCall := false
 			if this.GoalMode {
-				this.GoalModeBuffer += childOutStr
+				this.GoalModeBuffer += historyOutStr
 				if this.PromptSuffixCounter >= 2 {
 					// this means that since starting to collect command function call
 					// output, we've seen two prompts, which means the function call
@@ -849,9 +1279,9 @@ func (this *ShellState) Mux() {
 			// completion, or something unknown, so we don't want to add to history.
 			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
 				if this.ActiveFunction != "" {
-					this.History.AppendFunctionOutput(this.ActiveFunction, childOutStr)
+					this.History.AppendFunctionOutput(this.ActiveFunction, historyOutStr)
 				} else {
-					this.History.Append(historyTypeShellOutput, childOutStr)
+					this.History.Append(historyTypeShellOutput, historyOutStr)
 				}
 			}
 
@@ -968,7 +1398,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		return data
 
 	case stateNormal:
-		if HasRunningChildren() {
+		if this.childRunning() {
 			// If we have running children then the shell is running something,
 			// so just forward the input.
 			this.ChildIn.Write(data)
@@ -994,8 +1424,9 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			return data[1:]
 		}
 
-		// Check if the first character is uppercase or a bang
-		if unicode.IsUpper(rune(data[0])) || data[0] == '!' {
+		// Check if the first character is uppercase, a bang, or the start of a
+		// per-prompt override like @gpt-4o
+		if unicode.IsUpper(rune(data[0])) || data[0] == '!' || data[0] == promptOverridePrefix[0] {
 			this.setState(statePrompting)
 			this.ClearAutosuggest(this.Color.Command)
 			this.Prompt.Clear()
@@ -1124,7 +1555,10 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			index := bytes.Index(data, []byte{'\r'})
 			this.ChildIn.Write(data[:index+1])
-			this.History.Append(historyTypeShellInput, this.Command.String())
+			this.invalidateForeground()
+			if !this.ReportsCommands {
+				this.History.Append(historyTypeShellInput, this.Command.String())
+			}
 			this.Command = NewShellBuffer()
 
 			if this.AutosuggestCancel != nil {
@@ -1196,10 +1630,50 @@ func (this *ShellState) PrintStatus() {
 	text += fmt.Sprintf("Autosuggest model:     %s\n", this.Butterfish.Config.ShellAutosuggestModel)
 	text += fmt.Sprintf("Autosuggest timeout:   %s\n", this.Butterfish.Config.ShellAutosuggestTimeout)
 	text += fmt.Sprintf("Autosuggest history:   %d tokens\n", this.AutosuggestMaxTokens)
+	text += fmt.Sprintf("History redaction:     %t\n", this.History.redactor != nil)
+	if this.Butterfish.UsageLedger != nil {
+		totals := this.Butterfish.UsageLedger.SessionTotals()
+		text += fmt.Sprintf("Session spend:         %s (%d calls, %d tokens)\n",
+			formatCost(totals.Cost, totals.Estimated), totals.Calls,
+			totals.PromptTokens+totals.CompletionTokens)
+		text += this.Butterfish.budgetStatus()
+	}
+	text += fallbackStatus("Prompt", this.Butterfish.LLMClient)
+	text += fallbackStatus("Autosuggest", this.Butterfish.AutosuggestLLMClient)
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
 
+// Describe a fallback chain's backends and which one served the last
+// request, empty if the client isn't a chain.
+func fallbackStatus(name string, client LLM) string {
+	fallback, ok := UnwrapLLM[*FallbackLLM](client)
+	if !ok {
+		return ""
+	}
+
+	statuses, lastServed := fallback.Status()
+	if lastServed == "" {
+		lastServed = "none yet"
+	}
+
+	text := fmt.Sprintf("%s backends (last served by %s):\n", name, lastServed)
+	for _, status := range statuses {
+		name := status.Name
+		if status.Model != "" {
+			name += ":" + status.Model
+		}
+		health := "healthy"
+		if !status.Healthy {
+			health = fmt.Sprintf("unhealthy for %s, %s",
+				time.Until(status.UnhealthyUntil).Round(time.Second), status.LastError)
+		}
+		text += fmt.Sprintf("  %-20s %d served, %s\n", name, status.Served, health)
+	}
+
+	return text
+}
+
 func (this *ShellState) PrintHelp() {
 	text := `You're using the Butterfish Shell Mode, which means you have a Butterfish wrapper around your normal shell. Here's how you use it:
 
@@ -1207,16 +1681,19 @@ func (this *ShellState) PrintHelp() {
 	- Start a command with a capital letter to send it to GPT, like "How do I find local .py files?"
 	- Autosuggest will print command completions, press tab to fill them in
 	- GPT will be able to see your shell history, so you can ask contextual questions like "why didn't my last command work?"
-	- Type "Status" to show the current Butterfish configuration
-	- Type "History" to show the recent history that will be sent to GPT
+
+These commands are handled by Butterfish rather than sent to GPT, press tab to complete them:
 `
+	for _, command := range this.localCommands() {
+		text += fmt.Sprintf("	- %-26s %s\n", command.Usage(), command.Help)
+	}
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
 
 func (this *ShellState) PrintHistory() {
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
-	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptEncoder(),
+	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptTokenizer(),
 		maxHistoryBlockTokens, this.PromptMaxTokens, 4)
 	strBuilder := strings.Builder{}
 
@@ -1236,6 +1713,15 @@ func (this *ShellState) PrintHistory() {
 		strBuilder.WriteString(fmt.Sprintf("%s%s\n", blockColor, block.Content))
 	}
 
+	if redactions := this.History.GetRedactions(); len(redactions) > 0 {
+		strBuilder.WriteString(fmt.Sprintf("%sRedacted from history (%s)\n",
+			this.Color.GoalMode, summarizeRedactions(redactions)))
+		for _, redaction := range redactions {
+			strBuilder.WriteString(fmt.Sprintf("%s  %s  %s: %s\n", this.Color.Error,
+				redaction.Time.Format("15:04:05"), redaction.Detector, redaction.Preview))
+		}
+	}
+
 	this.History.LogRecentHistory()
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s", strBuilder.String(), this.Color.Command)
 	this.SendPromptResponse("")
@@ -1256,6 +1742,12 @@ func (this *ShellState) GoalModeStart() {
 		this.GoalModeUnsafe = false
 	}
 
+	if err := this.Butterfish.CheckBudget(FeatureGoal, 0); err != nil {
+		this.Prompt.Clear()
+		this.PrintError(fmt.Errorf("Can't start goal mode: %s.\n", err))
+		return
+	}
+
 	this.GoalMode = true
 	fmt.Fprintf(this.PromptAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
 	this.GoalModeGoal = goal
@@ -1302,6 +1794,7 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 		fmt.Fprintf(this.ChildIn, "%s", cmd)
 		if this.GoalModeUnsafe {
 			fmt.Fprintf(this.ChildIn, "\n")
+			this.invalidateForeground()
 		}
 
 	case "user_input":
@@ -1417,6 +1910,13 @@ func getGoalModeFunctionsString() string {
 }
 
 func (this *ShellState) goalModePrompt(lastPrompt string) {
+	// pause rather than exit so the goal and history are kept if the user
+	// wants to continue once there's budget
+	if err := this.Butterfish.CheckBudget(FeatureGoal, 0); err != nil {
+		this.PrintError(fmt.Errorf("Goal mode paused: %s. Enter a prompt to continue or Ctrl-C to exit goal mode.\n", err))
+		return
+	}
+
 	this.setState(statePromptResponse)
 	requestCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	this.PromptResponseCancel = cancel
@@ -1433,7 +1933,8 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 	}
 
 	tokensForAnswer := 1024
-	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
+	attachments := this.pinnedAttachments()
+	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, attachments, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1449,8 +1950,13 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		SystemMessage: sysMsg,
 		Functions:     goalModeFunctions,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Feature:       FeatureGoal,
+		Attachments:   attachments,
 	}
 
+	this.promptRequestChars = requestChars(request)
+	this.promptRequestTokenizer = this.getPromptTokenizer()
+
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
 	go CompletionRoutine(request, this.Butterfish.LLMClient,
@@ -1458,110 +1964,280 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		this.Color.GoalMode, this.Color.Error, this.StyleWriter)
 }
 
-func (this *ShellState) HandleLocalPrompt() bool {
-	promptStr := strings.ToLower(this.Prompt.String())
-	promptStr = strings.TrimSpace(promptStr)
+// Find a saved session by name or by its number in the Sessions list, nil
+// if there isn't one
+func (this *ShellState) findSession(arg string) *SessionInfo {
+	if this.HistoryStore == nil || arg == "" {
+		return nil
+	}
+	session, err := this.HistoryStore.Find(arg)
+	if err != nil {
+		log.Printf("Error finding history session: %s", err)
+		return nil
+	}
+	return session
+}
 
-	switch promptStr {
-	case "status":
-		this.PrintStatus()
-	case "help":
-		this.PrintHelp()
-	case "history":
-		this.PrintHistory()
-	default:
+// Handle "Resume <session>". If the argument isn't a saved session this
+// returns false so that a prompt like "Resume the download" still goes to
+// the LLM.
+func (this *ShellState) ResumeCommand(arg string) bool {
+	session := this.findSession(arg)
+	if session == nil {
+		return false
+	}
+
+	numBlocks, err := this.ResumeSession(session.Name)
+	if err != nil {
+		this.PrintError(err)
+		return true
+	}
+	this.printLocalOutput(fmt.Sprintf("Resumed session %s, loaded %d history blocks\n", session.Name, numBlocks))
+	return true
+}
+
+// Handle "Wipe [<session>|all]", by default the current session is wiped
+func (this *ShellState) WipeCommand(arg string) bool {
+	if this.HistoryStore == nil {
+		return false
+	}
+
+	wipeAll := strings.ToLower(arg) == "all"
+	session := this.findSession(arg)
+	if arg != "" && !wipeAll && session == nil {
 		return false
 	}
 
+	current := this.History.Session()
+	var text string
+	var err error
+	forget := ""
+	switch {
+	case session != nil:
+		err = this.HistoryStore.Wipe(session.Name)
+		forget = session.Name
+		text = fmt.Sprintf("Deleted session %s\n", session.Name)
+	case wipeAll:
+		err = this.HistoryStore.WipeAll()
+		text = "Deleted all saved sessions\n"
+	default:
+		if current != nil {
+			err = this.HistoryStore.Wipe(current.Name())
+			forget = current.Name()
+		}
+		text = "Cleared the history for this session\n"
+	}
+	// recall entries go with their session, or all of them for "Wipe all"
+	if err == nil && this.Recall != nil && (forget != "" || wipeAll) {
+		err = this.Recall.Forget(forget)
+	}
+	if err != nil {
+		this.PrintError(err)
+		return true
+	}
+
+	// if we deleted the current session start it over
+	if session == nil || (current != nil && session.Name == current.Name()) {
+		this.History.Clear()
+		if current != nil {
+			_, err = this.ResumeSession(current.Name())
+			if err != nil {
+				this.PrintError(err)
+				return true
+			}
+		}
+	}
+
+	this.printLocalOutput(text)
 	return true
 }
 
-// Given an encoder, a string, and a maximum number of takens, we count the
-// number of tokens in the string and truncate to the max tokens if the would
-// exceed it. Returns the number of tokens, the truncated string, and a bool
-// indicating whether the string was truncated.
-func countAndTruncate(data string,
-	encoder *tiktoken.Tiktoken,
-	maxTokens int) (int, string, bool) {
-	tokens := encoder.Encode(data, nil, nil)
-	truncated := false
-	if len(tokens) >= maxTokens {
-		tokens = tokens[:maxTokens]
-		data = encoder.Decode(tokens)
-		truncated = true
+// How many recalled blocks we show or add to a prompt
+const numRecallResults = 3
+
+// How long we wait to embed a query before giving up on recall
+const recallTimeout = 5 * time.Second
+
+// Search the recall index for history related to query, skipping blocks
+// that are already in the recent history
+func (this *ShellState) recallHistory(query string) ([]*RecallResult, error) {
+	recent := map[string]bool{}
+	this.History.IterateBlocks(func(block *HistoryBuffer) bool {
+		recent[recallText(sanitizeTTYString(block.String()))] = true
+		return true
+	})
+
+	// embed what's been queued while we're at it, rather than waiting
+	if this.Recall.HasPending() {
+		go flushRecall(this.Recall)
 	}
 
-	return len(tokens), data, truncated
+	ctx, cancel := context.WithTimeout(context.Background(), recallTimeout)
+	defer cancel()
+	return this.Recall.Search(ctx, query, numRecallResults,
+		this.Butterfish.Config.ShellRecallMinScore, recent)
+}
+
+// Show past history related to query, for the "Recall <query>" local prompt
+func (this *ShellState) PrintRecall(query string) {
+	if this.Recall == nil {
+		this.printLocalOutput("Recall isn't enabled, start the shell with --recall to index your history\n")
+		return
+	}
+
+	results, err := this.recallHistory(query)
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	strBuilder := strings.Builder{}
+	if len(results) == 0 {
+		strBuilder.WriteString(fmt.Sprintf("%sNo matching history\n", this.Color.Answer))
+	}
+	for _, result := range results {
+		entry := result.Entry
+		header := fmt.Sprintf("%s  %s  %.2f", entry.Time.Format("2006-01-02 15:04"),
+			HistoryTypeToString(entry.Type), result.Score)
+		if entry.Session != "" {
+			header += "  " + entry.Session
+		}
+		strBuilder.WriteString(fmt.Sprintf("%s%s\n%s%s\n", this.Color.GoalMode, header,
+			this.Color.Answer, entry.Content))
+	}
+
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s", strBuilder.String(), this.Color.Command)
+	this.SendPromptResponse("")
+}
+
+// List saved history sessions, most recent first
+func (this *ShellState) PrintSessions() {
+	if this.HistoryStore == nil {
+		this.printLocalOutput("No history store is configured\n")
+		return
+	}
+
+	sessions, err := this.HistoryStore.Sessions()
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	current := ""
+	if session := this.History.Session(); session != nil {
+		current = session.Name()
+	}
+
+	text := "No saved sessions, start the shell with --persist-history or --session to save history\n"
+	if len(sessions) > 0 {
+		text = "Saved sessions, use \"Resume <number>\" to load one or \"Wipe <number>\" to delete it\n"
+	}
+	for i, session := range sessions {
+		marker := " "
+		if session.Name == current {
+			marker = "*"
+		}
+		text += fmt.Sprintf("%s%3d  %-16s %5d blocks  %s\n", marker, i+1,
+			session.Updated.Format("2006-01-02 15:04"), session.Blocks, session.Name)
+	}
+
+	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
+	this.SendPromptResponse("")
 }
 
 // Prepare to call assembleChat() based on the ShellState variables for
 // calculating token limits.
-func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
-	// How many tokens can this model handle
-	totalTokens := this.PromptMaxTokens
+func (this *ShellState) AssembleChat(
+	prompt string,
+	attachments []util.Attachment,
+	sysMsg, functions string,
+	reserveForAnswer int,
+) (string, []util.HistoryBlock, error) {
+	return this.AssembleChatForModel(this.Butterfish.Config.ShellPromptModel,
+		this.PromptMaxTokens, this.getPromptTokenizer(),
+		prompt, attachments, sysMsg, functions, reserveForAnswer)
+}
+
+// AssembleChat for a model other than the prompting model, which has its own
+// context window and tokenizer
+func (this *ShellState) AssembleChatForModel(
+	model string,
+	totalTokens int,
+	tokenizer Tokenizer,
+	prompt string,
+	attachments []util.Attachment,
+	sysMsg, functions string,
+	reserveForAnswer int,
+) (string, []util.HistoryBlock, error) {
 	maxPromptTokens := 512 // for the prompt specifically
 	// for each individual history block
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
 	// How much for the total request (prompt, history, sys msg)
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
-	return assembleChat(prompt, sysMsg, functions, this.History,
-		this.Butterfish.Config.ShellPromptModel, this.getPromptEncoder(),
-		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
+	return assembleChat(prompt, attachments, sysMsg, functions, this.History,
+		this.Butterfish.Models.TokensPerMessage(model), tokenizer, maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
 }
 
 // Build a list of HistoryBlocks for use in GPT chat history, and ensure the
 // prompt and system message plus the history are within the token limit.
-// The prompt may be truncated based on maxPromptTokens.
+// The prompt may be truncated based on maxPromptTokens. Attachments aren't
+// truncated, they count against maxTokens and leave less room for history.
 func assembleChat(
 	prompt string,
+	attachments []util.Attachment,
 	sysMsg string,
 	functions string,
 	history *ShellHistory,
-	model string,
-	encoder *tiktoken.Tiktoken,
+	tokensPerMessage int,
+	tokenizer Tokenizer,
 	maxPromptTokens int,
 	maxHistoryBlockTokens int,
 	maxTokens int,
 ) (string, []util.HistoryBlock, error) {
-
-	tokensPerMessage := NumTokensPerMessageForModel(model)
-
 	// baseline for chat
 	usedTokens := 3
 
 	// account for prompt
-	numPromptTokens, prompt, truncated := countAndTruncate(prompt, encoder, maxPromptTokens)
+	numPromptTokens, prompt, truncated := tokenizer.Truncate(prompt, maxPromptTokens)
 	if truncated {
 		log.Printf("WARNING: truncated the prompt to %d tokens", numPromptTokens)
 	}
 	usedTokens += numPromptTokens
 
+	// account for attachments
+	if len(attachments) > 0 {
+		usedTokens += attachmentTokens(attachments, tokenizer)
+		if usedTokens > maxTokens {
+			return "", nil, fmt.Errorf("Attachments are too long, %d tokens with the prompt, the limit is %d", usedTokens, maxTokens)
+		}
+	}
+
 	// account for system message
-	sysMsgTokens := encoder.Encode(sysMsg, nil, nil)
-	if len(sysMsgTokens) > 1028 {
+	sysMsgTokens := tokenizer.Count(sysMsg)
+	if sysMsgTokens > 1028 {
 		log.Printf("WARNING: the system message is very long, this may cause you to hit the token limit. Recommend you reduce the size in prompts.yaml")
 	}
 
-	usedTokens += usedTokens + len(sysMsgTokens)
+	usedTokens += usedTokens + sysMsgTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message too long, %d tokens", usedTokens)
 	}
 
 	// account for functions
-	functionTokens := encoder.Encode(functions, nil, nil)
-	if len(functionTokens) > 1028 {
+	functionTokens := tokenizer.Count(functions)
+	if functionTokens > 1028 {
 		log.Printf("WARNING: the functions are very long and are taking up %d tokens. This may cause you to hit the token limit.", functionTokens)
 	}
 
-	usedTokens += usedTokens + len(functionTokens)
+	usedTokens += usedTokens + functionTokens
 	if usedTokens > maxTokens {
 		return "", nil, fmt.Errorf("System message too long, %d tokens", usedTokens)
 	}
 
 	blocks, historyTokens := getHistoryBlocksByTokens(
 		history,
-		encoder,
+		tokenizer,
 		maxHistoryBlockTokens,
 		maxTokens-usedTokens,
 		tokensPerMessage)
@@ -1581,7 +2257,7 @@ func assembleChat(
 // We return the history blocks and the number of tokens it uses.
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
 	maxHistoryBlockTokens,
 	maxTokens,
 	tokensPerMessage int,
@@ -1591,7 +2267,7 @@ func getHistoryBlocksByTokens(
 	usedTokens := 0
 
 	history.IterateBlocks(func(block *HistoryBuffer) bool {
-		if block.Content.Size() == 0 && block.FunctionName == "" {
+		if block.Size() == 0 && block.FunctionName == "" {
 			// empty block, skip
 			return true
 		}
@@ -1599,35 +2275,35 @@ func getHistoryBlocksByTokens(
 		roleString := ShellHistoryTypeToRole(block.Type)
 
 		// add tokens for role
-		msgTokens += len(encoder.Encode(roleString, nil, nil))
+		msgTokens += tokenizer.Count(roleString)
 
 		if block.FunctionName != "" {
 			// add tokens for function name
-			msgTokens += len(encoder.Encode(block.FunctionName, nil, nil))
+			msgTokens += tokenizer.Count(block.FunctionName)
 		}
 		if block.FunctionParams != "" {
 			// add tokens for function params
-			msgTokens += len(encoder.Encode(block.FunctionParams, nil, nil))
+			msgTokens += tokenizer.Count(block.FunctionParams)
 		}
 
 		// check existing block tokenizations
-		contentLen := block.Content.Size()
-		content, contentTokens, ok := block.GetTokenization(encoder.EncoderName(), contentLen)
+		contentLen := block.Size()
+		content, contentTokens, ok := block.GetTokenization(tokenizer.Name(), contentLen)
 
 		if !ok { // cache miss
-			contentStr := block.Content.String()
+			contentStr := block.String()
 			// avoid processing super long strings with a ceiling
 			ceiling := maxHistoryBlockTokens * 4
-			if contentLen > ceiling {
+			if len(contentStr) > ceiling {
 				contentStr = contentStr[:ceiling]
 			}
 
 			// remove ANSI escape codes
 			historyContent := sanitizeTTYString(contentStr)
 			// encode and truncate
-			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
+			contentTokens, content, _ = tokenizer.Truncate(historyContent, maxHistoryBlockTokens)
 			// save truncated string
-			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
+			block.SetTokenization(tokenizer.Name(), contentLen, contentTokens, content)
 		}
 		msgTokens += contentTokens
 
@@ -1652,6 +2328,21 @@ func getHistoryBlocksByTokens(
 	return blocks, usedTokens
 }
 
+// The wrapped shell's working directory, which is where the user expects
+// relative paths in a prompt to point. Falls back to our own.
+func (this *ShellState) childWorkingDir() string {
+	if this.ChildPid != 0 {
+		dir, err := processWorkingDir(this.ChildPid)
+		if err == nil {
+			return dir
+		}
+		log.Printf("Could not get shell working directory: %s", err)
+	}
+
+	dir, _ := os.Getwd()
+	return dir
+}
+
 func (this *ShellState) SendPrompt() {
 	this.setState(statePromptResponse)
 
@@ -1666,9 +2357,58 @@ func (this *ShellState) SendPrompt() {
 		return
 	}
 
-	prompt := this.Prompt.String()
+	override, prompt, err := parsePromptOverride(this.Prompt.String(), func(model string) bool {
+		if _, found := this.Butterfish.Models.Lookup(model); found {
+			return true
+		}
+		// "@main.go ..." attaches a file, we don't need to ask the server
+		if _, found := attachmentPath(model, this.childWorkingDir()); found {
+			return false
+		}
+		return this.Butterfish.IsKnownModel(this.Butterfish.LLMClient, model)
+	})
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
+	// a prompt like "@gpt-4o,t=0.2 ..." goes to another model or uses another
+	// temperature, just for this prompt
+	model := this.Butterfish.Config.ShellPromptModel
+	maxTokens := this.PromptMaxTokens
+	tokenizer := this.getPromptTokenizer()
+	temperature := float32(shellPromptTemperature)
+	if override != nil {
+		if override.Model != "" {
+			model = override.Model
+			maxTokens = this.Butterfish.ContextLengthForModel(this.Butterfish.LLMClient, model)
+			tokenizer = this.Butterfish.Models.Tokenizer(model)
+		}
+		if override.Temperature >= 0 {
+			temperature = override.Temperature
+		}
+	}
+
+	historyPrompt := prompt
+	attachments, err := promptAttachments(prompt, this.childWorkingDir())
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+	attachments = append(this.pinnedAttachments(), attachments...)
+
+	if this.Recall != nil {
+		results, err := this.recallHistory(prompt)
+		if err != nil {
+			log.Printf("Error recalling history: %s", err)
+		}
+		sysMsg += recallContext(results, tokenizer,
+			this.Butterfish.Config.ShellMaxHistoryBlockTokens)
+	}
+
 	tokensReservedForAnswer := this.Butterfish.Config.ShellMaxResponseTokens
-	prompt, historyBlocks, err := this.AssembleChat(prompt, sysMsg, "", tokensReservedForAnswer)
+	prompt, historyBlocks, err := this.AssembleChatForModel(model, maxTokens, tokenizer,
+		prompt, attachments, sysMsg, "", tokensReservedForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1677,16 +2417,29 @@ func (this *ShellState) SendPrompt() {
 	request := &util.CompletionRequest{
 		Ctx:           requestCtx,
 		Prompt:        prompt,
-		Model:         this.Butterfish.Config.ShellPromptModel,
+		Model:         model,
 		MaxTokens:     tokensReservedForAnswer,
-		Temperature:   0.7,
+		Temperature:   temperature,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
 		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
+		Feature:       FeaturePrompt,
+		Attachments:   attachments,
 	}
 
-	this.History.Append(historyTypePrompt, this.Prompt.String())
+	// warn but still send, the user asked for this explicitly
+	estimate := this.Butterfish.EstimateCost(request.Model,
+		estimateRequestTokens(request), request.MaxTokens)
+	if err := this.Butterfish.CheckBudget(FeaturePrompt, estimate); err != nil {
+		fmt.Fprintf(this.PromptAnswerWriter, "%sWarning: %s, this prompt may go over.%s\n",
+			this.Color.Error, err, this.Color.Answer)
+	}
+
+	this.History.Append(historyTypePrompt, historyPrompt)
+
+	this.promptRequestChars = requestChars(request)
+	this.promptRequestTokenizer = tokenizer
 
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
@@ -1880,40 +2633,50 @@ func (this *ShellState) ClearAutosuggest(colorStr string) {
 	this.AutosuggestBuffer = nil
 }
 
-func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
-	if this.AutosuggestEncoder == nil {
-		modelName := this.Butterfish.Config.ShellAutosuggestModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
-		if err != nil {
-			panic(fmt.Sprintf("Error getting encoder for autosuggest model %s: %s", modelName, err))
-		}
-
-		this.AutosuggestEncoder = encoder
+func (this *ShellState) getAutosuggestTokenizer() Tokenizer {
+	if this.AutosuggestTokenizer == nil {
+		this.AutosuggestTokenizer = this.Butterfish.Models.Tokenizer(this.Butterfish.Config.ShellAutosuggestModel)
 	}
-
-	return this.AutosuggestEncoder
+	return this.AutosuggestTokenizer
 }
 
-func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
-	if this.PromptEncoder == nil {
-		modelName := this.Butterfish.Config.ShellPromptModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
-		if err != nil {
-			panic(fmt.Sprintf("Error getting encoder for prompt model %s: %s", modelName, err))
-		}
-
-		this.PromptEncoder = encoder
+func (this *ShellState) getPromptTokenizer() Tokenizer {
+	if this.PromptTokenizer == nil {
+		this.PromptTokenizer = this.Butterfish.Models.Tokenizer(this.Butterfish.Config.ShellPromptModel)
 	}
-
-	return this.PromptEncoder
+	return this.PromptTokenizer
 }
 
 // rewrite this for autosuggest
 func (this *ShellState) RequestAutosuggest(delay time.Duration, command string) {
+	// local commands are completed without the LLM, even if autosuggest is off
+	if this.State == statePrompting {
+		if suggestion := this.completeLocalCommand(command); suggestion != "" {
+			if this.AutosuggestCancel != nil {
+				this.AutosuggestCancel()
+			}
+			result := &AutosuggestResult{Command: command, Suggestion: suggestion}
+			go func() {
+				this.AutosuggestChan <- result
+			}()
+			return
+		}
+	}
+
 	if !this.AutosuggestEnabled {
 		return
 	}
 
+	if err := this.Butterfish.CheckBudget(FeatureAutosuggest, 0); err != nil {
+		// only print the notice at a fresh prompt, printing an error resets
+		// the line which would run a half-typed command
+		if !this.AutosuggestBudgetNoticed && command == "" {
+			this.AutosuggestBudgetNoticed = true
+			this.PrintError(fmt.Errorf("%s, autosuggest is paused.\n", err))
+		}
+		return
+	}
+
 	if this.AutosuggestCancel != nil {
 		// clear out a previous request
 		this.AutosuggestCancel()
@@ -1931,7 +2694,7 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 	if len(command) == 0 {
 		// command completion when we haven't started a command
 		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestNewCommand)
-	} else if !unicode.IsUpper(rune(command[0])) {
+	} else if !unicode.IsUpper(rune(command[0])) && !strings.HasPrefix(command, promptOverridePrefix) {
 		// command completion when we have started typing a command
 		suggestPrompt, err = this.Butterfish.PromptLibrary.GetUninterpolatedPrompt(prompt.ShellAutosuggestCommand)
 	} else {
@@ -1949,8 +2712,9 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 		delay,
 		command,
 		suggestPrompt,
-		this.Butterfish.LLMClient,
+		this.Butterfish.AutosuggestLLMClient,
 		this.Butterfish.Config.ShellAutosuggestModel,
+		this.getAutosuggestTokenizer(),
 		this.Butterfish.Config.Verbose > 1,
 		this.History,
 		this.Butterfish.Config.ShellMaxHistoryBlockTokens,
@@ -1967,6 +2731,7 @@ func RequestCancelableAutosuggest(
 	rawPrompt string,
 	llmClient LLM,
 	model string,
+	tokenizer Tokenizer,
 	verbose bool,
 	history *ShellHistory,
 	maxHistoryBlockTokens int,
@@ -1982,16 +2747,12 @@ func RequestCancelableAutosuggest(
 	totalTokens := 1600 // limit autosuggest to 1600 tokens for cost reasons
 	reserveForAnswer := 64
 
-	encoder, err := tiktoken.EncodingForModel(model)
-	if err != nil {
-		panic(fmt.Sprintf("Error getting encoder for prompt model %s: %s", model, err))
-	}
-
-	historyBlocks, _ := getHistoryBlocksByTokens(history, encoder,
+	historyBlocks, _ := getHistoryBlocksByTokens(history, tokenizer,
 		maxHistoryBlockTokens, totalTokens-reserveForAnswer, 4)
 
-	historyStr := HistoryBlocksToString(historyBlocks)
+	historyStr := HistoryBlocksToString(historyBlocks, history.Redactor())
 	var prmpt string
+	var err error
 
 	if currCommand != "" {
 		prmpt, err = prompt.Interpolate(rawPrompt,
@@ -2014,6 +2775,7 @@ func RequestCancelableAutosuggest(
 		MaxTokens:   reserveForAnswer,
 		Temperature: 0.2,
 		Verbose:     verbose,
+		Feature:     FeatureAutosuggest,
 	}
 
 	response, err := llmClient.Completion(request)
@@ -2070,10 +2832,8 @@ func countChildPids(pid int) (int, error) {
 	totalPids := -1
 
 	for _, process := range pids {
-		switch process {
-		case "sh", "bash", "zsh":
-			// We want to keep butterfish on for child shells
-		default:
+		// We want to keep butterfish on for child shells
+		if !isShellName(process) {
 			totalPids++
 		}
 	}
@@ -2081,6 +2841,44 @@ func countChildPids(pid int) (int, error) {
 	return totalPids, nil
 }
 
+// Whether a program is running in the foreground of the child shell, so
+// input should be passed straight to it
+func (this *ShellState) childRunning() bool {
+	if this.Foreground == nil {
+		return HasRunningChildren()
+	}
+	return this.Foreground.Running()
+}
+
+// Name the full-screen program that just started, asking the terminal or
+// else taking the last command the user ran
+func (this *ShellState) fullScreenAppName() string {
+	if this.Foreground != nil {
+		if name := this.Foreground.Name(); name != "" {
+			return name
+		}
+	}
+
+	name := ""
+	this.History.IterateBlocks(func(block *HistoryBuffer) bool {
+		if block.Type != historyTypeShellInput {
+			return true
+		}
+		fields := strings.Fields(block.String())
+		if len(fields) > 0 {
+			name = filepath.Base(fields[0])
+		}
+		return false
+	})
+	return name
+}
+
+func (this *ShellState) invalidateForeground() {
+	if this.Foreground != nil {
+		this.Foreground.Invalidate()
+	}
+}
+
 func HasRunningChildren() bool {
 	// get this process's pid
 	pid := os.Getpid()
@@ -0,0 +1,291 @@
+package butterfish
+
+import (
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+// A real shell running in a pty with the Butterfish prompt set, so tests can
+// type commands and parse the prompts the shell prints, like the
+// multiplexer does
+type ptyShell struct {
+	t           *testing.T
+	cmd         *exec.Cmd
+	ptmx        *os.File
+	integration string
+	// commands the shell reported running
+	commands []string
+
+	mutex  sync.Mutex
+	output string
+	// output before this offset has been returned by WaitForPrompt
+	consumed int
+	done     chan struct{}
+}
+
+// Start a shell in a pty using a prompt integration, the test is skipped if
+// the shell isn't installed. The shell gets an empty home directory so the
+// user's config isn't loaded.
+func startPtyShell(t *testing.T, integration, shell string, args ...string) *ptyShell {
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		t.Skipf("%s is not installed", shell)
+	}
+
+	home := t.TempDir()
+	cmd := exec.Command(path, args...)
+	cmd.Dir = home
+	cmd.Env = []string{
+		"HOME=" + home,
+		"XDG_CONFIG_HOME=" + home,
+		"TERM=xterm-256color",
+		"PATH=" + os.Getenv("PATH"),
+	}
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 40, Cols: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	this := &ptyShell{t: t, cmd: cmd, ptmx: ptmx, done: make(chan struct{})}
+	go this.read()
+	t.Cleanup(this.Close)
+
+	config := MakeButterfishConfig()
+	config.ShellBinary = path
+	config.ShellPromptIntegration = integration
+	ctx := &ButterfishCtx{Config: config}
+	this.integration = ctx.SetShellIntegration(ptmx)
+
+	return this
+}
+
+// Queries a shell may send to the terminal and wait on, with the answer a
+// real terminal would give
+var ptyShellQueries = map[string]string{
+	"\x1b[c":  "\x1b[?62;22c", // primary device attributes
+	"\x1b[0c": "\x1b[?62;22c",
+	"\x1b[6n": "\x1b[1;1R", // cursor position
+}
+
+func (this *ptyShell) read() {
+	defer close(this.done)
+	buf := make([]byte, 4096)
+	for {
+		n, err := this.ptmx.Read(buf)
+		if n > 0 {
+			this.mutex.Lock()
+			this.output += string(buf[:n])
+			this.mutex.Unlock()
+
+			for query, answer := range ptyShellQueries {
+				for i := 0; i < strings.Count(string(buf[:n]), query); i++ {
+					this.ptmx.Write([]byte(answer))
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (this *ptyShell) Close() {
+	this.cmd.Process.Kill()
+	this.cmd.Wait()
+	this.ptmx.Close()
+	<-this.done
+}
+
+// Type a line into the shell
+func (this *ptyShell) Send(line string) {
+	_, err := this.ptmx.Write([]byte(line + "\r"))
+	if err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+// Wait for the next Butterfish prompt, returning the exit code it reports
+// and the output since the last prompt with the prompt markers removed
+func (this *ptyShell) WaitForPrompt() (int, string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		this.mutex.Lock()
+		pending := this.output[this.consumed:]
+		regex := ps1FullRegex
+		if this.integration == PromptIntegrationOSC133 {
+			regex = osc133PromptRegex
+		}
+		match := regex.FindStringIndex(pending)
+		if match != nil {
+			this.consumed += match[1]
+			this.mutex.Unlock()
+			return this.parse(pending[:match[1]])
+		}
+		this.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.t.Fatalf("Timed out waiting for a prompt, shell output: %q", this.output)
+	return 0, ""
+}
+
+// The start of a prompt, the last sequence our OSC 133 hooks send before it
+var osc133PromptRegex = regexp.MustCompile("\x1b\\]133;A;aid=butterfish\x07")
+
+func (this *ptyShell) parse(output string) (int, string) {
+	if this.integration == PromptIntegrationOSC133 {
+		status, _, commands, cleaned := ParseOSC133(output)
+		this.commands = append(this.commands, commands...)
+		return status, cleaned
+	}
+	status, _, cleaned := ParsePS1(output, ps1FullRegex, EMOJI_DEFAULT)
+	return status, cleaned
+}
+
+// Exercise a shell through the prompt Butterfish sets, after the shell has
+// been started and sent setup
+func testShellPrompt(t *testing.T, shell *ptyShell) {
+	status, _ := shell.WaitForPrompt()
+	assert.Equal(t, 0, status)
+
+	shell.Send("false")
+	status, _ = shell.WaitForPrompt()
+	assert.Equal(t, 1, status)
+
+	shell.Send("sh -c 'exit 3'")
+	status, _ = shell.WaitForPrompt()
+	assert.Equal(t, 3, status)
+
+	shell.Send("echo butterfish-test")
+	status, output := shell.WaitForPrompt()
+	assert.Equal(t, 0, status)
+	assert.Contains(t, output, "butterfish-test")
+}
+
+func TestShellPromptBash(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationPS1, "bash", "--norc", "--noprofile")
+	testShellPrompt(t, shell)
+}
+
+func TestShellPromptZsh(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationPS1, "zsh", "-f")
+	testShellPrompt(t, shell)
+}
+
+func TestShellPromptFish(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationPS1, "fish")
+	testShellPrompt(t, shell)
+
+	// the user's own prompt still sees the exit code of the last command
+	shell.Send("function __butterfish_fish_prompt; printf '[%s]> ' $status; end")
+	shell.WaitForPrompt()
+	shell.Send("false")
+	status, output := shell.WaitForPrompt()
+	assert.Equal(t, 1, status)
+	assert.Contains(t, output, "[1]> ")
+}
+
+func TestSetPS1Fish(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.ShellBinary = "/usr/bin/fish"
+	ctx := &ButterfishCtx{Config: config}
+
+	builder := &strings.Builder{}
+	ctx.SetPS1(builder)
+	assert.Contains(t, builder.String(), "functions -c fish_prompt __butterfish_fish_prompt")
+	assert.Contains(t, builder.String(), "printf '\\033Q'")
+	assert.Contains(t, builder.String(), "printf '"+EMOJI_DEFAULT+" %s\\033R ' $butterfish_status")
+	assert.True(t, strings.HasSuffix(builder.String(), "; end\n"))
+
+	config.ShellLeavePromptAlone = true
+	builder.Reset()
+	ctx.SetPS1(builder)
+	assert.Contains(t, builder.String(), "printf ' %s\\033R ' $butterfish_status")
+}
+
+func testShellOSC133(t *testing.T, shell *ptyShell) {
+	assert.Equal(t, PromptIntegrationOSC133, shell.integration)
+	testShellPrompt(t, shell)
+	assert.Equal(t, []string{"false", "sh -c 'exit 3'", "echo butterfish-test"}, shell.commands)
+}
+
+func TestShellOSC133Bash(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationOSC133, "bash", "--norc", "--noprofile")
+	testShellOSC133(t, shell)
+
+	// a prompt framework that sets PS1 each time still works
+	shell.Send(`PROMPT_COMMAND="${PROMPT_COMMAND}"'PS1="[$?] $ "'`)
+	shell.WaitForPrompt()
+	shell.Send("false")
+	status, _ := shell.WaitForPrompt()
+	assert.Equal(t, 1, status)
+	// the prompt is printed after the marker
+	shell.Send("true")
+	_, output := shell.WaitForPrompt()
+	assert.True(t, strings.Contains(output, "[1] $ true"), output)
+
+	// commands left out of history are still reported, and empty lines
+	// aren't reported
+	shell.commands = nil
+	shell.Send("HISTCONTROL=ignoreboth")
+	shell.WaitForPrompt()
+	shell.Send(" echo hidden | cat")
+	shell.WaitForPrompt()
+	shell.Send("")
+	shell.WaitForPrompt()
+	shell.Send("echo twice | cat")
+	shell.WaitForPrompt()
+	shell.Send("echo twice | cat")
+	shell.WaitForPrompt()
+	assert.Equal(t, []string{"HISTCONTROL=ignoreboth", "echo hidden",
+		"echo twice | cat", "echo twice | cat"}, shell.commands)
+}
+
+func TestShellOSC133Zsh(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationOSC133, "zsh", "-f")
+	testShellOSC133(t, shell)
+}
+
+func TestShellOSC133Fish(t *testing.T) {
+	shell := startPtyShell(t, PromptIntegrationOSC133, "fish")
+	testShellOSC133(t, shell)
+}
+
+func TestParseOSC133(t *testing.T) {
+	data := "ls\r\n\x1b]133;C;aid=butterfish;cmdline=ls; echo a;b\x07main.go\r\n" +
+		"\x1b]133;D;2;aid=butterfish\x07\x1b]133;A;aid=butterfish\x07$ " +
+		// someone else's sequences are left alone
+		"\x1b]133;A\x1b\\"
+	status, prompts, commands, cleaned := ParseOSC133(data)
+	assert.Equal(t, 2, status)
+	assert.Equal(t, 1, prompts)
+	assert.Equal(t, []string{"ls; echo a;b"}, commands)
+	assert.Equal(t, "ls\r\nmain.go\r\n$ \x1b]133;A\x1b\\", cleaned)
+
+	status, prompts, commands, cleaned = ParseOSC133("plain output")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, 0, prompts)
+	assert.Equal(t, 0, len(commands))
+	assert.Equal(t, "plain output", cleaned)
+}
+
+func TestSetShellIntegrationFallback(t *testing.T) {
+	config := MakeButterfishConfig()
+	config.ShellBinary = "/bin/sh"
+	config.ShellPromptIntegration = PromptIntegrationOSC133
+	ctx := &ButterfishCtx{Config: config}
+
+	builder := &strings.Builder{}
+	assert.Equal(t, PromptIntegrationPS1, ctx.SetShellIntegration(builder))
+	assert.True(t, strings.HasPrefix(builder.String(), "PS1="))
+}
@@ -0,0 +1,225 @@
+package butterfish
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/bakks/tiktoken-go"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// A Tokenizer counts tokens so we can fit prompts and history into a model's
+// context window. Which one a model gets is set by the tokenizer field in the
+// model catalog, see ModelCatalog.Tokenizer.
+type Tokenizer interface {
+	// Identifies the tokenizer, used as a key when caching counts
+	Name() string
+	Count(text string) int
+	// Cut text down to at most maxTokens, returning the number of tokens in
+	// the result, the result, and whether it was cut
+	Truncate(text string, maxTokens int) (int, string, bool)
+}
+
+// Exact counts with a tiktoken encoding, for OpenAI models
+type TiktokenTokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (this *TiktokenTokenizer) Name() string {
+	return this.encoding.EncoderName()
+}
+
+func (this *TiktokenTokenizer) Count(text string) int {
+	return len(this.encoding.Encode(text, nil, nil))
+}
+
+func (this *TiktokenTokenizer) Truncate(text string, maxTokens int) (int, string, bool) {
+	tokens := this.encoding.Encode(text, nil, nil)
+	if len(tokens) < maxTokens {
+		return len(tokens), text, false
+	}
+	tokens = tokens[:maxTokens]
+	return len(tokens), this.encoding.Decode(tokens), true
+}
+
+// Default characters per token for English text and code
+const defaultCharsPerToken = 4.0
+
+// HeuristicTokenizer estimates tokens from the number of characters, for
+// models whose tokenizer we don't have. It won't be exact but is close
+// enough to fit history into a context window.
+type HeuristicTokenizer struct {
+	CharsPerToken float64
+}
+
+func NewHeuristicTokenizer() *HeuristicTokenizer {
+	return &HeuristicTokenizer{CharsPerToken: defaultCharsPerToken}
+}
+
+func (this *HeuristicTokenizer) Name() string {
+	return TokenizerHeuristic
+}
+
+func (this *HeuristicTokenizer) Count(text string) int {
+	return heuristicCount(text, this.CharsPerToken)
+}
+
+func (this *HeuristicTokenizer) Truncate(text string, maxTokens int) (int, string, bool) {
+	return heuristicTruncate(text, maxTokens, this.CharsPerToken)
+}
+
+func heuristicCount(text string, charsPerToken float64) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / charsPerToken))
+}
+
+func heuristicTruncate(text string, maxTokens int, charsPerToken float64) (int, string, bool) {
+	count := heuristicCount(text, charsPerToken)
+	if count < maxTokens {
+		return count, text, false
+	}
+
+	maxChars := int(float64(maxTokens) * charsPerToken)
+	for i := range text {
+		if maxChars == 0 {
+			text = text[:i]
+			break
+		}
+		maxChars--
+	}
+	return heuristicCount(text, charsPerToken), text, true
+}
+
+// ProviderTokenizer estimates like HeuristicTokenizer, then calibrates its
+// characters per token from the prompt token counts the API reports for
+// requests we've sent, see Observe.
+type ProviderTokenizer struct {
+	mutex  sync.Mutex
+	chars  int
+	tokens int
+	// number of observations, counts change with each one
+	generation int
+}
+
+func NewProviderTokenizer() *ProviderTokenizer {
+	return &ProviderTokenizer{}
+}
+
+// The name includes the calibration generation, e.g. provider@3, since
+// cached tokenizations are keyed by name and go stale when it changes
+func (this *ProviderTokenizer) Name() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.generation == 0 {
+		return TokenizerProvider
+	}
+	return fmt.Sprintf("%s@%d", TokenizerProvider, this.generation)
+}
+
+// Record that the provider counted tokens for a request of chars characters
+func (this *ProviderTokenizer) Observe(chars, tokens int) {
+	if chars <= 0 || tokens <= 0 {
+		return
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.chars += chars
+	this.tokens += tokens
+	this.generation++
+}
+
+func (this *ProviderTokenizer) charsPerToken() float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.tokens == 0 {
+		return defaultCharsPerToken
+	}
+	// keep a wild count, e.g. from a request full of images, from throwing
+	// everything off
+	ratio := float64(this.chars) / float64(this.tokens)
+	return math.Max(1, math.Min(ratio, 10))
+}
+
+func (this *ProviderTokenizer) Count(text string) int {
+	return heuristicCount(text, this.charsPerToken())
+}
+
+func (this *ProviderTokenizer) Truncate(text string, maxTokens int) (int, string, bool) {
+	return heuristicTruncate(text, maxTokens, this.charsPerToken())
+}
+
+// Number of characters in a request as a ProviderTokenizer would count
+// them, returns 0 if the request has images since those are counted
+// separately by the provider
+func requestChars(request *util.CompletionRequest) int {
+	if len(util.ImageAttachments(request.Attachments)) > 0 {
+		return 0
+	}
+
+	chars := utf8.RuneCountInString(request.SystemMessage) +
+		utf8.RuneCountInString(util.PromptWithAttachments(request.Prompt, request.Attachments))
+	for _, block := range request.HistoryBlocks {
+		if len(util.ImageAttachments(block.Attachments)) > 0 {
+			return 0
+		}
+		chars += utf8.RuneCountInString(block.Content) +
+			utf8.RuneCountInString(block.FunctionParams) +
+			utf8.RuneCountInString(util.PromptWithAttachments("", block.Attachments))
+	}
+	return chars
+}
+
+// Loaded tiktoken encodings by name, loading one can mean a download
+var tiktokenEncodings = map[string]*tiktoken.Tiktoken{}
+var tiktokenMutex sync.Mutex
+
+func loadTiktoken(name string) (*tiktoken.Tiktoken, error) {
+	tiktokenMutex.Lock()
+	defer tiktokenMutex.Unlock()
+
+	if encoding, ok := tiktokenEncodings[name]; ok {
+		return encoding, nil
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	tiktokenEncodings[name] = encoding
+	return encoding, nil
+}
+
+// Get the tokenizer the model catalog gives a model, the same one each time
+// for a model. This never fails, if a tiktoken encoding can't be loaded (e.g.
+// we're offline and it isn't cached) we fall back to estimating.
+func (this *ModelCatalog) Tokenizer(model string) Tokenizer {
+	this.tokenizerMutex.Lock()
+	defer this.tokenizerMutex.Unlock()
+
+	if tokenizer, ok := this.tokenizers[model]; ok {
+		return tokenizer
+	}
+	tokenizer := this.newTokenizer(model)
+	this.tokenizers[model] = tokenizer
+	return tokenizer
+}
+
+func (this *ModelCatalog) newTokenizer(model string) Tokenizer {
+	spec, _ := this.Lookup(model)
+
+	switch spec.Tokenizer {
+	case TokenizerHeuristic, "":
+		return NewHeuristicTokenizer()
+	case TokenizerProvider:
+		return NewProviderTokenizer()
+	}
+
+	encoding, err := loadTiktoken(spec.Tokenizer)
+	if err != nil {
+		log.Printf("Could not load tokenizer %s for model %s, estimating tokens instead: %s", spec.Tokenizer, model, err)
+		return NewHeuristicTokenizer()
+	}
+	return &TiktokenTokenizer{encoding: encoding}
+}
@@ -0,0 +1,125 @@
+package butterfish
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestHeuristicTokenizer(t *testing.T) {
+	tokenizer := NewHeuristicTokenizer()
+
+	assert.Equal(t, 0, tokenizer.Count(""))
+	assert.Equal(t, 1, tokenizer.Count("abc"))
+	assert.Equal(t, 3, tokenizer.Count("hello world"))
+	// counts runes, not bytes
+	assert.Equal(t, 1, tokenizer.Count("héé"))
+
+	count, text, truncated := tokenizer.Truncate("hello world", 10)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, "hello world", text)
+	assert.False(t, truncated)
+
+	count, text, truncated = tokenizer.Truncate("hello world", 2)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "hello wo", text)
+	assert.True(t, truncated)
+
+	// doesn't split a multibyte rune
+	_, text, _ = tokenizer.Truncate("ééééééé", 1)
+	assert.Equal(t, "éééé", text)
+}
+
+func TestProviderTokenizer(t *testing.T) {
+	tokenizer := NewProviderTokenizer()
+	text := strings.Repeat("a", 100)
+
+	// uncalibrated, same as the heuristic
+	assert.Equal(t, 25, tokenizer.Count(text))
+
+	tokenizer.Observe(300, 100)
+	assert.Equal(t, 34, tokenizer.Count(text))
+	tokenizer.Observe(0, 50)
+	assert.Equal(t, 34, tokenizer.Count(text))
+
+	assert.Equal(t, TokenizerProvider+"@1", tokenizer.Name())
+
+	// cached history counts follow the calibration
+	history := NewShellHistory()
+	history.Append(historyTypeShellOutput, text)
+	history.Append(historyTypePrompt, "why?")
+	tokenizer = NewProviderTokenizer()
+	_, before := getHistoryBlocksByTokens(history, tokenizer, 1024, 4096, 0)
+	tokenizer.Observe(200, 100)
+	_, after := getHistoryBlocksByTokens(history, tokenizer, 1024, 4096, 0)
+	// two characters per token rather than four
+	assert.Equal(t, 2*before, after)
+
+	// a wild ratio is clamped
+	tokenizer = NewProviderTokenizer()
+	tokenizer.Observe(10000, 1)
+	assert.Equal(t, 10, tokenizer.Count(text))
+}
+
+func TestModelCatalogTokenizer(t *testing.T) {
+	catalog := DefaultModelCatalog()
+	assert.Equal(t, TokenizerHeuristic, catalog.Tokenizer("some-local-model").Name())
+	assert.Equal(t, TokenizerProvider, catalog.Tokenizer("claude-3-haiku-20240307").Name())
+
+	// calibration survives switching models and back
+	state, _ := newTestShellState()
+	state.SetPromptModel("claude-3-haiku-20240307")
+	state.getPromptTokenizer().(*ProviderTokenizer).Observe(1000, 100)
+	state.SetPromptModel("gpt-4")
+	state.SetPromptModel("claude-3-haiku-20240307")
+	assert.Equal(t, TokenizerProvider+"@1", state.getPromptTokenizer().Name())
+	assert.Same(t, state.getPromptTokenizer(), state.Butterfish.Models.Tokenizer("claude-3-haiku-20240307"))
+}
+
+func TestRequestChars(t *testing.T) {
+	request := &util.CompletionRequest{
+		SystemMessage: "system",
+		Prompt:        "prompt",
+		HistoryBlocks: []util.HistoryBlock{
+			{Type: historyTypeShellInput, Content: "ls"},
+		},
+	}
+	assert.Equal(t, 14, requestChars(request))
+
+	request.Attachments = []util.Attachment{{MimeType: "image/png", Data: []byte("png")}}
+	assert.Equal(t, 0, requestChars(request))
+}
+
+func TestAssembleChatWithTokenizer(t *testing.T) {
+	tokenizer := NewHeuristicTokenizer()
+	history := NewShellHistory()
+	history.Append(historyTypeShellInput, "ls")
+	history.Append(historyTypeShellOutput, strings.Repeat("x", 400))
+
+	blocks, used := getHistoryBlocksByTokens(history, tokenizer, 20, 1000, 5)
+	assert.Equal(t, 2, len(blocks))
+	assert.Equal(t, "ls", blocks[0].Content)
+	assert.Equal(t, strings.Repeat("x", 80), blocks[1].Content)
+	assert.Less(t, used, 1000)
+
+	// only room for the most recent block
+	blocks, _ = getHistoryBlocksByTokens(history, tokenizer, 20, 30, 5)
+	assert.Equal(t, 1, len(blocks))
+	assert.Equal(t, historyTypeShellOutput, blocks[0].Type)
+
+	prompt, blocks, err := assembleChat("what happened", nil, "", "", history,
+		DefaultModelCatalog().TokensPerMessage("some-local-model"), tokenizer, 100, 20, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, "what happened", prompt)
+	assert.Equal(t, 2, len(blocks))
+
+	attachments := []util.Attachment{
+		{Path: "big.txt", MimeType: "text/plain", Data: []byte(strings.Repeat("y", 8000))},
+	}
+	_, _, err = assembleChat("what happened", attachments, "", "", history,
+		DefaultModelCatalog().TokensPerMessage("some-local-model"), tokenizer, 100, 20, 1000)
+	assert.ErrorContains(t, err, "Attachments are too long")
+}
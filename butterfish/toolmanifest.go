@@ -0,0 +1,249 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sashabaranov/go-openai/jsonschema"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const DefaultToolTimeout = 60 * time.Second
+
+// Tool output beyond this is cut off before we send it back to the model
+const maxToolOutputBytes = 16 * 1024
+
+// A tool manifest describes functions the model can call and how to run
+// each one locally, e.g.
+//
+//	{
+//	  "tools": [
+//	    {
+//	      "name": "weather",
+//	      "description": "Get the weather for a city",
+//	      "parameters": {
+//	        "type": "object",
+//	        "properties": {"city": {"type": "string"}},
+//	        "required": ["city"]
+//	      },
+//	      "template": "curl -s wttr.in/{{.city}}?format=3"
+//	    },
+//	    {
+//	      "name": "lookup",
+//	      "parameters": {"type": "object", "properties": {}},
+//	      "command": ["./scripts/lookup.py", "--json"]
+//	    }
+//	  ]
+//	}
+//
+// A tool either has a command, an executable and arguments that is run
+// directly with the call's JSON arguments on stdin, or a template, a shell
+// command rendered with text/template where each argument has already been
+// shell-quoted. Relative executables are resolved against the manifest's
+// directory.
+type ToolManifest struct {
+	Tools []*ManifestTool `json:"tools"`
+
+	dir string
+}
+
+type ManifestTool struct {
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Parameters  jsonschema.Definition `json:"parameters"`
+	Command     []string              `json:"command"`
+	Template    string                `json:"template"`
+	// seconds, defaults to DefaultToolTimeout
+	Timeout float64 `json:"timeout"`
+}
+
+// Load a tool manifest from path. A -f file can also be a plain JSON array
+// of function definitions, which we don't execute, in that case this returns
+// nil with no error.
+func LoadToolManifest(path string) (*ToolManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, nil
+	}
+
+	manifest := &ToolManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing tool manifest %s: %s", path, err)
+	}
+	manifest.dir = filepath.Dir(path)
+
+	names := map[string]bool{}
+	for _, tool := range manifest.Tools {
+		if tool.Name == "" {
+			return nil, fmt.Errorf("Tool manifest %s has a tool with no name", path)
+		}
+		if names[tool.Name] {
+			return nil, fmt.Errorf("Tool manifest %s has more than one tool named %s", path, tool.Name)
+		}
+		names[tool.Name] = true
+
+		if (len(tool.Command) == 0) == (tool.Template == "") {
+			return nil, fmt.Errorf("Tool %s in %s needs exactly one of command or template", tool.Name, path)
+		}
+		if tool.Template != "" {
+			_, err := template.New(tool.Name).Option("missingkey=zero").Parse(tool.Template)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing template for tool %s: %s", tool.Name, err)
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// Tool definitions to send to the model
+func (this *ToolManifest) Definitions() []util.ToolDefinition {
+	definitions := []util.ToolDefinition{}
+	for _, tool := range this.Tools {
+		definitions = append(definitions, util.ToolDefinition{
+			Type: "function",
+			Function: util.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+func (this *ToolManifest) Tool(name string) *ManifestTool {
+	for _, tool := range this.Tools {
+		if tool.Name == name {
+			return tool
+		}
+	}
+	return nil
+}
+
+// Quote a string for a POSIX shell
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'"'"'`) + "'"
+}
+
+// Render the template for a call, every argument is shell-quoted, objects
+// and arrays are passed as quoted JSON
+func (this *ManifestTool) render(params map[string]any) (string, error) {
+	quoted := map[string]string{}
+	for key, value := range params {
+		str, ok := value.(string)
+		if !ok {
+			str = JSONString(value)
+		}
+		quoted[key] = shellQuote(str)
+	}
+
+	tmpl, err := template.New(this.Name).Option("missingkey=zero").Parse(this.Template)
+	if err != nil {
+		return "", err
+	}
+
+	out := new(bytes.Buffer)
+	err = tmpl.Execute(out, quoted)
+	return out.String(), err
+}
+
+// The command line we'll run for a call, for confirmation and logging
+func (this *ManifestTool) Describe(paramsJson string) (string, error) {
+	if this.Template == "" {
+		return strings.Join(this.Command, " ") + " <<< " + paramsJson, nil
+	}
+
+	params, err := parseToolParams(paramsJson)
+	if err != nil {
+		return "", err
+	}
+	return this.render(params)
+}
+
+func parseToolParams(paramsJson string) (map[string]any, error) {
+	params := map[string]any{}
+	if strings.TrimSpace(paramsJson) == "" {
+		return params, nil
+	}
+	err := json.Unmarshal([]byte(paramsJson), &params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid tool arguments: %s", err)
+	}
+	return params, nil
+}
+
+// Run the tool for a call and return its combined output, which is what we
+// send back to the model. A non-zero exit is reported in the output rather
+// than as an error so the model can react to it.
+func (this *ManifestTool) Run(ctx context.Context, dir, paramsJson string) (string, error) {
+	timeout := DefaultToolTimeout
+	if this.Timeout > 0 {
+		timeout = time.Duration(this.Timeout * float64(time.Second))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if this.Template != "" {
+		params, err := parseToolParams(paramsJson)
+		if err != nil {
+			return "", err
+		}
+		shellCmd, err := this.render(params)
+		if err != nil {
+			return "", err
+		}
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", shellCmd)
+	} else {
+		executable := this.Command[0]
+		if strings.Contains(executable, string(filepath.Separator)) && !filepath.IsAbs(executable) {
+			executable = filepath.Join(dir, executable)
+		}
+		cmd = exec.CommandContext(ctx, executable, this.Command[1:]...)
+		cmd.Stdin = strings.NewReader(paramsJson)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("Tool %s timed out after %s", this.Name, timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		output = append(output, []byte(fmt.Sprintf("\n[exit status %d]", exitErr.ExitCode()))...)
+	} else if err != nil {
+		return "", err
+	}
+
+	if len(output) > maxToolOutputBytes {
+		output = append(output[:maxToolOutputBytes], []byte("\n[output truncated]")...)
+	}
+	return string(output), nil
+}
+
+// Names of the tools in the manifest, for error messages
+func (this *ToolManifest) names() string {
+	names := []string{}
+	for _, tool := range this.Tools {
+		names = append(names, tool.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
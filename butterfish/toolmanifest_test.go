@@ -0,0 +1,149 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+const testManifest = `{
+  "tools": [
+    {
+      "name": "echo",
+      "description": "Echo a message",
+      "parameters": {"type": "object", "properties": {"msg": {"type": "string"}}},
+      "template": "echo {{.msg}}"
+    },
+    {
+      "name": "stdin",
+      "parameters": {"type": "object", "properties": {}},
+      "command": ["cat"]
+    }
+  ]
+}`
+
+func writeTestManifest(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tools.json")
+	os.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func TestLoadToolManifest(t *testing.T) {
+	manifest, err := LoadToolManifest(writeTestManifest(t, testManifest))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(manifest.Definitions()))
+	assert.Equal(t, "Echo a message", manifest.Definitions()[0].Function.Description)
+
+	// a plain list of functions isn't a manifest
+	manifest, err = LoadToolManifest(writeTestManifest(t, `[{"name": "f"}]`))
+	assert.NoError(t, err)
+	assert.Nil(t, manifest)
+
+	_, err = LoadToolManifest(writeTestManifest(t, `{"tools": [{"name": "x"}]}`))
+	assert.ErrorContains(t, err, "needs exactly one of command or template")
+}
+
+func TestManifestToolRun(t *testing.T) {
+	manifest, err := LoadToolManifest(writeTestManifest(t, testManifest))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// arguments are quoted so they can't inject commands
+	echo := manifest.Tool("echo")
+	description, err := echo.Describe(`{"msg": "hi'; rm -rf /"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `echo 'hi'"'"'; rm -rf /'`, description)
+	output, err := echo.Run(ctx, manifest.dir, `{"msg": "hi; ls"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi; ls\n", output)
+
+	// commands get the arguments on stdin
+	output, err = manifest.Tool("stdin").Run(ctx, manifest.dir, `{"a":1}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, output)
+
+	failing := &ManifestTool{Name: "fail", Template: "echo oops; exit 3"}
+	output, err = failing.Run(ctx, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "oops\n\n[exit status 3]", output)
+}
+
+// Streams a scripted list of responses, recording each request
+type scriptedStreamLLM struct {
+	fakeLLM
+	responses []*util.CompletionResponse
+	requests  []*util.CompletionRequest
+}
+
+func (this *scriptedStreamLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.requests = append(this.requests, request)
+	response := this.responses[0]
+	this.responses = this.responses[1:]
+	writer.Write([]byte(response.Completion))
+	return response, nil
+}
+
+func toolCallResponse(id, name, params string) *util.CompletionResponse {
+	return &util.CompletionResponse{
+		ToolCalls: []*util.ToolCall{{
+			Id:       id,
+			Type:     "function",
+			Function: util.FunctionCall{Name: name, Parameters: params},
+		}},
+	}
+}
+
+func TestPromptTools(t *testing.T) {
+	manifest, err := LoadToolManifest(writeTestManifest(t, testManifest))
+	assert.NoError(t, err)
+
+	llm := &scriptedStreamLLM{responses: []*util.CompletionResponse{
+		toolCallResponse("call_1", "echo", `{"msg": "one"}`),
+		toolCallResponse("call_2", "echo", `{"msg": "two"}`),
+		{Completion: "done"},
+	}}
+	out := new(bytes.Buffer)
+	ctx := &ButterfishCtx{
+		Ctx:       context.Background(),
+		Config:    MakeButterfishConfig(),
+		Models:    DefaultModelCatalog(),
+		LLMClient: llm,
+		Out:       out,
+	}
+	cmd := &promptCommand{Prompt: "echo things", SysMsg: "sys", NoColor: true}
+
+	// decline the second call
+	confirmed := []string{}
+	confirm := func(description string) (bool, error) {
+		confirmed = append(confirmed, description)
+		return len(confirmed) == 1, nil
+	}
+
+	err = ctx.PromptTools(cmd, manifest, 10, confirm)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"echo 'one'", "echo 'two'"}, confirmed)
+	assert.Equal(t, 3, len(llm.requests))
+
+	history := llm.requests[2].HistoryBlocks
+	assert.Equal(t, 5, len(history))
+	assert.Equal(t, "echo things", history[0].Content)
+	assert.Equal(t, "one\n", history[2].Content)
+	assert.Equal(t, "call_1", history[2].ToolCallId)
+	assert.Equal(t, "The user declined to run this tool.", history[4].Content)
+	assert.Equal(t, 2, len(llm.requests[0].Tools))
+
+	// the model never stops calling tools
+	llm.responses = []*util.CompletionResponse{
+		toolCallResponse("call_1", "missing", `{}`),
+		toolCallResponse("call_2", "missing", `{}`),
+	}
+	err = ctx.PromptTools(cmd, manifest, 2, nil)
+	assert.ErrorContains(t, err, "Stopped after 2 rounds")
+}
@@ -0,0 +1,286 @@
+package butterfish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// One line of the transcript log, a full LLM call with its timing. Image
+// attachments are logged without their data, which would make the log huge,
+// everything else is as it was sent.
+type TranscriptRecord struct {
+	Time     time.Time                `json:"time"`
+	Session  string                   `json:"session"`
+	Kind     string                   `json:"kind"`
+	Feature  string                   `json:"feature,omitempty"`
+	Model    string                   `json:"model,omitempty"`
+	Request  *CassetteRequest         `json:"request,omitempty"`
+	Input    []string                 `json:"input,omitempty"`
+	Response *util.CompletionResponse `json:"response,omitempty"`
+	// number of vectors returned for an embeddings call
+	Embeddings int `json:"embeddings,omitempty"`
+	// from the start of the call until it returned
+	LatencyMs int64 `json:"latency_ms"`
+	// from the start of a streamed call until the first token
+	FirstTokenMs int64  `json:"first_token_ms,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Text of the request and response, for searching a transcript
+func (this *TranscriptRecord) text() string {
+	builder := strings.Builder{}
+	if this.Request != nil {
+		builder.WriteString(this.Request.SystemMessage + "\n")
+		for _, block := range this.Request.HistoryBlocks {
+			builder.WriteString(block.Content + "\n")
+		}
+		builder.WriteString(this.Request.Prompt + "\n")
+	}
+	builder.WriteString(strings.Join(this.Input, "\n"))
+	if this.Response != nil {
+		builder.WriteString(this.Response.Completion + "\n")
+		builder.WriteString(this.Response.FunctionParameters + "\n")
+	}
+	builder.WriteString(this.Error)
+	return builder.String()
+}
+
+// Which records a transcript query returns, zero values match everything
+type TranscriptFilter struct {
+	Since   time.Time
+	Feature string
+	// matches model names containing this
+	Model      string
+	ErrorsOnly bool
+	// matches records whose request or response contains this
+	Text string
+}
+
+func (this *TranscriptFilter) Matches(record *TranscriptRecord) bool {
+	if record.Time.Before(this.Since) {
+		return false
+	}
+	if this.Feature != "" && record.Feature != this.Feature {
+		return false
+	}
+	if this.Model != "" && !strings.Contains(record.Model, this.Model) {
+		return false
+	}
+	if this.ErrorsOnly && record.Error == "" {
+		return false
+	}
+	if this.Text != "" && !strings.Contains(record.text(), this.Text) {
+		return false
+	}
+	return true
+}
+
+// TranscriptLog appends every LLM request and response to a JSONL file, so
+// unlike the boxes in the verbose log it can be searched and analyzed, e.g.
+// to audit what shell history was sent to an API.
+type TranscriptLog struct {
+	path    string
+	session string
+	mutex   sync.Mutex
+}
+
+func NewTranscriptLog(path string) *TranscriptLog {
+	return &TranscriptLog{
+		path:    path,
+		session: fmt.Sprintf("%d-%d", time.Now().Unix(), os.Getpid()),
+	}
+}
+
+func (this *TranscriptLog) Path() string {
+	return this.path
+}
+
+func (this *TranscriptLog) Record(record *TranscriptRecord) {
+	record.Session = this.session
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error serializing transcript record: %s", err)
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(this.path), 0700)
+	if err != nil {
+		log.Printf("Error creating transcript directory: %s", err)
+		return
+	}
+
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening transcript: %s", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Error writing transcript: %s", err)
+	}
+}
+
+// Read the records matching filter, oldest first
+func (this *TranscriptLog) Records(filter *TranscriptFilter) ([]*TranscriptRecord, error) {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readTranscriptRecords(file, filter)
+}
+
+func readTranscriptRecords(reader io.Reader, filter *TranscriptFilter) ([]*TranscriptRecord, error) {
+	records := []*TranscriptRecord{}
+	scanner := bufio.NewScanner(reader)
+	// records include whole conversations, allow long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := &TranscriptRecord{}
+		err := json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			// skip lines that were partially written
+			continue
+		}
+		if filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// The request as we log it, with image data dropped
+func newTranscriptRequest(request *util.CompletionRequest) *CassetteRequest {
+	logged := newCassetteRequest(request)
+	logged.Attachments = withoutImageData(logged.Attachments)
+
+	if len(logged.HistoryBlocks) > 0 {
+		blocks := make([]util.HistoryBlock, len(logged.HistoryBlocks))
+		for i, block := range logged.HistoryBlocks {
+			block.Attachments = withoutImageData(block.Attachments)
+			blocks[i] = block
+		}
+		logged.HistoryBlocks = blocks
+	}
+	return logged
+}
+
+func withoutImageData(attachments []util.Attachment) []util.Attachment {
+	if len(attachments) == 0 {
+		return attachments
+	}
+	result := make([]util.Attachment, len(attachments))
+	for i, attachment := range attachments {
+		if attachment.IsImage() {
+			attachment.Data = nil
+		}
+		result[i] = attachment
+	}
+	return result
+}
+
+// TranscriptLLM is an LLM decorator that logs every call made through it,
+// including failures, to a TranscriptLog.
+type TranscriptLLM struct {
+	llm LLM
+	log *TranscriptLog
+}
+
+func NewTranscriptLLM(llm LLM, transcriptLog *TranscriptLog) *TranscriptLLM {
+	return &TranscriptLLM{
+		llm: llm,
+		log: transcriptLog,
+	}
+}
+
+func (this *TranscriptLLM) Unwrap() LLM {
+	return this.llm
+}
+
+func (this *TranscriptLLM) record(record *TranscriptRecord, start time.Time, err error) {
+	record.Time = start
+	record.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	this.log.Record(record)
+}
+
+func (this *TranscriptLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	start := time.Now()
+	response, err := this.llm.Completion(request)
+	this.record(&TranscriptRecord{
+		Kind:     cassetteCompletion,
+		Feature:  request.Feature,
+		Model:    request.Model,
+		Request:  newTranscriptRequest(request),
+		Response: response,
+	}, start, err)
+	return response, err
+}
+
+// Notes when the first write happens so we can report time to first token
+type firstWriteTimer struct {
+	writer io.Writer
+	first  time.Time
+}
+
+func (this *firstWriteTimer) Write(p []byte) (int, error) {
+	if this.first.IsZero() && len(p) > 0 {
+		this.first = time.Now()
+	}
+	return this.writer.Write(p)
+}
+
+func (this *TranscriptLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	start := time.Now()
+	timer := &firstWriteTimer{writer: writer}
+	response, err := this.llm.CompletionStream(request, timer)
+
+	record := &TranscriptRecord{
+		Kind:     cassetteStream,
+		Feature:  request.Feature,
+		Model:    request.Model,
+		Request:  newTranscriptRequest(request),
+		Response: response,
+	}
+	if !timer.first.IsZero() {
+		record.FirstTokenMs = timer.first.Sub(start).Milliseconds()
+	}
+	this.record(record, start, err)
+	return response, err
+}
+
+func (this *TranscriptLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	start := time.Now()
+	embeddings, err := this.llm.Embeddings(ctx, input, verbose)
+	this.record(&TranscriptRecord{
+		Kind:       cassetteEmbeddings,
+		Feature:    featureFromContext(ctx, FeatureIndex),
+		Input:      input,
+		Embeddings: len(embeddings),
+	}, start, err)
+	return embeddings, err
+}
@@ -0,0 +1,91 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestTranscriptLLMRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	transcriptLog := NewTranscriptLog(path)
+
+	backend := &fakeLLM{output: "hello"}
+	client := NewTranscriptLLM(backend, transcriptLog)
+
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Model:         "gpt-4o",
+		Prompt:        "why did that fail?",
+		SystemMessage: "sys",
+		HistoryBlocks: []util.HistoryBlock{
+			{Type: historyTypeShellInput, Content: "make build"},
+			{Type: historyTypePrompt, Content: "look",
+				Attachments: []util.Attachment{{Path: "a.png", MimeType: "image/png", Data: []byte("png")}}},
+		},
+		Feature: FeaturePrompt,
+	}
+	out := new(bytes.Buffer)
+	_, err := client.CompletionStream(request, out)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", out.String())
+
+	backend.err = errors.New("rate limited")
+	request.Model = "gpt-3.5-turbo-instruct"
+	request.Feature = FeatureAutosuggest
+	client.Completion(request)
+
+	records, err := transcriptLog.Records(&TranscriptFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+
+	stream := records[0]
+	assert.Equal(t, cassetteStream, stream.Kind)
+	assert.Equal(t, FeaturePrompt, stream.Feature)
+	assert.Equal(t, "gpt-4o", stream.Model)
+	assert.Equal(t, "make build", stream.Request.HistoryBlocks[0].Content)
+	assert.Equal(t, "gpt-4o", stream.Response.Completion)
+	assert.Equal(t, "", stream.Error)
+	assert.NotEmpty(t, stream.Session)
+	// image data is dropped but we know it was attached
+	assert.Equal(t, "a.png", stream.Request.HistoryBlocks[1].Attachments[0].Path)
+	assert.Nil(t, stream.Request.HistoryBlocks[1].Attachments[0].Data)
+	assert.Equal(t, []byte("png"), request.HistoryBlocks[1].Attachments[0].Data)
+
+	assert.Equal(t, "rate limited", records[1].Error)
+	assert.Nil(t, records[1].Response)
+}
+
+func TestTranscriptFilter(t *testing.T) {
+	now := time.Now()
+	records := []*TranscriptRecord{
+		{Time: now.Add(-48 * time.Hour), Feature: FeaturePrompt, Model: "gpt-4o"},
+		{Time: now, Feature: FeaturePrompt, Model: "gpt-4o",
+			Request: &CassetteRequest{HistoryBlocks: []util.HistoryBlock{{Content: "cat secrets.txt"}}}},
+		{Time: now, Feature: FeatureAutosuggest, Model: "gpt-3.5-turbo-instruct", Error: "timeout"},
+	}
+
+	count := func(filter *TranscriptFilter) int {
+		matches := 0
+		for _, record := range records {
+			if filter.Matches(record) {
+				matches++
+			}
+		}
+		return matches
+	}
+
+	assert.Equal(t, 3, count(&TranscriptFilter{}))
+	assert.Equal(t, 2, count(&TranscriptFilter{Since: now.Add(-time.Hour)}))
+	assert.Equal(t, 2, count(&TranscriptFilter{Feature: FeaturePrompt}))
+	assert.Equal(t, 1, count(&TranscriptFilter{Model: "3.5"}))
+	assert.Equal(t, 1, count(&TranscriptFilter{ErrorsOnly: true}))
+	assert.Equal(t, 1, count(&TranscriptFilter{Text: "secrets.txt"}))
+}
@@ -0,0 +1,477 @@
+package butterfish
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Features that make LLM calls, recorded with each call in the usage ledger
+const (
+	FeaturePrompt      = "prompt"
+	FeatureAutosuggest = "autosuggest"
+	FeatureGoal        = "goal"
+	FeatureEdit        = "edit"
+	FeatureIndex       = "index"
+	FeatureSummarize   = "summarize"
+	FeatureGencmd      = "gencmd"
+	FeatureExec        = "exec"
+	FeatureRecall      = "recall"
+)
+
+type featureContextKey struct{}
+
+// Tag calls made with ctx as coming from feature, for calls like embeddings
+// that don't take a request with a Feature
+func WithFeature(ctx context.Context, feature string) context.Context {
+	return context.WithValue(ctx, featureContextKey{}, feature)
+}
+
+// The feature ctx was tagged with, or fallback if it wasn't
+func featureFromContext(ctx context.Context, fallback string) string {
+	if ctx == nil {
+		return fallback
+	}
+	if feature, ok := ctx.Value(featureContextKey{}).(string); ok {
+		return feature
+	}
+	return fallback
+}
+
+// One line of the usage ledger
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Session          string    `json:"session"`
+	Feature          string    `json:"feature"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	// true if the API didn't report token counts and we guessed
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+type UsageTotals struct {
+	Calls            int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	Estimated        bool
+}
+
+func (this *UsageTotals) Add(record UsageRecord, cost float64) {
+	this.Calls++
+	this.PromptTokens += record.PromptTokens
+	this.CompletionTokens += record.CompletionTokens
+	this.Cost += cost
+	this.Estimated = this.Estimated || record.Estimated
+}
+
+// UsageLedger appends a record of every LLM call to a local JSONL file so we
+// can report on token usage and estimated spend over time. Costs are
+// calculated when reading using the current price table rather than stored,
+// so fixing a price fixes the history too.
+type UsageLedger struct {
+	path    string
+	prices  map[string]ModelPrice
+	session string
+
+	mutex sync.Mutex
+	// records from this process, kept in memory for Status
+	sessionRecords []UsageRecord
+	// spend per feature for the current local day. Our own calls are added
+	// as we record them, calls by other processes are read from the ledger
+	// file on each check, starting from dailyOffset.
+	dailyDate   string
+	dailySpend  map[string]float64
+	dailyOffset int64
+}
+
+func NewUsageLedger(path string, prices map[string]ModelPrice) *UsageLedger {
+	if prices == nil {
+		prices = DefaultModelCatalog().Prices()
+	}
+
+	return &UsageLedger{
+		path:    path,
+		prices:  prices,
+		session: fmt.Sprintf("%d-%d", time.Now().Unix(), os.Getpid()),
+	}
+}
+
+// Load the price table, entries in the YAML file at path (if it exists)
+// override the prices in catalog. The file maps model names to
+// input and output prices in USD per million tokens, e.g.
+//
+//	gpt-4-turbo:
+//	  input: 10
+//	  output: 30
+func LoadPriceTable(path string, catalog *ModelCatalog) (map[string]ModelPrice, error) {
+	prices := catalog.Prices()
+
+	if path == "" {
+		return prices, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return prices, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]ModelPrice{}
+	err = yaml.Unmarshal(data, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing price table %s: %s", path, err)
+	}
+
+	for model, price := range overrides {
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// Estimated cost of a call in USD
+func (this *UsageLedger) Cost(record UsageRecord) float64 {
+	foundModel, price := findModelValue(record.Model, this.prices)
+	if foundModel == "" {
+		return 0
+	}
+
+	return (float64(record.PromptTokens)*price.Input +
+		float64(record.CompletionTokens)*price.Output) / 1000000
+}
+
+func (this *UsageLedger) Record(record UsageRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Session = this.session
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.sessionRecords = append(this.sessionRecords, record)
+	if this.dailySpend != nil && record.Time.Local().Format("2006-01-02") == this.dailyDate {
+		this.dailySpend[record.Feature] += this.Cost(record)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error serializing usage record: %s", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(this.path), 0700)
+	if err != nil {
+		log.Printf("Error creating usage ledger directory: %s", err)
+		return
+	}
+
+	file, err := os.OpenFile(this.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening usage ledger: %s", err)
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Error writing usage ledger: %s", err)
+	}
+}
+
+// Read records from the ledger made at or after since
+func (this *UsageLedger) Records(since time.Time) ([]UsageRecord, error) {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readUsageRecords(file, since)
+}
+
+func readUsageRecords(reader io.Reader, since time.Time) ([]UsageRecord, error) {
+	records := []UsageRecord{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var record UsageRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// skip lines that were partially written
+			continue
+		}
+		if record.Time.Before(since) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Totals for the calls made by this process
+func (this *UsageLedger) SessionTotals() UsageTotals {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	totals := UsageTotals{}
+	for _, record := range this.sessionRecords {
+		totals.Add(record, this.Cost(record))
+	}
+	return totals
+}
+
+// Spend for a feature (or all features if feature is BudgetTotal) by this
+// process
+func (this *UsageLedger) SessionSpend(feature string) float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	spend := 0.0
+	for _, record := range this.sessionRecords {
+		if feature == BudgetTotal || record.Feature == feature {
+			spend += this.Cost(record)
+		}
+	}
+	return spend
+}
+
+// Spend for a feature (or all features if feature is BudgetTotal) since
+// local midnight, across all processes including other shells that are
+// running at the same time.
+func (this *UsageLedger) DailySpend(feature string) float64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	if this.dailySpend == nil || this.dailyDate != today {
+		this.resetDailySpend(today)
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	err := this.readDailySpend(midnight)
+	if err != nil {
+		log.Printf("Error reading usage ledger: %s", err)
+	}
+
+	if feature != BudgetTotal {
+		return this.dailySpend[feature]
+	}
+	spend := 0.0
+	for _, cost := range this.dailySpend {
+		spend += cost
+	}
+	return spend
+}
+
+// Start counting a day's spend from our own records, the ledger file is then
+// read from the start
+func (this *UsageLedger) resetDailySpend(today string) {
+	this.dailyDate = today
+	this.dailySpend = map[string]float64{}
+	this.dailyOffset = 0
+	for _, record := range this.sessionRecords {
+		if record.Time.Local().Format("2006-01-02") == today {
+			this.dailySpend[record.Feature] += this.Cost(record)
+		}
+	}
+}
+
+// Add the spend from other processes' records that were written to the
+// ledger file since we last read it
+func (this *UsageLedger) readDailySpend(midnight time.Time) error {
+	file, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < this.dailyOffset {
+		// the ledger was truncated or replaced
+		this.resetDailySpend(this.dailyDate)
+	}
+	if info.Size() == this.dailyOffset {
+		return nil
+	}
+
+	_, err = file.Seek(this.dailyOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	// leave a partially written last line for next time
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		return nil
+	}
+	this.dailyOffset += int64(end + 1)
+
+	records, err := readUsageRecords(bytes.NewReader(data[:end+1]), midnight)
+	for _, record := range records {
+		if record.Session != this.session {
+			this.dailySpend[record.Feature] += this.Cost(record)
+		}
+	}
+	return err
+}
+
+// Group records by a key (e.g. day or feature) and total each group,
+// returning the keys in sorted order.
+func (this *UsageLedger) Summarize(records []UsageRecord, key func(UsageRecord) string) ([]string, map[string]*UsageTotals) {
+	groups := map[string]*UsageTotals{}
+	keys := []string{}
+
+	for _, record := range records {
+		k := key(record)
+		totals, ok := groups[k]
+		if !ok {
+			totals = &UsageTotals{}
+			groups[k] = totals
+			keys = append(keys, k)
+		}
+		totals.Add(record, this.Cost(record))
+	}
+
+	sort.Strings(keys)
+	return keys, groups
+}
+
+// Format a dollar amount, prefixed with ~ if based on estimated token counts
+func formatCost(cost float64, estimated bool) string {
+	prefix := ""
+	if estimated {
+		prefix = "~"
+	}
+	return fmt.Sprintf("%s$%.4f", prefix, cost)
+}
+
+// Rough token count for when the API doesn't tell us, about 4 characters per
+// token for English text.
+func estimateTokens(strs ...string) int {
+	total := 0
+	for _, str := range strs {
+		total += (len(str) + 3) / 4
+	}
+	return total
+}
+
+func estimateRequestTokens(request *util.CompletionRequest) int {
+	total := estimateTokens(request.Prompt, request.SystemMessage)
+	for _, block := range request.HistoryBlocks {
+		total += estimateTokens(block.Content, block.FunctionParams)
+		total += estimateAttachmentTokens(block.Attachments)
+	}
+	return total + estimateAttachmentTokens(request.Attachments)
+}
+
+func estimateAttachmentTokens(attachments []util.Attachment) int {
+	total := estimateTokens(util.PromptWithAttachments("", attachments))
+	for _, image := range util.ImageAttachments(attachments) {
+		total += estimateImageTokens(image)
+	}
+	return total
+}
+
+// UsageLLM is an LLM decorator that records each successful call in a
+// UsageLedger. Cached responses never reach it, so they aren't counted.
+type UsageLLM struct {
+	llm            LLM
+	ledger         *UsageLedger
+	provider       string
+	embeddingModel string
+}
+
+func NewUsageLLM(llm LLM, ledger *UsageLedger, provider, embeddingModel string) *UsageLLM {
+	return &UsageLLM{
+		llm:            llm,
+		ledger:         ledger,
+		provider:       provider,
+		embeddingModel: embeddingModel,
+	}
+}
+
+func (this *UsageLLM) Unwrap() LLM {
+	return this.llm
+}
+
+func (this *UsageLLM) record(request *util.CompletionRequest, response *util.CompletionResponse) {
+	record := UsageRecord{
+		Feature:  request.Feature,
+		Provider: this.provider,
+		Model:    request.Model,
+	}
+
+	if response.Usage != nil && response.Usage.PromptTokens > 0 {
+		record.PromptTokens = response.Usage.PromptTokens
+		record.CompletionTokens = response.Usage.CompletionTokens
+	} else {
+		// e.g. OpenAI streaming responses don't include usage
+		record.Estimated = true
+		record.PromptTokens = estimateRequestTokens(request)
+		record.CompletionTokens = estimateTokens(response.Completion, response.FunctionParameters)
+		for _, toolCall := range response.ToolCalls {
+			record.CompletionTokens += estimateTokens(toolCall.Function.Parameters)
+		}
+	}
+
+	this.ledger.Record(record)
+}
+
+func (this *UsageLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	response, err := this.llm.Completion(request)
+	if err == nil {
+		this.record(request, response)
+	}
+	return response, err
+}
+
+func (this *UsageLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	response, err := this.llm.CompletionStream(request, writer)
+	if err == nil {
+		this.record(request, response)
+	}
+	return response, err
+}
+
+func (this *UsageLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	embeddings, err := this.llm.Embeddings(ctx, input, verbose)
+	if err == nil {
+		this.ledger.Record(UsageRecord{
+			Feature:      featureFromContext(ctx, FeatureIndex),
+			Provider:     this.provider,
+			Model:        this.embeddingModel,
+			PromptTokens: estimateTokens(input...),
+			Estimated:    true,
+		})
+	}
+	return embeddings, err
+}
@@ -0,0 +1,121 @@
+package butterfish
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/bakks/butterfish/util"
+)
+
+func TestUsageLedgerCost(t *testing.T) {
+	ledger := NewUsageLedger("", nil)
+
+	// dated model names match the base model's price
+	cost := ledger.Cost(UsageRecord{Model: "gpt-4-turbo-2024-04-09", PromptTokens: 1000000, CompletionTokens: 1000000})
+	assert.InDelta(t, 40.0, cost, 0.0001)
+	cost = ledger.Cost(UsageRecord{Model: "claude-3-haiku-20240307", PromptTokens: 4000})
+	assert.InDelta(t, 0.001, cost, 0.0001)
+
+	// local models are free
+	assert.Equal(t, 0.0, ledger.Cost(UsageRecord{Model: "llama3:8b", PromptTokens: 1000}))
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.yaml")
+	os.WriteFile(path, []byte("llama3:\n  input: 1\n  output: 2\ngpt-4-turbo:\n  input: 5\n  output: 5\n"), 0600)
+
+	prices, err := LoadPriceTable(path, DefaultModelCatalog())
+	assert.NoError(t, err)
+	assert.Equal(t, ModelPrice{1, 2}, prices["llama3"])
+	assert.Equal(t, ModelPrice{5, 5}, prices["gpt-4-turbo"])
+	assert.Equal(t, DefaultModelCatalog().Prices()["gpt-4"], prices["gpt-4"])
+
+	// a missing file just means defaults
+	prices, err = LoadPriceTable(filepath.Join(t.TempDir(), "missing.yaml"), DefaultModelCatalog())
+	assert.NoError(t, err)
+	assert.Equal(t, len(DefaultModelCatalog().Prices()), len(prices))
+}
+
+// Returns a response with reported usage if usage is set
+type usageLLM struct {
+	fakeLLM
+	usage *util.TokenUsage
+}
+
+func (this *usageLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	return &util.CompletionResponse{Completion: "12345678", Usage: this.usage}, nil
+}
+
+func TestUsageLLMRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	ledger := NewUsageLedger(path, nil)
+
+	backend := &usageLLM{usage: &util.TokenUsage{PromptTokens: 100, CompletionTokens: 20}}
+	client := NewUsageLLM(backend, ledger, "openai", "text-embedding-ada-002")
+
+	request := &util.CompletionRequest{
+		Ctx:     context.Background(),
+		Model:   "gpt-3.5-turbo",
+		Prompt:  "1234",
+		Feature: FeatureAutosuggest,
+	}
+	client.Completion(request)
+
+	// without reported usage we estimate from the text
+	backend.usage = nil
+	request.Feature = FeaturePrompt
+	client.Completion(request)
+
+	client.Embeddings(context.Background(), []string{"12345678"}, false)
+
+	records, err := ledger.Records(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+
+	assert.Equal(t, FeatureAutosuggest, records[0].Feature)
+	assert.Equal(t, 100, records[0].PromptTokens)
+	assert.False(t, records[0].Estimated)
+
+	assert.Equal(t, FeaturePrompt, records[1].Feature)
+	assert.Equal(t, 1, records[1].PromptTokens)
+	assert.Equal(t, 2, records[1].CompletionTokens)
+	assert.True(t, records[1].Estimated)
+
+	assert.Equal(t, FeatureIndex, records[2].Feature)
+	assert.Equal(t, "text-embedding-ada-002", records[2].Model)
+
+	totals := ledger.SessionTotals()
+	assert.Equal(t, 3, totals.Calls)
+	assert.True(t, totals.Estimated)
+
+	features, byFeature := ledger.Summarize(records, func(record UsageRecord) string {
+		return record.Feature
+	})
+	assert.Equal(t, []string{FeatureAutosuggest, FeatureIndex, FeaturePrompt}, features)
+	assert.Equal(t, 1, byFeature[FeaturePrompt].Calls)
+
+	// nothing is returned from before the cutoff
+	records, err = ledger.Records(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestUsageLLMEmbeddingsFeature(t *testing.T) {
+	ledger := NewUsageLedger(filepath.Join(t.TempDir(), "usage.jsonl"), nil)
+	backend := &usageLLM{}
+	client := NewUsageLLM(backend, ledger, "openai", "text-embedding-ada-002")
+
+	client.Embeddings(WithFeature(context.Background(), FeatureRecall), []string{"1234"}, false)
+	client.Embeddings(context.Background(), []string{"1234"}, false)
+
+	records, err := ledger.Records(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, FeatureRecall, records[0].Feature)
+	assert.Equal(t, FeatureIndex, records[1].Feature)
+}
@@ -0,0 +1,396 @@
+package butterfish
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rows on the screen of a VirtualTerminal by default, programs rarely move
+// the cursor further up than this
+const defaultVirtualTerminalRows = 24
+
+// Longest incomplete escape sequence we hold between writes, e.g. an OSC
+// that's never terminated
+const maxPartialEscapeBytes = 4096
+
+// VirtualTerminal is a lightweight terminal emulator for turning captured
+// output into the text the user saw. A progress bar that redraws itself with
+// carriage returns or cursor movement ends up as its final state, not every
+// state in a row. It keeps a screen of rows and a cursor and understands
+// cursor movement, carriage returns, backspaces and erasing, attributes like
+// color are dropped. Rows that scroll off the top of the screen can't change
+// any more and are taken with Flush.
+type VirtualTerminal struct {
+	width  int // 0 means rows never wrap
+	height int
+
+	// rows from the first row that hasn't been flushed, the screen is the
+	// last height rows
+	rows     [][]rune
+	wrapped  []bool // whether each row continues on the next
+	row      int
+	col      int
+	wrapNext bool // we wrote in the last column, the next rune wraps
+	savedRow int
+	savedCol int
+
+	// an escape sequence split across writes
+	partial string
+}
+
+func NewVirtualTerminal(width, height int) *VirtualTerminal {
+	if height <= 0 {
+		height = defaultVirtualTerminalRows
+	}
+	return &VirtualTerminal{
+		width:   width,
+		height:  height,
+		rows:    [][]rune{{}},
+		wrapped: []bool{false},
+	}
+}
+
+func (this *VirtualTerminal) Write(data string) {
+	data = this.partial + data
+	this.partial = ""
+
+	for i := 0; i < len(data); {
+		if data[i] == 0x1b {
+			n := escapeSequenceLength(data[i:])
+			if n == 0 {
+				// incomplete, wait for the rest
+				if len(data)-i < maxPartialEscapeBytes {
+					this.partial = data[i:]
+				}
+				return
+			}
+			this.escape(data[i : i+n])
+			i += n
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(data[i:])
+		i += size
+		switch r {
+		case '\r':
+			this.col = 0
+			this.wrapNext = false
+		case '\n':
+			// this should only move down, but the pty turns \n into \r\n
+			// anyway and text we write ourselves expects a new line
+			this.lineFeed()
+			this.col = 0
+		case '\b':
+			if this.col > 0 && !this.wrapNext {
+				this.col--
+			}
+			this.wrapNext = false
+		case '\t':
+			this.col = (this.col/8 + 1) * 8
+			if this.width > 0 && this.col >= this.width {
+				this.col = this.width - 1
+			}
+		default:
+			if r >= 0x20 && r != 0x7f {
+				this.put(r)
+			}
+		}
+	}
+}
+
+// The length of the escape sequence at the start of data, or 0 if it's
+// incomplete
+func escapeSequenceLength(data string) int {
+	if len(data) < 2 {
+		return 0
+	}
+	switch data[1] {
+	case '[':
+		// CSI, parameters and intermediates then a final byte
+		for i := 2; i < len(data); i++ {
+			if data[i] >= 0x40 && data[i] <= 0x7e {
+				return i + 1
+			}
+			if data[i] < 0x20 || data[i] > 0x3f {
+				// not a valid sequence, drop the introducer
+				return 2
+			}
+		}
+		return 0
+	case ']', 'P', 'X', '^', '_':
+		// strings terminated by BEL or ST
+		for i := 2; i < len(data); i++ {
+			if data[i] == 0x07 {
+				return i + 1
+			}
+			if data[i] == 0x1b && i+1 < len(data) {
+				if data[i+1] == '\\' {
+					return i + 2
+				}
+			}
+		}
+		return 0
+	case '(', ')', '*', '+', '#', '%':
+		// character sets and the like take one more byte
+		if len(data) < 3 {
+			return 0
+		}
+		return 3
+	}
+	return 2
+}
+
+func (this *VirtualTerminal) escape(sequence string) {
+	if len(sequence) < 2 {
+		return
+	}
+	switch sequence[1] {
+	case '[':
+		this.csi(sequence[2:len(sequence)-1], sequence[len(sequence)-1])
+	case '7':
+		this.savedRow, this.savedCol = this.row, this.col
+	case '8':
+		this.restoreCursor()
+	case 'D':
+		this.lineFeed()
+	case 'E':
+		this.lineFeed()
+		this.col = 0
+	case 'M':
+		// reverse index, a real terminal scrolls down at the top of the screen
+		// but that's rare outside full-screen programs
+		this.moveTo(this.row-1, this.col)
+	}
+}
+
+func (this *VirtualTerminal) csi(params string, final byte) {
+	if strings.HasPrefix(params, "?") || strings.HasPrefix(params, ">") {
+		// private modes, we don't need any of them
+		return
+	}
+
+	args := []int{}
+	for _, param := range strings.Split(params, ";") {
+		n, _ := strconv.Atoi(param)
+		args = append(args, n)
+	}
+	arg := func(i, fallback int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return fallback
+	}
+
+	switch final {
+	case 'A':
+		this.moveTo(this.row-arg(0, 1), this.col)
+	case 'B':
+		this.moveTo(this.row+arg(0, 1), this.col)
+	case 'C':
+		this.moveTo(this.row, this.col+arg(0, 1))
+	case 'D':
+		this.moveTo(this.row, this.col-arg(0, 1))
+	case 'E':
+		this.moveTo(this.row+arg(0, 1), 0)
+	case 'F':
+		this.moveTo(this.row-arg(0, 1), 0)
+	case 'G', '`':
+		this.moveTo(this.row, arg(0, 1)-1)
+	case 'H', 'f':
+		this.moveTo(this.screenTop()+arg(0, 1)-1, arg(1, 1)-1)
+	case 'd':
+		this.moveTo(this.screenTop()+arg(0, 1)-1, this.col)
+	case 'K':
+		this.eraseLine(arg(0, 0))
+	case 'J':
+		this.eraseDisplay(arg(0, 0))
+	case 'X':
+		line := this.rows[this.row]
+		for i := this.col; i < this.col+arg(0, 1) && i < len(line); i++ {
+			line[i] = ' '
+		}
+	case 'P':
+		line := this.rows[this.row]
+		if this.col < len(line) {
+			end := this.col + arg(0, 1)
+			if end > len(line) {
+				end = len(line)
+			}
+			this.rows[this.row] = append(line[:this.col], line[end:]...)
+		}
+	case '@':
+		line := this.rows[this.row]
+		if this.col < len(line) {
+			blanks := []rune(strings.Repeat(" ", arg(0, 1)))
+			line = append(line[:this.col], append(blanks, line[this.col:]...)...)
+			if this.width > 0 && len(line) > this.width {
+				line = line[:this.width]
+			}
+			this.rows[this.row] = line
+		}
+	case 's':
+		this.savedRow, this.savedCol = this.row, this.col
+	case 'u':
+		this.restoreCursor()
+	}
+}
+
+// The index of the top row of the screen, the cursor can't move above it
+func (this *VirtualTerminal) screenTop() int {
+	return max(0, len(this.rows)-this.height)
+}
+
+// Move the cursor, keeping it on the screen
+func (this *VirtualTerminal) moveTo(row, col int) {
+	top := this.screenTop()
+	if row < top {
+		row = top
+	}
+	if row >= top+this.height {
+		row = top + this.height - 1
+	}
+	if col < 0 {
+		col = 0
+	}
+	if this.width > 0 && col >= this.width {
+		col = this.width - 1
+	}
+	this.ensureRow(row)
+	this.row = row
+	this.col = col
+	this.wrapNext = false
+}
+
+func (this *VirtualTerminal) restoreCursor() {
+	this.moveTo(this.savedRow, this.savedCol)
+}
+
+func (this *VirtualTerminal) ensureRow(row int) {
+	for len(this.rows) <= row {
+		this.rows = append(this.rows, []rune{})
+		this.wrapped = append(this.wrapped, false)
+	}
+}
+
+func (this *VirtualTerminal) lineFeed() {
+	this.row++
+	this.ensureRow(this.row)
+	this.wrapNext = false
+}
+
+// Write a rune at the cursor and advance it
+func (this *VirtualTerminal) put(r rune) {
+	if this.wrapNext {
+		this.wrapped[this.row] = true
+		this.lineFeed()
+		this.col = 0
+	}
+
+	line := this.rows[this.row]
+	for len(line) < this.col {
+		line = append(line, ' ')
+	}
+	if this.col < len(line) {
+		line[this.col] = r
+	} else {
+		line = append(line, r)
+	}
+	this.rows[this.row] = line
+
+	this.col++
+	if this.width > 0 && this.col >= this.width {
+		this.col = this.width - 1
+		this.wrapNext = true
+	}
+}
+
+func (this *VirtualTerminal) eraseLine(mode int) {
+	line := this.rows[this.row]
+	switch mode {
+	case 0: // to the end of the line
+		if this.col < len(line) {
+			this.rows[this.row] = line[:this.col]
+		}
+		this.wrapped[this.row] = false
+	case 1: // to the start of the line
+		for i := 0; i <= this.col && i < len(line); i++ {
+			line[i] = ' '
+		}
+	case 2:
+		this.rows[this.row] = []rune{}
+		this.wrapped[this.row] = false
+	}
+}
+
+func (this *VirtualTerminal) eraseDisplay(mode int) {
+	switch mode {
+	case 0: // to the end of the screen
+		this.eraseLine(0)
+		this.rows = this.rows[:this.row+1]
+		this.wrapped = this.wrapped[:this.row+1]
+	case 1: // to the start of the screen
+		for i := this.screenTop(); i < this.row; i++ {
+			this.rows[i] = []rune{}
+			this.wrapped[i] = false
+		}
+		this.eraseLine(1)
+	case 2, 3:
+		for i := this.screenTop(); i < len(this.rows); i++ {
+			this.rows[i] = []rune{}
+			this.wrapped[i] = false
+		}
+	}
+}
+
+func (this *VirtualTerminal) rowString(i int) string {
+	if this.wrapped[i] {
+		return string(this.rows[i])
+	}
+	return strings.TrimRight(string(this.rows[i]), " ") + "\n"
+}
+
+// Take the rows that have scrolled off the top of the screen, which can't
+// change any more
+func (this *VirtualTerminal) Flush() string {
+	top := this.screenTop()
+	if top == 0 {
+		return ""
+	}
+
+	builder := strings.Builder{}
+	for i := 0; i < top; i++ {
+		builder.WriteString(this.rowString(i))
+	}
+	this.rows = this.rows[top:]
+	this.wrapped = this.wrapped[top:]
+	this.row -= top
+	this.savedRow = max(0, this.savedRow-top)
+	return builder.String()
+}
+
+// The text of the rows that haven't been flushed, rows after the cursor that
+// have nothing on them are left out
+func (this *VirtualTerminal) String() string {
+	last := len(this.rows) - 1
+	for last > this.row && len(this.rows[last]) == 0 {
+		last--
+	}
+
+	builder := strings.Builder{}
+	for i := 0; i < last; i++ {
+		builder.WriteString(this.rowString(i))
+	}
+	builder.WriteString(strings.TrimRight(string(this.rows[last]), " "))
+	return builder.String()
+}
+
+// The number of runes on rows that haven't been flushed, including breaks
+// between rows
+func (this *VirtualTerminal) Size() int {
+	size := len(this.rows) - 1
+	for _, row := range this.rows {
+		size += len(row)
+	}
+	return size
+}
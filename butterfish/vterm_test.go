@@ -0,0 +1,98 @@
+package butterfish
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func renderTerminal(width int, writes ...string) string {
+	terminal := NewVirtualTerminal(width, 0)
+	for _, data := range writes {
+		terminal.Write(data)
+	}
+	return terminal.Flush() + terminal.String()
+}
+
+func TestVirtualTerminal(t *testing.T) {
+	// carriage returns overwrite, like a progress bar
+	assert.Equal(t, "downloading 100%\ndone\n",
+		renderTerminal(0, "downloading  10%\rdownloading  50%", "\rdownloading 100%\r\ndone\r\n"))
+
+	// backspace moves back and the next rune overwrites
+	assert.Equal(t, "spinner done", renderTerminal(0, "spinner |\b/\b-\b\\\bdone"))
+
+	// erase to the end of the line, the start, and the whole line
+	assert.Equal(t, "abc", renderTerminal(0, "abcdef\x1b[3D\x1b[K"))
+	assert.Equal(t, "    ef", renderTerminal(0, "abcdef\x1b[3D\x1b[1K"))
+	assert.Equal(t, "xyz", renderTerminal(0, "abcdef\x1b[2K\rxyz"))
+
+	// npm style multi-line progress redrawn by moving the cursor up
+	assert.Equal(t, "added 120 packages\nfound 0 vulnerabilities\n",
+		renderTerminal(0,
+			"fetching a\r\nfetching b\r\n",
+			"\x1b[2A\r\x1b[Kadded 120 packages\r\n\x1b[K\x1b[1B",
+			"\x1b[1A\rfound 0 vulnerabilities\r\n"))
+
+	// colors, titles and private modes are dropped, sequences may be split
+	assert.Equal(t, "red plain\n",
+		renderTerminal(0, "\x1b]0;title\x07\x1b[?25l\x1b[3", "1mred\x1b[0m pla", "in\x1b]0;x\x1b", "\\\r\n"))
+
+	// absolute positioning is relative to the top of the screen
+	assert.Equal(t, "one\nTWO", renderTerminal(0, "one\r\ntwo\x1b[2;1HTWO"))
+	assert.Equal(t, "ab   cd", renderTerminal(0, "ab\x1b[6Gcd"))
+	assert.Equal(t, "a       b", renderTerminal(0, "a\tb"))
+
+	// deleting and inserting characters
+	assert.Equal(t, "adef", renderTerminal(0, "abcdef\x1b[5D\x1b[2P"))
+	assert.Equal(t, "a  bc", renderTerminal(0, "abc\x1b[2D\x1b[2@"))
+
+	// clearing the screen
+	assert.Equal(t, "after", strings.TrimLeft(renderTerminal(0, "before\r\n\x1b[H\x1b[2Jafter"), "\n"))
+}
+
+func TestVirtualTerminalWrap(t *testing.T) {
+	// long lines wrap and are joined again when rendered
+	assert.Equal(t, "0123456789abc", renderTerminal(5, "0123456789abc"))
+
+	// a bar exactly as wide as the terminal doesn't wrap until the next rune
+	assert.Equal(t, "[###]\nok", renderTerminal(5, "[#  ]\r[## ]", "\r[###]", "\r\nok"))
+
+	// the cursor can move up across wrapped rows
+	assert.Equal(t, "abcdXfghij", renderTerminal(5, "abcdefghij", "\x1b[A\x1b[5GX\x1b[1B"))
+}
+
+func TestVirtualTerminalScroll(t *testing.T) {
+	terminal := NewVirtualTerminal(0, 3)
+	terminal.Write("1\r\n2\r\n3\r\n4\r\n5")
+	assert.Equal(t, "1\n2\n", terminal.Flush())
+	assert.Equal(t, "3\n4\n5", terminal.String())
+	assert.Equal(t, "", terminal.Flush())
+
+	// rows that scrolled off can't be reached
+	terminal.Write("\x1b[10A\rX\x1b[3;2HY")
+	assert.Equal(t, "X\n4\n5Y", terminal.String())
+	assert.Equal(t, len("X\n4\n5Y"), terminal.Size())
+}
+
+func TestShellHistoryTerminal(t *testing.T) {
+	history := NewShellHistory()
+	history.SetTerminalWidth(80)
+	history.Append(historyTypeShellInput, "npm install")
+	history.Append(historyTypeShellOutput, "\x1b[32m⸩\x1b[0m idealTree: timing 10%\r")
+
+	// the screen is rendered while the block is written to, and the cache is
+	// dropped even if the size doesn't change
+	tokenizer := NewHeuristicTokenizer()
+	blocks, _ := getHistoryBlocksByTokens(history, tokenizer, 1024, 4096, 4)
+	assert.Equal(t, "⸩ idealTree: timing 10%", blocks[1].Content)
+	history.Append(historyTypeShellOutput, "\x1b[K⸨ idealTree: timing 90%")
+	blocks, _ = getHistoryBlocksByTokens(history, tokenizer, 1024, 4096, 4)
+	assert.Equal(t, "⸨ idealTree: timing 90%", blocks[1].Content)
+
+	history.Append(historyTypeShellOutput, "\r\x1b[K\r\nadded 1 package\r\n")
+	history.Append(historyTypePrompt, "did it work?")
+	output := HistoryBlocksToString(history.GetLastNBytes(4096, 4096), history.Redactor())
+	assert.Equal(t, "npm install\n\nadded 1 package\n\ndid it work?", output)
+}
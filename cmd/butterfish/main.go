@@ -38,7 +38,15 @@ If you do not have OpenAI free credits then you will need a subscription and you
 `
 const license = "MIT License - Copyright (c) 2023 Peter Bakkum"
 const defaultEnvPath = "~/.config/butterfish/butterfish.env"
+const defaultBaseURL = "https://api.openai.com/v1"
 const defaultPromptPath = "~/.config/butterfish/prompts.yaml"
+const defaultUsageLedgerPath = "~/.config/butterfish/usage.jsonl"
+const defaultTranscriptPath = "~/.config/butterfish/transcripts.jsonl"
+const defaultPriceTablePath = "~/.config/butterfish/prices.yaml"
+const defaultModelCatalogPath = "~/.config/butterfish/models.yaml"
+const defaultRedactionConfigPath = "~/.config/butterfish/redact.yaml"
+const defaultHistoryStorePath = "~/.config/butterfish/sessions"
+const defaultRecallPath = "~/.config/butterfish/recall.jsonl"
 
 const shell_help = `Start the Butterfish shell wrapper. This wraps your existing shell, giving you access to LLM prompting by starting your command with a capital letter. LLM calls include prior shell context. This is great for keeping a chat-like terminal open, sending written prompts, debugging commands, and iterating on past actions.
 
@@ -49,14 +57,23 @@ Use:
   - GPT will be able to see your shell history, so you can ask contextual questions like 'why didnt my last command work?'
 	- Start a command with ! to enter Goal Mode, in which GPT will act as an Agent attempting to accomplish your goal by executing commands, for example '!Run make in this directory and debug any problems'.
 	- Start a command with !! to enter Unsafe Goal Mode, in which GPT will execute commands without confirmation. USE WITH CAUTION.
+  - Start a prompt with @ and a model or temperature to send one question with different settings, like '@gpt-4o,t=0.2 Why did that fail?'
 
-Here are special Butterfish commands:
-  - Help : Give hints about usage.
-  - Status : Show the current Butterfish configuration.
-  - History : Print out the history that would be sent in a GPT prompt.
+Here are special Butterfish commands, press tab to complete them:
+%s
 
 If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. Autosuggest will probably be the most expensive feature. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000).`
 
+// The shell help with the local commands filled in from the same registry
+// as the shell's Help command
+func shellHelp() string {
+	commands := []string{}
+	for _, command := range bf.DefaultLocalCommands() {
+		commands = append(commands, fmt.Sprintf("  - %s : %s.", command.Usage(), command.Help))
+	}
+	return fmt.Sprintf(shell_help, strings.Join(commands, "\n"))
+}
+
 type VerboseFlag bool
 
 var verboseCount int
@@ -72,23 +89,48 @@ func (v *VerboseFlag) BeforeResolve() error {
 // invoked, rather than when we're inside a butterfish console).
 // Kong will parse os.Args based on this struct.
 type CliConfig struct {
-	Verbose      VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
-	Log          bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
-	Version      kong.VersionFlag `short:"V" help:"Print version information and exit."`
-	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
-	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
+	Verbose        VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
+	Log            bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
+	Version        kong.VersionFlag `short:"V" help:"Print version information and exit."`
+	BaseURL        string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
+	Provider       string           `short:"P" default:"openai" enum:"openai,anthropic,ollama" help:"LLM API provider, one of openai, anthropic, or ollama. The anthropic provider reads a key from ANTHROPIC_API_KEY. The ollama provider talks to a local Ollama server (default http://localhost:11434) and needs no key."`
+	EmbeddingModel string           `default:"" help:"Model to use for embeddings when indexing, defaults to the provider's embedding model."`
+	TokenTimeout   int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
+
+	Fallback             []string `help:"Providers to fall back to, in order, when the main provider returns a server error or times out. Entries are provider or provider:model, e.g. --fallback anthropic:claude-3-haiku-20240307,ollama:llama3:8b."`
+	AutosuggestProviders []string `help:"Full provider chain for autosuggest, defaults to the main provider plus --fallback."`
+	EmbeddingProviders   []string `help:"Full provider chain for embeddings, defaults to the main provider plus --fallback."`
+	FallbackCooldown     int      `default:"60000" help:"How long to skip a provider after it fails before trying it again. In milliseconds."`
+
+	NoCache  bool   `default:"false" help:"Disable the on-disk cache of LLM responses."`
+	CacheTTL string `default:"168h" help:"How long cached LLM responses are kept, e.g. 24h."`
+
+	Transcript bool `default:"false" help:"Log every LLM request and response, with latency, time to first token, model, feature, and errors, to ~/.config/butterfish/transcripts.jsonl. Read it with the transcripts command."`
+
+	Record string `default:"" help:"Record every LLM request and response to this cassette file, e.g. to attach to a bug report."`
+	Replay string `default:"" help:"Serve LLM responses from a cassette file recorded with --record rather than calling an API."`
+
+	DailyBudget   map[string]float64 `help:"Daily spend limits in USD per feature, or total for all features, e.g. --daily-budget autosuggest=0.5;total=5. Features are prompt, autosuggest, goal, edit, index, recall, summarize, gencmd, and exec."`
+	SessionBudget map[string]float64 `help:"Spend limits in USD per feature for this process, same format as --daily-budget."`
 
 	Shell struct {
-		Bin                       string `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
-		Model                     string `short:"m" default:"gpt-4-turbo" help:"Model for when the user manually enters a prompt."`
-		AutosuggestDisabled       bool   `short:"A" default:"false" help:"Disable autosuggest."`
-		AutosuggestModel          string `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
-		AutosuggestTimeout        int    `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
-		NewlineAutosuggestTimeout int    `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
-		NoCommandPrompt           bool   `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
-		LightColor                bool   `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
-		MaxHistoryBlockTokens     int    `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
-		MaxResponseTokens         int    `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		Bin                       string  `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
+		Model                     string  `short:"m" default:"gpt-4-turbo" help:"Model for when the user manually enters a prompt."`
+		AutosuggestDisabled       bool    `short:"A" default:"false" help:"Disable autosuggest."`
+		AutosuggestModel          string  `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
+		AutosuggestTimeout        int     `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
+		NewlineAutosuggestTimeout int     `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
+		NoCommandPrompt           bool    `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
+		PromptIntegration         string  `default:"ps1" enum:"ps1,osc133" help:"How Butterfish finds prompts in the shell's output. ps1 adds markers (and the emoji) to PS1. osc133 emits OSC 133 sequences from shell hooks (PROMPT_COMMAND/PS0, precmd/preexec, fish events), which works with prompt frameworks like starship or powerlevel10k that rewrite PS1, and records the exact command text in history."`
+		LightColor                bool    `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+		MaxHistoryBlockTokens     int     `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
+		MaxResponseTokens         int     `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		NoRedact                  bool    `default:"false" help:"Don't mask secrets (API keys, private keys, passwords in URLs, etc) in shell history before it's sent to the LLM. Extra patterns can be added in ~/.config/butterfish/redact.yaml."`
+		PersistHistory            bool    `default:"false" help:"Save shell history for the current directory to ~/.config/butterfish/sessions and load it the next time you start the shell here."`
+		Session                   string  `default:"" help:"Save shell history to a named session and load it on start, implies --persist-history."`
+		HistoryRetention          string  `default:"720h" help:"How long saved shell history is kept, e.g. 168h."`
+		Recall                    bool    `default:"false" help:"Embed shell history so older commands, output, and answers can be found with Recall <query> and relevant ones are added to prompts. Stored in ~/.config/butterfish/recall.jsonl."`
+		RecallMinScore            float64 `default:"0.8" help:"How similar (cosine) older history must be to a prompt to be recalled. Lower this for embedding models other than ada-002."`
 	} `cmd:"" help:"${shell_help}"`
 
 	// We include the cliConsole options here so that we can parse them and hand them
@@ -154,11 +196,84 @@ func getOpenAIToken() string {
 	return token
 }
 
+func getAnthropicToken() string {
+	path, err := homedir.Expand(defaultEnvPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	godotenv.Load(path)
+
+	token := os.Getenv("ANTHROPIC_API_KEY")
+	if token == "" {
+		log.Fatalf("The anthropic provider requires an API key in the ANTHROPIC_API_KEY env var or in %s", path)
+	}
+
+	return token
+}
+
 func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
 	config := bf.MakeButterfishConfig()
-	config.OpenAIToken = getOpenAIToken()
+	config.LLMProvider = options.Provider
 	config.BaseURL = options.BaseURL
+
+	// the default base url points at OpenAI, let other clients pick their own
+	if options.Provider != bf.LLMProviderOpenAI && config.BaseURL == defaultBaseURL {
+		config.BaseURL = ""
+	}
+
+	if len(options.Fallback) > 0 {
+		config.PromptProviders = append([]string{options.Provider}, options.Fallback...)
+	}
+	config.AutosuggestProviders = options.AutosuggestProviders
+	config.EmbeddingProviders = options.EmbeddingProviders
+	config.FallbackCooldown = time.Duration(options.FallbackCooldown) * time.Millisecond
+
+	config.CacheEnabled = !options.NoCache
+	cacheTTL, err := time.ParseDuration(options.CacheTTL)
+	if err != nil {
+		log.Fatalf("Invalid --cache-ttl: %s", err)
+	}
+	config.CacheTTL = cacheTTL
+
+	config.DailyBudgets = options.DailyBudget
+	config.SessionBudgets = options.SessionBudget
+
+	config.TranscriptEnabled = options.Transcript
+	config.TranscriptPath = defaultTranscriptPath
+
+	config.RecordPath = options.Record
+	config.ReplayPath = options.Replay
+
+	// load keys for every provider we might talk to, none when replaying
+	providers := map[string]bool{options.Provider: true}
+	for _, chain := range [][]string{options.Fallback, options.AutosuggestProviders, options.EmbeddingProviders} {
+		for _, entry := range chain {
+			provider, _, _ := strings.Cut(entry, ":")
+			providers[provider] = true
+		}
+	}
+	if options.Replay != "" {
+		providers = map[string]bool{}
+	}
+
+	for provider := range providers {
+		switch provider {
+		case bf.LLMProviderAnthropic:
+			config.AnthropicToken = getAnthropicToken()
+		case bf.LLMProviderOllama:
+			// local server, no token needed
+		default:
+			config.OpenAIToken = getOpenAIToken()
+		}
+	}
+
+	config.EmbeddingModel = options.EmbeddingModel
 	config.PromptLibraryPath = defaultPromptPath
+	config.UsageLedgerPath = defaultUsageLedgerPath
+	config.PriceTablePath = defaultPriceTablePath
+	config.ModelCatalogPath = defaultModelCatalogPath
+	config.RedactionConfigPath = defaultRedactionConfigPath
 	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
 
 	if options.Verbose {
@@ -188,7 +303,7 @@ func main() {
 		kong.Description(desc),
 		kong.UsageOnError(),
 		kong.Vars{
-			"shell_help": shell_help,
+			"shell_help": shellHelp(),
 			"version":    getBuildInfo(),
 		})
 
@@ -234,8 +349,26 @@ func main() {
 		config.ShellColorDark = !cli.Shell.LightColor
 		config.ShellMode = true
 		config.ShellLeavePromptAlone = cli.Shell.NoCommandPrompt
+		config.ShellPromptIntegration = cli.Shell.PromptIntegration
 		config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
 		config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+		config.RedactionEnabled = !cli.Shell.NoRedact
+
+		config.ShellHistoryPath = defaultHistoryStorePath
+		config.ShellHistorySession = cli.Shell.Session
+		if config.ShellHistorySession == "" && cli.Shell.PersistHistory {
+			config.ShellHistorySession, err = os.Getwd()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.ShellHistoryRetention, err = time.ParseDuration(cli.Shell.HistoryRetention)
+		if err != nil {
+			log.Fatalf("Invalid --history-retention: %s", err)
+		}
+		config.ShellRecallEnabled = cli.Shell.Recall
+		config.ShellRecallPath = defaultRecallPath
+		config.ShellRecallMinScore = cli.Shell.RecallMinScore
 
 		bf.RunShell(ctx, config)
 
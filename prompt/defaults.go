@@ -6,6 +6,7 @@ const (
 	PromptSummarizeFacts       = "summarize_facts"
 	PromptSummarizeListOfFacts = "summarize_list_of_facts"
 	PromptGenerateCommand      = "generate_command"
+	PromptRankCommands         = "rank_commands"
 	PromptQuestion             = "question"
 	PromptSystemMessage        = "prompt_system_message"
 	ShellAutosuggestCommand    = "shell_autocomplete_command"
@@ -158,6 +159,21 @@ Description and Important Facts:`,
 Shell command:`,
 	},
 
+	// PromptRankCommands is a prompt for ranking generated commands
+	{
+		Name:        PromptRankCommands,
+		OkToReplace: true,
+		Prompt: `These are candidate shell commands for accomplishing the following goal:
+'''
+{content}
+'''
+
+Candidates:
+{commands}
+
+Rank the candidates from best to worst by whether they accomplish the goal, are safe to run, and are simple. Respond with only the candidate numbers in order separated by commas, e.g. 2,1,3.`,
+	},
+
 	// PromptQuestion is a prompt for answering a question
 	{
 		Name:        PromptQuestion,
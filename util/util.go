@@ -34,6 +34,65 @@ type CompletionRequest struct {
 	Tools         []ToolDefinition
 	Verbose       bool
 	TokenTimeout  time.Duration
+	// Which part of butterfish made the request (e.g. "autosuggest"), used
+	// for usage accounting
+	Feature string
+	// If set the response must be JSON matching this schema, returned in
+	// Completion. Backends use a structured output mode where they have one,
+	// otherwise they force a call to a single function. Only supported by
+	// Completion, not CompletionStream.
+	ResponseSchema json.RawMessage
+	// Files sent with the prompt, see Attachment
+	Attachments []Attachment
+}
+
+// A file attached to a prompt. Images are sent as image content to backends
+// that accept it, other files are inlined as text after the prompt with a
+// header giving their path.
+type Attachment struct {
+	Path     string `json:"path"`
+	MimeType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+func (this Attachment) IsImage() bool {
+	return strings.HasPrefix(this.MimeType, "image/")
+}
+
+// The prompt followed by each text attachment, e.g.
+//
+//	explain these files
+//
+//	--- src/main.go ---
+//	package main
+//	...
+func PromptWithAttachments(prompt string, attachments []Attachment) string {
+	var builder strings.Builder
+	builder.WriteString(prompt)
+
+	for _, attachment := range attachments {
+		if attachment.IsImage() {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\n\n")
+		}
+		fmt.Fprintf(&builder, "--- %s ---\n", attachment.Path)
+		builder.Write(attachment.Data)
+	}
+
+	return builder.String()
+}
+
+// The images attached to a request
+func ImageAttachments(attachments []Attachment) []Attachment {
+	images := []Attachment{}
+	for _, attachment := range attachments {
+		if attachment.IsImage() {
+			images = append(images, attachment)
+		}
+	}
+	return images
 }
 
 type FunctionCall struct {
@@ -52,6 +111,13 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+	// Token counts reported by the API, nil if the API didn't report them
+	Usage *TokenUsage
+}
+
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
 }
 
 type FunctionDefinition struct {
@@ -72,6 +138,8 @@ type HistoryBlock struct {
 	FunctionParams string
 	ToolCalls      []*ToolCall
 	ToolCallId     string
+	// files attached to a prompt block
+	Attachments []Attachment
 }
 
 func (this HistoryBlock) String() string {